@@ -16,7 +16,8 @@ const (
 )
 
 const (
-	// The domain we're serving email for (e.g. example.com)
+	// The domain we're serving email for (e.g. example.com). More can be added in the web interface,
+	// this one is used for usernames without a domain.
 	Domain = "Domain"
 
 	// Network
@@ -29,6 +30,9 @@ const (
 	MtaAddress             = "MtaAddress"
 	ImapAddress            = "ImapAddress"
 	ImapImplicitTLSAddress = "ImapImplicitTLSAddress"
+	ManageSieveAddress     = "ManageSieveAddress"
+	Pop3Address            = "Pop3Address"
+	Pop3ImplicitTLSAddress = "Pop3ImplicitTLSAddress"
 	WebAdminAddress        = "WebAdminAddress"
 
 	// DNS
@@ -40,6 +44,7 @@ const (
 	MtaUseTls      = "MtaUseTls"
 	MsaUseTls      = "MsaUseTls"
 	ImapUseTls     = "ImapUseTls"
+	Pop3UseTls     = "Pop3UseTls"
 	WebAdminUseTls = "WebAdminUseTls"
 
 	CertificateMode = "CertificateMode"
@@ -59,11 +64,19 @@ const (
 	MaxMessageBytes = "MaxMessageBytes"
 	MaxRecipients   = "MaxRecipients"
 
+	// Quotas for users that don't have their own, 0 for unlimited
+	DefaultQuotaBytes    = "DefaultQuotaBytes"
+	DefaultQuotaMessages = "DefaultQuotaMessages"
+
 	// Admin stuff
 	AdminUsername    = "AdminUsername"
 	AdminPassword    = "AdminPassword"
 	DefaultMailboxes = "DefaultMailboxes"
 
+	// Subaddressing, e.g. user+tag@example.com
+	SubaddressSeparator = "SubaddressSeparator" // Empty to turn it off
+	SubaddressFolders   = "SubaddressFolders"   // Deliver to the mailbox named after the tag, if there is one
+
 	// DKIM
 	DkimSign      = "DkimSign"
 	DkimVerify    = "DkimVerify"
@@ -71,8 +84,14 @@ const (
 	DkimKeyBits   = "DkimKeyBits"
 
 	// SPF
-	//SpfVerify    = "SpfVerify"
-	//SpfMandatory = "SpfMandatory" // Reject messages that aren't SPF verified
+	SpfVerify     = "SpfVerify"
+	SpfMandatory  = "SpfMandatory"  // Reject messages that aren't SPF verified
+	SpfRejectFail = "SpfRejectFail" // Reject messages that fail SPF, rather than leaving them to DMARC
+
+	// DMARC
+	DmarcVerify       = "DmarcVerify"
+	DmarcReports      = "DmarcReports"      // Send daily aggregate reports to domains that ask for them
+	QuarantineMailbox = "QuarantineMailbox" // Name of the \Junk mailbox, for users without one
 
 	// Web auth tokens
 	JwtCookieName        = "JwtCookieName"
@@ -80,6 +99,13 @@ const (
 
 	// Port our message sender will try to connect to MTAs on
 	MtaSendPort = "MtaSendPort"
+
+	// Outbound queue
+	QueuePollSeconds     = "QueuePollSeconds"     // How often to look for messages due a retry
+	QueueRetrySeconds    = "QueueRetrySeconds"    // Delay before the first retry, doubled on each attempt
+	QueueMaxRetrySeconds = "QueueMaxRetrySeconds" // Upper limit on the delay between retries
+	QueueLifetimeHours   = "QueueLifetimeHours"   // Give up delivering after this long
+	QueueWarningHours    = "QueueWarningHours"    // Tell the sender their message is delayed after this long
 )
 
 func SetupConfig() {
@@ -91,12 +117,16 @@ func SetupConfig() {
 	viper.SetDefault(MtaAddress, ":25")
 	viper.SetDefault(ImapAddress, ":143")
 	viper.SetDefault(ImapImplicitTLSAddress, ":993")
+	viper.SetDefault(ManageSieveAddress, ":4190")
+	viper.SetDefault(Pop3Address, ":110")
+	viper.SetDefault(Pop3ImplicitTLSAddress, ":995")
 	viper.SetDefault(WebAdminAddress, ":443")
 	viper.SetDefault(WebAdminUseTls, true)
 
 	viper.SetDefault(MtaUseTls, true)
 	viper.SetDefault(MsaUseTls, true)
 	viper.SetDefault(ImapUseTls, true)
+	viper.SetDefault(Pop3UseTls, true)
 	viper.SetDefault(WebAdminUseTls, true)
 
 	viper.SetDefault(CertificateMode, string(AutoCert))
@@ -112,14 +142,27 @@ func SetupConfig() {
 	viper.SetDefault(MaxMessageBytes, 1024*1024) // 1MB
 	viper.SetDefault(MaxRecipients, 50)
 
+	viper.SetDefault(DefaultQuotaBytes, 0)
+	viper.SetDefault(DefaultQuotaMessages, 0)
+
 	viper.SetDefault(AdminUsername, "admin")
 	viper.SetDefault(AdminPassword, "") // Empty means it will be generated
 	viper.SetDefault(DefaultMailboxes, []string{"INBOX", "Trash", "Sent", "Drafts"})
 
+	viper.SetDefault(SubaddressSeparator, "+")
+	viper.SetDefault(SubaddressFolders, false)
+
 	viper.SetDefault(DkimSign, true)
 	viper.SetDefault(DkimVerify, true)
 	viper.SetDefault(DkimKeyBits, 2048)
 
+	viper.SetDefault(SpfVerify, true)
+	viper.SetDefault(SpfRejectFail, false)
+
+	viper.SetDefault(DmarcVerify, true)
+	viper.SetDefault(DmarcReports, true)
+	viper.SetDefault(QuarantineMailbox, "Junk")
+
 	viper.SetDefault(JwtCookieName, "henrymail_jwt_token")
 
 	viper.SetDefault(DnsServer, "208.67.222.222:53") // OpenDNS
@@ -130,6 +173,12 @@ func SetupConfig() {
 	viper.SetDefault(MtaSendPort, ":25")
 	viper.SetDefault(CookieDomainOverride, "")
 
+	viper.SetDefault(QueuePollSeconds, 30)
+	viper.SetDefault(QueueRetrySeconds, 300)
+	viper.SetDefault(QueueMaxRetrySeconds, 4*60*60)
+	viper.SetDefault(QueueLifetimeHours, 5*24)
+	viper.SetDefault(QueueWarningHours, 4)
+
 	viper.SetConfigName("henrymail")
 	viper.AddConfigPath("/etc/henrymail/")
 	viper.AddConfigPath("$HOME/.henrymail")
@@ -23,7 +23,8 @@ func GetTLSConfig() *tls.Config {
 	if !GetBool(WebAdminUseTls) &&
 		!GetBool(MsaUseTls) &&
 		!GetBool(MtaUseTls) &&
-		!GetBool(ImapUseTls) {
+		!GetBool(ImapUseTls) &&
+		!GetBool(Pop3UseTls) {
 		log.Println("Not using TLS for any services")
 		return nil
 	}
@@ -2,6 +2,7 @@ package database
 
 import (
 	"database/sql"
+	"fmt"
 	_ "github.com/mattn/go-sqlite3"
 	"henrymail/config"
 	"henrymail/embedded"
@@ -23,9 +24,44 @@ func OpenDatabase() *sql.DB {
 	if err != nil {
 		log.Fatal(err)
 	}
+	err = addMissingColumns(db)
+	if err != nil {
+		log.Fatal(err)
+	}
+	searchSqlBytes, err := embedded.GetEmbeddedContent().GetContents("/database/search_index.sql")
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = db.Exec(string(searchSqlBytes))
+	if err != nil {
+		log.Fatal(err)
+	}
 	return db
 }
 
+/**
+ * Tables created by older versions won't have been touched by
+ * generate_schema.sql, so bring them up to date.
+ */
+func addMissingColumns(db *sql.DB) error {
+	for _, c := range addedColumns {
+		var count int
+		e := db.QueryRow("SELECT count(*) FROM pragma_table_info(?) WHERE name = ?", c.table, c.name).Scan(&count)
+		if e != nil {
+			return e
+		}
+		if count > 0 {
+			continue
+		}
+		log.Printf("Adding column %v to table %v", c.name, c.table)
+		_, e = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", c.table, c.name, c.definition))
+		if e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
 func Transact(db *sql.DB, txFunc func(*sql.Tx) error) (err error) {
 	tx, err := db.Begin()
 	if err != nil {
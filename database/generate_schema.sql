@@ -4,7 +4,10 @@ CREATE TABLE IF NOT EXISTS users (
                                      id integer primary key not null,
                                      username text not null,
                                      passwordBytes blob not null,
-                                     admin bool not null
+                                     admin bool not null,
+                                     quotabytes integer default 0 not null,
+                                     quotamessages integer default 0 not null,
+                                     lastuidvalidity integer default 0 not null
 );
 
 CREATE UNIQUE INDEX IF NOT EXISTS idx_users_username ON users (
@@ -18,6 +21,11 @@ CREATE TABLE IF NOT EXISTS mailboxes (
                                          uidnext integer default 1 not null,
                                          uidvalidity integer default 1 not null,
                                          subscribed bool default true not null,
+                                         highestmodseq integer default 1 not null,
+                                         specialuse text default '' not null,
+                                         firstrecentuid integer default 1 not null,
+                                         noselect bool default false not null,
+                                         prunedmodseq integer default 0 not null,
                                          FOREIGN KEY(userid) REFERENCES users(id) ON DELETE CASCADE
 );
 
@@ -37,6 +45,13 @@ CREATE TABLE IF NOT EXISTS messages (
                                         uid integer not null,
                                         ts timestamp not null,
                                         flagsjson blob not null,
+                                        modseq integer default 1 not null,
+                                        size integer default 0 not null,
+                                        envelopejson blob default '' not null,
+                                        bodystructurejson blob default '' not null,
+                                        referencesjson blob default '' not null,
+                                        messageidhdr text default '' not null,
+                                        threadid integer default 0 not null,
                                         FOREIGN KEY (mailboxid) REFERENCES mailboxes(id) ON DELETE CASCADE
 );
 
@@ -52,4 +67,153 @@ CREATE TABLE IF NOT EXISTS keys (
 
 CREATE UNIQUE INDEX IF NOT EXISTS idx_keys_name on keys (
     name
-);
\ No newline at end of file
+);
+
+CREATE TABLE IF NOT EXISTS queue (
+    id integer primary key not null,
+    sender text not null,
+    content blob not null,
+    ts timestamp not null,
+    ret text default '' not null,
+    envid text default '' not null,
+    userid integer default 0 not null
+);
+
+CREATE TABLE IF NOT EXISTS deliveries (
+    id integer primary key not null,
+    queueid integer not null,
+    recipient text not null,
+    status text not null,
+    attempts integer default 0 not null,
+    nextattempt timestamp not null,
+    lasterror text default '' not null,
+    notify text default '' not null,
+    orcpt text default '' not null,
+    warned bool default false not null,
+    FOREIGN KEY (queueid) REFERENCES queue(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_deliveries_queueid ON deliveries (
+    queueid
+);
+
+CREATE INDEX IF NOT EXISTS idx_deliveries_status ON deliveries (
+    status
+);
+
+CREATE TABLE IF NOT EXISTS dmarcresults (
+    id integer primary key not null,
+    ts timestamp not null,
+    domain text not null,
+    rua text not null,
+    adkim text not null,
+    aspf text not null,
+    p text not null,
+    sp text not null,
+    pct integer not null,
+    sourceip text not null,
+    headerfrom text not null,
+    envelopefrom text not null,
+    dkimjson blob not null,
+    spfdomain text not null,
+    spfresult text not null,
+    dkimaligned bool not null,
+    spfaligned bool not null,
+    disposition text not null
+);
+
+CREATE INDEX IF NOT EXISTS idx_dmarcresults_domain ON dmarcresults (
+    domain
+);
+
+CREATE TABLE IF NOT EXISTS sievescripts (
+    id integer primary key not null,
+    userid integer not null,
+    name text not null,
+    content text not null,
+    active bool default false not null,
+    FOREIGN KEY (userid) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_sievescripts_userid ON sievescripts (
+    userid
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_sievescripts_userid_name ON sievescripts (
+    userid,
+    name
+);
+
+CREATE TABLE IF NOT EXISTS aliases (
+    id integer primary key not null,
+    address text not null,
+    destination text not null
+);
+
+CREATE INDEX IF NOT EXISTS idx_aliases_address ON aliases (
+    address
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_aliases_address_destination ON aliases (
+    address,
+    destination
+);
+
+CREATE TABLE IF NOT EXISTS domains (
+    id integer primary key not null,
+    name text not null,
+    dkimselector text default 'mx' not null,
+    dkimkey blob not null
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_domains_name ON domains (
+    name
+);
+
+CREATE TABLE IF NOT EXISTS expunges (
+    id integer primary key not null,
+    mailboxid integer not null,
+    uid integer not null,
+    modseq integer not null,
+    messageid integer default 0 not null,
+    FOREIGN KEY (mailboxid) REFERENCES mailboxes(id) ON DELETE CASCADE
+);
+
+DROP INDEX IF EXISTS idx_expunges_mailboxid;
+
+CREATE INDEX IF NOT EXISTS idx_expunges_mailboxid_modseq ON expunges (
+    mailboxid,
+    modseq
+);
+
+CREATE TABLE IF NOT EXISTS acls (
+    id integer primary key not null,
+    mailboxid integer not null,
+    userid integer not null,
+    rights text not null,
+    subscribed bool default true not null,
+    FOREIGN KEY (mailboxid) REFERENCES mailboxes(id) ON DELETE CASCADE,
+    FOREIGN KEY (userid) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_acls_mailboxid_userid ON acls (
+    mailboxid,
+    userid
+);
+
+CREATE INDEX IF NOT EXISTS idx_acls_userid ON acls (
+    userid
+);
+
+CREATE TABLE IF NOT EXISTS uploads (
+    id integer primary key not null,
+    userid integer not null,
+    type text not null,
+    content blob not null,
+    ts timestamp not null,
+    FOREIGN KEY (userid) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_uploads_userid ON uploads (
+    userid
+);
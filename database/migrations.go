@@ -0,0 +1,47 @@
+package database
+
+type column struct {
+	table      string
+	name       string
+	definition string
+}
+
+/**
+ * Columns added to tables after they were first released. Each of
+ * these must match the table definition in generate_schema.sql.
+ */
+var addedColumns = []column{
+	// Delivery status notifications
+	{"queue", "ret", "text default '' not null"},
+	{"queue", "envid", "text default '' not null"},
+	{"deliveries", "notify", "text default '' not null"},
+	{"deliveries", "orcpt", "text default '' not null"},
+	{"deliveries", "warned", "bool default false not null"},
+	// Modification sequences for CONDSTORE
+	{"mailboxes", "highestmodseq", "integer default 1 not null"},
+	{"messages", "modseq", "integer default 1 not null"},
+	// SPECIAL-USE mailboxes
+	{"mailboxes", "specialuse", "text default '' not null"},
+	// Storage quotas
+	{"users", "quotabytes", "integer default 0 not null"},
+	{"users", "quotamessages", "integer default 0 not null"},
+	// Parsed message metadata, so FETCH doesn't have to parse messages
+	{"messages", "size", "integer default 0 not null"},
+	{"messages", "envelopejson", "blob default '' not null"},
+	{"messages", "bodystructurejson", "blob default '' not null"},
+	// The first message no IMAP session has seen, for \Recent
+	{"mailboxes", "firstrecentuid", "integer default 1 not null"},
+	// Mailbox hierarchy, and UIDVALIDITY that's never reused
+	{"mailboxes", "noselect", "bool default false not null"},
+	{"users", "lastuidvalidity", "integer default 0 not null"},
+	// Message-IDs from the References header, for THREAD
+	{"messages", "referencesjson", "blob default '' not null"},
+	// Threads and the ids of expunged messages, for JMAP
+	{"messages", "messageidhdr", "text default '' not null"},
+	{"messages", "threadid", "integer default 0 not null"},
+	{"expunges", "messageid", "integer default 0 not null"},
+	// Expunges that have been forgotten, for QRESYNC
+	{"mailboxes", "prunedmodseq", "integer default 0 not null"},
+	// Who sent queued messages, to tell them what happened
+	{"queue", "userid", "integer default 0 not null"},
+}
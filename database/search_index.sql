@@ -0,0 +1,17 @@
+-- Full-text index of messages for IMAP SEARCH, keyed by message id (docid).
+-- It's kept out of generate_schema.sql because xo can't make models for
+-- virtual tables.
+CREATE VIRTUAL TABLE IF NOT EXISTS messages_fts USING fts4 (
+                                                        fromhdr,
+                                                        tohdr,
+                                                        cchdr,
+                                                        bcchdr,
+                                                        subject,
+                                                        headers,
+                                                        body,
+                                                        tokenize=unicode61
+);
+
+CREATE TRIGGER IF NOT EXISTS messages_fts_delete AFTER DELETE ON messages BEGIN
+    DELETE FROM messages_fts WHERE docid = old.id;
+END;
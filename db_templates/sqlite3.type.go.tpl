@@ -191,7 +191,11 @@ func GetAll{{ .Name }}(db XODB) ([]*{{ .Name }}, error) {
     // load results
     var res []*{{ .Name }}
     for qry.Next() {
-        {{ $short }} := {{ .Name }}{}
+        {{ $short }} := {{ .Name }}{
+        {{- if .PrimaryKey }}
+            _exists: true,
+        {{ end -}}
+        }
 
         // scan
         err = qry.Scan({{ fieldnames .Fields (print "&" $short) }})
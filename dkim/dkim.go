@@ -14,62 +14,62 @@ import (
 )
 
 const (
+	// Before domains had their own keys, there was just this one
 	KeyName = "dkim"
+
+	DefaultSelector = "mx"
 )
 
-func GetDkimRecordString(db *sql.DB) (string, error) {
-	pk := GetOrCreateDkim(db)
-	pkb, e := x509.MarshalPKIXPublicKey(&pk.PublicKey)
+func init() {
+	gob.Register(rsa.PrivateKey{})
+}
+
+/**
+ * The TXT record a domain should publish at <selector>._domainkey
+ */
+func GetDkimRecordString(domain *models.Domain) (string, error) {
+	pk, e := DecodeKey(domain.Dkimkey)
 	if e != nil {
 		return "", e
 	}
-	buf := new(bytes.Buffer)
-	_, e = base64.NewEncoder(base64.StdEncoding, buf).Write(pkb)
+	pkb, e := x509.MarshalPKIXPublicKey(&pk.PublicKey)
 	if e != nil {
 		return "", e
 	}
-	return "v=dkim1; k=rsa; p=" + buf.String(), nil
+	return "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(pkb), nil
 }
 
-func GetOrCreateDkim(db *sql.DB) *rsa.PrivateKey {
-	// Try the database
-	gob.Register(rsa.PrivateKey{})
+func DecodeKey(key []byte) (*rsa.PrivateKey, error) {
 	var pk *rsa.PrivateKey
-	dbKey, e := models.KeyByName(db, KeyName)
-	if e == nil {
-		e = gob.NewDecoder(bytes.NewReader(dbKey.Key)).Decode(&pk)
+	e := gob.NewDecoder(bytes.NewReader(key)).Decode(&pk)
+	return pk, e
+}
+
+/**
+ * Generates a new signing key, encoded for storing on a domain
+ */
+func NewKey() ([]byte, error) {
+	pk, e := rsa.GenerateKey(rand.Reader, config.GetInt(config.DkimKeyBits))
+	if e != nil {
+		return nil, e
 	}
+	buffer := bytes.Buffer{}
+	e = gob.NewEncoder(&buffer).Encode(pk)
+	return buffer.Bytes(), e
+}
 
+/**
+ * The key from before domains had their own, so the first domain can
+ * keep using it and the record that's already published.
+ */
+func LegacyKey(db *sql.DB) []byte {
+	dbKey, e := models.KeyByName(db, KeyName)
 	if e != nil {
-		// Something is screwy, generate a new key
+		return nil
+	}
+	if _, e = DecodeKey(dbKey.Key); e != nil {
 		log.Print(e)
-		log.Println("Generating a new DKIM key")
-		pk, e = rsa.GenerateKey(rand.Reader, config.GetInt(config.DkimKeyBits))
-		if e != nil {
-			// Can't generate a key, can't recover from this
-			log.Fatal(e)
-		}
-
-		if dbKey == nil {
-			// Assign a new db object if required
-			dbKey = &models.Key{
-				Name: KeyName,
-			}
-		}
-
-		buffer := bytes.Buffer{}
-		e = gob.NewEncoder(&buffer).Encode(pk)
-		if e != nil {
-			// Can't encode the key, can't recover from this
-			log.Fatal(e)
-		}
-		dbKey.Key = buffer.Bytes()
-
-		e = dbKey.Save(db)
-		if e != nil {
-			// Can't recover from this
-			log.Fatal(e)
-		}
+		return nil
 	}
-	return pk
+	return dbKey.Key
 }
@@ -0,0 +1,309 @@
+package dmarc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"golang.org/x/net/publicsuffix"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/**
+ * Domain-based Message Authentication, Reporting and Conformance, see RFC 7489
+ */
+
+type Policy string
+
+const (
+	PolicyNone       Policy = "none"
+	PolicyQuarantine Policy = "quarantine"
+	PolicyReject     Policy = "reject"
+)
+
+type Alignment string
+
+const (
+	Relaxed Alignment = "r"
+	Strict  Alignment = "s"
+)
+
+// Result of a DMARC check, as used in Authentication-Results (RFC 8601)
+type Result string
+
+const (
+	None      Result = "none"
+	Pass      Result = "pass"
+	Fail      Result = "fail"
+	TempError Result = "temperror"
+	PermError Result = "permerror"
+)
+
+/**
+ * A domain's published DMARC policy
+ */
+type Record struct {
+	// The domain the record was found for, which might be the organizational domain
+	Domain string
+	Adkim  Alignment
+	Aspf   Alignment
+	P      Policy
+	Sp     Policy
+	Pct    int
+	// Aggregate report addresses, without the mailto:
+	Rua []string
+}
+
+/**
+ * The record we'd like published for one of our own domains
+ */
+func GetDmarcRecordString(domain string) string {
+	return fmt.Sprintf("v=DMARC1; p=quarantine; rua=mailto:postmaster@%s", domain)
+}
+
+/**
+ * Parses the tag-value list in a DMARC TXT record
+ */
+func ParseRecord(txt string) (*Record, error) {
+	tags := strings.Split(txt, ";")
+	if strings.TrimSpace(tags[0]) != "v=DMARC1" {
+		return nil, errors.New("not a DMARC record")
+	}
+	r := &Record{Adkim: Relaxed, Aspf: Relaxed, Pct: 100}
+	for _, tag := range tags[1:] {
+		ix := strings.Index(tag, "=")
+		if ix < 0 {
+			if strings.TrimSpace(tag) == "" {
+				continue
+			}
+			return nil, fmt.Errorf("invalid tag %q", tag)
+		}
+		name := strings.ToLower(strings.TrimSpace(tag[:ix]))
+		value := strings.TrimSpace(tag[ix+1:])
+		switch name {
+		case "p":
+			r.P = parsePolicy(value)
+			if r.P == "" {
+				return nil, fmt.Errorf("invalid policy %q", value)
+			}
+		case "sp":
+			r.Sp = parsePolicy(value)
+		case "adkim":
+			r.Adkim = parseAlignment(value)
+		case "aspf":
+			r.Aspf = parseAlignment(value)
+		case "pct":
+			pct, e := strconv.Atoi(value)
+			if e == nil && pct >= 0 && pct <= 100 {
+				r.Pct = pct
+			}
+		case "rua":
+			for _, uri := range strings.Split(value, ",") {
+				uri = strings.TrimSpace(uri)
+				// Drop any size limit, our reports are small
+				if ix := strings.LastIndex(uri, "!"); ix >= 0 {
+					uri = uri[:ix]
+				}
+				if len(uri) > 7 && strings.EqualFold(uri[:7], "mailto:") {
+					r.Rua = append(r.Rua, uri[7:])
+				}
+			}
+		default:
+			// Failure reports (ruf, fo, rf) and anything newer are ignored
+		}
+	}
+	if r.P == "" {
+		// Without a policy the record is only any use for reporting
+		if len(r.Rua) == 0 {
+			return nil, errors.New("missing policy")
+		}
+		r.P = PolicyNone
+	}
+	if r.Sp == "" {
+		r.Sp = r.P
+	}
+	return r, nil
+}
+
+func parsePolicy(s string) Policy {
+	switch p := Policy(strings.ToLower(s)); p {
+	case PolicyNone, PolicyQuarantine, PolicyReject:
+		return p
+	}
+	return ""
+}
+
+func parseAlignment(s string) Alignment {
+	if strings.ToLower(s) == "s" {
+		return Strict
+	}
+	return Relaxed
+}
+
+// How long the DNS queries for a message can take
+const timeout = 20 * time.Second
+
+// The DNS queries that DMARC needs. *net.Resolver does the job.
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+type Checker struct {
+	Resolver Resolver
+}
+
+func NewChecker() *Checker {
+	return &Checker{Resolver: net.DefaultResolver}
+}
+
+/**
+ * Finds the policy for a domain, falling back to its organizational
+ * domain. Returns nil if neither publishes one.
+ */
+func (ch *Checker) Lookup(domain string) (*Record, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	r, e := ch.lookupRecord(ctx, domain)
+	if r != nil || e != nil {
+		return r, e
+	}
+	org := OrganizationalDomain(domain)
+	if org == domain {
+		return nil, nil
+	}
+	return ch.lookupRecord(ctx, org)
+}
+
+func (ch *Checker) lookupRecord(ctx context.Context, domain string) (*Record, error) {
+	txts, e := ch.Resolver.LookupTXT(ctx, "_dmarc."+domain)
+	if dnsErr, ok := e.(*net.DNSError); ok && dnsErr.IsNotFound {
+		return nil, nil
+	} else if e != nil {
+		return nil, e
+	}
+	var records []*Record
+	for _, txt := range txts {
+		r, e := ParseRecord(txt)
+		if e == nil {
+			r.Domain = domain
+			records = append(records, r)
+		}
+	}
+	// More than one record means nothing applies
+	if len(records) != 1 {
+		return nil, nil
+	}
+	return records[0], nil
+}
+
+/**
+ * The registered domain, one label below the public suffix
+ */
+func OrganizationalDomain(domain string) string {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	org, e := publicsuffix.EffectiveTLDPlusOne(domain)
+	if e != nil {
+		return domain
+	}
+	return org
+}
+
+/**
+ * Whether an authenticated domain is aligned with the From: domain
+ */
+func Aligned(from, authenticated string, mode Alignment) bool {
+	from = strings.ToLower(strings.TrimSuffix(from, "."))
+	authenticated = strings.ToLower(strings.TrimSuffix(authenticated, "."))
+	if from == authenticated {
+		return true
+	}
+	return mode == Relaxed && authenticated != "" && OrganizationalDomain(from) == OrganizationalDomain(authenticated)
+}
+
+/**
+ * The outcome of checking a message against its From: domain's policy
+ */
+type Evaluation struct {
+	Result      Result
+	HeaderFrom  string
+	Record      *Record
+	DkimAligned bool
+	SpfAligned  bool
+	// What should happen to the message
+	Disposition Policy
+}
+
+/**
+ * Evaluates the policy for the From: domain, given the domains of the
+ * DKIM signatures that verified and the domain SPF passed for (if it did).
+ */
+func (ch *Checker) Evaluate(headerFrom string, dkimDomains []string, spfDomain string) *Evaluation {
+	headerFrom = strings.ToLower(strings.TrimSuffix(headerFrom, "."))
+	eval := &Evaluation{
+		Result:      None,
+		HeaderFrom:  headerFrom,
+		Disposition: PolicyNone,
+	}
+	r, e := ch.Lookup(headerFrom)
+	if e != nil {
+		eval.Result = TempError
+		return eval
+	}
+	if r == nil {
+		return eval
+	}
+	eval.Record = r
+
+	for _, d := range dkimDomains {
+		eval.DkimAligned = eval.DkimAligned || Aligned(headerFrom, d, r.Adkim)
+	}
+	eval.SpfAligned = spfDomain != "" && Aligned(headerFrom, spfDomain, r.Aspf)
+	if eval.DkimAligned || eval.SpfAligned {
+		eval.Result = Pass
+		return eval
+	}
+
+	eval.Result = Fail
+	policy := r.P
+	if r.Domain != headerFrom {
+		policy = r.Sp
+	}
+	// Only some failures get the policy, the rest get the next one down
+	if rand.Intn(100) >= r.Pct {
+		switch policy {
+		case PolicyReject:
+			policy = PolicyQuarantine
+		case PolicyQuarantine:
+			policy = PolicyNone
+		}
+	}
+	eval.Disposition = policy
+	return eval
+}
+
+/**
+ * Whether a domain has agreed to receive reports about another domain,
+ * see RFC 7489 section 7.1. Reports within an organization are always allowed.
+ */
+func (ch *Checker) AcceptsReportsFor(address, domain string) bool {
+	destination := strings.ToLower(address[strings.LastIndex(address, "@")+1:])
+	if OrganizationalDomain(destination) == OrganizationalDomain(domain) {
+		return true
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	txts, e := ch.Resolver.LookupTXT(ctx, domain+"._report._dmarc."+destination)
+	if e != nil {
+		return false
+	}
+	for _, txt := range txts {
+		if strings.TrimSpace(strings.Split(txt, ";")[0]) == "v=DMARC1" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,179 @@
+package dmarc
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type fakeResolver struct {
+	txt  map[string][]string
+	fail map[string]bool
+}
+
+func (f *fakeResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	name = strings.TrimSuffix(name, ".")
+	if f.fail[name] {
+		return nil, &net.DNSError{Err: "server misbehaving", Name: name, IsTemporary: true}
+	}
+	if txt, ok := f.txt[name]; ok {
+		return txt, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func testChecker() *Checker {
+	return &Checker{Resolver: &fakeResolver{
+		txt: map[string][]string{
+			"_dmarc.example.com":     {"v=DMARC1; p=reject; sp=quarantine", "unrelated"},
+			"_dmarc.sub.example.com": {"v=spf1 -all"},
+			"_dmarc.own.example.com": {"v=DMARC1; p=none"},
+			"_dmarc.example.org":     {"v=DMARC1; p=none", "v=DMARC1; p=reject"},
+			"_dmarc.sampled.example": {"v=DMARC1; p=reject; sp=quarantine; pct=0"},
+			"_dmarc.always.example":  {"v=DMARC1; p=reject; pct=100"},
+		},
+		fail: map[string]bool{"_dmarc.broken.example": true},
+	}}
+}
+
+func TestParseRecord(t *testing.T) {
+	r, e := ParseRecord("v=DMARC1; p=reject; sp=quarantine; adkim=s; pct=50; rua=mailto:a@example.com!10m, https://example.com/r,mailto:b@example.org")
+	if e != nil {
+		t.Fatal(e)
+	}
+	expected := &Record{
+		Adkim: Strict,
+		Aspf:  Relaxed,
+		P:     PolicyReject,
+		Sp:    PolicyQuarantine,
+		Pct:   50,
+		Rua:   []string{"a@example.com", "b@example.org"},
+	}
+	if !reflect.DeepEqual(r, expected) {
+		t.Errorf("got %+v, expected %+v", r, expected)
+	}
+
+	r, e = ParseRecord("v=DMARC1;p=none")
+	if e != nil || r.Sp != PolicyNone || r.Pct != 100 || r.Adkim != Relaxed {
+		t.Errorf("defaults not applied: %+v %v", r, e)
+	}
+
+	// Reporting only
+	r, e = ParseRecord("v=DMARC1; rua=mailto:a@example.com")
+	if e != nil || r.P != PolicyNone {
+		t.Errorf("expected policy none: %+v %v", r, e)
+	}
+
+	for _, bad := range []string{"v=spf1 -all", "p=reject; v=DMARC1", "v=DMARC1; p=bogus", "v=DMARC1; adkim=s"} {
+		if _, e := ParseRecord(bad); e == nil {
+			t.Errorf("ParseRecord(%q) should have failed", bad)
+		}
+	}
+}
+
+func TestAligned(t *testing.T) {
+	tests := []struct {
+		from, authenticated string
+		mode                Alignment
+		aligned             bool
+	}{
+		{"example.com", "example.com", Strict, true},
+		{"example.com", "EXAMPLE.com.", Strict, true},
+		{"news.example.com", "example.com", Strict, false},
+		{"news.example.com", "example.com", Relaxed, true},
+		{"news.example.com", "mail.example.com", Relaxed, true},
+		{"example.co.uk", "other.co.uk", Relaxed, false},
+		{"example.com", "example.org", Relaxed, false},
+		{"example.com", "", Relaxed, false},
+	}
+	for _, test := range tests {
+		if Aligned(test.from, test.authenticated, test.mode) != test.aligned {
+			t.Errorf("Aligned(%q, %q, %v) should be %v", test.from, test.authenticated, test.mode, test.aligned)
+		}
+	}
+}
+
+func TestLookup(t *testing.T) {
+	ch := testChecker()
+	tests := []struct {
+		domain string
+		found  string // The domain the record belongs to, empty if there isn't one
+		p      Policy
+	}{
+		{"example.com", "example.com", PolicyReject},
+		{"EXAMPLE.com.", "example.com", PolicyReject},
+		// Subdomains without a record of their own fall back to the organizational domain
+		{"sub.example.com", "example.com", PolicyReject},
+		{"a.b.example.com", "example.com", PolicyReject},
+		{"own.example.com", "own.example.com", PolicyNone},
+		// More than one record means there isn't one
+		{"example.org", "", ""},
+		{"mail.example.org", "", ""},
+		{"example.net", "", ""},
+	}
+	for _, test := range tests {
+		r, e := ch.Lookup(test.domain)
+		if e != nil {
+			t.Errorf("Lookup(%q) failed: %v", test.domain, e)
+		} else if test.found == "" && r != nil {
+			t.Errorf("Lookup(%q) = %+v, expected nothing", test.domain, r)
+		} else if test.found != "" && (r == nil || r.Domain != test.found || r.P != test.p) {
+			t.Errorf("Lookup(%q) = %+v, expected p=%v from %v", test.domain, r, test.p, test.found)
+		}
+	}
+	if r, e := ch.Lookup("broken.example"); e == nil {
+		t.Errorf("Lookup(\"broken.example\") = %+v, expected an error", r)
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	ch := testChecker()
+	tests := []struct {
+		headerFrom  string
+		dkimDomains []string
+		spfDomain   string
+		result      Result
+		disposition Policy
+	}{
+		{"example.com", []string{"example.com"}, "", Pass, PolicyNone},
+		{"example.com", nil, "mail.example.com", Pass, PolicyNone},
+		{"example.com", []string{"example.org"}, "example.net", Fail, PolicyReject},
+		// The subdomain policy applies to records found for the organizational domain
+		{"sub.example.com", nil, "", Fail, PolicyQuarantine},
+		// With pct=0 every failure gets the next policy down
+		{"sampled.example", nil, "", Fail, PolicyQuarantine},
+		{"news.sampled.example", nil, "", Fail, PolicyNone},
+		{"always.example", nil, "", Fail, PolicyReject},
+		{"example.net", nil, "", None, PolicyNone},
+		{"broken.example", []string{"broken.example"}, "", TempError, PolicyNone},
+	}
+	for _, test := range tests {
+		eval := ch.Evaluate(test.headerFrom, test.dkimDomains, test.spfDomain)
+		if eval.Result != test.result || eval.Disposition != test.disposition {
+			t.Errorf("Evaluate(%q, %q, %q) = %v %v, expected %v %v", test.headerFrom, test.dkimDomains,
+				test.spfDomain, eval.Result, eval.Disposition, test.result, test.disposition)
+		}
+	}
+}
+
+func TestAcceptsReportsFor(t *testing.T) {
+	ch := &Checker{Resolver: &fakeResolver{txt: map[string][]string{
+		"example.com._report._dmarc.reports.example.net": {"v=DMARC1"},
+	}}}
+	tests := []struct {
+		address, domain string
+		accepts         bool
+	}{
+		{"dmarc@mail.example.com", "example.com", true},
+		{"dmarc@reports.example.net", "example.com", true},
+		{"dmarc@reports.example.net", "example.org", false},
+		{"dmarc@elsewhere.example", "example.com", false},
+	}
+	for _, test := range tests {
+		if ch.AcceptsReportsFor(test.address, test.domain) != test.accepts {
+			t.Errorf("AcceptsReportsFor(%q, %q) should be %v", test.address, test.domain, test.accepts)
+		}
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"github.com/miekg/dns"
 	"henrymail/config"
 	"henrymail/dkim"
+	"henrymail/dmarc"
+	"henrymail/models"
 	"henrymail/spf"
 	"log"
 	"net"
@@ -17,11 +19,17 @@ func StartFakeDNS(db *sql.DB, addr, proto string) {
 		Addr: addr,
 		Net:  proto,
 	}
-	dns.HandleFunc(config.GetString(config.Domain)+".", func(writer dns.ResponseWriter, r *dns.Msg) {
+	dns.HandleFunc(".", func(writer dns.ResponseWriter, r *dns.Msg) {
 		//log.Printf("DNS Request %v", r)
 		m := new(dns.Msg)
 		m.SetReply(r)
 		for _, q := range r.Question {
+			domain := hostedDomain(db, q.Name)
+			if domain == nil {
+				// Not one of ours, as if there were no server for it
+				dns.HandleFailed(writer, r)
+				return
+			}
 			switch q.Qtype {
 			case dns.TypeA:
 				m.Answer = append(m.Answer, &dns.A{
@@ -36,8 +44,10 @@ func StartFakeDNS(db *sql.DB, addr, proto string) {
 				})
 			case dns.TypeTXT:
 				result := ""
-				if strings.Contains(q.Name, "mx._domainkey.") {
-					result, _ = dkim.GetDkimRecordString(db)
+				if strings.HasPrefix(q.Name, domain.Dkimselector+"._domainkey.") {
+					result, _ = dkim.GetDkimRecordString(domain)
+				} else if strings.HasPrefix(q.Name, "_dmarc.") {
+					result = dmarc.GetDmarcRecordString(domain.Name)
 				} else {
 					result = spf.GetSpfRecordString()
 				}
@@ -80,6 +90,24 @@ func StartFakeDNS(db *sql.DB, addr, proto string) {
 	log.Printf("Started FAKE DNS SERVER at " + config.GetString(config.FakeDnsAddress))
 }
 
+/**
+ * Finds the domain we host that a name is in, if any
+ */
+func hostedDomain(db *sql.DB, name string) *models.Domain {
+	name = strings.ToLower(name)
+	domains, e := models.GetAllDomain(db)
+	if e != nil {
+		log.Print(e)
+		return nil
+	}
+	for _, d := range domains {
+		if name == d.Name+"." || strings.HasSuffix(name, "."+d.Name+".") {
+			return d
+		}
+	}
+	return nil
+}
+
 func chunk(buf string, lim int) []string {
 	var chunk string
 	chunks := make([]string, 0, len(buf)/lim+1)
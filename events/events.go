@@ -0,0 +1,143 @@
+package events
+
+import (
+	"sync"
+)
+
+/**
+ * An in-process bus for changes to mailboxes, so that IMAP sessions
+ * can tell their clients about mail that was delivered, or changed
+ * by another session.
+ */
+
+type Type int
+
+const (
+	// New messages were added to the mailbox
+	Exists Type = iota
+	// The message with UID was removed from the mailbox
+	Expunge
+	// The flags of the message with UID changed, at modification sequence Modseq
+	Flags
+)
+
+type Event struct {
+	Type      Type
+	Userid    int
+	Mailboxid int
+	UID       int
+	Flags     []string
+	Modseq    int
+	// Whatever made the change, like an IMAP session, so it can tell its own
+	// changes apart. Nil for changes from elsewhere.
+	Origin interface{}
+}
+
+/**
+ * Handles events one at a time, in the order they were published. It
+ * mustn't block, PublishAndWait waits for it: anything slow, like writing
+ * to a client, should be queued and done elsewhere.
+ */
+type Handler func(Event)
+
+type subscriber struct {
+	handler Handler
+	lock    sync.Mutex
+	cond    *sync.Cond
+	queue   []delivery
+	closed  bool
+}
+
+type delivery struct {
+	event Event
+	done  *sync.WaitGroup
+}
+
+var (
+	lock        sync.Mutex
+	subscribers = map[*subscriber]struct{}{}
+)
+
+/**
+ * Registers the handler for all future events. Each subscriber has its own
+ * goroutine, so a slow one doesn't hold up publishers or other subscribers.
+ * Call the returned function to unsubscribe.
+ */
+func Subscribe(handler Handler) func() {
+	s := &subscriber{handler: handler}
+	s.cond = sync.NewCond(&s.lock)
+	lock.Lock()
+	subscribers[s] = struct{}{}
+	lock.Unlock()
+	go s.run()
+	return func() {
+		lock.Lock()
+		delete(subscribers, s)
+		lock.Unlock()
+		s.lock.Lock()
+		s.closed = true
+		s.cond.Signal()
+		s.lock.Unlock()
+	}
+}
+
+/**
+ * Queues the events for every subscriber and returns straight away.
+ * Should be called after the change is committed, so that subscribers
+ * see it when they read the database.
+ */
+func Publish(events ...Event) {
+	publish(nil, events)
+}
+
+/**
+ * Like Publish, but waits for every subscriber to handle the events. The IMAP
+ * server needs this so the session that made a change can wait for its own
+ * updates before the command completes.
+ */
+func PublishAndWait(events ...Event) {
+	done := &sync.WaitGroup{}
+	publish(done, events)
+	done.Wait()
+}
+
+func publish(done *sync.WaitGroup, events []Event) {
+	lock.Lock()
+	defer lock.Unlock()
+	for s := range subscribers {
+		s.lock.Lock()
+		for _, ev := range events {
+			if done != nil {
+				done.Add(1)
+			}
+			s.queue = append(s.queue, delivery{event: ev, done: done})
+		}
+		s.cond.Signal()
+		s.lock.Unlock()
+	}
+}
+
+func (s *subscriber) run() {
+	for {
+		s.lock.Lock()
+		for len(s.queue) == 0 && !s.closed {
+			s.cond.Wait()
+		}
+		queue := s.queue
+		s.queue = nil
+		closed := s.closed
+		s.lock.Unlock()
+
+		for _, d := range queue {
+			if !closed {
+				s.handler(d.event)
+			}
+			if d.done != nil {
+				d.done.Done()
+			}
+		}
+		if closed {
+			return
+		}
+	}
+}
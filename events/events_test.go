@@ -0,0 +1,38 @@
+package events
+
+import (
+	"testing"
+)
+
+func TestPublishAndWait(t *testing.T) {
+	var got []Event
+	unsubscribe := Subscribe(func(ev Event) {
+		got = append(got, ev)
+	})
+	defer unsubscribe()
+
+	PublishAndWait(
+		Event{Type: Expunge, Mailboxid: 1, UID: 3},
+		Event{Type: Expunge, Mailboxid: 1, UID: 2},
+		Event{Type: Exists, Mailboxid: 2},
+	)
+	if len(got) != 3 {
+		t.Fatalf("expected 3 events, got %v", got)
+	}
+	if got[0].UID != 3 || got[1].UID != 2 || got[2].Type != Exists {
+		t.Errorf("events out of order: %v", got)
+	}
+}
+
+func TestUnsubscribe(t *testing.T) {
+	count := 0
+	unsubscribe := Subscribe(func(ev Event) {
+		count++
+	})
+	PublishAndWait(Event{Type: Exists})
+	unsubscribe()
+	PublishAndWait(Event{Type: Exists})
+	if count != 1 {
+		t.Errorf("expected 1 event before unsubscribing, got %v", count)
+	}
+}
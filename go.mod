@@ -17,9 +17,9 @@ require (
 	github.com/emersion/go-dkim v0.3.0
 	github.com/emersion/go-imap v1.0.3
 	github.com/emersion/go-message v0.11.1
+	github.com/emersion/go-sasl v0.0.0-20200509203442-7bfe0ed36a21
 	github.com/emersion/go-msgauth v0.2.0 // indirect
-	github.com/emersion/go-sasl v0.0.0-20191210011802-430746ea8b9b // indirect
-	github.com/emersion/go-smtp v0.12.1
+	github.com/emersion/go-smtp v0.20.2
 	github.com/go-kit/kit v0.9.0 // indirect
 	github.com/golang/groupcache v0.0.0-20190702054246-869f871628b6 // indirect
 	github.com/google/go-cmp v0.3.0
@@ -52,7 +52,7 @@ require (
 	github.com/xo/xoutil v0.0.0-20171112033149-46189f4026a5
 	go.etcd.io/bbolt v1.3.3 // indirect
 	golang.org/x/crypto v0.0.0-20200214034016-1d94cc7ab1c6
-	golang.org/x/net v0.0.0-20200202094626-16171245cfb2 // indirect
+	golang.org/x/net v0.0.0-20200202094626-16171245cfb2
 	golang.org/x/sync v0.0.0-20190911185100-cd5d95a43a6e // indirect
 	golang.org/x/sys v0.0.0-20200212091648-12a6c2dcc1e4 // indirect
 	google.golang.org/appengine v1.6.5 // indirect
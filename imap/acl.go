@@ -0,0 +1,419 @@
+package imap
+
+import (
+	"database/sql"
+	"errors"
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/server"
+	"github.com/emersion/go-imap/utf7"
+	"henrymail/logic"
+	"henrymail/models"
+	"strings"
+)
+
+/**
+ * ACL from RFC 4314, so users can share mailboxes, and NAMESPACE from
+ * RFC 2342. Other users' mailboxes are named Shared/<owner>/<mailbox>.
+ */
+type aclExtension struct{}
+
+const sharedNamespace = "Shared" + logic.MailboxDelimiter
+
+func (aclExtension) Capabilities(c server.Conn) []string {
+	return []string{"ACL", "RIGHTS=kxte", "NAMESPACE"}
+}
+
+func (aclExtension) Command(name string) server.HandlerFactory {
+	switch name {
+	case "SETACL":
+		return func() server.Handler { return &setACLHandler{} }
+	case "DELETEACL":
+		return func() server.Handler { return &setACLHandler{delete: true} }
+	case "GETACL":
+		return func() server.Handler { return &getACLHandler{} }
+	case "LISTRIGHTS":
+		return func() server.Handler { return &listRightsHandler{} }
+	case "MYRIGHTS":
+		return func() server.Handler { return &myRightsHandler{} }
+	case "NAMESPACE":
+		return func() server.Handler { return &namespaceHandler{} }
+	}
+	return nil
+}
+
+/**
+ * Works out whose mailbox a name refers to. prefix is what goes in front
+ * of the owner's name for the mailbox, so the user sees the same name.
+ */
+func (u *imapUser) resolve(db models.XODB, name string) (ownerid int, prefix, local string, e error) {
+	if name+logic.MailboxDelimiter == sharedNamespace {
+		return 0, "", "", logic.ErrInvalidMailboxName
+	}
+	if !strings.HasPrefix(name, sharedNamespace) {
+		return u.userid, "", name, nil
+	}
+	parts := strings.SplitN(strings.TrimPrefix(name, sharedNamespace), logic.MailboxDelimiter, 2)
+	if len(parts) < 2 || parts[1] == "" {
+		// The levels of the namespace aren't mailboxes
+		return 0, "", "", backend.ErrNoSuchMailbox
+	}
+	owner, e := models.UserByUsername(db, parts[0])
+	if e == sql.ErrNoRows {
+		return 0, "", "", backend.ErrNoSuchMailbox
+	} else if e != nil {
+		return 0, "", "", e
+	}
+	return owner.ID, sharedNamespace + owner.Username + logic.MailboxDelimiter, parts[1], nil
+}
+
+/**
+ * Mailboxes the user can't look up don't exist as far as they're concerned,
+ * whatever other rights they have, see RFC 4314 section 4
+ */
+func (u *imapUser) findMailbox(db models.XODB, name string) (*models.Mailbox, string, string, error) {
+	ownerid, prefix, local, e := u.resolve(db, name)
+	if e != nil {
+		return nil, "", "", e
+	}
+	mailbox, e := models.MailboxByUseridName(db, ownerid, local)
+	if e == sql.ErrNoRows {
+		return nil, "", "", backend.ErrNoSuchMailbox
+	} else if e != nil {
+		return nil, "", "", e
+	}
+	rights, e := logic.Rights(db, mailbox, u.userid)
+	if e != nil {
+		return nil, "", "", e
+	}
+	if !logic.HasRights(rights, logic.RightLookup) {
+		return nil, "", "", backend.ErrNoSuchMailbox
+	}
+	return mailbox, prefix, rights, nil
+}
+
+/**
+ * The rights needed on the mailbox above the one named, to create it there
+ */
+func (u *imapUser) checkParentRights(db models.XODB, name string) (ownerid int, local string, e error) {
+	ownerid, _, local, e = u.resolve(db, name)
+	if e != nil || ownerid == u.userid {
+		return ownerid, local, e
+	}
+	parentName := logic.ParentName(local)
+	if parentName == "" {
+		return 0, "", logic.ErrNoRights
+	}
+	parent, e := models.MailboxByUseridName(db, ownerid, parentName)
+	if e == sql.ErrNoRows {
+		return 0, "", logic.ErrNoRights
+	} else if e != nil {
+		return 0, "", e
+	}
+	rights, e := logic.Rights(db, parent, u.userid)
+	if e != nil {
+		return 0, "", e
+	}
+	if !logic.HasRights(rights, logic.RightCreate) {
+		return 0, "", logic.ErrNoRights
+	}
+	return ownerid, local, nil
+}
+
+func (m *imapMailbox) rights(db models.XODB) (string, error) {
+	mailbox, e := models.MailboxByID(db, m.mailboxid)
+	if e != nil {
+		return "", e
+	}
+	return logic.Rights(db, mailbox, m.user.userid)
+}
+
+/**
+ * Checked for each command, so rights that are taken away apply straight away
+ */
+func (m *imapMailbox) checkRights(db models.XODB, needed string) error {
+	rights, e := m.rights(db)
+	if e != nil {
+		return e
+	}
+	if !logic.HasRights(rights, needed) {
+		return logic.ErrNoRights
+	}
+	return nil
+}
+
+func canChangeFlag(rights, flag string) bool {
+	switch flag {
+	case imap.SeenFlag:
+		return logic.HasRights(rights, logic.RightSeen)
+	case imap.DeletedFlag:
+		return logic.HasRights(rights, logic.RightDeleteMessages)
+	}
+	return logic.HasRights(rights, logic.RightWrite)
+}
+
+/**
+ * The updated flags, except that those the user hasn't the rights
+ * to change are left as they were
+ */
+func restrictFlags(rights string, existing, updated []string) []string {
+	flags := []string{}
+	for _, flag := range updated {
+		if canChangeFlag(rights, flag) {
+			flags = append(flags, flag)
+		}
+	}
+	for _, flag := range existing {
+		if !canChangeFlag(rights, flag) && !stringSl(flags).contains(flag) {
+			flags = append(flags, flag)
+		}
+	}
+	return flags
+}
+
+/**
+ * The user's own mailboxes and those shared with them, named as they see
+ * them. Levels of the shared namespace that aren't mailboxes they can see
+ * are added as \Noselect, so clients can show the hierarchy.
+ */
+func (u *imapUser) visibleMailboxes() ([]*models.Mailbox, error) {
+	mailboxes, e := models.MailboxesByUserid(u.db, u.userid)
+	if e != nil {
+		return nil, e
+	}
+	shared, e := logic.SharedMailboxes(u.db, u.userid)
+	if e != nil {
+		return nil, e
+	}
+	names := map[string]bool{}
+	for _, s := range shared {
+		name := sharedNamespace + s.Owner + logic.MailboxDelimiter + s.Name
+		names[name] = true
+		mailboxes = append(mailboxes, &models.Mailbox{
+			ID:         s.ID,
+			Userid:     s.Userid,
+			Name:       name,
+			Subscribed: s.ACL.Subscribed,
+			Noselect:   s.Noselect,
+		})
+	}
+	for _, s := range shared {
+		name := sharedNamespace + s.Owner + logic.MailboxDelimiter + s.Name
+		for parent := logic.ParentName(name); parent != "" && !names[parent]; parent = logic.ParentName(parent) {
+			names[parent] = true
+			mailboxes = append(mailboxes, &models.Mailbox{
+				Userid:     s.Userid,
+				Name:       parent,
+				Subscribed: s.ACL.Subscribed,
+				Noselect:   true,
+			})
+		}
+	}
+	return mailboxes, nil
+}
+
+func encodeMailboxName(name string) (interface{}, error) {
+	encoded, e := utf7.Encoding.NewEncoder().String(name)
+	if e != nil {
+		return nil, e
+	}
+	return imap.FormatMailboxName(encoded), nil
+}
+
+func parseMailboxName(field interface{}) (string, error) {
+	name, e := imap.ParseString(field)
+	if e != nil {
+		return "", e
+	}
+	name, e = utf7.Encoding.NewDecoder().String(name)
+	if e != nil {
+		return "", e
+	}
+	return imap.CanonicalMailboxName(name), nil
+}
+
+/**
+ * Finds the mailbox a command is about and checks the user may administer it
+ */
+func adminMailbox(conn server.Conn, name string) (*imapUser, *models.Mailbox, error) {
+	ctx := conn.Context()
+	if ctx.User == nil {
+		return nil, nil, server.ErrNotAuthenticated
+	}
+	user := ctx.User.(*imapUser)
+	mailbox, _, rights, e := user.findMailbox(user.db, name)
+	if e != nil {
+		return nil, nil, e
+	}
+	if !logic.HasRights(rights, logic.RightAdmin) {
+		return nil, nil, logic.ErrNoRights
+	}
+	return user, mailbox, nil
+}
+
+// SETACL mailbox identifier rights, and DELETEACL mailbox identifier
+type setACLHandler struct {
+	delete     bool
+	mailbox    string
+	identifier string
+	rights     string
+}
+
+func (h *setACLHandler) Parse(fields []interface{}) error {
+	if len(fields) != 3 && !(h.delete && len(fields) == 2) {
+		return errors.New("wrong number of arguments")
+	}
+	var e error
+	h.mailbox, e = parseMailboxName(fields[0])
+	if e != nil {
+		return e
+	}
+	h.identifier, e = imap.ParseString(fields[1])
+	if e != nil {
+		return e
+	}
+	if !h.delete {
+		h.rights, e = imap.ParseString(fields[2])
+	}
+	return e
+}
+
+func (h *setACLHandler) Handle(conn server.Conn) error {
+	user, mailbox, e := adminMailbox(conn, h.mailbox)
+	if e != nil {
+		return e
+	}
+	// Negative rights and "anyone" aren't supported
+	if strings.HasPrefix(h.identifier, "-") || h.identifier == "anyone" {
+		return logic.ErrUnknownIdentifier
+	}
+	return logic.SetRights(user.db, mailbox, h.identifier, h.rights)
+}
+
+type getACLHandler struct {
+	mailbox string
+}
+
+func (h *getACLHandler) Parse(fields []interface{}) error {
+	if len(fields) != 1 {
+		return errors.New("GETACL needs a mailbox")
+	}
+	var e error
+	h.mailbox, e = parseMailboxName(fields[0])
+	return e
+}
+
+func (h *getACLHandler) Handle(conn server.Conn) error {
+	user, mailbox, e := adminMailbox(conn, h.mailbox)
+	if e != nil {
+		return e
+	}
+	entries, e := logic.MailboxACL(user.db, mailbox)
+	if e != nil {
+		return e
+	}
+	name, e := encodeMailboxName(h.mailbox)
+	if e != nil {
+		return e
+	}
+	fields := []interface{}{imap.RawString("ACL"), name}
+	for _, entry := range entries {
+		fields = append(fields, entry.Username, entry.Rights)
+	}
+	return conn.WriteResp(imap.NewUntaggedResp(fields))
+}
+
+type listRightsHandler struct {
+	mailbox    string
+	identifier string
+}
+
+func (h *listRightsHandler) Parse(fields []interface{}) error {
+	if len(fields) != 2 {
+		return errors.New("LISTRIGHTS needs a mailbox and an identifier")
+	}
+	var e error
+	h.mailbox, e = parseMailboxName(fields[0])
+	if e != nil {
+		return e
+	}
+	h.identifier, e = imap.ParseString(fields[1])
+	return e
+}
+
+/**
+ * The owner always has every right, anyone else can be given any of them
+ */
+func (h *listRightsHandler) Handle(conn server.Conn) error {
+	user, mailbox, e := adminMailbox(conn, h.mailbox)
+	if e != nil {
+		return e
+	}
+	owner, e := models.UserByID(user.db, mailbox.Userid)
+	if e != nil {
+		return e
+	}
+	name, e := encodeMailboxName(h.mailbox)
+	if e != nil {
+		return e
+	}
+	fields := []interface{}{imap.RawString("LISTRIGHTS"), name, h.identifier}
+	if logic.QualifyUsername(h.identifier) == owner.Username {
+		fields = append(fields, logic.AllRights)
+	} else {
+		fields = append(fields, "")
+		for _, right := range logic.AllRights {
+			fields = append(fields, imap.RawString(right))
+		}
+	}
+	return conn.WriteResp(imap.NewUntaggedResp(fields))
+}
+
+type myRightsHandler struct {
+	mailbox string
+}
+
+func (h *myRightsHandler) Parse(fields []interface{}) error {
+	if len(fields) != 1 {
+		return errors.New("MYRIGHTS needs a mailbox")
+	}
+	var e error
+	h.mailbox, e = parseMailboxName(fields[0])
+	return e
+}
+
+func (h *myRightsHandler) Handle(conn server.Conn) error {
+	ctx := conn.Context()
+	if ctx.User == nil {
+		return server.ErrNotAuthenticated
+	}
+	user := ctx.User.(*imapUser)
+	_, _, rights, e := user.findMailbox(user.db, h.mailbox)
+	if e != nil {
+		return e
+	}
+	name, e := encodeMailboxName(h.mailbox)
+	if e != nil {
+		return e
+	}
+	return conn.WriteResp(imap.NewUntaggedResp([]interface{}{imap.RawString("MYRIGHTS"), name, rights}))
+}
+
+type namespaceHandler struct{}
+
+func (h *namespaceHandler) Parse(fields []interface{}) error {
+	return nil
+}
+
+// The user's own mailboxes, then other users', and there are no public ones
+func (h *namespaceHandler) Handle(conn server.Conn) error {
+	if conn.Context().User == nil {
+		return server.ErrNotAuthenticated
+	}
+	return conn.WriteResp(imap.NewUntaggedResp([]interface{}{
+		imap.RawString("NAMESPACE"),
+		[]interface{}{[]interface{}{"", logic.MailboxDelimiter}},
+		[]interface{}{[]interface{}{sharedNamespace, logic.MailboxDelimiter}},
+		nil,
+	}))
+}
@@ -0,0 +1,36 @@
+package imap
+
+import (
+	"github.com/emersion/go-imap"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestRestrictFlags(t *testing.T) {
+	tests := []struct {
+		rights            string
+		existing, updated []string
+		expected          []string
+	}{
+		// The owner can change anything
+		{"lrswipkxtea", []string{imap.SeenFlag, "todo"}, []string{imap.DeletedFlag}, []string{imap.DeletedFlag}},
+		// s is just for \Seen, t for \Deleted and w for the rest
+		{"lrs", nil, []string{imap.SeenFlag, imap.DeletedFlag, "todo"}, []string{imap.SeenFlag}},
+		{"lrt", nil, []string{imap.SeenFlag, imap.DeletedFlag, "todo"}, []string{imap.DeletedFlag}},
+		{"lrw", nil, []string{imap.SeenFlag, imap.DeletedFlag, imap.FlaggedFlag, "todo"}, []string{imap.FlaggedFlag, "todo"}},
+		// Flags that can't be changed are kept, and can't be taken away
+		{"lrs", []string{imap.FlaggedFlag, imap.SeenFlag}, []string{}, []string{imap.FlaggedFlag}},
+		{"lrw", []string{imap.SeenFlag, "todo"}, []string{"done"}, []string{imap.SeenFlag, "done"}},
+		{"lr", []string{imap.DeletedFlag}, []string{imap.DeletedFlag, imap.SeenFlag}, []string{imap.DeletedFlag}},
+		{"lr", nil, nil, []string{}},
+	}
+	for _, test := range tests {
+		got := restrictFlags(test.rights, test.existing, test.updated)
+		sort.Strings(got)
+		sort.Strings(test.expected)
+		if !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("restrictFlags(%q, %q, %q) = %q, expected %q", test.rights, test.existing, test.updated, got, test.expected)
+		}
+	}
+}
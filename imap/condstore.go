@@ -0,0 +1,697 @@
+package imap
+
+import (
+	"errors"
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/commands"
+	"github.com/emersion/go-imap/responses"
+	"github.com/emersion/go-imap/server"
+	"henrymail/models"
+	"strconv"
+	"strings"
+)
+
+/**
+ * RFC 7162 CONDSTORE and QRESYNC, which let clients find out what's changed
+ * in a mailbox since they last looked, instead of fetching it all again.
+ * Every change to a message's flags, and every expunge, is given a new
+ * modification sequence (modseq) from its mailbox's highestmodseq.
+ */
+
+const (
+	fetchModseq         imap.FetchItem  = "MODSEQ"
+	statusHighestModseq imap.StatusItem = "HIGHESTMODSEQ"
+)
+
+type condstoreExtension struct{}
+
+func (condstoreExtension) Capabilities(c server.Conn) []string {
+	return []string{"ENABLE", "CONDSTORE", "QRESYNC"}
+}
+
+func (condstoreExtension) Command(name string) server.HandlerFactory {
+	switch name {
+	case "ENABLE":
+		return func() server.Handler { return &enableHandler{} }
+	case "SELECT":
+		return func() server.Handler { return &selectHandler{} }
+	case "EXAMINE":
+		return func() server.Handler {
+			h := &selectHandler{}
+			h.ReadOnly = true
+			return h
+		}
+	case "FETCH":
+		return func() server.Handler { return &fetchHandler{} }
+	case "STORE":
+		return func() server.Handler { return &storeHandler{} }
+	case "SEARCH":
+		return func() server.Handler { return &searchHandler{} }
+	}
+	return nil
+}
+
+func parseModseq(f interface{}) (int, error) {
+	s, ok := f.(string)
+	if !ok {
+		return 0, errors.New("modseq must be a number")
+	}
+	modseq, e := strconv.ParseInt(s, 10, 64)
+	if e != nil || modseq < 0 {
+		return 0, errors.New("modseq must be a number")
+	}
+	return int(modseq), nil
+}
+
+func isAtom(f interface{}, name string) bool {
+	s, ok := f.(string)
+	return ok && strings.EqualFold(s, name)
+}
+
+/**
+ * ENABLE from RFC 5161, which is how clients turn on QRESYNC
+ */
+type enableHandler struct {
+	capabilities []string
+}
+
+func (h *enableHandler) Parse(fields []interface{}) error {
+	if len(fields) == 0 {
+		return errors.New("no capabilities to enable")
+	}
+	for _, f := range fields {
+		capability, ok := f.(string)
+		if !ok {
+			return errors.New("capabilities must be atoms")
+		}
+		h.capabilities = append(h.capabilities, strings.ToUpper(capability))
+	}
+	return nil
+}
+
+func (h *enableHandler) Handle(conn server.Conn) error {
+	if conn.Context().User == nil {
+		return server.ErrNotAuthenticated
+	}
+	sess := sessionFor(conn)
+	enabled := []interface{}{imap.RawString("ENABLED")}
+	for _, capability := range h.capabilities {
+		switch capability {
+		case "CONDSTORE":
+			sess.enableCondstore()
+		case "QRESYNC":
+			sess.enableQresync()
+		default:
+			// Clients can ask for anything, we just don't mention what we don't support
+			continue
+		}
+		enabled = append(enabled, imap.RawString(capability))
+	}
+	return conn.WriteResp(imap.NewUntaggedResp(enabled))
+}
+
+/**
+ * SELECT and EXAMINE, with the CONDSTORE and QRESYNC parameters
+ */
+type selectHandler struct {
+	commands.Select
+	condstore bool
+	qresync   *qresyncParams
+}
+
+type qresyncParams struct {
+	uidValidity uint32
+	modseq      int
+	knownUids   *imap.SeqSet // nil if the client didn't say
+}
+
+func (h *selectHandler) Parse(fields []interface{}) error {
+	if len(fields) > 1 {
+		params, ok := fields[1].([]interface{})
+		if !ok {
+			return errors.New("select parameters must be a list")
+		}
+		for i := 0; i < len(params); i++ {
+			switch {
+			case isAtom(params[i], "CONDSTORE"):
+				h.condstore = true
+			case isAtom(params[i], "QRESYNC") && i+1 < len(params):
+				i++
+				args, ok := params[i].([]interface{})
+				if !ok {
+					return errors.New("QRESYNC parameters must be a list")
+				}
+				qresync, e := parseQresync(args)
+				if e != nil {
+					return e
+				}
+				h.qresync = qresync
+			default:
+				return errors.New("unknown select parameter")
+			}
+		}
+	}
+	if len(fields) > 1 {
+		fields = fields[:1]
+	}
+	return h.Select.Parse(fields)
+}
+
+/**
+ * (uidvalidity modseq [known-uids [seq-match-data]]) the seq-match-data is
+ * just an optimisation for us, so it's ignored.
+ */
+func parseQresync(args []interface{}) (*qresyncParams, error) {
+	if len(args) < 2 {
+		return nil, errors.New("QRESYNC needs a UIDVALIDITY and a modseq")
+	}
+	uidValidity, e := imap.ParseNumber(args[0])
+	if e != nil {
+		return nil, e
+	}
+	modseq, e := parseModseq(args[1])
+	if e != nil {
+		return nil, e
+	}
+	params := &qresyncParams{uidValidity: uidValidity, modseq: modseq}
+	if len(args) > 2 {
+		if s, ok := args[2].(string); ok {
+			params.knownUids, e = imap.ParseSeqSet(s)
+			if e != nil {
+				return nil, e
+			}
+		}
+	}
+	return params, nil
+}
+
+func (h *selectHandler) Handle(conn server.Conn) error {
+	ctx := conn.Context()
+	if ctx.User == nil {
+		return server.ErrNotAuthenticated
+	}
+	sess := sessionFor(conn)
+	if h.condstore {
+		sess.enableCondstore()
+	}
+	condstore, qresync, _ := sess.state()
+	if h.qresync != nil && !qresync {
+		return server.ErrStatusResp(&imap.StatusResp{
+			Type: imap.StatusRespBad,
+			Info: "QRESYNC must be enabled first",
+		})
+	}
+	if ctx.Mailbox != nil {
+		ctx.Mailbox = nil
+		if qresync {
+			e := conn.WriteResp(&imap.StatusResp{
+				Type: imap.StatusRespOk,
+				Code: "CLOSED",
+				Info: "Previous mailbox closed",
+			})
+			if e != nil {
+				return e
+			}
+		}
+	}
+
+	mbox, e := ctx.User.GetMailbox(h.Mailbox)
+	if e != nil {
+		return e
+	}
+	mailbox := mbox.(*imapMailbox)
+	// Changes from now on are queued for the session, and sent after the
+	// mailbox's responses. The ones before are in what it loads.
+	sess.updating.Lock()
+	defer sess.updating.Unlock()
+	ctx.Mailbox = mailbox
+	status, e := h.open(mailbox)
+	if e != nil {
+		ctx.Mailbox = nil
+		return e
+	}
+	ctx.MailboxReadOnly = h.ReadOnly || status.ReadOnly
+
+	e = conn.WriteResp(&responses.Select{Mailbox: status})
+	if e != nil {
+		return e
+	}
+	if condstore {
+		mbx, e := models.MailboxByID(mailbox.db, mailbox.mailboxid)
+		if e != nil {
+			return e
+		}
+		e = conn.WriteResp(&imap.StatusResp{
+			Type:      imap.StatusRespOk,
+			Code:      imap.StatusRespCode(statusHighestModseq),
+			Arguments: []interface{}{formatModseq(mbx.Highestmodseq)},
+			Info:      "Highest",
+		})
+		if e != nil {
+			return e
+		}
+	}
+	// If the UIDs aren't valid any more, the client has to start again anyway
+	if h.qresync != nil && h.qresync.uidValidity == status.UidValidity {
+		e = mailbox.resync(conn, h.qresync)
+		if e != nil {
+			return e
+		}
+	}
+
+	var code imap.StatusRespCode = imap.CodeReadWrite
+	if ctx.MailboxReadOnly {
+		code = imap.CodeReadOnly
+	}
+	return server.ErrStatusResp(&imap.StatusResp{
+		Type: imap.StatusRespOk,
+		Code: code,
+	})
+}
+
+func (h *selectHandler) open(mailbox *imapMailbox) (*imap.MailboxStatus, error) {
+	e := mailbox.selectSeqnums()
+	if e != nil {
+		return nil, e
+	}
+	e = mailbox.selectRecent(!h.ReadOnly)
+	if e != nil {
+		return nil, e
+	}
+	status, e := mailbox.Status([]imap.StatusItem{
+		imap.StatusMessages, imap.StatusRecent, imap.StatusUnseen,
+		imap.StatusUidNext, imap.StatusUidValidity,
+	})
+	if e != nil {
+		return nil, e
+	}
+	status.UnseenSeqNum, e = mailbox.firstUnseen(mailbox.db)
+	return status, e
+}
+
+/**
+ * Tells a client selecting with QRESYNC what was expunged
+ * and which flags changed since it last saw the mailbox
+ */
+func (m *imapMailbox) resync(conn server.Conn, params *qresyncParams) error {
+	e := m.writeVanished(conn, params.knownUids, params.modseq)
+	if e != nil {
+		return e
+	}
+	items := []imap.FetchItem{imap.FetchUid, imap.FetchFlags, fetchModseq}
+	return writeFetch(conn, func(ch chan *imap.Message) error {
+		return m.listMessages(false, allMessages(), items, params.modseq, ch, nil)
+	})
+}
+
+/**
+ * Sends VANISHED (EARLIER) for the messages in uids which have been expunged
+ * since the given modseq. A nil uids means all of them.
+ */
+func (m *imapMailbox) writeVanished(conn server.Conn, uids *imap.SeqSet, since int) error {
+	mailbox, e := models.MailboxByID(m.db, m.mailboxid)
+	if e != nil {
+		return e
+	}
+	if uids == nil {
+		uids = allMessages()
+	}
+	uids = withLast(uids, uint32(mailbox.Uidnext-1))
+	var vanished *imap.SeqSet
+	if since < mailbox.Prunedmodseq {
+		vanished, e = m.missingUids(uids, uint32(mailbox.Uidnext))
+	} else {
+		vanished, e = expungedUids(m.db, m.mailboxid, uids, since)
+	}
+	if e != nil || vanished.Empty() {
+		return e
+	}
+	return conn.WriteResp(imap.NewUntaggedResp([]interface{}{
+		imap.RawString("VANISHED"),
+		[]interface{}{imap.RawString("EARLIER")},
+		vanished,
+	}))
+}
+
+func expungedUids(db models.XODB, mailboxid int, uids *imap.SeqSet, since int) (*imap.SeqSet, error) {
+	rows, e := db.Query("SELECT uid FROM expunges WHERE mailboxid = ? AND modseq > ?", mailboxid, since)
+	if e != nil {
+		return nil, e
+	}
+	defer rows.Close()
+	vanished := &imap.SeqSet{}
+	for rows.Next() {
+		var uid uint32
+		e = rows.Scan(&uid)
+		if e != nil {
+			return nil, e
+		}
+		if uids.Contains(uid) {
+			vanished.AddNum(uid)
+		}
+	}
+	return vanished, rows.Err()
+}
+
+/**
+ * Some of what's been expunged since has been forgotten, so every UID in
+ * uids that isn't in the mailbox now is reported. RFC 7162 section 3.2.10
+ * allows for UIDs that were never used being among them.
+ */
+func (m *imapMailbox) missingUids(uids *imap.SeqSet, uidnext uint32) (*imap.SeqSet, error) {
+	present, e := loadUids(m.db, m.mailboxid, 0)
+	if e != nil {
+		return nil, e
+	}
+	vanished := &imap.SeqSet{}
+	gap := func(first, last uint32) {
+		for _, seq := range uids.Set {
+			if seq.Start <= last && seq.Stop >= first {
+				vanished.AddRange(maxUid(seq.Start, first), minUid(seq.Stop, last))
+			}
+		}
+	}
+	next := uint32(1)
+	for _, uid := range append(present, uidnext) {
+		if uid > next {
+			gap(next, uid-1)
+		}
+		next = uid + 1
+	}
+	return vanished, nil
+}
+
+func minUid(a, b uint32) uint32 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxUid(a, b uint32) uint32 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func allMessages() *imap.SeqSet {
+	all := &imap.SeqSet{}
+	all.AddRange(1, 0)
+	return all
+}
+
+func writeFetch(conn server.Conn, list func(chan *imap.Message) error) error {
+	ch := make(chan *imap.Message)
+	done := make(chan error, 1)
+	go func() {
+		done <- conn.WriteResp(&responses.Fetch{Messages: ch})
+	}()
+	e := list(ch)
+	if e != nil {
+		return e
+	}
+	return <-done
+}
+
+/**
+ * FETCH with the CHANGEDSINCE and VANISHED modifiers
+ */
+type fetchHandler struct {
+	commands.Fetch
+	expungeReleaser
+	changedSince int
+	vanished     bool
+}
+
+func (h *fetchHandler) Parse(fields []interface{}) error {
+	if len(fields) > 2 {
+		modifiers, ok := fields[2].([]interface{})
+		if !ok {
+			return errors.New("fetch modifiers must be a list")
+		}
+		for i := 0; i < len(modifiers); i++ {
+			switch {
+			case isAtom(modifiers[i], "CHANGEDSINCE") && i+1 < len(modifiers):
+				i++
+				var e error
+				h.changedSince, e = parseModseq(modifiers[i])
+				if e != nil {
+					return e
+				}
+			case isAtom(modifiers[i], "VANISHED"):
+				h.vanished = true
+			default:
+				return errors.New("unknown fetch modifier")
+			}
+		}
+		if h.vanished && h.changedSince == 0 {
+			return errors.New("VANISHED needs CHANGEDSINCE")
+		}
+		fields = fields[:2]
+	}
+	return h.Fetch.Parse(fields)
+}
+
+func (h *fetchHandler) handle(uid bool, conn server.Conn) error {
+	ctx := conn.Context()
+	if ctx.Mailbox == nil {
+		return server.ErrNoMailboxSelected
+	}
+	sess := sessionFor(conn)
+	if h.changedSince > 0 && !hasItem(h.Items, fetchModseq) {
+		h.Items = append(h.Items, fetchModseq)
+	}
+	if hasItem(h.Items, fetchModseq) {
+		sess.enableCondstore()
+	}
+	if h.vanished {
+		if _, qresync, _ := sess.state(); !uid || !qresync {
+			return server.ErrStatusResp(&imap.StatusResp{
+				Type: imap.StatusRespBad,
+				Info: "VANISHED needs UID FETCH, with QRESYNC enabled",
+			})
+		}
+	}
+	var unseen *imap.SeqSet
+	if setsSeen(h.Items) && !ctx.MailboxReadOnly {
+		unseen = &imap.SeqSet{}
+	}
+	sess.holdExpunges()
+	sess.updating.Lock()
+	e := h.fetch(uid, conn, unseen)
+	sess.updating.Unlock()
+	// The new flags are sent with the session's updates, so it can't be
+	// updating, but still mustn't send expunges
+	if e == nil && unseen != nil && !unseen.Empty() {
+		e = ctx.Mailbox.(*imapMailbox).markSeen(unseen)
+	}
+	if e != nil {
+		sess.releaseExpunges()
+	}
+	return e
+}
+
+func (h *fetchHandler) fetch(uid bool, conn server.Conn, unseen *imap.SeqSet) error {
+	mailbox := conn.Context().Mailbox.(*imapMailbox)
+	if h.vanished {
+		e := mailbox.writeVanished(conn, h.SeqSet, h.changedSince)
+		if e != nil {
+			return e
+		}
+	}
+	return writeFetch(conn, func(ch chan *imap.Message) error {
+		return mailbox.listMessages(uid, h.SeqSet, h.Items, h.changedSince, ch, unseen)
+	})
+}
+
+func (h *fetchHandler) Handle(conn server.Conn) error {
+	return h.handle(false, conn)
+}
+
+func (h *fetchHandler) UidHandle(conn server.Conn) error {
+	if !hasItem(h.Items, imap.FetchUid) {
+		h.Items = append(h.Items, imap.FetchUid)
+	}
+	return h.handle(true, conn)
+}
+
+func hasItem(items []imap.FetchItem, item imap.FetchItem) bool {
+	for _, i := range items {
+		if i == item {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+ * STORE with the UNCHANGEDSINCE modifier
+ */
+type storeHandler struct {
+	commands.Store
+	expungeReleaser
+	unchangedSince int // Negative if the client didn't give one
+}
+
+func (h *storeHandler) Parse(fields []interface{}) error {
+	h.unchangedSince = -1
+	if len(fields) > 1 {
+		if modifiers, ok := fields[1].([]interface{}); ok {
+			if len(modifiers) != 2 || !isAtom(modifiers[0], "UNCHANGEDSINCE") {
+				return errors.New("unknown store modifier")
+			}
+			var e error
+			h.unchangedSince, e = parseModseq(modifiers[1])
+			if e != nil {
+				return e
+			}
+			fields = append(fields[:1:1], fields[2:]...)
+		}
+	}
+	return h.Store.Parse(fields)
+}
+
+func (h *storeHandler) handle(uid bool, conn server.Conn) error {
+	ctx := conn.Context()
+	if ctx.Mailbox == nil {
+		return server.ErrNoMailboxSelected
+	}
+	if ctx.MailboxReadOnly {
+		return server.ErrMailboxReadOnly
+	}
+	op, silent, e := imap.ParseFlagsOp(h.Item)
+	if e != nil {
+		return e
+	}
+	flagsList, ok := h.Value.([]interface{})
+	if !ok {
+		return errors.New("flags must be a list")
+	}
+	flags, e := imap.ParseStringList(flagsList)
+	if e != nil {
+		return e
+	}
+	for i, flag := range flags {
+		flags[i] = imap.CanonicalFlag(flag)
+	}
+
+	sess := sessionFor(conn)
+	if h.unchangedSince >= 0 {
+		sess.enableCondstore()
+	}
+	mailbox := ctx.Mailbox.(*imapMailbox)
+	sess.holdExpunges()
+	sess.updating.Lock()
+	changes, modified, e := mailbox.changeFlags(uid, h.SeqSet, op, flags, h.unchangedSince)
+	sess.updating.Unlock()
+	if e != nil {
+		sess.releaseExpunges()
+		return e
+	}
+	// The FETCH responses are sent with the session's updates, which need to
+	// know not to. They're sent before publish returns.
+	sess.setSilent(silent)
+	mailbox.user.publish(changes...)
+	sess.setSilent(false)
+	if len(modified) > 0 {
+		set := &imap.SeqSet{}
+		set.AddNum(modified...)
+		return server.ErrStatusResp(&imap.StatusResp{
+			Type:      imap.StatusRespOk,
+			Code:      "MODIFIED",
+			Arguments: []interface{}{set},
+			Info:      "Conditional STORE failed",
+		})
+	}
+	return nil
+}
+
+func (h *storeHandler) Handle(conn server.Conn) error {
+	return h.handle(false, conn)
+}
+
+func (h *storeHandler) UidHandle(conn server.Conn) error {
+	return h.handle(true, conn)
+}
+
+/**
+ * SEARCH with the MODSEQ criterion. It's only understood at the top level,
+ * not inside OR or NOT, which is how clients use it.
+ */
+type searchHandler struct {
+	commands.Search
+	expungeReleaser
+	modseq int // Zero if the client didn't give one
+}
+
+func (h *searchHandler) Parse(fields []interface{}) error {
+	var rest []interface{}
+	for i := 0; i < len(fields); i++ {
+		if !isAtom(fields[i], "MODSEQ") {
+			rest = append(rest, fields[i])
+			continue
+		}
+		// MODSEQ [<entry-name> <entry-type-req>] <mod-sequence-valzer>
+		if i+1 < len(fields) {
+			if _, e := parseModseq(fields[i+1]); e != nil {
+				i += 2
+			}
+		}
+		if i+1 >= len(fields) {
+			return errors.New("MODSEQ needs a modseq")
+		}
+		i++
+		var e error
+		h.modseq, e = parseModseq(fields[i])
+		if e != nil {
+			return e
+		}
+	}
+	if len(rest) == 0 || (len(rest) == 2 && isAtom(rest[0], "CHARSET")) {
+		rest = append(rest, "ALL")
+	}
+	return h.Search.Parse(rest)
+}
+
+func (h *searchHandler) handle(uid bool, conn server.Conn) error {
+	ctx := conn.Context()
+	if ctx.Mailbox == nil {
+		return server.ErrNoMailboxSelected
+	}
+	sess := sessionFor(conn)
+	if h.modseq > 0 {
+		sess.enableCondstore()
+	}
+	sess.holdExpunges()
+	sess.updating.Lock()
+	e := h.search(uid, conn)
+	sess.updating.Unlock()
+	if e != nil {
+		sess.releaseExpunges()
+	}
+	return e
+}
+
+func (h *searchHandler) search(uid bool, conn server.Conn) error {
+	ids, highest, e := conn.Context().Mailbox.(*imapMailbox).searchMessages(uid, h.Criteria, h.modseq)
+	if e != nil {
+		return e
+	}
+	fields := []interface{}{imap.RawString("SEARCH")}
+	for _, id := range ids {
+		fields = append(fields, id)
+	}
+	if h.modseq > 0 && len(ids) > 0 {
+		fields = append(fields, []interface{}{imap.RawString("MODSEQ"), formatModseq(highest)})
+	}
+	return conn.WriteResp(imap.NewUntaggedResp(fields))
+}
+
+func (h *searchHandler) Handle(conn server.Conn) error {
+	return h.handle(false, conn)
+}
+
+func (h *searchHandler) UidHandle(conn server.Conn) error {
+	return h.handle(true, conn)
+}
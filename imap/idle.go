@@ -0,0 +1,68 @@
+package imap
+
+import (
+	"errors"
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/server"
+	"strings"
+)
+
+/**
+ * The IDLE command from RFC 2177. The client waits for updates instead of
+ * polling, and the server sends them as they're published by the backend.
+ */
+type idleExtension struct{}
+
+func (idleExtension) Capabilities(c server.Conn) []string {
+	if c.Context().State&imap.AuthenticatedState != 0 {
+		return []string{"IDLE"}
+	}
+	return nil
+}
+
+func (idleExtension) Command(name string) server.HandlerFactory {
+	if name != "IDLE" {
+		return nil
+	}
+	return func() server.Handler {
+		return &idleHandler{}
+	}
+}
+
+type idleHandler struct{}
+
+func (*idleHandler) Parse(fields []interface{}) error {
+	return nil
+}
+
+// The connection reads commands with this, so anything the client has sent is already buffered in it
+type lineReader interface {
+	ReadLine() ([]interface{}, error)
+}
+
+func (*idleHandler) Handle(conn server.Conn) error {
+	if conn.Context().User == nil {
+		return server.ErrNotAuthenticated
+	}
+	reader, ok := conn.(lineReader)
+	if !ok {
+		return errors.New("IDLE is not supported on this connection")
+	}
+	e := conn.WriteResp(&imap.ContinuationReq{Info: "idling"})
+	if e != nil {
+		return e
+	}
+	// Updates are written by the server while this waits for the client to finish
+	fields, e := reader.ReadLine()
+	if e != nil {
+		return e
+	}
+	if len(fields) != 1 {
+		return errors.New("expected DONE")
+	}
+	done, e := imap.ParseString(fields[0])
+	if e != nil || !strings.EqualFold(done, "DONE") {
+		return errors.New("expected DONE")
+	}
+	return nil
+}
@@ -15,11 +15,14 @@ import (
 	"github.com/xo/xoutil"
 	"henrymail/config"
 	"henrymail/database"
+	"henrymail/events"
 	"henrymail/logic"
 	"henrymail/models"
 	"io/ioutil"
 	"log"
 	"os"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -32,6 +35,8 @@ func StartImap(db *sql.DB, tls *tls.Config) {
 	s.Debug = os.Stdout
 	s.TLSConfig = tls
 	s.AllowInsecureAuth = !config.GetBool(config.ImapUseTls)
+	s.AutoLogout = server.MinAutoLogout
+	enableExtensions(s)
 	go func() {
 		log.Println("Starting IMAP server at ", s.Addr)
 		if err := s.ListenAndServe(); err != nil {
@@ -45,6 +50,8 @@ func StartImap(db *sql.DB, tls *tls.Config) {
 		s.Addr = config.GetString(config.ImapImplicitTLSAddress)
 		s.Debug = os.Stdout
 		s.TLSConfig = tls
+		s.AutoLogout = server.MinAutoLogout
+		enableExtensions(s)
 		go func() {
 			log.Println("Starting IMAP server with implicit TLS at ", s.Addr)
 			if err := s.ListenAndServeTLS(); err != nil {
@@ -54,6 +61,11 @@ func StartImap(db *sql.DB, tls *tls.Config) {
 	}
 }
 
+func enableExtensions(s *server.Server) {
+	s.Enable(sessionExtension{}, idleExtension{}, condstoreExtension{}, uidplusExtension{}, specialUseExtension{}, quotaExtension{}, listExtension{}, aclExtension{}, sortExtension{}, compressExtension{})
+	subscribeUpdates(s)
+}
+
 type imapBackend struct {
 	db *sql.DB
 }
@@ -69,9 +81,13 @@ func (b *imapBackend) Login(connInfo *imap.ConnInfo, username, password string)
 	}, nil
 }
 
+/**
+ * Each session has its own
+ */
 type imapUser struct {
-	userid int
-	db     *sql.DB
+	userid  int
+	db      *sql.DB
+	pending sync.WaitGroup // Updates the session is yet to send about its own changes
 }
 
 func (u *imapUser) Username() string {
@@ -83,56 +99,139 @@ func (u *imapUser) Username() string {
 }
 
 func (u *imapUser) ListMailboxes(subscribed bool) ([]backend.Mailbox, error) {
-	mbxs, err := models.MailboxesByUserid(u.db, u.userid)
+	mbxs, err := u.visibleMailboxes()
 	if err != nil {
 		return nil, err
 	}
-	mailboxes := make([]backend.Mailbox, len(mbxs))
-	for ix, mbx := range mbxs {
-		mailboxes[ix] = &imapMailbox{
-			mailboxid: mbx.ID,
-			db:        u.db,
+	var mailboxes []backend.Mailbox
+	for _, mbx := range mbxs {
+		if mbx.Noselect || (subscribed && !mbx.Subscribed) {
+			continue
 		}
+		mailbox, err := u.GetMailbox(mbx.Name)
+		if err != nil {
+			return nil, err
+		}
+		mailboxes = append(mailboxes, mailbox)
 	}
 	return mailboxes, nil
 }
 
 func (u *imapUser) GetMailbox(name string) (backend.Mailbox, error) {
-	mailbox, e := models.MailboxByUseridName(u.db, u.userid, name)
+	mailbox, prefix, _, e := u.findMailbox(u.db, name)
 	if e != nil {
 		return nil, e
 	}
+	if mailbox.Noselect {
+		return nil, logic.ErrNoselect
+	}
 	return &imapMailbox{
+		user:      u,
+		prefix:    prefix,
+		userid:    mailbox.Userid,
 		mailboxid: mailbox.ID,
 		db:        u.db,
-		userid:    u.userid,
 	}, nil
 }
 
 func (u *imapUser) CreateMailbox(name string) error {
-	mailbox := &models.Mailbox{
-		Name:       name,
-		Userid:     u.userid,
-		Subscribed: true,
-	}
-	return mailbox.Save(u.db)
+	return u.createMailbox(name, "")
+}
+
+/**
+ * With a special use, from CREATE-SPECIAL-USE. Only the owner of
+ * a mailbox can choose its special use.
+ */
+func (u *imapUser) createMailbox(name, use string) error {
+	return database.Transact(u.db, func(tx *sql.Tx) error {
+		ownerid, local, e := u.checkParentRights(tx, name)
+		if e != nil {
+			return e
+		}
+		if use != "" && ownerid != u.userid {
+			return logic.ErrNoRights
+		}
+		mailbox, e := logic.CreateMailbox(tx, ownerid, local)
+		if e != nil || use == "" {
+			return e
+		}
+		return logic.SetSpecialUse(tx, mailbox, use)
+	})
 }
 
 func (u *imapUser) DeleteMailbox(name string) error {
-	mailbox, e := models.MailboxByUseridName(u.db, u.userid, name)
-	if e != nil {
-		return e
-	}
-	return mailbox.Delete(u.db)
+	return database.Transact(u.db, func(tx *sql.Tx) error {
+		mailbox, _, rights, e := u.findMailbox(tx, name)
+		if e != nil {
+			return e
+		}
+		if !logic.HasRights(rights, logic.RightDelete) {
+			return logic.ErrNoRights
+		}
+		return logic.DeleteMailbox(tx, mailbox.Userid, mailbox.Name)
+	})
 }
 
+/**
+ * Mailboxes can't be moved from one user to another
+ */
 func (u *imapUser) RenameMailbox(existingName, newName string) error {
-	mailbox, e := models.MailboxByUseridName(u.db, u.userid, existingName)
+	if existingName == imap.InboxName {
+		return u.renameInbox(newName)
+	}
+	return database.Transact(u.db, func(tx *sql.Tx) error {
+		mailbox, _, rights, e := u.findMailbox(tx, existingName)
+		if e != nil {
+			return e
+		}
+		ownerid, local, e := u.checkParentRights(tx, newName)
+		if e != nil {
+			return e
+		}
+		if !logic.HasRights(rights, logic.RightDelete) || ownerid != mailbox.Userid {
+			return logic.ErrNoRights
+		}
+		return logic.RenameMailbox(tx, ownerid, mailbox.Name, local)
+	})
+}
+
+/**
+ * The messages leave the INBOX, so sessions which have it selected are told
+ */
+func (u *imapUser) renameInbox(newName string) error {
+	var changes []events.Event
+	e := database.Transact(u.db, func(tx *sql.Tx) error {
+		ownerid, local, e := u.checkParentRights(tx, newName)
+		if e != nil {
+			return e
+		}
+		if ownerid != u.userid {
+			return logic.ErrNoRights
+		}
+		mailbox, uids, e := logic.RenameInbox(tx, u.userid, local)
+		if e != nil {
+			return e
+		}
+		inbox, e := models.MailboxByUseridName(tx, u.userid, imap.InboxName)
+		if e != nil {
+			return e
+		}
+		for _, uid := range uids {
+			changes = append(changes, events.Event{
+				Type:      events.Expunge,
+				Userid:    u.userid,
+				Mailboxid: inbox.ID,
+				UID:       uid,
+			})
+		}
+		changes = append(changes, events.Event{Type: events.Exists, Userid: u.userid, Mailboxid: mailbox.ID})
+		return nil
+	})
 	if e != nil {
 		return e
 	}
-	mailbox.Name = newName
-	return mailbox.Save(u.db)
+	u.publish(changes...)
+	return nil
 }
 
 func (*imapUser) Logout() error {
@@ -141,9 +240,13 @@ func (*imapUser) Logout() error {
 
 // Only store the ID, so we dont end up with stale data being read!
 type imapMailbox struct {
-	userid    int
+	user      *imapUser // Who's looking at it
+	prefix    string    // Put in front of the name, for mailboxes shared with the user
+	userid    int       // Who owns it
 	mailboxid int
 	db        *sql.DB
+	seqnums   seqnumMap
+	recent    recentSet
 }
 
 func (m *imapMailbox) Name() string {
@@ -151,15 +254,21 @@ func (m *imapMailbox) Name() string {
 	if e != nil {
 		return "UNKNOWN"
 	}
-	return mailbox.Name
+	return m.prefix + mailbox.Name
 }
 
 func (m *imapMailbox) Info() (*imap.MailboxInfo, error) {
-	return &imap.MailboxInfo{
-		Attributes: []string{},
-		Delimiter:  "/",
-		Name:       m.Name(),
-	}, nil
+	mailbox, e := models.MailboxByID(m.db, m.mailboxid)
+	if e != nil {
+		return nil, e
+	}
+	hasChildren, e := logic.HasChildren(m.db, mailbox)
+	if e != nil {
+		return nil, e
+	}
+	info := mailboxInfo(mailbox, hasChildren)
+	info.Name = m.prefix + info.Name
+	return info, nil
 }
 
 func (m *imapMailbox) Status(items []imap.StatusItem) (*imap.MailboxStatus, error) {
@@ -167,43 +276,67 @@ func (m *imapMailbox) Status(items []imap.StatusItem) (*imap.MailboxStatus, erro
 	if err != nil {
 		return nil, err
 	}
-	//TODO make this more efficient
-	messages, err := models.MessagesByMailboxid(m.db, m.mailboxid)
+	rights, err := logic.Rights(m.db, mbx, m.user.userid)
 	if err != nil {
 		return nil, err
 	}
-
-	status := imap.NewMailboxStatus(mbx.Name, items)
+	if !logic.HasRights(rights, logic.RightRead) {
+		return nil, logic.ErrNoRights
+	}
+	status := imap.NewMailboxStatus(m.prefix+mbx.Name, items)
+	// Users who can't change anything get the mailbox read-only, see RFC 4314 section 4
+	status.ReadOnly = !strings.ContainsAny(rights, logic.RightSeen+logic.RightWrite+logic.RightInsert+
+		logic.RightDeleteMessages+logic.RightExpunge)
 
 	//TODO fill this in correctly
 	//status.Flags = m.x.Flags
 	status.PermanentFlags = []string{"\\*"}
-	//status.UnseenSeqNum = mbox.unseenSeqNum()
 
 	for _, name := range items {
 		switch name {
 		case imap.StatusMessages:
-			status.Messages = uint32(len(messages))
+			status.Messages, err = m.countMessages()
+			if err != nil {
+				return nil, err
+			}
 		case imap.StatusUidNext:
 			status.UidNext = uint32(mbx.Uidnext)
 		case imap.StatusUidValidity:
 			status.UidValidity = uint32(mbx.Uidvalidity)
-		// TODO fill these in correctly
+		case statusHighestModseq:
+			status.Items[name] = formatModseq(mbx.Highestmodseq)
 		case imap.StatusRecent:
-			status.Recent = 0
+			status.Recent, err = m.countRecent()
+			if err != nil {
+				return nil, err
+			}
 		case imap.StatusUnseen:
-			status.Unseen = 0
+			status.Unseen, err = countUnseen(m.db, m.mailboxid)
+			if err != nil {
+				return nil, err
+			}
 		}
 	}
 
 	return status, nil
 }
 
+/**
+ * Users subscribe to shared mailboxes for themselves, not for the owner
+ */
 func (m *imapMailbox) SetSubscribed(subscribed bool) error {
 	mailbox, e := models.MailboxByID(m.db, m.mailboxid)
 	if e != nil {
 		return e
 	}
+	if mailbox.Userid != m.user.userid {
+		acl, e := models.ACLByMailboxidUserid(m.db, mailbox.ID, m.user.userid)
+		if e != nil {
+			return e
+		}
+		acl.Subscribed = subscribed
+		return acl.Save(m.db)
+	}
 	mailbox.Subscribed = subscribed
 	return mailbox.Save(m.db)
 }
@@ -213,73 +346,208 @@ func (*imapMailbox) Check() error {
 }
 
 func (m *imapMailbox) ListMessages(uid bool, seqset *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+	return m.listMessages(uid, seqset, items, 0, ch, nil)
+}
+
+/**
+ * Only lists the messages which have changed since the given modseq. The
+ * UIDs of those listed without \Seen are added to unseen, unless it's nil.
+ */
+func (m *imapMailbox) listMessages(uid bool, seqset *imap.SeqSet, items []imap.FetchItem, changedSince int,
+	ch chan<- *imap.Message, unseen *imap.SeqSet) error {
 	defer close(ch)
-	messages, e := models.MessagesByMailboxid(m.db, m.mailboxid)
-	if e != nil {
-		return e
-	}
-	return applyToSet(messages, uid, seqset, func(msg *models.Message, seqnum uint32) error {
-		imsg, e := fetch(msg, seqnum, items)
+	return m.forEachMessage(m.db, uid, seqset, needsContent(items), func(msg *models.Message, seqnum uint32) error {
+		if msg.Modseq <= changedSince {
+			return nil
+		}
+		imsg, e := fetch(msg, seqnum, m.isRecent(msg.UID), items)
 		if e != nil {
 			return e
 		}
 		ch <- imsg
+		if unseen != nil {
+			flags, e := getFlags(msg)
+			if e != nil {
+				return e
+			}
+			if !stringSl(flags).contains(imap.SeenFlag) {
+				unseen.AddNum(uint32(msg.UID))
+			}
+		}
 		return nil
 	})
 }
 
+/**
+ * Fetching a body section without PEEK, which RFC822 and RFC822.TEXT
+ * are, sets \Seen (RFC 3501 section 6.4.5)
+ */
+func setsSeen(items []imap.FetchItem) bool {
+	for _, item := range items {
+		section, e := imap.ParseBodySectionName(item)
+		if e == nil && !section.Peek {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+ * Sets \Seen on messages that have been fetched, if the user has the right to,
+ * and tells sessions about it, including this one
+ */
+func (m *imapMailbox) markSeen(uids *imap.SeqSet) error {
+	_, e := m.updateMessagesFlags(true, uids, imap.AddFlags, []string{imap.SeenFlag}, -1)
+	return e
+}
+
 func (m *imapMailbox) SearchMessages(uid bool, criteria *imap.SearchCriteria) ([]uint32, error) {
-	msgs, e := models.MessagesByMailboxid(m.db, m.mailboxid)
-	if e != nil {
-		return nil, e
+	matches, _, e := m.searchMessages(uid, criteria, 0)
+	return matches, e
+}
+
+/**
+ * Only matches messages with at least the given modseq, and also
+ * returns the highest modseq of the messages that matched. Messages
+ * are only loaded if the search index can't answer all the criteria.
+ */
+func (m *imapMailbox) searchMessages(uid bool, criteria *imap.SearchCriteria, minModseq int) ([]uint32, int, error) {
+	var candidates map[int]bool
+	query, rest := indexedCriteria(criteria)
+	if !query.Empty() {
+		var e error
+		candidates, e = logic.SearchIndex(m.db, m.mailboxid, query)
+		if e != nil {
+			return nil, 0, e
+		}
+		criteria = rest
 	}
 	var matches []uint32
-	for ix, msg := range msgs {
-		seqnum := uint32(ix + 1)
-		match, e := match(msg, seqnum, criteria)
-		if e != nil {
-			return nil, e
+	highest := 0
+	e := m.forEachMessage(m.db, false, allMessages(), false, func(msg *models.Message, seqnum uint32) error {
+		if msg.Modseq < minModseq || (candidates != nil && !candidates[msg.ID]) {
+			return nil
 		}
-		if match {
-			if uid {
-				matches = append(matches, uint32(msg.UID))
-			} else {
-				matches = append(matches, seqnum)
+		if !matchesAll(criteria) {
+			full, e := models.MessageByID(m.db, msg.ID)
+			if e != nil {
+				return e
+			}
+			ok, e := match(full, seqnum, m.isRecent(msg.UID), criteria)
+			if e != nil || !ok {
+				return e
 			}
 		}
+		if uid {
+			matches = append(matches, uint32(msg.UID))
+		} else {
+			matches = append(matches, seqnum)
+		}
+		if msg.Modseq > highest {
+			highest = msg.Modseq
+		}
+		return nil
+	})
+	if e != nil {
+		return nil, 0, e
 	}
-	return matches, nil
+	return matches, highest, nil
 }
 
 func (m *imapMailbox) CreateMessage(flags []string, ts time.Time, body imap.Literal) error {
-	return database.Transact(m.db, func(tx *sql.Tx) error {
-		mailbox, e := models.MailboxByID(tx, m.mailboxid)
+	_, _, e := m.createMessage(flags, ts, body)
+	return e
+}
+
+/**
+ * Returns the mailbox's UIDVALIDITY and the new message's UID, for UIDPLUS
+ */
+func (m *imapMailbox) createMessage(flags []string, ts time.Time, body imap.Literal) (uint32, uint32, error) {
+	// APPEND doesn't have to give a date
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+	msg := &models.Message{
+		Ts: xoutil.SqTime{Time: ts},
+	}
+	var mailbox *models.Mailbox
+	e := database.Transact(m.db, func(tx *sql.Tx) error {
+		var e error
+		mailbox, e = models.MailboxByID(tx, m.mailboxid)
 		if e != nil {
 			return e
 		}
-		content, e := ioutil.ReadAll(body)
+		rights, e := logic.Rights(tx, mailbox, m.user.userid)
 		if e != nil {
 			return e
 		}
-
-		return logic.SaveMessages(tx, mailbox, &models.Message{
-			Mailboxid: mailbox.ID,
-			UID:       mailbox.Uidnext,
-			Flagsjson: []byte("[]"),
-			Content:   content,
-			Ts:        xoutil.SqTime{Time: ts},
-		})
+		if !logic.HasRights(rights, logic.RightInsert) {
+			return logic.ErrNoRights
+		}
+		msg.Content, e = ioutil.ReadAll(body)
+		if e != nil {
+			return e
+		}
+		e = setFlags(msg, restrictFlags(rights, nil, withoutRecent(flags)))
+		if e != nil {
+			return e
+		}
+		return logic.SaveMessages(tx, mailbox, msg)
 	})
+	if e != nil {
+		return 0, 0, e
+	}
+	m.user.publish(events.Event{Type: events.Exists, Userid: mailbox.Userid, Mailboxid: mailbox.ID})
+	return uint32(mailbox.Uidvalidity), uint32(msg.UID), nil
 }
 
 func (m *imapMailbox) UpdateMessagesFlags(uid bool, seqset *imap.SeqSet, operation imap.FlagsOp, flags []string) error {
-	return database.Transact(m.db, func(tx *sql.Tx) error {
-		messages, e := models.MessagesByMailboxid(tx, m.mailboxid)
+	_, e := m.updateMessagesFlags(uid, seqset, operation, flags, -1)
+	return e
+}
+
+/**
+ * Messages which have changed since unchangedSince are left alone, and their
+ * UIDs or sequence numbers returned (see RFC 7162 section 3.1.3). Pass a
+ * negative unchangedSince to update them regardless.
+ */
+func (m *imapMailbox) updateMessagesFlags(uid bool, seqset *imap.SeqSet, operation imap.FlagsOp, flags []string, unchangedSince int) ([]uint32, error) {
+	changes, modified, e := m.changeFlags(uid, seqset, operation, flags, unchangedSince)
+	if e != nil {
+		return nil, e
+	}
+	m.user.publish(changes...)
+	return modified, nil
+}
+
+/**
+ * Changes the flags without publishing the changes, which are returned
+ */
+func (m *imapMailbox) changeFlags(uid bool, seqset *imap.SeqSet, operation imap.FlagsOp, flags []string, unchangedSince int) ([]events.Event, []uint32, error) {
+	var changes []events.Event
+	var modified []uint32
+	flags = withoutRecent(flags)
+	e := database.Transact(m.db, func(tx *sql.Tx) error {
+		mailbox, e := models.MailboxByID(tx, m.mailboxid)
+		if e != nil {
+			return e
+		}
+		rights, e := logic.Rights(tx, mailbox, m.user.userid)
 		if e != nil {
 			return e
 		}
+		// All the changes from one command share a modseq
+		modseq := 0
+		e = m.forEachMessage(tx, uid, seqset, false, func(msg *models.Message, seqnum uint32) error {
+			if unchangedSince >= 0 && msg.Modseq > unchangedSince {
+				if uid {
+					modified = append(modified, uint32(msg.UID))
+				} else {
+					modified = append(modified, seqnum)
+				}
+				return nil
+			}
 
-		return applyToSet(messages, uid, seqset, func(msg *models.Message, _ uint32) error {
 			existingFlags, e := getFlags(msg)
 			if e != nil {
 				return e
@@ -290,7 +558,12 @@ func (m *imapMailbox) UpdateMessagesFlags(uid bool, seqset *imap.SeqSet, operati
 			case imap.SetFlags:
 				newFlags = flags
 			case imap.AddFlags:
-				newFlags = append(existingFlags, flags...)
+				newFlags = existingFlags
+				for _, flag := range flags {
+					if !stringSl(newFlags).contains(flag) {
+						newFlags = append(newFlags, flag)
+					}
+				}
 			case imap.RemoveFlags:
 				for _, existingFlag := range existingFlags {
 					if !stringSl(flags).contains(existingFlag) {
@@ -300,78 +573,244 @@ func (m *imapMailbox) UpdateMessagesFlags(uid bool, seqset *imap.SeqSet, operati
 			default:
 				return errors.New(fmt.Sprintf("unexpected flags operation %v", operation))
 			}
+			newFlags = restrictFlags(rights, existingFlags, newFlags)
 
-			e = setFlags(msg, newFlags)
-			if e != nil {
-				return e
+			// Clients are told the flags either way, but only changes get a new modseq
+			if !sameFlags(existingFlags, newFlags) {
+				if modseq == 0 {
+					modseq = logic.NextModseq(mailbox)
+				}
+				msg.Modseq = modseq
+				e = setFlags(msg, newFlags)
+				if e != nil {
+					return e
+				}
+				e = saveFlags(tx, msg)
+				if e != nil {
+					return e
+				}
 			}
-			return msg.Save(tx)
+			changes = append(changes, events.Event{
+				Type:      events.Flags,
+				Userid:    m.userid,
+				Mailboxid: m.mailboxid,
+				UID:       msg.UID,
+				Flags:     newFlags,
+				Modseq:    msg.Modseq,
+			})
+			return nil
 		})
+		if e != nil || modseq == 0 {
+			return e
+		}
+		return mailbox.Save(tx)
 	})
+	if e != nil {
+		return nil, nil, e
+	}
+	return changes, modified, nil
 }
 
 func (m *imapMailbox) CopyMessages(uid bool, seqset *imap.SeqSet, dest string) error {
-	return database.Transact(m.db, func(tx *sql.Tx) error {
-		messages, e := models.MessagesByMailboxid(tx, m.mailboxid)
+	_, e := m.copy(uid, seqset, dest)
+	return e
+}
+
+// The UIDs given to copied messages, for UIDPLUS (RFC 4315)
+type copyUids struct {
+	mailboxid   int
+	uidValidity uint32
+	source      []uint32
+	dest        []uint32
+}
+
+func (m *imapMailbox) copy(uid bool, seqset *imap.SeqSet, dest string) (*copyUids, error) {
+	var copied *copyUids
+	e := database.Transact(m.db, func(tx *sql.Tx) error {
+		var e error
+		copied, e = m.copyMessages(tx, uid, seqset, dest)
+		return e
+	})
+	if e != nil {
+		return nil, e
+	}
+	m.user.publish(events.Event{Type: events.Exists, Userid: m.userid, Mailboxid: copied.mailboxid})
+	return copied, nil
+}
+
+/**
+ * MOVE from RFC 6851, done in one transaction so the messages can't end up in both
+ * mailboxes. The events are returned for publishing after COPYUID has been sent.
+ */
+func (m *imapMailbox) move(uid bool, seqset *imap.SeqSet, dest string) (*copyUids, []events.Event, error) {
+	var copied *copyUids
+	var changes []events.Event
+	e := database.Transact(m.db, func(tx *sql.Tx) error {
+		e := m.checkRights(tx, logic.RightDeleteMessages+logic.RightExpunge)
 		if e != nil {
 			return e
 		}
-		destmailbox, e := models.MailboxByUseridName(tx, m.userid, dest)
+		destid, sources, e := m.copySources(tx, uid, seqset, dest)
 		if e != nil {
 			return e
 		}
-		var newMessages []*models.Message
-		e = applyToSet(messages, uid, seqset, func(msg *models.Message, _ uint32) error {
-			newMessages = append(newMessages, &models.Message{
-				Ts:        msg.Ts,
-				Content:   msg.Content,
-				Flagsjson: msg.Flagsjson,
-			})
-			return nil
+		// Expunged first, so the messages aren't counted twice against the quota
+		moved := map[int]bool{}
+		for _, msg := range sources {
+			moved[msg.ID] = true
+		}
+		changes, e = m.expungeMessages(tx, func(msg *models.Message) (bool, error) {
+			return moved[msg.ID], nil
 		})
-		return logic.SaveMessages(tx, destmailbox, newMessages...)
+		if e != nil {
+			return e
+		}
+		copied, e = saveCopies(tx, destid, sources)
+		return e
 	})
+	if e != nil {
+		return nil, nil, e
+	}
+	changes = append(changes, events.Event{Type: events.Exists, Userid: m.userid, Mailboxid: copied.mailboxid})
+	return copied, changes, nil
 }
 
-func (m *imapMailbox) Expunge() error {
-	return database.Transact(m.db, func(tx *sql.Tx) error {
-		messages, e := models.MessagesByMailboxid(m.db, m.mailboxid)
+func (m *imapMailbox) copyMessages(tx *sql.Tx, uid bool, seqset *imap.SeqSet, dest string) (*copyUids, error) {
+	destid, sources, e := m.copySources(tx, uid, seqset, dest)
+	if e != nil {
+		return nil, e
+	}
+	return saveCopies(tx, destid, sources)
+}
+
+/**
+ * The ID of the destination mailbox and the messages to copy there. The
+ * messages only keep the flags the user could set in the destination.
+ */
+func (m *imapMailbox) copySources(tx *sql.Tx, uid bool, seqset *imap.SeqSet, dest string) (int, []*models.Message, error) {
+	destmailbox, _, rights, e := m.user.findMailbox(tx, dest)
+	if e != nil {
+		return 0, nil, e
+	}
+	if destmailbox.Noselect {
+		return 0, nil, logic.ErrNoselect
+	}
+	if !logic.HasRights(rights, logic.RightInsert) {
+		return 0, nil, logic.ErrNoRights
+	}
+	var sources []*models.Message
+	e = m.forEachMessage(tx, uid, seqset, true, func(msg *models.Message, _ uint32) error {
+		flags, e := getFlags(msg)
 		if e != nil {
 			return e
 		}
-
-		for _, msg := range messages {
-			flags, e := getFlags(msg)
-			if stringSl(flags).contains(imap.DeletedFlag) {
-				e = msg.Delete(tx)
-				if e != nil {
-					return e
-				}
-			}
+		e = setFlags(msg, restrictFlags(rights, nil, flags))
+		if e != nil {
+			return e
 		}
+		sources = append(sources, msg)
 		return nil
 	})
+	if e != nil {
+		return 0, nil, e
+	}
+	return destmailbox.ID, sources, nil
 }
 
-func applyToSet(messages []*models.Message, uid bool, set *imap.SeqSet, f func(*models.Message, uint32) error) error {
-	for ix, msg := range messages {
-		seqnum := uint32(ix + 1)
-		var check uint32
-		if uid {
-			check = uint32(msg.UID)
-		} else {
-			check = seqnum
+/**
+ * The mailbox is loaded here, in case it's changed since the sources were found
+ */
+func saveCopies(tx *sql.Tx, destid int, sources []*models.Message) (*copyUids, error) {
+	destmailbox, e := models.MailboxByID(tx, destid)
+	if e != nil {
+		return nil, e
+	}
+	var newMessages []*models.Message
+	for _, msg := range sources {
+		newMessages = append(newMessages, &models.Message{
+			Ts:        msg.Ts,
+			Content:   msg.Content,
+			Flagsjson: msg.Flagsjson,
+		})
+	}
+	e = logic.SaveMessages(tx, destmailbox, newMessages...)
+	if e != nil {
+		return nil, e
+	}
+	copied := &copyUids{
+		mailboxid:   destmailbox.ID,
+		uidValidity: uint32(destmailbox.Uidvalidity),
+	}
+	for i, msg := range sources {
+		copied.source = append(copied.source, uint32(msg.UID))
+		copied.dest = append(copied.dest, uint32(newMessages[i].UID))
+	}
+	return copied, nil
+}
+
+func (m *imapMailbox) Expunge() error {
+	return m.expunge(nil)
+}
+
+/**
+ * Only expunges messages in uids, unless it's nil (UID EXPUNGE from UIDPLUS)
+ */
+func (m *imapMailbox) expunge(uids *imap.SeqSet) error {
+	var expunged []events.Event
+	e := database.Transact(m.db, func(tx *sql.Tx) error {
+		e := m.checkRights(tx, logic.RightExpunge)
+		if e != nil {
+			return e
 		}
-		if set.Contains(check) {
-			e := f(msg, seqnum)
-			if e != nil {
-				return e
+		expunged, e = m.expungeMessages(tx, func(msg *models.Message) (bool, error) {
+			if uids != nil && !uids.Contains(uint32(msg.UID)) {
+				return false, nil
 			}
-		}
+			flags, e := getFlags(msg)
+			return stringSl(flags).contains(imap.DeletedFlag), e
+		})
+		return e
+	})
+	if e != nil {
+		return e
 	}
+	m.user.publish(expunged...)
 	return nil
 }
 
+/**
+ * Returns the events to publish once the transaction is committed
+ */
+func (m *imapMailbox) expungeMessages(tx *sql.Tx, matches func(*models.Message) (bool, error)) ([]events.Event, error) {
+	mailbox, e := models.MailboxByID(tx, m.mailboxid)
+	if e != nil {
+		return nil, e
+	}
+	var expunged []events.Event
+	var deleted []*models.Message
+	e = m.forEachMessage(tx, false, allMessages(), false, func(msg *models.Message, _ uint32) error {
+		match, e := matches(msg)
+		if e != nil || !match {
+			return e
+		}
+		expunged = append(expunged, events.Event{
+			Type:      events.Expunge,
+			Userid:    m.userid,
+			Mailboxid: m.mailboxid,
+			UID:       msg.UID,
+		})
+		deleted = append(deleted, msg)
+		return nil
+	})
+	if e != nil {
+		return nil, e
+	}
+	if len(deleted) == 0 {
+		return nil, nil
+	}
+	return expunged, logic.ExpungeMessages(tx, mailbox, deleted...)
+}
+
 type stringSl []string
 
 func (sl stringSl) contains(s string) bool {
@@ -389,6 +828,18 @@ func getFlags(m *models.Message) ([]string, error) {
 	return flags, e
 }
 
+func sameFlags(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, flag := range a {
+		if !stringSl(b).contains(flag) {
+			return false
+		}
+	}
+	return true
+}
+
 func setFlags(m *models.Message, flags []string) error {
 	flagsJson, e := json.Marshal(flags)
 	if e != nil {
@@ -398,11 +849,12 @@ func setFlags(m *models.Message, flags []string) error {
 	return nil
 }
 
-func match(m *models.Message, seqNum uint32, c *imap.SearchCriteria) (bool, error) {
+func match(m *models.Message, seqNum uint32, recent bool, c *imap.SearchCriteria) (bool, error) {
 	msgflags, e := getFlags(m)
 	if e != nil {
 		return false, e
 	}
+	msgflags = withRecent(msgflags, recent)
 	ent, e := entity(m)
 	if e != nil {
 		return false, e
@@ -410,42 +862,47 @@ func match(m *models.Message, seqNum uint32, c *imap.SearchCriteria) (bool, erro
 	return backendutil.Match(ent, seqNum, uint32(m.UID), m.Ts.Time, msgflags, c)
 }
 
-func fetch(m *models.Message, seqNum uint32, items []imap.FetchItem) (*imap.Message, error) {
+func fetch(m *models.Message, seqNum uint32, recent bool, items []imap.FetchItem) (*imap.Message, error) {
 	fetched := imap.NewMessage(seqNum, items)
 	for _, item := range items {
 		switch item {
 		case imap.FetchEnvelope:
-			ent, e := message.Read(bytes.NewReader(m.Content))
+			envelope, e := logic.Envelope(m)
 			if e != nil {
 				return nil, e
 			}
-			fetched.Envelope, _ = backendutil.FetchEnvelope(ent.Header.Header)
+			fetched.Envelope = envelope
 		case imap.FetchBody, imap.FetchBodyStructure:
-			ent, e := message.Read(bytes.NewReader(m.Content))
+			structure, e := logic.BodyStructure(m)
 			if e != nil {
 				return nil, e
 			}
-			fetched.BodyStructure, _ = backendutil.FetchBodyStructure(ent.Header.Header, ent.Body, item == imap.FetchBodyStructure)
+			if item == imap.FetchBody {
+				withoutExtensions(structure)
+			}
+			fetched.BodyStructure = structure
 		case imap.FetchFlags:
 			flags, e := getFlags(m)
 			if e != nil {
 				return nil, e
 			}
-			fetched.Flags = flags
+			fetched.Flags = withRecent(flags, recent)
 		case imap.FetchInternalDate:
-			//TODO what is this
-			fetched.InternalDate = time.Now()
+			// When we received it, or the date given to APPEND
+			fetched.InternalDate = m.Ts.Time
 		case imap.FetchRFC822Size:
-			fetched.Size = uint32(len(m.Content))
+			fetched.Size = uint32(m.Size)
 		case imap.FetchUid:
 			fetched.Uid = uint32(m.UID)
+		case fetchModseq:
+			fetched.Items[item] = []interface{}{formatModseq(m.Modseq)}
 		default:
 			section, err := imap.ParseBodySectionName(item)
 			if err != nil {
 				break
 			}
 
-			e, _ := message.Read(bytes.NewReader(m.Content))
+			e, _ := entity(m)
 			l, _ := backendutil.FetchBodySection(e.Header.Header, e.Body, section)
 			fetched.Body[section] = l
 		}
@@ -454,6 +911,24 @@ func fetch(m *models.Message, seqNum uint32, items []imap.FetchItem) (*imap.Mess
 	return fetched, nil
 }
 
+// BODY is BODYSTRUCTURE without the extension data, all the way down
+func withoutExtensions(structure *imap.BodyStructure) {
+	structure.Extended = false
+	for _, part := range structure.Parts {
+		withoutExtensions(part)
+	}
+	if structure.BodyStructure != nil {
+		withoutExtensions(structure.BodyStructure)
+	}
+}
+
+/**
+ * Messages without a header we can read are treated as all body
+ */
 func entity(m *models.Message) (*message.Entity, error) {
-	return message.Read(bytes.NewReader(m.Content))
+	ent, e := message.Read(bytes.NewReader(m.Content))
+	if e != nil && !message.IsUnknownCharset(e) {
+		return message.New(message.Header{}, bytes.NewReader(m.Content))
+	}
+	return ent, nil
 }
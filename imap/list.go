@@ -0,0 +1,186 @@
+package imap
+
+import (
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/commands"
+	"github.com/emersion/go-imap/responses"
+	"github.com/emersion/go-imap/server"
+	"henrymail/logic"
+	"henrymail/models"
+	"sort"
+	"strings"
+)
+
+/**
+ * LIST and LSUB for the mailbox hierarchy, with the attributes from
+ * CHILDREN (RFC 3348). The names are matched here rather than by go-imap
+ * so that INBOX matches in any case, and LSUB can show the parents of
+ * subscribed mailboxes as RFC 3501 asks.
+ */
+type listExtension struct{}
+
+const (
+	attrHasChildren   = "\\HasChildren"
+	attrHasNoChildren = "\\HasNoChildren"
+)
+
+func (listExtension) Capabilities(c server.Conn) []string {
+	return []string{"CHILDREN"}
+}
+
+func (listExtension) Command(name string) server.HandlerFactory {
+	switch name {
+	case "LIST":
+		return func() server.Handler { return &listHandler{} }
+	case "LSUB":
+		return func() server.Handler {
+			return &listHandler{List: commands.List{Subscribed: true}}
+		}
+	}
+	return nil
+}
+
+func mailboxInfo(mailbox *models.Mailbox, hasChildren bool) *imap.MailboxInfo {
+	attributes := []string{}
+	if mailbox.Noselect {
+		attributes = append(attributes, imap.NoSelectAttr)
+	}
+	if hasChildren {
+		attributes = append(attributes, attrHasChildren)
+	} else {
+		attributes = append(attributes, attrHasNoChildren)
+	}
+	// SPECIAL-USE, see RFC 6154
+	if mailbox.Specialuse != "" {
+		attributes = append(attributes, mailbox.Specialuse)
+	}
+	return &imap.MailboxInfo{
+		Attributes: attributes,
+		Delimiter:  logic.MailboxDelimiter,
+		Name:       mailbox.Name,
+	}
+}
+
+type listHandler struct {
+	commands.List
+}
+
+func (h *listHandler) Handle(conn server.Conn) error {
+	ctx := conn.Context()
+	if ctx.User == nil {
+		return server.ErrNotAuthenticated
+	}
+	user := ctx.User.(*imapUser)
+	var infos []*imap.MailboxInfo
+	if h.Mailbox == "" {
+		// Just asking for the delimiter
+		infos = append(infos, &imap.MailboxInfo{
+			Attributes: []string{imap.NoSelectAttr},
+			Delimiter:  logic.MailboxDelimiter,
+		})
+	} else {
+		mailboxes, e := user.visibleMailboxes()
+		if e != nil {
+			return e
+		}
+		infos = listMailboxes(mailboxes, listPattern(h.Reference, h.Mailbox), h.Subscribed)
+	}
+	ch := make(chan *imap.MailboxInfo, len(infos))
+	for _, info := range infos {
+		ch <- info
+	}
+	close(ch)
+	return conn.WriteResp(&responses.List{Mailboxes: ch, Subscribed: h.Subscribed})
+}
+
+/**
+ * The reference and the mailbox are joined, unless the mailbox starts at
+ * the top of the hierarchy. INBOX is the one name that isn't case sensitive.
+ */
+func listPattern(reference, mailbox string) string {
+	pattern := reference + mailbox
+	if strings.HasPrefix(mailbox, logic.MailboxDelimiter) {
+		pattern = strings.TrimPrefix(mailbox, logic.MailboxDelimiter)
+	}
+	top := strings.SplitN(pattern, logic.MailboxDelimiter, 2)
+	if strings.EqualFold(top[0], imap.InboxName) {
+		top[0] = imap.InboxName
+	}
+	return strings.Join(top, logic.MailboxDelimiter)
+}
+
+func listMailboxes(mailboxes []*models.Mailbox, pattern string, subscribed bool) []*imap.MailboxInfo {
+	byName := map[string]*models.Mailbox{}
+	hasChildren := map[string]bool{}
+	for _, mailbox := range mailboxes {
+		byName[mailbox.Name] = mailbox
+		parents := strings.Split(mailbox.Name, logic.MailboxDelimiter)
+		for i := 1; i < len(parents); i++ {
+			hasChildren[strings.Join(parents[:i], logic.MailboxDelimiter)] = true
+		}
+	}
+	matched := map[string]*imap.MailboxInfo{}
+	for _, mailbox := range mailboxes {
+		if subscribed && !mailbox.Subscribed {
+			continue
+		}
+		if listMatch(mailbox.Name, pattern) {
+			matched[mailbox.Name] = mailboxInfo(mailbox, hasChildren[mailbox.Name])
+			continue
+		}
+		if !subscribed {
+			continue
+		}
+		// With %, LSUB lists the parent of a subscribed mailbox which isn't matched itself
+		parents := strings.Split(mailbox.Name, logic.MailboxDelimiter)
+		for i := len(parents) - 1; i > 0; i-- {
+			parent := strings.Join(parents[:i], logic.MailboxDelimiter)
+			if !listMatch(parent, pattern) {
+				continue
+			}
+			if p, ok := byName[parent]; (!ok || !p.Subscribed) && matched[parent] == nil {
+				matched[parent] = &imap.MailboxInfo{
+					Attributes: []string{imap.NoSelectAttr},
+					Delimiter:  logic.MailboxDelimiter,
+					Name:       parent,
+				}
+			}
+			break
+		}
+	}
+	var infos []*imap.MailboxInfo
+	for _, info := range matched {
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name < infos[j].Name
+	})
+	return infos
+}
+
+/**
+ * * matches anything, % anything but the delimiter. The pattern is matched
+ * a character at a time against every place in the name it could have got
+ * to, so patterns full of wildcards don't take exponential time.
+ */
+func listMatch(name, pattern string) bool {
+	// reached[i] is true if the pattern so far matches the first i bytes of the name
+	reached := make([]bool, len(name)+1)
+	next := make([]bool, len(name)+1)
+	reached[0] = true
+	for p := 0; p < len(pattern); p++ {
+		c := pattern[p]
+		for i := range next {
+			switch {
+			case c == '*' || c == '%':
+				// Either nothing more, or the next character as well
+				next[i] = reached[i] || (i > 0 && next[i-1] &&
+					(c == '*' || !strings.HasPrefix(name[i-1:], logic.MailboxDelimiter)))
+			default:
+				next[i] = i > 0 && reached[i-1] && name[i-1] == c
+			}
+		}
+		reached, next = next, reached
+	}
+	return reached[len(name)]
+}
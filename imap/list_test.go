@@ -0,0 +1,129 @@
+package imap
+
+import (
+	"github.com/emersion/go-imap"
+	"henrymail/models"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestListMatch(t *testing.T) {
+	tests := []struct {
+		name, pattern string
+		match         bool
+	}{
+		{"INBOX", "INBOX", true},
+		{"INBOX", "inbox", false},
+		{"Archive", "*", true},
+		{"Archive/2019", "*", true},
+		{"Archive", "%", true},
+		{"Archive/2019", "%", false},
+		{"Archive/2019", "%/%", true},
+		{"Archive/2019/Jan", "Archive/%", false},
+		{"Archive/2019/Jan", "Archive/*", true},
+		{"Archive", "Archive/*", false},
+		{"Archive/2019", "Ar*9", true},
+		{"Archive/2019", "Ar%9", false},
+		{"Archive/2019", "*/20%", true},
+		{"Archive/2019", "A*e*2*1*", true},
+		{"Archive/2019", "A*e*1*2", false},
+		{"", "", true},
+		{"", "*", true},
+		{"", "%", true},
+		{"a", "", false},
+		{"Sent", "Sen", false},
+		{"Sent", "Sentx", false},
+	}
+	for _, test := range tests {
+		if listMatch(test.name, test.pattern) != test.match {
+			t.Errorf("listMatch(%q, %q) should be %v", test.name, test.pattern, test.match)
+		}
+	}
+}
+
+func TestListMatchManyWildcards(t *testing.T) {
+	name := strings.Repeat("a", 100)
+	pattern := strings.Repeat("*%", 50) + "b"
+	done := make(chan bool)
+	go func() {
+		done <- listMatch(name, pattern)
+	}()
+	select {
+	case matched := <-done:
+		if matched {
+			t.Errorf("%q shouldn't match", pattern)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("listMatch took too long")
+	}
+}
+
+func TestListPattern(t *testing.T) {
+	tests := []struct {
+		reference, mailbox, pattern string
+	}{
+		{"", "*", "*"},
+		{"", "inbox", "INBOX"},
+		{"", "Inbox/%", "INBOX/%"},
+		{"", "inboxes", "inboxes"},
+		{"Archive/", "%", "Archive/%"},
+		{"Archive/", "/Sent", "Sent"},
+		{"inbox", "/Sub", "Sub"},
+		{"in", "box/*", "INBOX/*"},
+	}
+	for _, test := range tests {
+		if pattern := listPattern(test.reference, test.mailbox); pattern != test.pattern {
+			t.Errorf("listPattern(%q, %q) = %q, expected %q", test.reference, test.mailbox, pattern, test.pattern)
+		}
+	}
+}
+
+func TestListMailboxes(t *testing.T) {
+	mailboxes := []*models.Mailbox{
+		{Name: "INBOX", Subscribed: true},
+		{Name: "Archive", Subscribed: false},
+		{Name: "Archive/2019", Subscribed: true},
+		{Name: "Lists", Noselect: true, Subscribed: true},
+		{Name: "Lists/go", Subscribed: false},
+	}
+	names := func(infos []*imap.MailboxInfo) []string {
+		var names []string
+		for _, info := range infos {
+			names = append(names, info.Name+" "+strings.Join(info.Attributes, " "))
+		}
+		return names
+	}
+
+	got := names(listMailboxes(mailboxes, "%", false))
+	expected := []string{
+		"Archive \\HasChildren",
+		"INBOX \\HasNoChildren",
+		"Lists \\Noselect \\HasChildren",
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("LIST %% gave %q, expected %q", got, expected)
+	}
+
+	// The parent of a subscribed mailbox is listed, as \Noselect if it isn't subscribed itself
+	got = names(listMailboxes(mailboxes, "%", true))
+	expected = []string{
+		"Archive \\Noselect",
+		"INBOX \\HasNoChildren",
+		"Lists \\Noselect \\HasChildren",
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("LSUB %% gave %q, expected %q", got, expected)
+	}
+
+	got = names(listMailboxes(mailboxes, "*", true))
+	expected = []string{
+		"Archive/2019 \\HasNoChildren",
+		"INBOX \\HasNoChildren",
+		"Lists \\Noselect \\HasChildren",
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("LSUB * gave %q, expected %q", got, expected)
+	}
+}
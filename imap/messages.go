@@ -0,0 +1,330 @@
+package imap
+
+import (
+	"database/sql"
+	"github.com/emersion/go-imap"
+	"henrymail/models"
+	"sort"
+	"sync"
+)
+
+/**
+ * Loading just the messages a command asks for. Sequence numbers are mapped
+ * to UIDs with a list of the mailbox's UIDs, then the messages are read a
+ * range of UIDs at a time.
+ */
+
+// Messages read from the database at once
+const messageBatchSize = 100
+
+// Everything but the content, which is only loaded when it's needed
+const summaryColumns = "id, mailboxid, uid, ts, flagsjson, modseq, size, envelopejson, bodystructurejson, referencesjson"
+
+/**
+ * The UIDs of the messages the session knows about, in order, so a message's
+ * sequence number is its index plus one. It's loaded when the mailbox is
+ * selected, then only changes as the session tells its client: new messages
+ * are added when it sends EXISTS, and expunged ones are taken out when it
+ * sends EXPUNGE, so the numbers always match the client's. Messages can be
+ * gone from the database before then, and they're skipped until they're
+ * taken out. The list is replaced rather than changed, so callers can keep
+ * using the one they got.
+ */
+type seqnumMap struct {
+	lock sync.Mutex
+	uids []uint32 // nil until it's loaded
+}
+
+func (m *imapMailbox) uids(db models.XODB) ([]uint32, error) {
+	m.seqnums.lock.Lock()
+	defer m.seqnums.lock.Unlock()
+	if m.seqnums.uids != nil {
+		return m.seqnums.uids, nil
+	}
+	uids, e := loadUids(db, m.mailboxid, 0)
+	if e != nil {
+		return nil, e
+	}
+	m.seqnums.uids = uids
+	return uids, nil
+}
+
+/**
+ * Starts again with the messages that are in the mailbox now, when it's selected
+ */
+func (m *imapMailbox) selectSeqnums() error {
+	uids, e := loadUids(m.db, m.mailboxid, 0)
+	if e != nil {
+		return e
+	}
+	m.seqnums.lock.Lock()
+	defer m.seqnums.lock.Unlock()
+	m.seqnums.uids = uids
+	return nil
+}
+
+/**
+ * Adds the messages which have arrived since the session last looked, and
+ * returns how many it now knows about, to send as EXISTS
+ */
+func (m *imapMailbox) addArrived() (uint32, error) {
+	m.seqnums.lock.Lock()
+	defer m.seqnums.lock.Unlock()
+	var last uint32
+	if n := len(m.seqnums.uids); n > 0 {
+		last = m.seqnums.uids[n-1]
+	}
+	arrived, e := loadUids(m.db, m.mailboxid, last)
+	if e != nil {
+		return 0, e
+	}
+	if m.seqnums.uids == nil || len(arrived) > 0 {
+		n := len(m.seqnums.uids)
+		m.seqnums.uids = append(m.seqnums.uids[:n:n], arrived...)
+	}
+	return uint32(len(m.seqnums.uids)), nil
+}
+
+/**
+ * Takes the message out and returns the sequence number it had,
+ * or 0 if the session didn't know about it
+ */
+func (m *imapMailbox) removeExpunged(uid uint32) uint32 {
+	m.seqnums.lock.Lock()
+	defer m.seqnums.lock.Unlock()
+	seqnum := seqnumOf(m.seqnums.uids, uid)
+	if seqnum == 0 {
+		return 0
+	}
+	ix := int(seqnum - 1)
+	uids := make([]uint32, 0, len(m.seqnums.uids)-1)
+	uids = append(uids, m.seqnums.uids[:ix]...)
+	m.seqnums.uids = append(uids, m.seqnums.uids[ix+1:]...)
+	return seqnum
+}
+
+/**
+ * The message's sequence number, or 0 if the session doesn't know about it
+ */
+func (m *imapMailbox) seqnum(uid uint32) uint32 {
+	m.seqnums.lock.Lock()
+	defer m.seqnums.lock.Unlock()
+	return seqnumOf(m.seqnums.uids, uid)
+}
+
+func seqnumOf(uids []uint32, uid uint32) uint32 {
+	ix := sort.Search(len(uids), func(i int) bool { return uids[i] >= uid })
+	if ix == len(uids) || uids[ix] != uid {
+		return 0
+	}
+	return uint32(ix + 1)
+}
+
+/**
+ * The number of messages, as the session sees them if it has the mailbox selected
+ */
+func (m *imapMailbox) countMessages() (uint32, error) {
+	m.seqnums.lock.Lock()
+	if m.seqnums.uids != nil {
+		defer m.seqnums.lock.Unlock()
+		return uint32(len(m.seqnums.uids)), nil
+	}
+	m.seqnums.lock.Unlock()
+	return countMessages(m.db, m.mailboxid)
+}
+
+func loadUids(db models.XODB, mailboxid int, after uint32) ([]uint32, error) {
+	rows, e := db.Query("SELECT uid FROM messages WHERE mailboxid = ? AND uid > ? ORDER BY uid", mailboxid, after)
+	if e != nil {
+		return nil, e
+	}
+	defer rows.Close()
+	uids := []uint32{}
+	for rows.Next() {
+		var uid uint32
+		e = rows.Scan(&uid)
+		if e != nil {
+			return nil, e
+		}
+		uids = append(uids, uid)
+	}
+	return uids, rows.Err()
+}
+
+/**
+ * Messages next to each other in the mailbox
+ */
+type uidRange struct {
+	first, last uint32
+}
+
+func uidRanges(uids []uint32, uid bool, set *imap.SeqSet) []uidRange {
+	if len(uids) == 0 {
+		return nil
+	}
+	last := uint32(len(uids))
+	if uid {
+		last = uids[len(uids)-1]
+	}
+	set = withLast(set, last)
+	var ranges []uidRange
+	inRange := false
+	for ix, u := range uids {
+		check := uint32(ix + 1)
+		if uid {
+			check = u
+		}
+		if !set.Contains(check) {
+			inRange = false
+			continue
+		}
+		if inRange {
+			ranges[len(ranges)-1].last = u
+		} else {
+			ranges = append(ranges, uidRange{first: u, last: u})
+			inRange = true
+		}
+	}
+	return ranges
+}
+
+/**
+ * "*" is the last message in the mailbox, and a range
+ * can be given either way round (RFC 3501 section 9)
+ */
+func withLast(set *imap.SeqSet, last uint32) *imap.SeqSet {
+	resolved := &imap.SeqSet{}
+	for _, seq := range set.Set {
+		start, stop := seq.Start, seq.Stop
+		if start == 0 {
+			start = last
+		}
+		if stop == 0 {
+			stop = last
+		}
+		if start > stop {
+			start, stop = stop, start
+		}
+		resolved.AddRange(start, stop)
+	}
+	return resolved
+}
+
+/**
+ * Calls f with each message in the set, in order. The content is only
+ * loaded if it's asked for. Messages loaded without it mustn't be
+ * saved, use saveFlags instead.
+ */
+func (m *imapMailbox) forEachMessage(db models.XODB, uid bool, set *imap.SeqSet, withContent bool, f func(*models.Message, uint32) error) error {
+	uids, e := m.uids(db)
+	if e != nil {
+		return e
+	}
+	columns := summaryColumns
+	if withContent {
+		columns += ", content"
+	}
+	for _, r := range uidRanges(uids, uid, set) {
+		from := r.first
+		for {
+			batch, e := loadMessages(db, columns, withContent, m.mailboxid, from, r.last)
+			if e != nil {
+				return e
+			}
+			for _, msg := range batch {
+				// Anything expunged since isn't there, so the numbers come from the session's list
+				e = f(msg, seqnumOf(uids, uint32(msg.UID)))
+				if e != nil {
+					return e
+				}
+			}
+			if len(batch) < messageBatchSize {
+				break
+			}
+			from = uint32(batch[len(batch)-1].UID) + 1
+		}
+	}
+	return nil
+}
+
+func loadMessages(db models.XODB, columns string, withContent bool, mailboxid int, from, to uint32) ([]*models.Message, error) {
+	rows, e := db.Query("SELECT "+columns+" FROM messages WHERE mailboxid = ? AND uid BETWEEN ? AND ? ORDER BY uid LIMIT ?",
+		mailboxid, from, to, messageBatchSize)
+	if e != nil {
+		return nil, e
+	}
+	defer rows.Close()
+	var msgs []*models.Message
+	for rows.Next() {
+		msg := &models.Message{}
+		dest := []interface{}{&msg.ID, &msg.Mailboxid, &msg.UID, &msg.Ts, &msg.Flagsjson, &msg.Modseq,
+			&msg.Size, &msg.Envelopejson, &msg.Bodystructurejson, &msg.Referencesjson}
+		if withContent {
+			dest = append(dest, &msg.Content)
+		}
+		e = rows.Scan(dest...)
+		if e != nil {
+			return nil, e
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, rows.Err()
+}
+
+func saveFlags(tx *sql.Tx, msg *models.Message) error {
+	_, e := tx.Exec("UPDATE messages SET flagsjson = ?, modseq = ? WHERE id = ?", msg.Flagsjson, msg.Modseq, msg.ID)
+	return e
+}
+
+func countMessages(db models.XODB, mailboxid int) (uint32, error) {
+	var count uint32
+	e := db.QueryRow("SELECT count(*) FROM messages WHERE mailboxid = ?", mailboxid).Scan(&count)
+	return count, e
+}
+
+/**
+ * Only body sections need the message's content, everything
+ * else is kept alongside it
+ */
+func needsContent(items []imap.FetchItem) bool {
+	for _, item := range items {
+		switch item {
+		case imap.FetchEnvelope, imap.FetchBody, imap.FetchBodyStructure, imap.FetchFlags,
+			imap.FetchInternalDate, imap.FetchRFC822Size, imap.FetchUid, fetchModseq:
+		default:
+			return true
+		}
+	}
+	return false
+}
+
+// Flags are kept as a JSON list, where \Seen is "\\Seen"
+const seenPattern = `%"\\Seen"%`
+
+func countUnseen(db models.XODB, mailboxid int) (uint32, error) {
+	var count uint32
+	e := db.QueryRow("SELECT count(*) FROM messages WHERE mailboxid = ? AND flagsjson NOT LIKE ?",
+		mailboxid, seenPattern).Scan(&count)
+	return count, e
+}
+
+/**
+ * The sequence number of the first message without \Seen, or 0 if they've all been seen
+ */
+func (m *imapMailbox) firstUnseen(db models.XODB) (uint32, error) {
+	var first uint32
+	e := db.QueryRow("SELECT uid FROM messages WHERE mailboxid = ? AND flagsjson NOT LIKE ? ORDER BY uid LIMIT 1",
+		m.mailboxid, seenPattern).Scan(&first)
+	if e == sql.ErrNoRows {
+		return 0, nil
+	}
+	if e != nil {
+		return 0, e
+	}
+	uids, e := m.uids(db)
+	if e != nil {
+		return 0, e
+	}
+	// 0 if the client hasn't been told about it yet
+	return seqnumOf(uids, first), nil
+}
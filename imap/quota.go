@@ -0,0 +1,153 @@
+package imap
+
+import (
+	"errors"
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/server"
+	"github.com/emersion/go-imap/utf7"
+	"henrymail/logic"
+	"henrymail/models"
+)
+
+/**
+ * QUOTA from RFC 9208 (which replaced RFC 2087), for clients to show users
+ * how full their mailboxes are. Each user has one quota root, named "",
+ * covering all of their mailboxes. Quotas are set on the users admin page,
+ * so SETQUOTA is refused.
+ */
+type quotaExtension struct{}
+
+const (
+	codeOverQuota imap.StatusRespCode = "OVERQUOTA"
+
+	quotaRoot = ""
+)
+
+func (quotaExtension) Capabilities(c server.Conn) []string {
+	return []string{"QUOTA", "QUOTA=RES-STORAGE", "QUOTA=RES-MESSAGE"}
+}
+
+func (quotaExtension) Command(name string) server.HandlerFactory {
+	switch name {
+	case "GETQUOTA":
+		return func() server.Handler { return &getQuotaHandler{} }
+	case "GETQUOTAROOT":
+		return func() server.Handler { return &getQuotaRootHandler{} }
+	case "SETQUOTA":
+		return func() server.Handler { return &setQuotaHandler{} }
+	}
+	return nil
+}
+
+/**
+ * The untagged QUOTA response. Only resources with a limit are listed,
+ * storage is counted in units of 1024 octets.
+ */
+func quotaResp(db models.XODB, userid int) (imap.WriterTo, error) {
+	user, e := models.UserByID(db, userid)
+	if e != nil {
+		return nil, e
+	}
+	q, e := logic.GetQuota(db, user)
+	if e != nil {
+		return nil, e
+	}
+	var resources []interface{}
+	if q.Bytes > 0 {
+		resources = append(resources, imap.RawString("STORAGE"), uint32((q.UsedBytes+1023)/1024), uint32(q.Bytes/1024))
+	}
+	if q.Messages > 0 {
+		resources = append(resources, imap.RawString("MESSAGE"), uint32(q.UsedMessages), uint32(q.Messages))
+	}
+	if resources == nil {
+		resources = []interface{}{}
+	}
+	return imap.NewUntaggedResp([]interface{}{imap.RawString("QUOTA"), quotaRoot, resources}), nil
+}
+
+type getQuotaHandler struct {
+	root string
+}
+
+func (h *getQuotaHandler) Parse(fields []interface{}) error {
+	if len(fields) != 1 {
+		return errors.New("GETQUOTA needs a quota root")
+	}
+	var e error
+	h.root, e = imap.ParseString(fields[0])
+	return e
+}
+
+func (h *getQuotaHandler) Handle(conn server.Conn) error {
+	ctx := conn.Context()
+	if ctx.User == nil {
+		return server.ErrNotAuthenticated
+	}
+	if h.root != quotaRoot {
+		return errors.New("no such quota root")
+	}
+	user := ctx.User.(*imapUser)
+	res, e := quotaResp(user.db, user.userid)
+	if e != nil {
+		return e
+	}
+	return conn.WriteResp(res)
+}
+
+type getQuotaRootHandler struct {
+	mailbox string
+}
+
+func (h *getQuotaRootHandler) Parse(fields []interface{}) error {
+	if len(fields) != 1 {
+		return errors.New("GETQUOTAROOT needs a mailbox")
+	}
+	mailbox, e := imap.ParseString(fields[0])
+	if e != nil {
+		return e
+	}
+	mailbox, e = utf7.Encoding.NewDecoder().String(mailbox)
+	if e != nil {
+		return e
+	}
+	h.mailbox = imap.CanonicalMailboxName(mailbox)
+	return nil
+}
+
+func (h *getQuotaRootHandler) Handle(conn server.Conn) error {
+	ctx := conn.Context()
+	if ctx.User == nil {
+		return server.ErrNotAuthenticated
+	}
+	_, e := ctx.User.GetMailbox(h.mailbox)
+	if e != nil {
+		return e
+	}
+	name, e := utf7.Encoding.NewEncoder().String(h.mailbox)
+	if e != nil {
+		return e
+	}
+	e = conn.WriteResp(imap.NewUntaggedResp([]interface{}{imap.RawString("QUOTAROOT"), imap.FormatMailboxName(name), quotaRoot}))
+	if e != nil {
+		return e
+	}
+	user := ctx.User.(*imapUser)
+	res, e := quotaResp(user.db, user.userid)
+	if e != nil {
+		return e
+	}
+	return conn.WriteResp(res)
+}
+
+type setQuotaHandler struct{}
+
+func (h *setQuotaHandler) Parse(fields []interface{}) error {
+	return nil
+}
+
+func (h *setQuotaHandler) Handle(conn server.Conn) error {
+	if conn.Context().User == nil {
+		return server.ErrNotAuthenticated
+	}
+	return errors.New("quotas can only be changed by the administrator")
+}
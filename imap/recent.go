@@ -0,0 +1,156 @@
+package imap
+
+import (
+	"database/sql"
+	"henrymail/database"
+	"henrymail/models"
+	"sync"
+)
+
+/**
+ * The \Recent flag from RFC 3501. A message is recent in the first session
+ * to select its mailbox after it arrived, and in no other. The mailbox
+ * keeps the first UID that no session has taken yet, and a session which
+ * SELECTs it takes everything from there on, as well as mail which is
+ * delivered while it's selected. EXAMINE sees which messages are recent
+ * without taking them.
+ */
+
+const flagRecent = "\\Recent"
+
+type recentSet struct {
+	lock   sync.Mutex
+	claims bool
+	uids   map[uint32]bool // nil until the mailbox is selected
+}
+
+/**
+ * Called when the mailbox is selected, claim is false for EXAMINE
+ */
+func (m *imapMailbox) selectRecent(claim bool) error {
+	var uids []uint32
+	e := database.Transact(m.db, func(tx *sql.Tx) error {
+		var e error
+		uids, e = takeRecent(tx, m.mailboxid, claim)
+		return e
+	})
+	if e != nil {
+		return e
+	}
+	m.recent.lock.Lock()
+	defer m.recent.lock.Unlock()
+	m.recent.claims = claim
+	m.recent.uids = map[uint32]bool{}
+	for _, uid := range uids {
+		m.recent.uids[uid] = true
+	}
+	return nil
+}
+
+/**
+ * Takes any messages which have arrived since the mailbox was selected.
+ * Returns false if this session doesn't take recent messages.
+ */
+func (m *imapMailbox) claimRecent() (bool, error) {
+	m.recent.lock.Lock()
+	defer m.recent.lock.Unlock()
+	if !m.recent.claims {
+		return false, nil
+	}
+	var uids []uint32
+	e := database.Transact(m.db, func(tx *sql.Tx) error {
+		var e error
+		uids, e = takeRecent(tx, m.mailboxid, true)
+		return e
+	})
+	if e != nil {
+		return false, e
+	}
+	for _, uid := range uids {
+		m.recent.uids[uid] = true
+	}
+	return true, nil
+}
+
+func (m *imapMailbox) isRecent(uid int) bool {
+	m.recent.lock.Lock()
+	defer m.recent.lock.Unlock()
+	return m.recent.uids[uint32(uid)]
+}
+
+func (m *imapMailbox) forgetRecent(uid int) {
+	m.recent.lock.Lock()
+	defer m.recent.lock.Unlock()
+	delete(m.recent.uids, uint32(uid))
+}
+
+/**
+ * The number of recent messages, as this session sees them if it has
+ * the mailbox selected, otherwise as the next session to select it will
+ */
+func (m *imapMailbox) countRecent() (uint32, error) {
+	m.recent.lock.Lock()
+	if m.recent.uids != nil {
+		defer m.recent.lock.Unlock()
+		return uint32(len(m.recent.uids)), nil
+	}
+	m.recent.lock.Unlock()
+	var count uint32
+	e := m.db.QueryRow(`SELECT count(*) FROM messages, mailboxes WHERE mailboxes.id = ?
+		AND messages.mailboxid = mailboxes.id AND messages.uid >= mailboxes.firstrecentuid`, m.mailboxid).Scan(&count)
+	return count, e
+}
+
+/**
+ * The UIDs of the messages no session has taken yet. If claim is set,
+ * no other session will get them.
+ */
+func takeRecent(tx *sql.Tx, mailboxid int, claim bool) ([]uint32, error) {
+	mailbox, e := models.MailboxByID(tx, mailboxid)
+	if e != nil {
+		return nil, e
+	}
+	rows, e := tx.Query("SELECT uid FROM messages WHERE mailboxid = ? AND uid >= ?", mailboxid, mailbox.Firstrecentuid)
+	if e != nil {
+		return nil, e
+	}
+	defer rows.Close()
+	var uids []uint32
+	for rows.Next() {
+		var uid uint32
+		e = rows.Scan(&uid)
+		if e != nil {
+			return nil, e
+		}
+		uids = append(uids, uid)
+	}
+	if e = rows.Err(); e != nil {
+		return nil, e
+	}
+	if !claim || mailbox.Firstrecentuid == mailbox.Uidnext {
+		return uids, nil
+	}
+	mailbox.Firstrecentuid = mailbox.Uidnext
+	return uids, mailbox.Save(tx)
+}
+
+/**
+ * \Recent is kept by the server, clients can't set or clear it
+ */
+func withRecent(flags []string, recent bool) []string {
+	flags = withoutRecent(flags)
+	if recent {
+		flags = append(flags, flagRecent)
+	}
+	return flags
+}
+
+func withoutRecent(flags []string) []string {
+	without := []string{}
+	for _, flag := range flags {
+		if flag != flagRecent {
+			without = append(without, flag)
+		}
+	}
+	return without
+}
@@ -0,0 +1,61 @@
+package imap
+
+import (
+	"github.com/emersion/go-imap"
+	"henrymail/logic"
+	"net/textproto"
+)
+
+// The header fields with their own columns in the search index
+var indexedHeaders = map[string]string{
+	"From":    logic.SearchFrom,
+	"To":      logic.SearchTo,
+	"Cc":      logic.SearchCc,
+	"Bcc":     logic.SearchBcc,
+	"Subject": logic.SearchSubject,
+}
+
+/**
+ * Moves the top level criteria the search index can answer into a query,
+ * and returns what's left to be checked against each message. Criteria
+ * inside NOT and OR are always left, as are strings the index can only
+ * narrow the messages down for.
+ */
+func indexedCriteria(c *imap.SearchCriteria) (*logic.SearchQuery, *imap.SearchCriteria) {
+	query := &logic.SearchQuery{}
+	rest := *c
+	rest.Header = textproto.MIMEHeader{}
+	rest.Body = nil
+	rest.Text = nil
+	for key, values := range c.Header {
+		for _, value := range values {
+			column, ok := indexedHeaders[textproto.CanonicalMIMEHeaderKey(key)]
+			if !ok || !query.AddSubstring(column, value) {
+				rest.Header.Add(key, value)
+			}
+		}
+	}
+	for _, value := range c.Body {
+		if !query.AddSubstring(logic.SearchBody, value) {
+			rest.Body = append(rest.Body, value)
+		}
+	}
+	for _, value := range c.Text {
+		if !query.AddSubstring(logic.SearchAny, value) {
+			rest.Text = append(rest.Text, value)
+		}
+	}
+	return query, &rest
+}
+
+/**
+ * True if the criteria match every message, so there's no need to load them
+ */
+func matchesAll(c *imap.SearchCriteria) bool {
+	return c.SeqNum == nil && c.Uid == nil &&
+		c.Since.IsZero() && c.Before.IsZero() && c.SentSince.IsZero() && c.SentBefore.IsZero() &&
+		len(c.Header) == 0 && len(c.Body) == 0 && len(c.Text) == 0 &&
+		len(c.WithFlags) == 0 && len(c.WithoutFlags) == 0 &&
+		c.Larger == 0 && c.Smaller == 0 &&
+		len(c.Not) == 0 && len(c.Or) == 0
+}
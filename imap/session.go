@@ -0,0 +1,409 @@
+package imap
+
+import (
+	"errors"
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/commands"
+	"github.com/emersion/go-imap/server"
+	"henrymail/events"
+	"log"
+	"strconv"
+	"sync"
+)
+
+/**
+ * State for each connection which changes what the server sends it,
+ * like whether the client has enabled CONDSTORE.
+ */
+type session struct {
+	server.Conn
+
+	lock      sync.Mutex
+	condstore bool
+	// Held while telling the client about changes, while selecting a
+	// mailbox, so the client hears about changes after it's selected, and
+	// while FETCH, STORE and SEARCH turn sequence numbers into messages and
+	// write their responses, so the numbers can't change in between
+	updating sync.Mutex
+	queue    updateQueue
+	qresync  bool
+	// Set while this session is storing flags with .SILENT, which
+	// only quietens the updates about its own changes
+	silent bool
+	// Once COMPRESS=DEFLATE has started
+	compressed bool
+	// Set while a FETCH, STORE or SEARCH is running, when expunges are
+	// held back (RFC 3501 section 7.4.1)
+	holding bool
+	held    []events.Event
+}
+
+type sessionExtension struct{}
+
+func (sessionExtension) Capabilities(c server.Conn) []string {
+	return nil
+}
+
+func (sessionExtension) Command(name string) server.HandlerFactory {
+	if name == "UID" {
+		return func() server.Handler { return &uidHandler{} }
+	}
+	return nil
+}
+
+func (sessionExtension) NewConn(c server.Conn) server.Conn {
+	s := &session{Conn: c}
+	s.queue.ready = make(chan struct{}, 1)
+	go s.sendUpdates()
+	return s
+}
+
+func (s *session) ReadLine() ([]interface{}, error) {
+	reader, ok := s.Conn.(lineReader)
+	if !ok {
+		return nil, errors.New("unable to read from connection")
+	}
+	return reader.ReadLine()
+}
+
+func (s *session) enableCondstore() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.condstore = true
+}
+
+// QRESYNC implies CONDSTORE
+func (s *session) enableQresync() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.condstore = true
+	s.qresync = true
+}
+
+func (s *session) setSilent(silent bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.silent = silent
+}
+
+func (s *session) state() (condstore, qresync, silent bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.condstore, s.qresync, s.silent
+}
+
+func sessionFor(conn server.Conn) *session {
+	s, ok := conn.(*session)
+	if !ok {
+		// Every connection is wrapped by sessionExtension, so this can't happen
+		panic("connection has no session")
+	}
+	return s
+}
+
+/**
+ * More updates than this waiting to be sent, and the client isn't keeping up
+ */
+const maxQueuedUpdates = 10000
+
+/**
+ * Events for the session's mailbox, waiting to be sent to the client
+ */
+type updateQueue struct {
+	lock       sync.Mutex
+	queued     []queuedUpdate
+	ready      chan struct{}
+	overflowed bool
+}
+
+type queuedUpdate struct {
+	event events.Event
+	done  *sync.WaitGroup // For the session's own changes
+}
+
+/**
+ * Queues the update, unless the client has fallen too far behind. Returns
+ * true the first time it has, when the session should be disconnected. The
+ * session's own changes are always queued, as it's waiting for them.
+ */
+func (q *updateQueue) push(u queuedUpdate) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if u.done == nil && (q.overflowed || len(q.queued) >= maxQueuedUpdates) {
+		first := !q.overflowed
+		q.overflowed = true
+		return first
+	}
+	q.queued = append(q.queued, u)
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+	return false
+}
+
+func (q *updateQueue) take() []queuedUpdate {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	queued := q.queued
+	q.queued = nil
+	return queued
+}
+
+/**
+ * Queues mailbox events for each connection which has that mailbox selected.
+ * Each connection sends its own, so a slow client only holds up itself, and
+ * one which falls too far behind is disconnected.
+ */
+func subscribeUpdates(s *server.Server) {
+	events.Subscribe(func(ev events.Event) {
+		// New messages are recent in only one of the sessions
+		claimed := false
+		s.ForEachConn(func(c server.Conn) {
+			sess, ok := c.(*session)
+			if !ok {
+				return
+			}
+			ctx := c.Context()
+			mailbox, ok := ctx.Mailbox.(*imapMailbox)
+			if !ok || mailbox.mailboxid != ev.Mailboxid {
+				return
+			}
+			if ev.Type == events.Exists && !claimed {
+				var e error
+				claimed, e = mailbox.claimRecent()
+				if e != nil {
+					log.Printf("Unable to claim recent messages in mailbox %v: %v", ev.Mailboxid, e)
+				}
+			}
+			u := queuedUpdate{event: ev}
+			if user, ok := ctx.User.(*imapUser); ok && ev.Origin == user {
+				u.done = &user.pending
+				u.done.Add(1)
+			}
+			if sess.queue.push(u) {
+				log.Printf("Disconnecting %v, it isn't keeping up with updates", c.Info().RemoteAddr)
+				c.Close()
+			}
+		})
+	})
+}
+
+/**
+ * Writes the session's updates until it logs out
+ */
+func (s *session) sendUpdates() {
+	ctx := s.Context()
+	for {
+		select {
+		case <-s.queue.ready:
+		case <-ctx.LoggedOut:
+			return
+		}
+		for _, u := range s.queue.take() {
+			s.sendUpdate(u.event)
+			if u.done != nil {
+				u.done.Done()
+			}
+		}
+	}
+}
+
+func (s *session) sendUpdate(ev events.Event) {
+	s.updating.Lock()
+	defer s.updating.Unlock()
+	// The client would take the command's sequence numbers to be after it
+	if ev.Type == events.Expunge && s.holding {
+		s.held = append(s.held, ev)
+		return
+	}
+	s.writeUpdate(ev)
+}
+
+func (s *session) writeUpdate(ev events.Event) {
+	ctx := s.Context()
+	// It may have selected another since
+	mailbox, ok := ctx.Mailbox.(*imapMailbox)
+	if !ok || mailbox.mailboxid != ev.Mailboxid {
+		return
+	}
+	res, e := s.update(ev, mailbox)
+	if e != nil {
+		log.Printf("Unable to send update for mailbox %v: %v", ev.Mailboxid, e)
+		return
+	}
+	if res == nil {
+		return
+	}
+	// The responses are written in order, so the session's own updates reach
+	// the client before the tagged response to the command that caused them
+	select {
+	case ctx.Responses <- res:
+	case <-ctx.LoggedOut:
+	}
+}
+
+/**
+ * Holds back expunges until releaseExpunges, for a command whose
+ * responses have sequence numbers in them
+ */
+func (s *session) holdExpunges() {
+	s.updating.Lock()
+	defer s.updating.Unlock()
+	s.holding = true
+}
+
+/**
+ * Sends the expunges that were held back. This is done once the command's
+ * tagged response has gone out, which is when go-imap calls Upgrade, but
+ * that's only for an OK. Commands that fail release them before then.
+ */
+func (s *session) releaseExpunges() {
+	s.updating.Lock()
+	defer s.updating.Unlock()
+	s.holding = false
+	held := s.held
+	s.held = nil
+	for _, ev := range held {
+		s.writeUpdate(ev)
+	}
+}
+
+/**
+ * Commands which hold back expunges release them with this
+ */
+type expungeReleaser struct{}
+
+func (expungeReleaser) Upgrade(conn server.Conn) error {
+	sessionFor(conn).releaseExpunges()
+	return nil
+}
+
+/**
+ * UID, which go-imap only asks whether to upgrade the connection,
+ * so UID FETCH, UID STORE and UID SEARCH are asked here instead
+ */
+type uidHandler struct {
+	commands.Uid
+	handler server.Handler
+}
+
+func (h *uidHandler) Handle(conn server.Conn) error {
+	inner := h.Cmd.Command()
+	newHandler := conn.Server().Command(inner.Name)
+	if newHandler == nil {
+		return errors.New("Unknown command")
+	}
+	h.handler = newHandler()
+	e := h.handler.Parse(inner.Arguments)
+	if e != nil {
+		return e
+	}
+	uidHandler, ok := h.handler.(server.UidHandler)
+	if !ok {
+		return errors.New("Command unsupported with UID")
+	}
+	e = uidHandler.UidHandle(conn)
+	if e != nil {
+		return e
+	}
+	return server.ErrStatusResp(&imap.StatusResp{
+		Type: imap.StatusRespOk,
+		Info: "UID " + inner.Name + " completed",
+	})
+}
+
+func (h *uidHandler) Upgrade(conn server.Conn) error {
+	if up, ok := h.handler.(server.Upgrader); ok {
+		return up.Upgrade(conn)
+	}
+	return nil
+}
+
+/**
+ * Publishes changes made by this user's session, then waits for the session
+ * to send its own updates about them
+ */
+func (u *imapUser) publish(changes ...events.Event) {
+	for i := range changes {
+		changes[i].Origin = u
+	}
+	events.PublishAndWait(changes...)
+	u.pending.Wait()
+}
+
+/**
+ * The response telling the client about the event, if it needs to know.
+ * The mailbox's sequence numbers are changed to match what it's told.
+ */
+func (s *session) update(ev events.Event, mailbox *imapMailbox) (imap.WriterTo, error) {
+	condstore, qresync, silent := s.state()
+	silent = silent && ev.Origin != nil && ev.Origin == s.Context().User
+	switch ev.Type {
+	case events.Exists:
+		exists, e := mailbox.addArrived()
+		if e != nil {
+			return nil, e
+		}
+		recent, _ := mailbox.countRecent()
+		return responseList{
+			imap.NewUntaggedResp([]interface{}{exists, imap.RawString("EXISTS")}),
+			imap.NewUntaggedResp([]interface{}{recent, imap.RawString("RECENT")}),
+		}, nil
+	case events.Expunge:
+		mailbox.forgetRecent(ev.UID)
+		seqnum := mailbox.removeExpunged(uint32(ev.UID))
+		if seqnum == 0 {
+			// It arrived and left before the client heard about it
+			return nil, nil
+		}
+		if qresync {
+			uids := &imap.SeqSet{}
+			uids.AddNum(uint32(ev.UID))
+			return imap.NewUntaggedResp([]interface{}{imap.RawString("VANISHED"), uids}), nil
+		}
+		return imap.NewUntaggedResp([]interface{}{seqnum, imap.RawString("EXPUNGE")}), nil
+	case events.Flags:
+		seqnum := mailbox.seqnum(uint32(ev.UID))
+		// RFC 7162 says the new modseq must be sent even when .SILENT
+		if seqnum == 0 || (silent && !condstore) {
+			return nil, nil
+		}
+		var items []imap.FetchItem
+		if !silent {
+			items = append(items, imap.FetchFlags)
+		}
+		items = append(items, imap.FetchUid)
+		if condstore {
+			items = append(items, fetchModseq)
+		}
+		msg := imap.NewMessage(seqnum, items)
+		msg.Flags = withRecent(ev.Flags, mailbox.isRecent(ev.UID))
+		msg.Uid = uint32(ev.UID)
+		if condstore {
+			msg.Items[fetchModseq] = []interface{}{formatModseq(ev.Modseq)}
+		}
+		return imap.NewUntaggedResp([]interface{}{seqnum, imap.RawString("FETCH"), msg.Format()}), nil
+	}
+	return nil, nil
+}
+
+/**
+ * Several responses to send together
+ */
+type responseList []imap.WriterTo
+
+func (l responseList) WriteTo(w *imap.Writer) error {
+	for _, res := range l {
+		e := res.WriteTo(w)
+		if e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// The writer doesn't do 64 bit numbers
+func formatModseq(modseq int) imap.RawString {
+	return imap.RawString(strconv.Itoa(modseq))
+}
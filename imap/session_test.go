@@ -0,0 +1,397 @@
+package imap
+
+import (
+	"bufio"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/emersion/go-imap/server"
+	_ "github.com/mattn/go-sqlite3"
+	"golang.org/x/crypto/bcrypt"
+	"henrymail/database"
+	"henrymail/events"
+	"henrymail/logic"
+	"henrymail/models"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+/**
+ * An empty database in memory, with the user bob@example.com whose
+ * password is pw, and his INBOX
+ */
+func testDb(t *testing.T) *sql.DB {
+	db, e := sql.Open("sqlite3", ":memory:")
+	if e != nil {
+		t.Fatal(e)
+	}
+	// Each connection would have a database of its own
+	db.SetMaxOpenConns(1)
+	for _, file := range []string{"generate_schema.sql", "search_index.sql"} {
+		schema, e := ioutil.ReadFile("../database/" + file)
+		if e != nil {
+			t.Fatal(e)
+		}
+		_, e = db.Exec(string(schema))
+		if e != nil {
+			t.Fatal(e)
+		}
+	}
+	password, e := bcrypt.GenerateFromPassword([]byte("pw"), bcrypt.MinCost)
+	if e != nil {
+		t.Fatal(e)
+	}
+	_, e = db.Exec("INSERT INTO users (id, username, passwordBytes, admin) VALUES (1, 'bob@example.com', ?, 0)", password)
+	if e != nil {
+		t.Fatal(e)
+	}
+	_, e = logic.CreateMailbox(db, 1, "INBOX")
+	if e != nil {
+		t.Fatal(e)
+	}
+	return db
+}
+
+/**
+ * Saves messages to bob's mailbox, each with a body of the given size
+ */
+func addMessages(t *testing.T, db *sql.DB, name string, count, size int) {
+	e := database.Transact(db, func(tx *sql.Tx) error {
+		mailbox, e := models.MailboxByUseridName(tx, 1, name)
+		if e != nil {
+			return e
+		}
+		for i := 0; i < count; i++ {
+			content := fmt.Sprintf("Subject: Message %d\r\n\r\n%v\r\n", i+1, strings.Repeat("x", size))
+			e = logic.SaveMessages(tx, mailbox, &models.Message{Content: []byte(content), Flagsjson: []byte("[]")})
+			if e != nil {
+				return e
+			}
+		}
+		return nil
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+}
+
+/**
+ * Expunges the message the way another session would, and tells
+ * the sessions about it
+ */
+func expungeMessage(t *testing.T, db *sql.DB, name string, uid int) {
+	var ev events.Event
+	e := database.Transact(db, func(tx *sql.Tx) error {
+		mailbox, e := models.MailboxByUseridName(tx, 1, name)
+		if e != nil {
+			return e
+		}
+		var id int
+		e = tx.QueryRow("SELECT id FROM messages WHERE mailboxid = ? AND uid = ?", mailbox.ID, uid).Scan(&id)
+		if e != nil {
+			return e
+		}
+		ev = events.Event{Type: events.Expunge, Userid: 1, Mailboxid: mailbox.ID, UID: uid}
+		return logic.ExpungeMessages(tx, mailbox, &models.Message{ID: id})
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+	events.PublishAndWait(ev)
+}
+
+/**
+ * Hands the server the other end of pipes, so that it can't get ahead
+ * of a client which isn't reading
+ */
+type pipeListener struct {
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, errors.New("listener closed")
+	}
+}
+
+// The server closes it as well
+func (l *pipeListener) Close() error {
+	l.once.Do(func() {
+		close(l.closed)
+	})
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+}
+
+func testServer(t *testing.T, db *sql.DB) *pipeListener {
+	s := server.New(&imapBackend{db: db})
+	s.AllowInsecureAuth = true
+	enableExtensions(s)
+	l := &pipeListener{conns: make(chan net.Conn), closed: make(chan struct{})}
+	go func() {
+		_ = s.Serve(l)
+	}()
+	return l
+}
+
+/**
+ * The client's end of a connection, logged in as bob
+ */
+type testClient struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+	tags   int
+}
+
+func (l *pipeListener) dial(t *testing.T) *testClient {
+	server, conn := net.Pipe()
+	l.conns <- server
+	c := &testClient{t: t, conn: conn, reader: bufio.NewReader(conn)}
+	if greeting := c.readLine(); !strings.HasPrefix(greeting, "* OK") {
+		t.Fatalf("unexpected greeting %q", greeting)
+	}
+	c.command("LOGIN bob@example.com pw")
+	return c
+}
+
+func (c *testClient) readLine() string {
+	_ = c.conn.SetDeadline(time.Now().Add(5 * time.Second))
+	line, e := c.reader.ReadString('\n')
+	if e != nil {
+		c.t.Fatalf("reading from the server: %v", e)
+	}
+	return strings.TrimRight(line, "\r\n")
+}
+
+/**
+ * Sends the command and returns its tag
+ */
+func (c *testClient) send(command string) string {
+	c.tags++
+	tag := fmt.Sprintf("a%d", c.tags)
+	_ = c.conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, e := c.conn.Write([]byte(tag + " " + command + "\r\n"))
+	// Compressed connections hold on to what's written until they're flushed
+	if f, ok := c.conn.(interface{ Flush() error }); ok && e == nil {
+		e = f.Flush()
+	}
+	if e != nil {
+		c.t.Fatalf("sending %q: %v", command, e)
+	}
+	return tag
+}
+
+/**
+ * The untagged responses up to the tagged one, and the tagged one without its tag.
+ * Lines which don't start with a * are in literals, and are left out.
+ */
+func (c *testClient) response(tag string) ([]string, string) {
+	var untagged []string
+	for {
+		line := c.readLine()
+		if strings.HasPrefix(line, tag+" ") {
+			return untagged, strings.TrimPrefix(line, tag+" ")
+		}
+		if strings.HasPrefix(line, "* ") {
+			untagged = append(untagged, line)
+		}
+	}
+}
+
+/**
+ * Runs a command which should succeed, and returns its untagged responses
+ */
+func (c *testClient) command(command string) []string {
+	untagged, status := c.response(c.send(command))
+	if !strings.HasPrefix(status, "OK") {
+		c.t.Fatalf("%q gave %q %q", command, untagged, status)
+	}
+	return untagged
+}
+
+func (c *testClient) expect(command string, expected ...string) {
+	if untagged := c.command(command); !reflect.DeepEqual(untagged, expected) {
+		c.t.Errorf("%q gave %q, expected %q", command, untagged, expected)
+	}
+}
+
+func TestExpungeDuringFetch(t *testing.T) {
+	db := testDb(t)
+	defer db.Close()
+	// Big enough that the server can't write a message without the client reading it
+	const size = 100000
+	addMessages(t, db, "INBOX", 4, size)
+	l := testServer(t, db)
+	defer l.Close()
+	c := l.dial(t)
+	defer c.conn.Close()
+	c.command("SELECT INBOX")
+
+	literal := fmt.Sprintf("{%d}", len("Subject: Message 1\r\n\r\n\r\n")+size)
+	for _, test := range []struct {
+		command  string
+		uid      int // Expunged once the client has the first message
+		untagged []string
+		expunge  string
+	}{
+		{"FETCH 1:3 (UID BODY.PEEK[])", 1, []string{
+			"* 1 FETCH (UID 1 BODY[] " + literal,
+			"* 2 FETCH (UID 2 BODY[] " + literal,
+			"* 3 FETCH (UID 3 BODY[] " + literal,
+		}, "* 1 EXPUNGE"},
+		// UID 3 is now the second message
+		{"UID FETCH 2:4 (UID BODY.PEEK[])", 3, []string{
+			"* 1 FETCH (UID 2 BODY[] " + literal,
+			"* 2 FETCH (UID 3 BODY[] " + literal,
+			"* 3 FETCH (UID 4 BODY[] " + literal,
+		}, "* 2 EXPUNGE"},
+	} {
+		tag := c.send(test.command)
+		first := c.readLine()
+		expungeMessage(t, db, "INBOX", test.uid)
+		untagged, status := c.response(tag)
+		untagged = append([]string{first}, untagged...)
+		if !reflect.DeepEqual(untagged, test.untagged) || !strings.HasPrefix(status, "OK") {
+			t.Errorf("%q gave %q %q, expected %q", test.command, untagged, status, test.untagged)
+		}
+		// It's only sent once the FETCH has finished
+		if line := c.readLine(); line != test.expunge {
+			t.Errorf("got %q after %q, expected %q", line, test.command, test.expunge)
+		}
+	}
+	c.expect("FETCH 1:* (UID)", "* 1 FETCH (UID 2)", "* 2 FETCH (UID 4)")
+	c.expect("SEARCH ALL", "* SEARCH 1 2")
+	c.expect(`STORE 2 +FLAGS (\Flagged)`, `* 2 FETCH (FLAGS (\Flagged \Recent) UID 4)`)
+	c.expect(`UID STORE 4 -FLAGS.SILENT (\Flagged)`)
+}
+
+func TestFetchSetsSeen(t *testing.T) {
+	db := testDb(t)
+	defer db.Close()
+	addMessages(t, db, "INBOX", 3, 10)
+	l := testServer(t, db)
+	defer l.Close()
+	c := l.dial(t)
+	defer c.conn.Close()
+
+	// EXAMINE is read-only, so nothing is changed
+	c.command("EXAMINE INBOX")
+	c.expect("FETCH 1 (BODY[HEADER.FIELDS (SUBJECT)])", "* 1 FETCH (BODY[HEADER.FIELDS (SUBJECT)] {22}")
+	c.command("SELECT INBOX")
+	c.expect("FETCH 1 (BODY.PEEK[HEADER.FIELDS (SUBJECT)])", "* 1 FETCH (BODY[HEADER.FIELDS (SUBJECT)] {22}")
+	c.expect("FETCH 1:* (FLAGS)", `* 1 FETCH (FLAGS (\Recent))`, `* 2 FETCH (FLAGS (\Recent))`,
+		`* 3 FETCH (FLAGS (\Recent))`)
+	c.expect("FETCH 1 (BODY[HEADER.FIELDS (SUBJECT)])", "* 1 FETCH (BODY[HEADER.FIELDS (SUBJECT)] {22}",
+		`* 1 FETCH (FLAGS (\Seen \Recent) UID 1)`)
+	// Only the messages that weren't already seen
+	c.expect("UID FETCH 1:2 (UID BODY[TEXT])", "* 1 FETCH (UID 1 BODY[TEXT] {12}", "* 2 FETCH (UID 2 BODY[TEXT] {12}",
+		`* 2 FETCH (FLAGS (\Seen \Recent) UID 2)`)
+	c.expect("SEARCH UNSEEN", "* SEARCH 3")
+}
+
+func TestQuota(t *testing.T) {
+	db := testDb(t)
+	defer db.Close()
+	addMessages(t, db, "INBOX", 2, 10)
+	_, e := db.Exec("UPDATE users SET quotamessages = 3, quotabytes = 10240 WHERE id = 1")
+	if e != nil {
+		t.Fatal(e)
+	}
+	l := testServer(t, db)
+	defer l.Close()
+	c := l.dial(t)
+	defer c.conn.Close()
+
+	c.expect("GETQUOTAROOT INBOX", `* QUOTAROOT INBOX ""`, `* QUOTA "" (STORAGE 1 10 MESSAGE 2 3)`)
+	c.expect(`GETQUOTA ""`, `* QUOTA "" (STORAGE 1 10 MESSAGE 2 3)`)
+	c.command("SELECT INBOX")
+	c.command("COPY 1 INBOX")
+	// There's only room for one of them
+	if untagged, status := c.response(c.send("COPY 1:2 INBOX")); status != "NO [OVERQUOTA] mailbox is full" {
+		t.Errorf("COPY over quota gave %q %q", untagged, status)
+	}
+	c.expect(`GETQUOTA ""`, `* QUOTA "" (STORAGE 1 10 MESSAGE 3 3)`)
+}
+
+func TestMove(t *testing.T) {
+	db := testDb(t)
+	defer db.Close()
+	addMessages(t, db, "INBOX", 4, 10)
+	l := testServer(t, db)
+	defer l.Close()
+	c := l.dial(t)
+	defer c.conn.Close()
+	c.command("CREATE Archive")
+	var uidValidity uint32
+	status := c.command("STATUS Archive (UIDVALIDITY)")
+	if len(status) != 1 {
+		t.Fatalf("STATUS gave %q", status)
+	}
+	_, e := fmt.Sscanf(status[0], `* STATUS "Archive" (UIDVALIDITY %d)`, &uidValidity)
+	if e != nil {
+		t.Fatalf("STATUS gave %q: %v", status, e)
+	}
+	c.command("SELECT INBOX")
+
+	c.expect("MOVE 1:2 Archive", fmt.Sprintf("* OK [COPYUID %d 1:2 1:2] Moved", uidValidity),
+		"* 1 EXPUNGE", "* 1 EXPUNGE")
+	if untagged, status := c.response(c.send("MOVE 1 Nowhere")); status != "NO [TRYCREATE] No such mailbox" {
+		t.Errorf("MOVE to a missing mailbox gave %q %q", untagged, status)
+	}
+	// With QRESYNC, clients are told which UIDs went instead
+	c.command("ENABLE QRESYNC")
+	c.expect("UID MOVE 4 Archive", fmt.Sprintf("* OK [COPYUID %d 4 3] Moved", uidValidity), "* VANISHED 4")
+	c.expect("FETCH 1:* (UID)", "* 1 FETCH (UID 3)")
+	c.command("SELECT Archive")
+	c.expect("FETCH 1:* (UID BODY.PEEK[HEADER.FIELDS (SUBJECT)])",
+		"* 1 FETCH (UID 1 BODY[HEADER.FIELDS (SUBJECT)] {22}",
+		"* 2 FETCH (UID 2 BODY[HEADER.FIELDS (SUBJECT)] {22}",
+		"* 3 FETCH (UID 3 BODY[HEADER.FIELDS (SUBJECT)] {22}")
+}
+
+func TestCompress(t *testing.T) {
+	db := testDb(t)
+	defer db.Close()
+	addMessages(t, db, "INBOX", 1, 100000)
+	l := testServer(t, db)
+	defer l.Close()
+	c := l.dial(t)
+	defer c.conn.Close()
+
+	capabilities := c.command("CAPABILITY")
+	if len(capabilities) != 1 || !strings.Contains(capabilities[0], " COMPRESS=DEFLATE") {
+		t.Errorf("CAPABILITY gave %q, without COMPRESS=DEFLATE", capabilities)
+	}
+	if untagged, status := c.response(c.send("COMPRESS LZW")); status != "BAD Only DEFLATE is supported" {
+		t.Errorf("COMPRESS LZW gave %q %q", untagged, status)
+	}
+	c.command("COMPRESS DEFLATE")
+	compressed, e := newDeflateConn(c.conn)
+	if e != nil {
+		t.Fatal(e)
+	}
+	c.conn, c.reader = compressed, bufio.NewReader(compressed)
+
+	c.expect("STATUS INBOX (MESSAGES)", "* STATUS INBOX (MESSAGES 1)")
+	c.command("SELECT INBOX")
+	// Enough that it takes more than one flush
+	c.expect("FETCH 1 (UID BODY.PEEK[])", fmt.Sprintf("* 1 FETCH (UID 1 BODY[] {%d}", 100000+len("Subject: Message 1\r\n\r\n\r\n")))
+	if untagged, status := c.response(c.send("COMPRESS DEFLATE")); status != "NO [COMPRESSIONACTIVE] Already compressing" {
+		t.Errorf("COMPRESS again gave %q %q", untagged, status)
+	}
+	c.command("NOOP")
+}
@@ -0,0 +1,285 @@
+package imap
+
+import (
+	"errors"
+	"fmt"
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/commands"
+	"github.com/emersion/go-imap/server"
+	"henrymail/logic"
+	"henrymail/models"
+	"sort"
+	"strings"
+	"time"
+)
+
+/**
+ * SORT and THREAD from RFC 5256, so clients don't have to fetch every
+ * envelope to show a big mailbox in order. Both work from the envelope
+ * and references kept with each message, never its content.
+ */
+type sortExtension struct{}
+
+func (sortExtension) Capabilities(c server.Conn) []string {
+	return []string{"SORT", "THREAD=ORDEREDSUBJECT", "THREAD=REFERENCES"}
+}
+
+func (sortExtension) Command(name string) server.HandlerFactory {
+	switch name {
+	case "SORT":
+		return func() server.Handler { return &sortHandler{} }
+	case "THREAD":
+		return func() server.Handler { return &threadHandler{} }
+	}
+	return nil
+}
+
+const (
+	sortArrival = "ARRIVAL"
+	sortCc      = "CC"
+	sortDate    = "DATE"
+	sortFrom    = "FROM"
+	sortReverse = "REVERSE"
+	sortSize    = "SIZE"
+	sortSubject = "SUBJECT"
+	sortTo      = "TO"
+)
+
+type sortKey struct {
+	criterion string
+	reverse   bool
+}
+
+/**
+ * What messages are sorted and threaded on
+ */
+type sortMessage struct {
+	id         uint32 // The sequence number or UID, whichever the client asked for
+	seqnum     uint32
+	arrival    time.Time
+	date       time.Time // When it was sent, or when it arrived if that's not known
+	from       string
+	to         string
+	cc         string
+	subject    string // The base subject
+	reply      bool   // If the subject said it was a reply or forward
+	size       int
+	messageId  string
+	references []string
+}
+
+func newSortMessage(msg *models.Message, seqnum uint32) (*sortMessage, error) {
+	envelope, e := logic.Envelope(msg)
+	if e != nil {
+		return nil, e
+	}
+	references, e := logic.References(msg)
+	if e != nil {
+		return nil, e
+	}
+	// Without References, the first message ID in In-Reply-To will do
+	if len(references) == 0 {
+		references = logic.MessageIds(envelope.InReplyTo)
+		if len(references) > 1 {
+			references = references[:1]
+		}
+	}
+	s := &sortMessage{
+		seqnum:     seqnum,
+		arrival:    msg.Ts.Time,
+		date:       envelope.Date,
+		from:       firstMailbox(envelope.From),
+		to:         firstMailbox(envelope.To),
+		cc:         firstMailbox(envelope.Cc),
+		size:       msg.Size,
+		references: references,
+	}
+	if s.date.IsZero() {
+		s.date = s.arrival
+	}
+	s.subject, s.reply = logic.BaseSubject(envelope.Subject)
+	if ids := logic.MessageIds(envelope.MessageId); len(ids) > 0 {
+		s.messageId = ids[0]
+	}
+	return s, nil
+}
+
+// The local part of the first address, which is what addresses are sorted on
+func firstMailbox(addresses []*imap.Address) string {
+	if len(addresses) == 0 {
+		return ""
+	}
+	return strings.ToUpper(addresses[0].MailboxName)
+}
+
+/**
+ * The messages matching the criteria, in mailbox order
+ */
+func (m *imapMailbox) sortMessages(uid bool, criteria *imap.SearchCriteria) ([]*sortMessage, error) {
+	seqnums, _, e := m.searchMessages(false, criteria, 0)
+	if e != nil || len(seqnums) == 0 {
+		return nil, e
+	}
+	set := &imap.SeqSet{}
+	set.AddNum(seqnums...)
+	var msgs []*sortMessage
+	e = m.forEachMessage(m.db, false, set, false, func(msg *models.Message, seqnum uint32) error {
+		s, e := newSortMessage(msg, seqnum)
+		if e != nil {
+			return e
+		}
+		s.id = seqnum
+		if uid {
+			s.id = uint32(msg.UID)
+		}
+		msgs = append(msgs, s)
+		return nil
+	})
+	return msgs, e
+}
+
+func compareTimes(a, b time.Time) int {
+	switch {
+	case a.Before(b):
+		return -1
+	case a.After(b):
+		return 1
+	}
+	return 0
+}
+
+func compareMessages(a, b *sortMessage, criterion string) int {
+	switch criterion {
+	case sortArrival:
+		return compareTimes(a.arrival, b.arrival)
+	case sortCc:
+		return strings.Compare(a.cc, b.cc)
+	case sortDate:
+		return compareTimes(a.date, b.date)
+	case sortFrom:
+		return strings.Compare(a.from, b.from)
+	case sortSize:
+		return a.size - b.size
+	case sortSubject:
+		return strings.Compare(a.subject, b.subject)
+	case sortTo:
+		return strings.Compare(a.to, b.to)
+	}
+	return 0
+}
+
+/**
+ * Messages that are the same by every key stay in mailbox order,
+ * even when the keys are reversed
+ */
+func sortByKeys(msgs []*sortMessage, keys []sortKey) {
+	sort.SliceStable(msgs, func(i, j int) bool {
+		for _, key := range keys {
+			c := compareMessages(msgs[i], msgs[j], key.criterion)
+			if key.reverse {
+				c = -c
+			}
+			if c != 0 {
+				return c < 0
+			}
+		}
+		return msgs[i].seqnum < msgs[j].seqnum
+	})
+}
+
+/**
+ * SORT and THREAD name a charset for the search criteria. Strings are
+ * searched for as UTF-8, which US-ASCII is part of.
+ */
+func parseSearch(search *commands.Search, fields []interface{}) error {
+	charset, ok := fields[0].(string)
+	if !ok {
+		return errors.New("Charset must be a string")
+	}
+	search.Charset = charset
+	if !supportedCharset(charset) {
+		return nil
+	}
+	return search.Parse(append([]interface{}{"CHARSET"}, fields...))
+}
+
+func supportedCharset(charset string) bool {
+	return strings.EqualFold(charset, "UTF-8") || strings.EqualFold(charset, "US-ASCII")
+}
+
+func badCharset(charset string) error {
+	return server.ErrStatusResp(&imap.StatusResp{
+		Type: imap.StatusRespNo,
+		Code: imap.CodeBadCharset,
+		Info: fmt.Sprintf("Charset %v isn't supported, use UTF-8", charset),
+	})
+}
+
+// SORT (sort-criteria) charset search-criteria
+type sortHandler struct {
+	commands.Search
+	keys []sortKey
+}
+
+func (h *sortHandler) Parse(fields []interface{}) error {
+	if len(fields) < 3 {
+		return errors.New("SORT needs sort criteria, a charset and search criteria")
+	}
+	list, ok := fields[0].([]interface{})
+	if !ok || len(list) == 0 {
+		return errors.New("Sort criteria must be a list")
+	}
+	reverse := false
+	for _, f := range list {
+		criterion, ok := f.(string)
+		if !ok {
+			return errors.New("Sort criteria must be atoms")
+		}
+		criterion = strings.ToUpper(criterion)
+		switch criterion {
+		case sortReverse:
+			if reverse {
+				return errors.New("REVERSE can only be given once for each sort key")
+			}
+			reverse = true
+			continue
+		case sortArrival, sortCc, sortDate, sortFrom, sortSize, sortSubject, sortTo:
+			h.keys = append(h.keys, sortKey{criterion: criterion, reverse: reverse})
+			reverse = false
+		default:
+			return fmt.Errorf("Unknown sort criterion %v", criterion)
+		}
+	}
+	if reverse {
+		return errors.New("REVERSE must be followed by a sort key")
+	}
+	return parseSearch(&h.Search, fields[1:])
+}
+
+func (h *sortHandler) handle(uid bool, conn server.Conn) error {
+	ctx := conn.Context()
+	if ctx.Mailbox == nil {
+		return server.ErrNoMailboxSelected
+	}
+	if !supportedCharset(h.Charset) {
+		return badCharset(h.Charset)
+	}
+	msgs, e := ctx.Mailbox.(*imapMailbox).sortMessages(uid, h.Criteria)
+	if e != nil {
+		return e
+	}
+	sortByKeys(msgs, h.keys)
+	fields := []interface{}{imap.RawString("SORT")}
+	for _, msg := range msgs {
+		fields = append(fields, msg.id)
+	}
+	return conn.WriteResp(imap.NewUntaggedResp(fields))
+}
+
+func (h *sortHandler) Handle(conn server.Conn) error {
+	return h.handle(false, conn)
+}
+
+func (h *sortHandler) UidHandle(conn server.Conn) error {
+	return h.handle(true, conn)
+}
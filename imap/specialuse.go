@@ -0,0 +1,76 @@
+package imap
+
+import (
+	"errors"
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/commands"
+	"github.com/emersion/go-imap/server"
+	"henrymail/logic"
+)
+
+/**
+ * SPECIAL-USE and CREATE-SPECIAL-USE from RFC 6154. The attributes are
+ * sent in every LIST response by imapMailbox.Info, this lets clients
+ * choose them when they create a mailbox.
+ */
+type specialUseExtension struct{}
+
+func (specialUseExtension) Capabilities(c server.Conn) []string {
+	return []string{"SPECIAL-USE", "CREATE-SPECIAL-USE"}
+}
+
+func (specialUseExtension) Command(name string) server.HandlerFactory {
+	if name != "CREATE" {
+		return nil
+	}
+	return func() server.Handler {
+		return &createHandler{}
+	}
+}
+
+type createHandler struct {
+	commands.Create
+	use string
+}
+
+// CREATE name (USE (\Sent))
+func (h *createHandler) Parse(fields []interface{}) error {
+	if len(fields) > 1 {
+		params, ok := fields[1].([]interface{})
+		if !ok || len(params) != 2 || !isAtom(params[0], "USE") {
+			return errors.New("unknown create parameter")
+		}
+		uses, ok := params[1].([]interface{})
+		if !ok {
+			return errors.New("USE needs a list")
+		}
+		list, e := imap.ParseStringList(uses)
+		if e != nil {
+			return e
+		}
+		if len(list) > 1 {
+			return errors.New("only one special use per mailbox")
+		}
+		if len(list) == 1 {
+			h.use = list[0]
+		}
+		fields = fields[:1]
+	}
+	return h.Create.Parse(fields)
+}
+
+func (h *createHandler) Handle(conn server.Conn) error {
+	ctx := conn.Context()
+	if ctx.User == nil {
+		return server.ErrNotAuthenticated
+	}
+	e := ctx.User.(*imapUser).createMailbox(h.Mailbox, h.use)
+	if e == logic.ErrInvalidSpecialUse || e == logic.ErrSpecialUseTaken {
+		return server.ErrStatusResp(&imap.StatusResp{
+			Type: imap.StatusRespNo,
+			Code: "USEATTR",
+			Info: e.Error(),
+		})
+	}
+	return e
+}
@@ -0,0 +1,322 @@
+package imap
+
+import (
+	"errors"
+	"fmt"
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/commands"
+	"github.com/emersion/go-imap/server"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/**
+ * The THREAD algorithms from RFC 5256. ORDEREDSUBJECT groups messages by
+ * their base subject, REFERENCES follows Message-ID, References and
+ * In-Reply-To, then joins up threads with the same subject.
+ */
+
+const (
+	threadOrderedSubject = "ORDEREDSUBJECT"
+	threadReferences     = "REFERENCES"
+)
+
+type threadNode struct {
+	msg      *sortMessage // nil for messages which are referred to but aren't in the results
+	parent   *threadNode
+	children []*threadNode
+}
+
+/**
+ * The message the thread's date and subject come from, even if this
+ * node has no message of its own
+ */
+func (n *threadNode) first() *sortMessage {
+	for ; n.msg == nil; n = n.children[0] {
+	}
+	return n.msg
+}
+
+func (n *threadNode) isBelow(other *threadNode) bool {
+	for p := n.parent; p != nil; p = p.parent {
+		if p == other {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *threadNode) setParent(parent *threadNode) {
+	if n.parent != nil {
+		siblings := n.parent.children
+		for i, sibling := range siblings {
+			if sibling == n {
+				n.parent.children = append(siblings[:i:i], siblings[i+1:]...)
+				break
+			}
+		}
+	}
+	n.parent = parent
+	if parent != nil {
+		parent.children = append(parent.children, n)
+	}
+}
+
+/**
+ * By the date of each thread's first message, and the same for
+ * the replies at every level
+ */
+func sortThreads(nodes []*threadNode) {
+	for _, node := range nodes {
+		sortThreads(node.children)
+	}
+	sort.SliceStable(nodes, func(i, j int) bool {
+		a, b := nodes[i].first(), nodes[j].first()
+		if c := compareTimes(a.date, b.date); c != 0 {
+			return c < 0
+		}
+		return a.seqnum < b.seqnum
+	})
+}
+
+/**
+ * The first message with each subject starts a thread, and every other
+ * message with that subject is a reply to it
+ */
+func orderedSubjectThreads(msgs []*sortMessage) []*threadNode {
+	sortByKeys(msgs, []sortKey{{criterion: sortSubject}, {criterion: sortDate}})
+	var threads []*threadNode
+	var thread *threadNode
+	for _, msg := range msgs {
+		if thread != nil && thread.msg.subject == msg.subject {
+			(&threadNode{msg: msg}).setParent(thread)
+			continue
+		}
+		thread = &threadNode{msg: msg}
+		threads = append(threads, thread)
+	}
+	sortThreads(threads)
+	return threads
+}
+
+/**
+ * The REFERENCES algorithm, as RFC 5256 section 3 describes it
+ */
+func referencesThreads(msgs []*sortMessage) []*threadNode {
+	// (1) Link messages to the ones they refer to
+	var nodes []*threadNode
+	byId := map[string]*threadNode{}
+	node := func(id string) *threadNode {
+		n, ok := byId[id]
+		if !ok {
+			n = &threadNode{}
+			byId[id] = n
+			nodes = append(nodes, n)
+		}
+		return n
+	}
+	for _, msg := range msgs {
+		var current *threadNode
+		if existing := byId[msg.messageId]; msg.messageId != "" && (existing == nil || existing.msg == nil) {
+			current = node(msg.messageId)
+		} else {
+			// No Message-ID, or one that's been seen already, counts as unique
+			current = &threadNode{}
+			nodes = append(nodes, current)
+		}
+		current.msg = msg
+		var parent *threadNode
+		for _, id := range msg.references {
+			ref := node(id)
+			if parent != nil && ref.parent == nil && ref != parent && !parent.isBelow(ref) {
+				ref.setParent(parent)
+			}
+			parent = ref
+		}
+		if parent != nil && (parent == current || parent.isBelow(current)) {
+			parent = nil
+		}
+		current.setParent(parent)
+	}
+
+	// (2) The threads are the messages that don't refer to anything
+	var roots []*threadNode
+	for _, n := range nodes {
+		if n.parent == nil {
+			roots = append(roots, n)
+		}
+	}
+
+	// (3) and (4)
+	roots = pruneThreads(roots, true)
+	sortThreads(roots)
+
+	// (5) Join threads with the same subject
+	subjects := map[string]*threadNode{}
+	for _, root := range roots {
+		first := root.first()
+		if first.subject == "" {
+			continue
+		}
+		existing, ok := subjects[first.subject]
+		if !ok || (root.msg == nil && existing.msg != nil) ||
+			(existing.msg != nil && root.msg != nil && existing.msg.reply && !root.msg.reply) {
+			subjects[first.subject] = root
+		}
+	}
+	merged := map[*threadNode]bool{}
+	for _, root := range roots {
+		subject := root.first().subject
+		existing := subjects[subject]
+		if subject == "" || existing == root || root.parent != nil {
+			continue
+		}
+		switch {
+		case root.msg == nil && existing.msg == nil:
+			for len(root.children) > 0 {
+				root.children[0].setParent(existing)
+			}
+			merged[root] = true
+		case existing.msg == nil:
+			root.setParent(existing)
+		case root.msg != nil && root.msg.reply && !existing.msg.reply:
+			root.setParent(existing)
+		default:
+			dummy := &threadNode{}
+			existing.setParent(dummy)
+			root.setParent(dummy)
+			subjects[subject] = dummy
+		}
+	}
+	var threads []*threadNode
+	seen := map[*threadNode]bool{}
+	for _, root := range roots {
+		for root.parent != nil {
+			root = root.parent
+		}
+		if !merged[root] && !seen[root] {
+			seen[root] = true
+			threads = append(threads, root)
+		}
+	}
+
+	// (6)
+	sortThreads(threads)
+	return threads
+}
+
+/**
+ * Takes out nodes without messages, moving their replies up a level.
+ * Replies aren't made into threads of their own unless there's just one.
+ */
+func pruneThreads(nodes []*threadNode, top bool) []*threadNode {
+	var pruned []*threadNode
+	for _, node := range nodes {
+		node.children = pruneThreads(node.children, false)
+		if node.msg == nil && (!top || len(node.children) <= 1) {
+			for _, child := range node.children {
+				child.parent = node.parent
+			}
+			pruned = append(pruned, node.children...)
+			continue
+		}
+		pruned = append(pruned, node)
+	}
+	return pruned
+}
+
+/**
+ * As in RFC 5256 section 4, where "(1 2 (3)(4 5))" is 1, replied to by 2,
+ * which had replies 3 and 4, and 4 was replied to by 5
+ */
+func formatThreads(threads []*threadNode) string {
+	var b strings.Builder
+	for _, thread := range threads {
+		b.WriteString("(")
+		formatThread(&b, thread, true)
+		b.WriteString(")")
+	}
+	return b.String()
+}
+
+func formatThread(b *strings.Builder, node *threadNode, first bool) {
+	for {
+		if node.msg != nil {
+			if !first {
+				b.WriteString(" ")
+			}
+			b.WriteString(strconv.FormatUint(uint64(node.msg.id), 10))
+			first = false
+		}
+		if len(node.children) != 1 {
+			break
+		}
+		node = node.children[0]
+	}
+	if len(node.children) == 0 {
+		return
+	}
+	if !first {
+		b.WriteString(" ")
+	}
+	for _, child := range node.children {
+		b.WriteString("(")
+		formatThread(b, child, true)
+		b.WriteString(")")
+	}
+}
+
+// THREAD algorithm charset search-criteria
+type threadHandler struct {
+	commands.Search
+	algorithm string
+}
+
+func (h *threadHandler) Parse(fields []interface{}) error {
+	if len(fields) < 3 {
+		return errors.New("THREAD needs an algorithm, a charset and search criteria")
+	}
+	algorithm, ok := fields[0].(string)
+	if !ok {
+		return errors.New("Thread algorithm must be an atom")
+	}
+	h.algorithm = strings.ToUpper(algorithm)
+	if h.algorithm != threadOrderedSubject && h.algorithm != threadReferences {
+		return fmt.Errorf("Unknown thread algorithm %v", algorithm)
+	}
+	return parseSearch(&h.Search, fields[1:])
+}
+
+func (h *threadHandler) handle(uid bool, conn server.Conn) error {
+	ctx := conn.Context()
+	if ctx.Mailbox == nil {
+		return server.ErrNoMailboxSelected
+	}
+	if !supportedCharset(h.Charset) {
+		return badCharset(h.Charset)
+	}
+	msgs, e := ctx.Mailbox.(*imapMailbox).sortMessages(uid, h.Criteria)
+	if e != nil {
+		return e
+	}
+	var threads []*threadNode
+	if h.algorithm == threadOrderedSubject {
+		threads = orderedSubjectThreads(msgs)
+	} else {
+		threads = referencesThreads(msgs)
+	}
+	fields := []interface{}{imap.RawString("THREAD")}
+	if len(threads) > 0 {
+		fields = append(fields, imap.RawString(formatThreads(threads)))
+	}
+	return conn.WriteResp(imap.NewUntaggedResp(fields))
+}
+
+func (h *threadHandler) Handle(conn server.Conn) error {
+	return h.handle(false, conn)
+}
+
+func (h *threadHandler) UidHandle(conn server.Conn) error {
+	return h.handle(true, conn)
+}
@@ -0,0 +1,147 @@
+package imap
+
+import (
+	"henrymail/logic"
+	"testing"
+	"time"
+)
+
+type testMessage struct {
+	subject    string
+	messageId  string
+	references []string
+}
+
+/**
+ * Numbered from 1, a minute apart
+ */
+func threadTestMessages(msgs ...testMessage) []*sortMessage {
+	start := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	var sorted []*sortMessage
+	for i, msg := range msgs {
+		subject, reply := logic.BaseSubject(msg.subject)
+		sorted = append(sorted, &sortMessage{
+			id:         uint32(i + 1),
+			seqnum:     uint32(i + 1),
+			date:       start.Add(time.Duration(i) * time.Minute),
+			subject:    subject,
+			reply:      reply,
+			messageId:  msg.messageId,
+			references: msg.references,
+		})
+	}
+	return sorted
+}
+
+func TestReferencesThreads(t *testing.T) {
+	tests := []struct {
+		name     string
+		msgs     []testMessage
+		expected string
+	}{
+		{"chain", []testMessage{
+			{"Hello", "<a>", nil},
+			{"Re: Hello", "<b>", []string{"<a>"}},
+			{"Re: Hello", "<c>", []string{"<a>", "<b>"}},
+		}, "(1 2 3)"},
+		{"replies to one message", []testMessage{
+			{"Hello", "<a>", nil},
+			{"Re: Hello", "<b>", []string{"<a>"}},
+			{"Re: Hello", "<c>", []string{"<a>"}},
+			{"Re: Hello", "<d>", []string{"<a>", "<b>"}},
+		}, "(1 (2 4)(3))"},
+		// Only References counts here, In-Reply-To is turned into one when the message is saved
+		{"parents out of order", []testMessage{
+			{"Re: Hello", "<c>", []string{"<a>", "<b>"}},
+			{"Hello", "<a>", nil},
+			{"Re: Hello", "<b>", []string{"<a>"}},
+		}, "(2 3 1)"},
+		{"missing parent with one reply", []testMessage{
+			{"First", "<a>", nil},
+			{"Re: Second", "<b>", []string{"<missing>"}},
+		}, "(1)(2)"},
+		{"missing parent with two replies", []testMessage{
+			{"First", "<a>", nil},
+			{"Re: Second", "<b>", []string{"<missing>"}},
+			{"Re: Third", "<c>", []string{"<missing>"}},
+		}, "(1)((2)(3))"},
+		{"missing message between", []testMessage{
+			{"Hello", "<a>", nil},
+			{"Re: Hello", "<c>", []string{"<a>", "<missing>"}},
+			{"Re: Hello", "<d>", []string{"<a>", "<missing>"}},
+		}, "(1 (2)(3))"},
+		// (5) in RFC 5256 section 3
+		{"reply joins thread by subject", []testMessage{
+			{"Hello", "<a>", nil},
+			{"Re: Hello", "<b>", nil},
+		}, "(1 2)"},
+		{"same subject without replies", []testMessage{
+			{"Hello", "<a>", nil},
+			{"Hello", "<b>", nil},
+		}, "((1)(2))"},
+		{"reply before the original", []testMessage{
+			{"Re: Hello", "<b>", nil},
+			{"Hello", "<a>", nil},
+		}, "(2 1)"},
+		{"empty subjects aren't joined", []testMessage{
+			{"", "<a>", nil},
+			{"Re:", "<b>", nil},
+		}, "(1)(2)"},
+		{"no message id", []testMessage{
+			{"One", "", nil},
+			{"Two", "", nil},
+		}, "(1)(2)"},
+		{"duplicate message id", []testMessage{
+			{"One", "<a>", nil},
+			{"Two", "<a>", nil},
+		}, "(1)(2)"},
+		{"loop", []testMessage{
+			{"One", "<a>", []string{"<b>"}},
+			{"Two", "<b>", []string{"<a>"}},
+		}, "(2 1)"},
+		{"refers to itself", []testMessage{
+			{"One", "<a>", []string{"<a>"}},
+		}, "(1)"},
+	}
+	for _, test := range tests {
+		if got := formatThreads(referencesThreads(threadTestMessages(test.msgs...))); got != test.expected {
+			t.Errorf("%v: got %v, expected %v", test.name, got, test.expected)
+		}
+	}
+}
+
+func TestOrderedSubjectThreads(t *testing.T) {
+	msgs := threadTestMessages(
+		testMessage{subject: "Hello"},
+		testMessage{subject: "Other"},
+		testMessage{subject: "Re: Hello"},
+		testMessage{subject: "[list] Fwd: hello"},
+		testMessage{subject: "Re: Other"},
+	)
+	if got := formatThreads(orderedSubjectThreads(msgs)); got != "(1 (3)(4))(2 5)" {
+		t.Errorf("got %v", got)
+	}
+}
+
+func TestFormatThreads(t *testing.T) {
+	msgs := threadTestMessages(testMessage{}, testMessage{}, testMessage{}, testMessage{}, testMessage{})
+	node := func(i int, children ...*threadNode) *threadNode {
+		n := &threadNode{}
+		if i > 0 {
+			n.msg = msgs[i-1]
+		}
+		for _, child := range children {
+			child.setParent(n)
+		}
+		return n
+	}
+	// Like the example in RFC 5256 section 4
+	threads := []*threadNode{node(1), node(2, node(3, node(4), node(5)))}
+	if got := formatThreads(threads); got != "(1)(2 3 (4)(5))" {
+		t.Errorf("got %v", got)
+	}
+	// A thread whose first message is missing
+	if got := formatThreads([]*threadNode{node(0, node(1), node(2, node(3)))}); got != "((1)(2 3))" {
+		t.Errorf("got %v", got)
+	}
+}
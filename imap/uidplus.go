@@ -0,0 +1,209 @@
+package imap
+
+import (
+	"errors"
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/commands"
+	"github.com/emersion/go-imap/server"
+	"henrymail/logic"
+)
+
+/**
+ * UIDPLUS from RFC 4315, which tells clients the UIDs of messages they've
+ * appended or copied so they don't have to resynchronise to find out,
+ * and MOVE from RFC 6851.
+ */
+type uidplusExtension struct{}
+
+func (uidplusExtension) Capabilities(c server.Conn) []string {
+	return []string{"UIDPLUS", "MOVE"}
+}
+
+func (uidplusExtension) Command(name string) server.HandlerFactory {
+	switch name {
+	case "APPEND":
+		return func() server.Handler { return &appendHandler{} }
+	case "COPY":
+		return func() server.Handler { return &copyHandler{} }
+	case "MOVE":
+		return func() server.Handler { return &moveHandler{} }
+	case "EXPUNGE":
+		return func() server.Handler { return &expungeHandler{} }
+	}
+	return nil
+}
+
+/**
+ * Adds the response codes that tell clients why a message couldn't be
+ * stored: TRYCREATE from RFC 3501, or OVERQUOTA from RFC 9208
+ */
+func storeFailure(e error) error {
+	var code imap.StatusRespCode
+	switch e {
+	case backend.ErrNoSuchMailbox:
+		code = imap.CodeTryCreate
+	case logic.ErrOverQuota, logic.ErrMessageExceedsQuota:
+		code = codeOverQuota
+	default:
+		return e
+	}
+	return server.ErrStatusResp(&imap.StatusResp{
+		Type: imap.StatusRespNo,
+		Code: code,
+		Info: e.Error(),
+	})
+}
+
+type appendHandler struct {
+	commands.Append
+}
+
+func (h *appendHandler) Handle(conn server.Conn) error {
+	ctx := conn.Context()
+	if ctx.User == nil {
+		return server.ErrNotAuthenticated
+	}
+	mbox, e := ctx.User.GetMailbox(h.Mailbox)
+	if e != nil {
+		return storeFailure(e)
+	}
+	uidValidity, uid, e := mbox.(*imapMailbox).createMessage(h.Flags, h.Date, h.Message)
+	if e != nil {
+		return storeFailure(e)
+	}
+	return server.ErrStatusResp(&imap.StatusResp{
+		Type:      imap.StatusRespOk,
+		Code:      "APPENDUID",
+		Arguments: []interface{}{uidValidity, uid},
+		Info:      "APPEND completed",
+	})
+}
+
+func (c *copyUids) code() (imap.StatusRespCode, []interface{}) {
+	source, dest := &imap.SeqSet{}, &imap.SeqSet{}
+	source.AddNum(c.source...)
+	dest.AddNum(c.dest...)
+	return "COPYUID", []interface{}{c.uidValidity, source, dest}
+}
+
+type copyHandler struct {
+	commands.Copy
+}
+
+func (h *copyHandler) handle(uid bool, conn server.Conn) error {
+	ctx := conn.Context()
+	if ctx.Mailbox == nil {
+		return server.ErrNoMailboxSelected
+	}
+	copied, e := ctx.Mailbox.(*imapMailbox).copy(uid, h.SeqSet, h.Mailbox)
+	if e != nil {
+		return storeFailure(e)
+	}
+	if len(copied.source) == 0 {
+		return nil
+	}
+	code, args := copied.code()
+	return server.ErrStatusResp(&imap.StatusResp{
+		Type:      imap.StatusRespOk,
+		Code:      code,
+		Arguments: args,
+		Info:      "COPY completed",
+	})
+}
+
+func (h *copyHandler) Handle(conn server.Conn) error {
+	return h.handle(false, conn)
+}
+
+func (h *copyHandler) UidHandle(conn server.Conn) error {
+	return h.handle(true, conn)
+}
+
+type moveHandler struct {
+	commands.Copy
+}
+
+func (h *moveHandler) handle(uid bool, conn server.Conn) error {
+	ctx := conn.Context()
+	if ctx.Mailbox == nil {
+		return server.ErrNoMailboxSelected
+	}
+	if ctx.MailboxReadOnly {
+		return server.ErrMailboxReadOnly
+	}
+	mailbox := ctx.Mailbox.(*imapMailbox)
+	copied, changes, e := mailbox.move(uid, h.SeqSet, h.Mailbox)
+	if e != nil {
+		return storeFailure(e)
+	}
+	// COPYUID comes before the EXPUNGE responses, see RFC 6851 section 4.3
+	if len(copied.source) > 0 {
+		code, args := copied.code()
+		e = conn.WriteResp(&imap.StatusResp{
+			Type:      imap.StatusRespOk,
+			Code:      code,
+			Arguments: args,
+			Info:      "Moved",
+		})
+		if e != nil {
+			return e
+		}
+	}
+	mailbox.user.publish(changes...)
+	return nil
+}
+
+func (h *moveHandler) Handle(conn server.Conn) error {
+	return h.handle(false, conn)
+}
+
+func (h *moveHandler) UidHandle(conn server.Conn) error {
+	return h.handle(true, conn)
+}
+
+/**
+ * Also replaces the built in EXPUNGE, which sends its own responses
+ * when those from subscribeUpdates are all that's needed
+ */
+type expungeHandler struct {
+	uids *imap.SeqSet // Only given with UID EXPUNGE
+}
+
+func (h *expungeHandler) Parse(fields []interface{}) error {
+	if len(fields) == 0 {
+		return nil
+	}
+	set, ok := fields[0].(string)
+	if !ok {
+		return errors.New("invalid sequence set")
+	}
+	var e error
+	h.uids, e = imap.ParseSeqSet(set)
+	return e
+}
+
+func (h *expungeHandler) Handle(conn server.Conn) error {
+	if h.uids != nil {
+		return errors.New("only UID EXPUNGE takes a sequence set")
+	}
+	return h.handle(conn)
+}
+
+func (h *expungeHandler) UidHandle(conn server.Conn) error {
+	if h.uids == nil {
+		return errors.New("UID EXPUNGE needs a sequence set")
+	}
+	return h.handle(conn)
+}
+
+func (h *expungeHandler) handle(conn server.Conn) error {
+	ctx := conn.Context()
+	if ctx.Mailbox == nil {
+		return server.ErrNoMailboxSelected
+	}
+	if ctx.MailboxReadOnly {
+		return server.ErrMailboxReadOnly
+	}
+	return ctx.Mailbox.(*imapMailbox).expunge(h.uids)
+}
@@ -0,0 +1,233 @@
+package logic
+
+import (
+	"database/sql"
+	"errors"
+	"henrymail/models"
+	"sort"
+	"strings"
+)
+
+/**
+ * Access control lists for mailboxes, with the rights from RFC 4314. A
+ * user always has every right on their own mailboxes, and other users
+ * have the rights they've been granted.
+ */
+
+const (
+	RightLookup         = "l"
+	RightRead           = "r"
+	RightSeen           = "s"
+	RightWrite          = "w"
+	RightInsert         = "i"
+	RightPost           = "p"
+	RightCreate         = "k"
+	RightDelete         = "x"
+	RightDeleteMessages = "t"
+	RightExpunge        = "e"
+	RightAdmin          = "a"
+
+	AllRights = "lrswipkxtea"
+)
+
+var (
+	ErrNoRights          = errors.New("permission denied")
+	ErrInvalidRights     = errors.New("unknown rights")
+	ErrOwnerRights       = errors.New("the owner's rights can't be changed")
+	ErrUnknownIdentifier = errors.New("no such user")
+)
+
+/**
+ * The rights in their usual order, without duplicates. The obsolete
+ * rights from RFC 2086 are turned into the ones that replaced them.
+ */
+func CanonicalRights(rights string) (string, error) {
+	rights = strings.NewReplacer("c", RightCreate, "d", RightDelete+RightDeleteMessages+RightExpunge).Replace(rights)
+	var canonical strings.Builder
+	for _, right := range AllRights {
+		if strings.ContainsRune(rights, right) {
+			canonical.WriteRune(right)
+		}
+	}
+	for _, right := range rights {
+		if !strings.ContainsRune(AllRights, right) {
+			return "", ErrInvalidRights
+		}
+	}
+	return canonical.String(), nil
+}
+
+/**
+ * True if the rights include all of the needed ones
+ */
+func HasRights(rights, needed string) bool {
+	for _, right := range needed {
+		if !strings.ContainsRune(rights, right) {
+			return false
+		}
+	}
+	return true
+}
+
+/**
+ * The rights the user has on the mailbox
+ */
+func Rights(db models.XODB, mailbox *models.Mailbox, userid int) (string, error) {
+	if mailbox.Userid == userid {
+		return AllRights, nil
+	}
+	acl, e := models.ACLByMailboxidUserid(db, mailbox.ID, userid)
+	if e == sql.ErrNoRows {
+		return "", nil
+	}
+	if e != nil {
+		return "", e
+	}
+	return acl.Rights, nil
+}
+
+/**
+ * Replaces the rights granted to the user, or adds or takes away some of
+ * them if the rights start with + or -. Empty rights take them all away.
+ */
+func SetRights(db models.XODB, mailbox *models.Mailbox, username, rights string) error {
+	grantee, e := models.UserByUsername(db, QualifyUsername(username))
+	if e == sql.ErrNoRows {
+		return ErrUnknownIdentifier
+	} else if e != nil {
+		return e
+	}
+	if grantee.ID == mailbox.Userid {
+		return ErrOwnerRights
+	}
+	acl, e := models.ACLByMailboxidUserid(db, mailbox.ID, grantee.ID)
+	if e == sql.ErrNoRows {
+		acl = &models.ACL{Mailboxid: mailbox.ID, Userid: grantee.ID, Subscribed: true}
+	} else if e != nil {
+		return e
+	}
+	switch {
+	case strings.HasPrefix(rights, "+"):
+		rights = acl.Rights + rights[1:]
+	case strings.HasPrefix(rights, "-"):
+		removed, e := CanonicalRights(rights[1:])
+		if e != nil {
+			return e
+		}
+		rights = strings.Map(func(r rune) rune {
+			if strings.ContainsRune(removed, r) {
+				return -1
+			}
+			return r
+		}, acl.Rights)
+	}
+	rights, e = CanonicalRights(rights)
+	if e != nil {
+		return e
+	}
+	if rights == "" && !acl.Exists() {
+		return nil
+	}
+	if rights == "" {
+		return acl.Delete(db)
+	}
+	acl.Rights = rights
+	return acl.Save(db)
+}
+
+type ACLEntry struct {
+	Username string
+	Rights   string
+}
+
+/**
+ * Everyone with rights on the mailbox, starting with its owner
+ */
+func MailboxACL(db models.XODB, mailbox *models.Mailbox) ([]ACLEntry, error) {
+	owner, e := models.UserByID(db, mailbox.Userid)
+	if e != nil {
+		return nil, e
+	}
+	rows, e := db.Query(`SELECT users.username, acls.rights FROM acls, users
+		WHERE acls.mailboxid = ? AND acls.userid = users.id`, mailbox.ID)
+	if e != nil {
+		return nil, e
+	}
+	defer rows.Close()
+	var entries []ACLEntry
+	for rows.Next() {
+		var entry ACLEntry
+		e = rows.Scan(&entry.Username, &entry.Rights)
+		if e != nil {
+			return nil, e
+		}
+		entries = append(entries, entry)
+	}
+	if e = rows.Err(); e != nil {
+		return nil, e
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Username < entries[j].Username
+	})
+	return append([]ACLEntry{{owner.Username, AllRights}}, entries...), nil
+}
+
+/**
+ * Another user's mailbox, as someone it's been shared with sees it
+ */
+type SharedMailbox struct {
+	*models.Mailbox
+	Owner string
+	ACL   *models.ACL
+}
+
+/**
+ * Other users' mailboxes which the user can see
+ */
+func SharedMailboxes(db models.XODB, userid int) ([]SharedMailbox, error) {
+	acls, e := models.ACLsByUserid(db, userid)
+	if e != nil {
+		return nil, e
+	}
+	var shared []SharedMailbox
+	owners := map[int]string{}
+	for _, acl := range acls {
+		if !HasRights(acl.Rights, RightLookup) {
+			continue
+		}
+		mailbox, e := models.MailboxByID(db, acl.Mailboxid)
+		if e == sql.ErrNoRows {
+			continue
+		} else if e != nil {
+			return nil, e
+		}
+		if _, ok := owners[mailbox.Userid]; !ok {
+			owner, e := models.UserByID(db, mailbox.Userid)
+			if e != nil {
+				return nil, e
+			}
+			owners[mailbox.Userid] = owner.Username
+		}
+		shared = append(shared, SharedMailbox{mailbox, owners[mailbox.Userid], acl})
+	}
+	return shared, nil
+}
+
+/**
+ * A new mailbox gets the rights granted on the one above it
+ */
+func inheritACL(db models.XODB, parent, mailbox *models.Mailbox) error {
+	_, e := db.Exec(`INSERT INTO acls (mailboxid, userid, rights, subscribed)
+		SELECT ?, userid, rights, subscribed FROM acls WHERE mailboxid = ?`, mailbox.ID, parent.ID)
+	return e
+}
+
+/**
+ * Takes away everything granted to the user, and everything they've
+ * granted on their own mailboxes, when they're deleted
+ */
+func RemoveGrants(db models.XODB, userid int) error {
+	_, e := db.Exec(`DELETE FROM acls WHERE userid = ?
+		OR mailboxid IN (SELECT id FROM mailboxes WHERE userid = ?)`, userid, userid)
+	return e
+}
@@ -0,0 +1,38 @@
+package logic
+
+import (
+	"testing"
+)
+
+func TestCanonicalRights(t *testing.T) {
+	tests := []struct {
+		rights, canonical string
+	}{
+		{"", ""},
+		{"lr", "lr"},
+		{"rl", "lr"},
+		{"aetxkpiwsrl", AllRights},
+		{"llrr", "lr"},
+		// The obsolete rights from RFC 2086
+		{"c", "k"},
+		{"d", "xte"},
+		{"lrcd", "lrkxte"},
+		{"cdk", "kxte"},
+	}
+	for _, test := range tests {
+		if canonical, e := CanonicalRights(test.rights); e != nil || canonical != test.canonical {
+			t.Errorf("CanonicalRights(%q) = %q %v, expected %q", test.rights, canonical, e, test.canonical)
+		}
+	}
+	for _, bad := range []string{"lrq", "L", "+l", " "} {
+		if _, e := CanonicalRights(bad); e != ErrInvalidRights {
+			t.Errorf("CanonicalRights(%q) should have failed, got %v", bad, e)
+		}
+	}
+}
+
+func TestHasRights(t *testing.T) {
+	if !HasRights("lrs", "") || !HasRights("lrs", "sl") || HasRights("lrs", "lw") || HasRights("", RightLookup) {
+		t.Error("HasRights got it wrong")
+	}
+}
@@ -0,0 +1,229 @@
+package logic
+
+import (
+	"database/sql"
+	"errors"
+	"henrymail/models"
+	"log"
+	"net/mail"
+	"strings"
+)
+
+/**
+ * Aliases send mail for an address on to one or more other addresses,
+ * which can be our own users or addresses on other servers. An alias
+ * for @example.com catches mail for any address there that doesn't exist.
+ */
+
+// Aliases pointing at aliases are followed this deep, and no deeper
+const maxAliasDepth = 10
+
+var (
+	ErrInvalidAlias = errors.New("aliases must be for an address at one of our domains, or @ and the domain for a catch-all")
+	ErrAliasExists  = errors.New("that alias already exists")
+)
+
+/**
+ * Somewhere mail for an address should be delivered
+ */
+type Destination struct {
+	Address string
+	User    *models.User // Nil for addresses on other servers
+}
+
+/**
+ * Works out where mail for an address should go, following aliases
+ */
+func ExpandAddress(db models.XODB, emailaddress string) ([]*Destination, error) {
+	_, domain := SplitAddress(emailaddress)
+	if domain != "" {
+		local, e := IsLocalDomain(db, domain)
+		if e != nil {
+			return nil, e
+		}
+		if !local {
+			return nil, ErrForeignDomain
+		}
+	}
+	var destinations []*Destination
+	e := expand(db, emailaddress, 0, make(map[string]bool), &destinations)
+	if e != nil {
+		return nil, e
+	}
+	if len(destinations) == 0 {
+		return nil, ErrUnknownRecipient
+	}
+	return destinations, nil
+}
+
+func expand(db models.XODB, emailaddress string, depth int, seen map[string]bool, destinations *[]*Destination) error {
+	key := strings.ToLower(emailaddress)
+	if seen[key] || depth > maxAliasDepth {
+		return nil
+	}
+	seen[key] = true
+
+	localPart, domain := SplitAddress(emailaddress)
+	if domain != "" {
+		local, e := IsLocalDomain(db, domain)
+		if e != nil {
+			return e
+		}
+		if !local {
+			*destinations = append(*destinations, &Destination{Address: emailaddress})
+			return nil
+		}
+	}
+
+	aliases, e := models.AliasesByAddress(db, key)
+	if e != nil {
+		return e
+	}
+	if len(aliases) == 0 {
+		user, e := FindRecipient(db, emailaddress)
+		if e == nil {
+			// Several addresses can lead to the same user, they only need one copy
+			for _, d := range *destinations {
+				if d.User != nil && d.User.ID == user.ID {
+					return nil
+				}
+			}
+			*destinations = append(*destinations, &Destination{Address: emailaddress, User: user})
+			return nil
+		}
+		if e != ErrUnknownRecipient {
+			return e
+		}
+		// Subaddresses of aliases go wherever the alias does
+		if base, tag := SplitSubaddress(localPart); tag != "" && domain != "" {
+			aliases, e = models.AliasesByAddress(db, strings.ToLower(base+"@"+domain))
+			if e != nil {
+				return e
+			}
+		}
+		if len(aliases) == 0 && domain != "" {
+			aliases, e = models.AliasesByAddress(db, "@"+strings.ToLower(domain))
+			if e != nil {
+				return e
+			}
+		}
+	}
+	for _, alias := range aliases {
+		e = expand(db, alias.Destination, depth+1, seen, destinations)
+		if e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+func AddAlias(db models.XODB, address, destination string) error {
+	address = strings.ToLower(strings.TrimSpace(address))
+	localPart, domain := SplitAddress(address)
+	local, e := IsLocalDomain(db, domain)
+	if e != nil {
+		return e
+	}
+	if !local || strings.ContainsAny(localPart, " <>") {
+		return ErrInvalidAlias
+	}
+	parsed, e := mail.ParseAddress(strings.TrimSpace(destination))
+	if e != nil {
+		return e
+	}
+	destination = parsed.Address
+	// Catch typos in our own addresses now, rather than losing mail later
+	_, destinationDomain := SplitAddress(destination)
+	local, e = IsLocalDomain(db, destinationDomain)
+	if e != nil {
+		return e
+	}
+	if local {
+		_, e = ExpandAddress(db, destination)
+		if e != nil {
+			return e
+		}
+	}
+	_, e = models.AliasByAddressDestination(db, address, destination)
+	if e == nil {
+		return ErrAliasExists
+	} else if e != sql.ErrNoRows {
+		return e
+	}
+	alias := &models.Alias{
+		Address:     address,
+		Destination: destination,
+	}
+	return alias.Save(db)
+}
+
+func DeleteAlias(db models.XODB, id int) error {
+	alias, e := models.AliasByID(db, id)
+	if e != nil {
+		return e
+	}
+	return alias.Delete(db)
+}
+
+/**
+ * The aliases which deliver to a user, including through other aliases
+ */
+func AliasesForUser(db models.XODB, user *models.User) ([]*models.Alias, error) {
+	aliases, e := models.GetAllAlias(db)
+	if e != nil {
+		return nil, e
+	}
+	var theirs []*models.Alias
+	seen := make(map[string]bool)
+	for _, alias := range aliases {
+		// Aliases with several destinations have a row for each
+		if seen[alias.Address] {
+			continue
+		}
+		seen[alias.Address] = true
+		destinations, e := ExpandAddress(db, alias.Address)
+		if e != nil {
+			log.Printf("Alias %v doesn't go anywhere: %v", alias.Address, e)
+			continue
+		}
+		for _, d := range destinations {
+			if d.User != nil && d.User.ID == user.ID {
+				theirs = append(theirs, alias)
+				break
+			}
+		}
+	}
+	return theirs, nil
+}
+
+/**
+ * Whether the user can send from the address: their own, a subaddress of
+ * it, or an alias which delivers to them. Catch-all aliases don't count,
+ * or they could send as anyone at the domain.
+ */
+func MaySendAs(db models.XODB, userid int, address string) (bool, error) {
+	user, e := FindRecipient(db, address)
+	switch e {
+	case nil:
+		return user.ID == userid, nil
+	case ErrForeignDomain:
+		return false, nil
+	case ErrUnknownRecipient:
+	default:
+		return false, e
+	}
+	aliases, e := models.AliasesByAddress(db, strings.ToLower(address))
+	if e != nil || len(aliases) == 0 {
+		return false, e
+	}
+	destinations, e := ExpandAddress(db, address)
+	if e != nil {
+		return false, e
+	}
+	for _, d := range destinations {
+		if d.User != nil && d.User.ID == userid {
+			return true, nil
+		}
+	}
+	return false, nil
+}
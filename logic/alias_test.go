@@ -0,0 +1,47 @@
+package logic
+
+import (
+	"github.com/spf13/viper"
+	"henrymail/config"
+	"testing"
+)
+
+func TestMaySendAs(t *testing.T) {
+	viper.Set(config.SubaddressSeparator, "+")
+	db := testDb(t)
+	defer db.Close()
+	for _, statement := range []string{
+		"INSERT INTO domains (name, dkimkey) VALUES ('example.com', ''), ('example.org', '')",
+		"INSERT INTO users (id, username, passwordBytes, admin) VALUES (2, 'carol@example.org', '', 0)",
+		`INSERT INTO aliases (address, destination) VALUES ('sales@example.com', 'bob@example.com'),
+			('team@example.org', 'carol@example.org'), ('team@example.org', 'bob@example.com'),
+			('help@example.org', 'someone@elsewhere.example'), ('@example.com', 'bob@example.com')`,
+	} {
+		_, e := db.Exec(statement)
+		if e != nil {
+			t.Fatal(e)
+		}
+	}
+	tests := []struct {
+		address string
+		may     bool
+	}{
+		{"bob@example.com", true},
+		{"bob@Example.COM", true},
+		{"bob+lists@example.com", true},
+		{"sales@example.com", true},
+		{"team@example.org", true},
+		{"carol@example.org", false},
+		{"help@example.org", false},
+		// Only the catch-all delivers it to bob
+		{"anyone@example.com", false},
+		{"bob@elsewhere.example", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		may, e := MaySendAs(db, 1, test.address)
+		if e != nil || may != test.may {
+			t.Errorf("MaySendAs(%q) = %v %v, expected %v", test.address, may, e, test.may)
+		}
+	}
+}
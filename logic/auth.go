@@ -13,7 +13,7 @@ import (
  * User administration functions
  */
 func Login(db *sql.DB, username, password string) (*models.User, error) {
-	user, e := models.UserByUsername(db, username)
+	user, e := models.UserByUsername(db, QualifyUsername(username))
 	if e != nil {
 		return nil, e
 	}
@@ -25,6 +25,18 @@ func Login(db *sql.DB, username, password string) (*models.User, error) {
 }
 
 func NewUser(db *sql.DB, username, password string, admin bool) (*models.User, error) {
+	username = QualifyUsername(username)
+	localPart, domain := SplitAddress(username)
+	if localPart == "" {
+		return nil, errors.New("You must enter a username")
+	}
+	local, e := IsLocalDomain(db, domain)
+	if e != nil {
+		return nil, e
+	}
+	if !local {
+		return nil, ErrForeignDomain
+	}
 	passwordBytes, e := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if e != nil {
 		return nil, e
@@ -42,13 +54,11 @@ func NewUser(db *sql.DB, username, password string, admin bool) (*models.User, e
 
 		defaultMailboxes := config.GetStringSlice(config.DefaultMailboxes)
 		for _, name := range defaultMailboxes {
-			mailbox := &models.Mailbox{
-				Userid:      user.ID,
-				Uidnext:     1,
-				Uidvalidity: 1,
-				Subscribed:  true,
-				Name:        name,
+			mailbox, e := CreateMailbox(tx, user.ID, name)
+			if e != nil {
+				return e
 			}
+			mailbox.Specialuse = SpecialUseByName(name)
 			e = mailbox.Save(tx)
 			if e != nil {
 				return e
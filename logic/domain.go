@@ -0,0 +1,155 @@
+package logic
+
+import (
+	"database/sql"
+	"errors"
+	"henrymail/config"
+	"henrymail/database"
+	"henrymail/dkim"
+	"henrymail/models"
+	"log"
+	"strings"
+)
+
+/**
+ * The domains we host mail for. Usernames are full addresses at one of
+ * them; the configured Domain is the first, and logging in without
+ * a domain means that one.
+ */
+
+var (
+	ErrInvalidDomain = errors.New("invalid domain name")
+	ErrDomainExists  = errors.New("that domain is already hosted here")
+	ErrDomainInUse   = errors.New("the domain still has users, delete them first")
+	ErrPrimaryDomain = errors.New("the domain from the configuration can't be deleted")
+)
+
+func FindDomain(db models.XODB, name string) (*models.Domain, error) {
+	return models.DomainByName(db, strings.ToLower(name))
+}
+
+func IsLocalDomain(db models.XODB, name string) (bool, error) {
+	_, e := FindDomain(db, name)
+	if e == sql.ErrNoRows {
+		return false, nil
+	}
+	return e == nil, e
+}
+
+func AddDomain(db models.XODB, name, selector string) (*models.Domain, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "" || strings.ContainsAny(name, "@ /") || !strings.Contains(name, ".") {
+		return nil, ErrInvalidDomain
+	}
+	if selector == "" {
+		selector = dkim.DefaultSelector
+	}
+	_, e := FindDomain(db, name)
+	if e == nil {
+		return nil, ErrDomainExists
+	} else if e != sql.ErrNoRows {
+		return nil, e
+	}
+	key, e := dkim.NewKey()
+	if e != nil {
+		return nil, e
+	}
+	domain := &models.Domain{
+		Name:         name,
+		Dkimselector: selector,
+		Dkimkey:      key,
+	}
+	return domain, domain.Save(db)
+}
+
+/**
+ * Removes a domain which has no users left, along with its aliases
+ */
+func DeleteDomain(db *sql.DB, id int) error {
+	return database.Transact(db, func(tx *sql.Tx) error {
+		domain, e := models.DomainByID(tx, id)
+		if e != nil {
+			return e
+		}
+		if domain.Name == strings.ToLower(config.GetString(config.Domain)) {
+			return ErrPrimaryDomain
+		}
+		users, e := models.GetAllUser(tx)
+		if e != nil {
+			return e
+		}
+		for _, u := range users {
+			if _, d := SplitAddress(u.Username); d == domain.Name {
+				return ErrDomainInUse
+			}
+		}
+		aliases, e := models.GetAllAlias(tx)
+		if e != nil {
+			return e
+		}
+		for _, a := range aliases {
+			if _, d := SplitAddress(a.Address); d == domain.Name {
+				e = a.Delete(tx)
+				if e != nil {
+					return e
+				}
+			}
+		}
+		return domain.Delete(tx)
+	})
+}
+
+/**
+ * Usernames without a domain are at the configured one
+ */
+func QualifyUsername(username string) string {
+	localPart, domain := SplitAddress(username)
+	if domain == "" {
+		domain = config.GetString(config.Domain)
+	}
+	return localPart + "@" + strings.ToLower(domain)
+}
+
+/**
+ * Makes sure the configured domain is hosted, and moves users from before
+ * there were domains to it. Safe to run every time we start.
+ */
+func SetupDomains(db *sql.DB) error {
+	legacyKey := dkim.LegacyKey(db)
+	return database.Transact(db, func(tx *sql.Tx) error {
+		name := config.GetString(config.Domain)
+		_, e := FindDomain(tx, name)
+		if e == sql.ErrNoRows {
+			domain, e := AddDomain(tx, name, dkim.DefaultSelector)
+			if e != nil {
+				return e
+			}
+			// Keep the key that's already published, if there is one
+			if legacyKey != nil {
+				domain.Dkimkey = legacyKey
+				e = domain.Save(tx)
+			}
+			if e != nil {
+				return e
+			}
+		} else if e != nil {
+			return e
+		}
+
+		users, e := models.GetAllUser(tx)
+		if e != nil {
+			return e
+		}
+		for _, u := range users {
+			if !strings.Contains(u.Username, "@") {
+				log.Printf("Moving user %v to %v", u.Username, name)
+				u.Username = QualifyUsername(u.Username)
+				e = u.Save(tx)
+				if e != nil {
+					return e
+				}
+			}
+		}
+		return nil
+	})
+}
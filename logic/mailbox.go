@@ -0,0 +1,376 @@
+package logic
+
+import (
+	"database/sql"
+	"errors"
+	"github.com/emersion/go-imap"
+	"henrymail/models"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+/**
+ * Mailboxes form a hierarchy, with names like "Archive/2019". Every level
+ * above a mailbox exists too, if only as a \Noselect placeholder left
+ * behind when a mailbox with children is deleted.
+ */
+
+const MailboxDelimiter = "/"
+
+var (
+	ErrMailboxExists      = errors.New("mailbox already exists")
+	ErrNoSuchMailbox      = errors.New("no such mailbox")
+	ErrInvalidMailboxName = errors.New("invalid mailbox name")
+	ErrDeleteInbox        = errors.New("the inbox can't be deleted")
+	ErrHasChildren        = errors.New("mailbox has children, delete them first")
+	ErrNoselect           = errors.New("mailbox can't be selected, it only holds other mailboxes")
+	ErrRenameIntoItself   = errors.New("a mailbox can't be moved inside itself")
+)
+
+/**
+ * A mailbox that's ready to save. Each gets a UIDVALIDITY greater than any
+ * the user has had before, so a name that's used again doesn't reuse the
+ * old UIDs, even if it's within the same second.
+ */
+func newMailbox(db models.XODB, userid int, name string) (*models.Mailbox, error) {
+	uidValidity, e := nextUidValidity(db, userid)
+	if e != nil {
+		return nil, e
+	}
+	return &models.Mailbox{
+		Userid:         userid,
+		Name:           name,
+		Uidnext:        1,
+		Uidvalidity:    uidValidity,
+		Highestmodseq:  1,
+		Subscribed:     true,
+		Firstrecentuid: 1,
+	}, nil
+}
+
+// Never less than the time, which is all older versions used
+func nextUidValidity(db models.XODB, userid int) (int, error) {
+	_, e := db.Exec("UPDATE users SET lastuidvalidity = max(lastuidvalidity + 1, ?) WHERE id = ?",
+		int(uint32(time.Now().Unix())), userid)
+	if e != nil {
+		return 0, e
+	}
+	var uidValidity int
+	e = db.QueryRow("SELECT lastuidvalidity FROM users WHERE id = ?", userid).Scan(&uidValidity)
+	return uidValidity, e
+}
+
+/**
+ * Canonical, and without the trailing delimiter which clients may send
+ * to say they want to put mailboxes inside it
+ */
+func cleanMailboxName(name string) (string, error) {
+	name = strings.TrimSuffix(name, MailboxDelimiter)
+	if name == "" || !utf8.ValidString(name) {
+		return "", ErrInvalidMailboxName
+	}
+	for _, level := range strings.Split(name, MailboxDelimiter) {
+		if level == "" {
+			return "", ErrInvalidMailboxName
+		}
+	}
+	if strings.EqualFold(name, imap.InboxName) {
+		return imap.InboxName, nil
+	}
+	return name, nil
+}
+
+/**
+ * The names above this one, from the top
+ */
+func parentNames(name string) []string {
+	var parents []string
+	for ix := strings.Index(name, MailboxDelimiter); ix >= 0; {
+		parents = append(parents, name[:ix])
+		next := strings.Index(name[ix+1:], MailboxDelimiter)
+		if next < 0 {
+			break
+		}
+		ix += next + 1
+	}
+	return parents
+}
+
+/**
+ * The name of the mailbox above this one, or "" if it's at the top
+ */
+func ParentName(name string) string {
+	parents := parentNames(name)
+	if len(parents) == 0 {
+		return ""
+	}
+	return parents[len(parents)-1]
+}
+
+/**
+ * Creates the mailbox, and any above it that don't exist yet. Creating a
+ * \Noselect mailbox makes it a real one again.
+ */
+func CreateMailbox(db models.XODB, userid int, name string) (*models.Mailbox, error) {
+	name, e := cleanMailboxName(name)
+	if e != nil {
+		return nil, e
+	}
+	e = createParents(db, userid, name)
+	if e != nil {
+		return nil, e
+	}
+	return createMailbox(db, userid, name)
+}
+
+func createParents(db models.XODB, userid int, name string) error {
+	for _, parent := range parentNames(name) {
+		_, e := models.MailboxByUseridName(db, userid, parent)
+		if e == sql.ErrNoRows {
+			_, e = createMailbox(db, userid, parent)
+		}
+		if e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+func createMailbox(db models.XODB, userid int, name string) (*models.Mailbox, error) {
+	existing, e := models.MailboxByUseridName(db, userid, name)
+	if e == nil && !existing.Noselect {
+		return nil, ErrMailboxExists
+	} else if e != nil && e != sql.ErrNoRows {
+		return nil, e
+	}
+	mailbox, e := newMailbox(db, userid, name)
+	if e != nil {
+		return nil, e
+	}
+	if existing != nil {
+		existing.Noselect = false
+		existing.Uidvalidity = mailbox.Uidvalidity
+		return existing, existing.Save(db)
+	}
+	e = mailbox.Save(db)
+	if e != nil {
+		return nil, e
+	}
+	if parentName := ParentName(name); parentName != "" {
+		parent, e := models.MailboxByUseridName(db, userid, parentName)
+		if e != nil {
+			return nil, e
+		}
+		e = inheritACL(db, parent, mailbox)
+		if e != nil {
+			return nil, e
+		}
+	}
+	return mailbox, nil
+}
+
+/**
+ * The mailboxes below this one, at any level
+ */
+func ChildMailboxes(db models.XODB, mailbox *models.Mailbox) ([]*models.Mailbox, error) {
+	mailboxes, e := models.MailboxesByUserid(db, mailbox.Userid)
+	if e != nil {
+		return nil, e
+	}
+	var children []*models.Mailbox
+	for _, child := range mailboxes {
+		if strings.HasPrefix(child.Name, mailbox.Name+MailboxDelimiter) {
+			children = append(children, child)
+		}
+	}
+	return children, nil
+}
+
+func HasChildren(db models.XODB, mailbox *models.Mailbox) (bool, error) {
+	prefix := mailbox.Name + MailboxDelimiter
+	var count int
+	// substr counts characters, not bytes
+	e := db.QueryRow("SELECT count(*) FROM mailboxes WHERE userid = ? AND substr(name, 1, ?) = ?",
+		mailbox.Userid, utf8.RuneCountInString(prefix), prefix).Scan(&count)
+	return count > 0, e
+}
+
+/**
+ * A mailbox with children loses its messages and becomes \Noselect, as
+ * RFC 3501 says. The INBOX can't be deleted.
+ */
+func DeleteMailbox(tx *sql.Tx, userid int, name string) error {
+	mailbox, e := models.MailboxByUseridName(tx, userid, name)
+	if e == sql.ErrNoRows {
+		return ErrNoSuchMailbox
+	} else if e != nil {
+		return e
+	}
+	if mailbox.Name == imap.InboxName {
+		return ErrDeleteInbox
+	}
+	hasChildren, e := HasChildren(tx, mailbox)
+	if e != nil {
+		return e
+	}
+	if hasChildren && mailbox.Noselect {
+		return ErrHasChildren
+	}
+	// Foreign keys are only enforced on the connection that created the schema
+	_, e = tx.Exec("DELETE FROM messages WHERE mailboxid = ?", mailbox.ID)
+	if e != nil {
+		return e
+	}
+	_, e = tx.Exec("DELETE FROM expunges WHERE mailboxid = ?", mailbox.ID)
+	if e != nil {
+		return e
+	}
+	if hasChildren {
+		mailbox.Noselect = true
+		mailbox.Specialuse = ""
+		return mailbox.Save(tx)
+	}
+	_, e = tx.Exec("DELETE FROM acls WHERE mailboxid = ?", mailbox.ID)
+	if e != nil {
+		return e
+	}
+	e = mailbox.Delete(tx)
+	if e != nil {
+		return e
+	}
+	return removeEmptyParents(tx, userid, name)
+}
+
+/**
+ * \Noselect mailboxes are only there for their children, so they go
+ * when the last one does
+ */
+func removeEmptyParents(tx *sql.Tx, userid int, name string) error {
+	parents := parentNames(name)
+	for i := len(parents) - 1; i >= 0; i-- {
+		parent, e := models.MailboxByUseridName(tx, userid, parents[i])
+		if e == sql.ErrNoRows {
+			continue
+		} else if e != nil {
+			return e
+		}
+		if !parent.Noselect {
+			return nil
+		}
+		hasChildren, e := HasChildren(tx, parent)
+		if e != nil || hasChildren {
+			return e
+		}
+		e = parent.Delete(tx)
+		if e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+/**
+ * Renames the mailbox and everything below it. Renaming the INBOX is
+ * different, see RenameInbox.
+ */
+func RenameMailbox(tx *sql.Tx, userid int, existingName, newName string) error {
+	newName, e := cleanMailboxName(newName)
+	if e != nil {
+		return e
+	}
+	mailbox, e := models.MailboxByUseridName(tx, userid, existingName)
+	if e == sql.ErrNoRows {
+		return ErrNoSuchMailbox
+	} else if e != nil {
+		return e
+	}
+	if strings.HasPrefix(newName, existingName+MailboxDelimiter) {
+		return ErrRenameIntoItself
+	}
+	_, e = models.MailboxByUseridName(tx, userid, newName)
+	if e == nil {
+		return ErrMailboxExists
+	} else if e != sql.ErrNoRows {
+		return e
+	}
+	children, e := ChildMailboxes(tx, mailbox)
+	if e != nil {
+		return e
+	}
+	e = createParents(tx, userid, newName)
+	if e != nil {
+		return e
+	}
+	for _, child := range append(children, mailbox) {
+		child.Name = newName + strings.TrimPrefix(child.Name, existingName)
+		e = child.Save(tx)
+		if e != nil {
+			return e
+		}
+	}
+	return removeEmptyParents(tx, userid, existingName)
+}
+
+/**
+ * Renaming the INBOX moves its messages to a new mailbox and leaves it
+ * empty, see RFC 3501 section 6.3.5. Returns the UIDs the messages had
+ * in the INBOX, in order.
+ */
+func RenameInbox(tx *sql.Tx, userid int, newName string) (*models.Mailbox, []int, error) {
+	inbox, e := models.MailboxByUseridName(tx, userid, imap.InboxName)
+	if e != nil {
+		return nil, nil, e
+	}
+	mailbox, e := CreateMailbox(tx, userid, newName)
+	if e != nil {
+		return nil, nil, e
+	}
+	rows, e := tx.Query("SELECT id, uid FROM messages WHERE mailboxid = ? ORDER BY uid", inbox.ID)
+	if e != nil {
+		return nil, nil, e
+	}
+	var ids, uids []int
+	for rows.Next() {
+		var id, uid int
+		e = rows.Scan(&id, &uid)
+		if e != nil {
+			rows.Close()
+			return nil, nil, e
+		}
+		ids = append(ids, id)
+		uids = append(uids, uid)
+	}
+	rows.Close()
+	if e = rows.Err(); e != nil {
+		return nil, nil, e
+	}
+	if len(ids) == 0 {
+		return mailbox, nil, nil
+	}
+	// The messages keep their content and search index entries, only their place changes
+	inboxModseq := NextModseq(inbox)
+	modseq := NextModseq(mailbox)
+	for i, id := range ids {
+		_, e = tx.Exec("UPDATE messages SET mailboxid = ?, uid = ?, modseq = ? WHERE id = ?",
+			mailbox.ID, mailbox.Uidnext, modseq, id)
+		if e != nil {
+			return nil, nil, e
+		}
+		mailbox.Uidnext += 1
+		expunge := &models.Expunge{
+			Mailboxid: inbox.ID,
+			UID:       uids[i],
+			Modseq:    inboxModseq,
+		}
+		e = expunge.Save(tx)
+		if e != nil {
+			return nil, nil, e
+		}
+	}
+	e = inbox.Save(tx)
+	if e != nil {
+		return nil, nil, e
+	}
+	return mailbox, uids, mailbox.Save(tx)
+}
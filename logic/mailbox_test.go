@@ -0,0 +1,142 @@
+package logic
+
+import (
+	"database/sql"
+	_ "github.com/mattn/go-sqlite3"
+	"henrymail/database"
+	"henrymail/models"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+/**
+ * An empty database in memory, with a user whose id is 1
+ */
+func testDb(t *testing.T) *sql.DB {
+	db, e := sql.Open("sqlite3", ":memory:")
+	if e != nil {
+		t.Fatal(e)
+	}
+	// Each connection would have a database of its own
+	db.SetMaxOpenConns(1)
+	for _, file := range []string{"generate_schema.sql", "search_index.sql"} {
+		schema, e := ioutil.ReadFile("../database/" + file)
+		if e != nil {
+			t.Fatal(e)
+		}
+		_, e = db.Exec(string(schema))
+		if e != nil {
+			t.Fatal(e)
+		}
+	}
+	_, e = db.Exec("INSERT INTO users (id, username, passwordBytes, admin) VALUES (1, 'bob@example.com', '', 0)")
+	if e != nil {
+		t.Fatal(e)
+	}
+	return db
+}
+
+func mailboxNames(t *testing.T, db *sql.DB) []string {
+	mailboxes, e := models.MailboxesByUserid(db, 1)
+	if e != nil {
+		t.Fatal(e)
+	}
+	var names []string
+	for _, mailbox := range mailboxes {
+		name := mailbox.Name
+		if mailbox.Noselect {
+			name += " (noselect)"
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestParentNames(t *testing.T) {
+	tests := []struct {
+		name    string
+		parents []string
+	}{
+		{"INBOX", nil},
+		{"a/b", []string{"a"}},
+		{"a/b/c", []string{"a", "a/b"}},
+		{"Archive/2019/Jan/1st", []string{"Archive", "Archive/2019", "Archive/2019/Jan"}},
+	}
+	for _, test := range tests {
+		if parents := parentNames(test.name); !reflect.DeepEqual(parents, test.parents) {
+			t.Errorf("parentNames(%q) = %q, expected %q", test.name, parents, test.parents)
+		}
+	}
+	if parent := ParentName("a/b/c"); parent != "a/b" {
+		t.Errorf("ParentName(\"a/b/c\") = %q", parent)
+	}
+	if parent := ParentName("a"); parent != "" {
+		t.Errorf("ParentName(\"a\") = %q", parent)
+	}
+}
+
+func TestRenameMailbox(t *testing.T) {
+	db := testDb(t)
+	defer db.Close()
+	for _, name := range []string{"INBOX", "Archive/2019/Jan", "Archive/2019/Feb", "Lists/go/"} {
+		_, e := CreateMailbox(db, 1, name)
+		if e != nil {
+			t.Fatalf("CreateMailbox(%q) failed: %v", name, e)
+		}
+	}
+	rename := func(from, to string) error {
+		return database.Transact(db, func(tx *sql.Tx) error {
+			return RenameMailbox(tx, 1, from, to)
+		})
+	}
+
+	// The children move with it, and the new parents are created
+	e := rename("Archive/2019", "Old/Archive/2019/")
+	if e != nil {
+		t.Fatal(e)
+	}
+	expected := []string{"Archive", "INBOX", "Lists", "Lists/go", "Old", "Old/Archive",
+		"Old/Archive/2019", "Old/Archive/2019/Feb", "Old/Archive/2019/Jan"}
+	if names := mailboxNames(t, db); !reflect.DeepEqual(names, expected) {
+		t.Errorf("got %q, expected %q", names, expected)
+	}
+
+	// A \Noselect parent goes when its last child does
+	e = database.Transact(db, func(tx *sql.Tx) error {
+		return DeleteMailbox(tx, 1, "Lists")
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+	e = rename("Lists/go", "Go")
+	if e != nil {
+		t.Fatal(e)
+	}
+	expected = []string{"Archive", "Go", "INBOX", "Old", "Old/Archive",
+		"Old/Archive/2019", "Old/Archive/2019/Feb", "Old/Archive/2019/Jan"}
+	if names := mailboxNames(t, db); !reflect.DeepEqual(names, expected) {
+		t.Errorf("got %q, expected %q", names, expected)
+	}
+
+	for _, test := range []struct {
+		from, to string
+		e        error
+	}{
+		{"Old", "Old/Older", ErrRenameIntoItself},
+		{"Old", "Archive", ErrMailboxExists},
+		{"Nothing", "Something", ErrNoSuchMailbox},
+		{"Go", "a//b", ErrInvalidMailboxName},
+	} {
+		if e := rename(test.from, test.to); e != test.e {
+			t.Errorf("renaming %q to %q gave %v, expected %v", test.from, test.to, e, test.e)
+		}
+	}
+	// Only the whole name is inside itself
+	e = rename("Old", "Older")
+	if e != nil {
+		t.Errorf("renaming Old to Older failed: %v", e)
+	}
+}
@@ -0,0 +1,229 @@
+package logic
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend/backendutil"
+	"github.com/emersion/go-message"
+	"henrymail/models"
+	"log"
+	"mime"
+	"regexp"
+	"strings"
+)
+
+/**
+ * What IMAP clients ask for most when they sync, the size, envelope and
+ * body structure, is worked out when a message is saved and kept with it.
+ * So are the references, which aren't in the envelope but are needed to
+ * thread messages, and the thread each message is in for JMAP.
+ */
+
+var msgIdPattern = regexp.MustCompile(`<[^<>\s]+>`)
+
+/**
+ * The message IDs in a header such as References, with their angle brackets
+ */
+func MessageIds(value string) []string {
+	ids := msgIdPattern.FindAllString(value, -1)
+	if ids == nil {
+		ids = []string{}
+	}
+	return ids
+}
+
+func setMetadata(msg *models.Message) error {
+	msg.Size = len(msg.Content)
+	envelope := &imap.Envelope{}
+	structure := &imap.BodyStructure{MIMEType: "text", MIMESubType: "plain", Size: uint32(msg.Size)}
+	references := []string{}
+	ent, e := message.Read(bytes.NewReader(msg.Content))
+	if e == nil || message.IsUnknownCharset(e) {
+		if parsed, e := backendutil.FetchEnvelope(ent.Header.Header); e == nil {
+			envelope = parsed
+		}
+		if parsed, e := backendutil.FetchBodyStructure(ent.Header.Header, ent.Body, true); e == nil {
+			structure = parsed
+		}
+		references = MessageIds(ent.Header.Get("References"))
+		if ids := MessageIds(ent.Header.Get("Message-Id")); len(ids) > 0 {
+			msg.Messageidhdr = ids[0]
+		}
+	} else {
+		// Still worth keeping, and the client can fetch it to see what's wrong
+		log.Printf("Unable to parse message for its metadata: %v", e)
+	}
+	msg.Envelopejson, e = json.Marshal(envelope)
+	if e != nil {
+		return e
+	}
+	msg.Bodystructurejson, e = json.Marshal(structure)
+	if e != nil {
+		return e
+	}
+	msg.Referencesjson, e = json.Marshal(references)
+	return e
+}
+
+func Envelope(msg *models.Message) (*imap.Envelope, error) {
+	envelope := &imap.Envelope{}
+	return envelope, json.Unmarshal(msg.Envelopejson, envelope)
+}
+
+/**
+ * With extension data, for BODYSTRUCTURE
+ */
+func BodyStructure(msg *models.Message) (*imap.BodyStructure, error) {
+	structure := &imap.BodyStructure{}
+	return structure, json.Unmarshal(msg.Bodystructurejson, structure)
+}
+
+func References(msg *models.Message) ([]string, error) {
+	var references []string
+	return references, json.Unmarshal(msg.Referencesjson, &references)
+}
+
+var (
+	subjTrailer = regexp.MustCompile(`(?i)(\(fwd\)|\s)$`)
+	subjLeader  = regexp.MustCompile(`(?i)^((\[[^\[\]]*\]\s*)*(re|fwd?)\s*(\[[^\[\]]*\]\s*)?:|\s)`)
+	subjBlob    = regexp.MustCompile(`^\[[^\[\]]*\]\s*`)
+	subjFwd     = regexp.MustCompile(`(?is)^\[fwd:(.*)\]$`)
+)
+
+/**
+ * The subject without "Re:", "[list]" and the like, as described in
+ * RFC 5256 section 2.1, and whether anything taken off it showed the
+ * message was a reply or forward. It's upper case, for comparing.
+ */
+func BaseSubject(subject string) (string, bool) {
+	if decoded, e := new(mime.WordDecoder).DecodeHeader(subject); e == nil {
+		subject = decoded
+	}
+	subject = strings.Join(strings.Fields(subject), " ")
+	reply := false
+	for {
+		for trailer := subjTrailer.FindString(subject); trailer != ""; trailer = subjTrailer.FindString(subject) {
+			reply = reply || strings.TrimSpace(trailer) != ""
+			subject = subject[:len(subject)-len(trailer)]
+		}
+		for {
+			if leader := subjLeader.FindString(subject); leader != "" {
+				reply = reply || strings.TrimSpace(leader) != ""
+				subject = subject[len(leader):]
+				continue
+			}
+			// A blob on its own is only taken off if there's something after it
+			if blob := subjBlob.FindString(subject); blob != "" && strings.TrimSpace(subject[len(blob):]) != "" {
+				subject = subject[len(blob):]
+				continue
+			}
+			break
+		}
+		if fwd := subjFwd.FindStringSubmatch(subject); fwd != nil {
+			reply = true
+			subject = fwd[1]
+			continue
+		}
+		break
+	}
+	return strings.ToUpper(subject), reply
+}
+
+/**
+ * Messages join the thread of the first message the user has that they
+ * refer to, or a copy of themselves. Otherwise they start a new thread,
+ * which is numbered after them. The message must have been saved.
+ */
+func assignThread(db models.XODB, userid int, msg *models.Message) error {
+	ids, e := References(msg)
+	if e != nil {
+		return e
+	}
+	if len(ids) == 0 {
+		envelope, e := Envelope(msg)
+		if e != nil {
+			return e
+		}
+		ids = MessageIds(envelope.InReplyTo)
+	}
+	if msg.Messageidhdr != "" {
+		ids = append(ids, msg.Messageidhdr)
+	}
+	msg.Threadid = msg.ID
+	if len(ids) > 0 {
+		args := []interface{}{userid, msg.ID}
+		for _, id := range ids {
+			args = append(args, id)
+		}
+		var threadid int
+		e = db.QueryRow(`SELECT m.threadid FROM messages m JOIN mailboxes b ON b.id = m.mailboxid
+			WHERE b.userid = ? AND m.id != ? AND m.threadid != 0 AND m.messageidhdr IN (?`+
+			strings.Repeat(", ?", len(ids)-1)+`) ORDER BY m.id LIMIT 1`, args...).Scan(&threadid)
+		if e == nil {
+			msg.Threadid = threadid
+		} else if e != sql.ErrNoRows {
+			return e
+		}
+	}
+	_, e = db.Exec("UPDATE messages SET threadid = ? WHERE id = ?", msg.Threadid, msg.ID)
+	return e
+}
+
+/**
+ * Works out the metadata for messages saved before it was kept.
+ * Safe to run every time we start.
+ */
+func SetupMessageMetadata(db *sql.DB) error {
+	// In order, so messages are threaded after the ones they refer to
+	rows, e := db.Query(`SELECT id FROM messages WHERE length(envelopejson) = 0 OR length(referencesjson) = 0
+		OR threadid = 0 ORDER BY id`)
+	if e != nil {
+		return e
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		e = rows.Scan(&id)
+		if e != nil {
+			rows.Close()
+			return e
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if e = rows.Err(); e != nil {
+		return e
+	}
+	if len(ids) > 0 {
+		log.Printf("Working out metadata for %v messages", len(ids))
+	}
+	for _, id := range ids {
+		msg, e := models.MessageByID(db, id)
+		if e != nil {
+			return e
+		}
+		e = setMetadata(msg)
+		if e != nil {
+			return e
+		}
+		e = msg.Save(db)
+		if e != nil {
+			return e
+		}
+		// Messages left behind by a deleted mailbox get threads of their own
+		userid := 0
+		mailbox, e := models.MailboxByID(db, msg.Mailboxid)
+		if e == nil {
+			userid = mailbox.Userid
+		} else if e != sql.ErrNoRows {
+			return e
+		}
+		e = assignThread(db, userid, msg)
+		if e != nil {
+			return e
+		}
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package logic
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBaseSubject(t *testing.T) {
+	// Mostly from RFC 5256 section 2.1
+	tests := []struct {
+		subject, base string
+		reply         bool
+	}{
+		{"Hello", "HELLO", false},
+		{"  Hello \t  world  ", "HELLO WORLD", false},
+		{"Re: Hello", "HELLO", true},
+		{"RE: re:Re :hello", "HELLO", true},
+		{"Fwd: Hello", "HELLO", true},
+		{"Fw: Hello", "HELLO", true},
+		{"Re[2]: Hello", "HELLO", true},
+		{"[list] Re: Hello", "HELLO", true},
+		{"Re: [list] Hello", "HELLO", true},
+		{"[list] Hello", "HELLO", false},
+		{"Hello (fwd)", "HELLO", true},
+		{"Hello (FWD) (fwd)", "HELLO", true},
+		{"[fwd: Hello]", "HELLO", true},
+		{"[Fwd: Re: [list] Hello (fwd)]", "HELLO", true},
+		{"Re: [fwd: Re: Hello]", "HELLO", true},
+		// A blob that would leave nothing behind is kept
+		{"[list]", "[LIST]", false},
+		{"Re: [list]", "[LIST]", true},
+		{"Reply: Hello", "REPLY: HELLO", false},
+		{"Hello: Re: world", "HELLO: RE: WORLD", false},
+		{"=?utf-8?q?Re=3A_caf=C3=A9?=", "CAFÉ", true},
+		{"", "", false},
+		{"Re:", "", true},
+	}
+	for _, test := range tests {
+		base, reply := BaseSubject(test.subject)
+		if base != test.base || reply != test.reply {
+			t.Errorf("BaseSubject(%q) = %q, %v, expected %q, %v", test.subject, base, reply, test.base, test.reply)
+		}
+	}
+}
+
+func TestMessageIds(t *testing.T) {
+	ids := MessageIds("<a@example.com> <b@example.com>\r\n\t<c@example.com> not-an-id <d e>")
+	expected := []string{"<a@example.com>", "<b@example.com>", "<c@example.com>"}
+	if !reflect.DeepEqual(ids, expected) {
+		t.Errorf("got %q, expected %q", ids, expected)
+	}
+	if ids := MessageIds(""); ids == nil || len(ids) != 0 {
+		t.Errorf("expected an empty list, got %#v", ids)
+	}
+}
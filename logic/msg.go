@@ -2,7 +2,9 @@ package logic
 
 import (
 	"database/sql"
+	"errors"
 	"github.com/emersion/go-imap"
+	"henrymail/config"
 	"henrymail/models"
 	"strings"
 )
@@ -11,13 +13,74 @@ import (
  * Common functions for mail logic
  */
 
+var (
+	ErrForeignDomain    = errors.New("we don't accept mail for that domain")
+	ErrUnknownRecipient = errors.New("no such user here")
+)
+
+/**
+ * Works out which of our users an address belongs to. The postmaster
+ * address is required by RFC 5321, so it always goes to the administrator.
+ * Subaddresses like user+tag@example.com belong to the user.
+ */
+func FindRecipient(db models.XODB, emailaddress string) (*models.User, error) {
+	localPart, domain := SplitAddress(emailaddress)
+	isPostmaster := strings.EqualFold(localPart, "postmaster")
+	if domain == "" && !isPostmaster {
+		return nil, ErrUnknownRecipient
+	}
+	if domain != "" {
+		local, e := IsLocalDomain(db, domain)
+		if e != nil {
+			return nil, e
+		}
+		if !local {
+			return nil, ErrForeignDomain
+		}
+	}
+	username := localPart + "@" + strings.ToLower(domain)
+	if isPostmaster {
+		username = QualifyUsername(config.GetString(config.AdminUsername))
+	}
+	user, e := models.UserByUsername(db, username)
+	if e == sql.ErrNoRows {
+		if base, tag := SplitSubaddress(localPart); tag != "" {
+			return FindRecipient(db, base+"@"+domain)
+		}
+		return nil, ErrUnknownRecipient
+	}
+	return user, e
+}
+
+/**
+ * Splits an address into the parts before and after the last @
+ */
+func SplitAddress(emailaddress string) (string, string) {
+	if ix := strings.LastIndex(emailaddress, "@"); ix >= 0 {
+		return emailaddress[:ix], emailaddress[ix+1:]
+	}
+	return emailaddress, ""
+}
+
+/**
+ * Splits user+tag into user and tag. The tag is empty if there isn't one.
+ */
+func SplitSubaddress(localPart string) (string, string) {
+	separator := config.GetString(config.SubaddressSeparator)
+	if separator == "" {
+		return localPart, ""
+	}
+	if ix := strings.Index(localPart, separator); ix > 0 {
+		return localPart[:ix], localPart[ix+len(separator):]
+	}
+	return localPart, ""
+}
+
 /**
  * We do this in a few places, might make it a custom query
  */
 func FindInbox(db models.XODB, emailaddress string) (*models.Mailbox, error) {
-	split := strings.Split(emailaddress, "@")
-	username := split[0]
-	user, e := models.UserByUsername(db, username)
+	user, e := FindRecipient(db, emailaddress)
 	if e != nil {
 		return nil, e
 	}
@@ -25,10 +88,50 @@ func FindInbox(db models.XODB, emailaddress string) (*models.Mailbox, error) {
 }
 
 /**
- * Should be done in a transaction since multiple updates are required
+ * Where mail to an address goes when nothing else says: the INBOX, or
+ * the mailbox named after the subaddress tag if that's turned on.
+ */
+func FindDeliveryMailbox(db models.XODB, emailaddress string) (*models.Mailbox, error) {
+	user, e := FindRecipient(db, emailaddress)
+	if e != nil {
+		return nil, e
+	}
+	localPart, _ := SplitAddress(emailaddress)
+	if _, tag := SplitSubaddress(localPart); tag != "" && config.GetBool(config.SubaddressFolders) {
+		mailbox, e := models.MailboxByUseridName(db, user.ID, tag)
+		if e != sql.ErrNoRows && (e != nil || !mailbox.Noselect) {
+			return mailbox, e
+		}
+	}
+	return models.MailboxByUseridName(db, user.ID, imap.InboxName)
+}
+
+/**
+ * Should be done in a transaction since multiple updates are required.
+ * Returns ErrOverQuota or ErrMessageExceedsQuota if the owner hasn't
+ * got room for them.
  */
 func SaveMessages(tx *sql.Tx, mailbox *models.Mailbox, messages ...*models.Message) error {
+	e := checkQuota(tx, mailbox.Userid, messages)
+	if e != nil {
+		return e
+	}
+	return saveMessages(tx, mailbox, messages...)
+}
+
+/**
+ * Like SaveMessages, but for notices from the server itself, like delivery
+ * status notifications. They're saved even if the owner is over quota, since
+ * that's when they most need to know their mail didn't get through.
+ */
+func SaveNotices(tx *sql.Tx, mailbox *models.Mailbox, messages ...*models.Message) error {
+	return saveMessages(tx, mailbox, messages...)
+}
+
+func saveMessages(tx *sql.Tx, mailbox *models.Mailbox, messages ...*models.Message) error {
+	modseq := NextModseq(mailbox)
 	for _, msg := range messages {
+		msg.Modseq = modseq
 		// Ensure the link
 		msg.Mailboxid = mailbox.ID
 		// And the UID
@@ -36,7 +139,19 @@ func SaveMessages(tx *sql.Tx, mailbox *models.Mailbox, messages ...*models.Messa
 		// increment the UID
 		mailbox.Uidnext += 1
 
-		e := msg.Save(tx)
+		e := setMetadata(msg)
+		if e != nil {
+			return e
+		}
+		e = msg.Save(tx)
+		if e != nil {
+			return e
+		}
+		e = assignThread(tx, mailbox.Userid, msg)
+		if e != nil {
+			return e
+		}
+		e = IndexMessage(tx, msg)
 		if e != nil {
 			return e
 		}
@@ -44,3 +159,112 @@ func SaveMessages(tx *sql.Tx, mailbox *models.Mailbox, messages ...*models.Messa
 	// Ensure the new Uidnext is saved on the mailbox too
 	return mailbox.Save(tx)
 }
+
+/**
+ * Deletes the messages, remembering their UIDs so that clients
+ * resynchronising with QRESYNC can be told they've gone, and their
+ * ids for JMAP clients
+ */
+func ExpungeMessages(tx *sql.Tx, mailbox *models.Mailbox, messages ...*models.Message) error {
+	modseq := NextModseq(mailbox)
+	for _, msg := range messages {
+		// The messages needn't have been loaded in full, which Delete expects
+		_, e := tx.Exec("DELETE FROM messages WHERE id = ?", msg.ID)
+		if e != nil {
+			return e
+		}
+		expunge := &models.Expunge{
+			Mailboxid: mailbox.ID,
+			UID:       msg.UID,
+			Modseq:    modseq,
+			Messageid: msg.ID,
+		}
+		e = expunge.Save(tx)
+		if e != nil {
+			return e
+		}
+	}
+	e := pruneExpunges(tx, mailbox)
+	if e != nil {
+		return e
+	}
+	return mailbox.Save(tx)
+}
+
+// Expunges remembered for each mailbox, older ones are forgotten
+const keptExpunges = 10000
+
+/**
+ * Forgets the oldest expunges once there are too many. The mailbox's
+ * Prunedmodseq is the last modseq forgotten, and clients which last
+ * looked before then can't be told exactly what's gone. The mailbox
+ * must be saved afterwards.
+ */
+func pruneExpunges(tx *sql.Tx, mailbox *models.Mailbox) error {
+	var modseq int
+	e := tx.QueryRow("SELECT modseq FROM expunges WHERE mailboxid = ? ORDER BY modseq DESC LIMIT 1 OFFSET ?",
+		mailbox.ID, keptExpunges).Scan(&modseq)
+	if e == sql.ErrNoRows {
+		return nil
+	}
+	if e != nil {
+		return e
+	}
+	_, e = tx.Exec("DELETE FROM expunges WHERE mailboxid = ? AND modseq <= ?", mailbox.ID, modseq)
+	if e != nil {
+		return e
+	}
+	if modseq > mailbox.Prunedmodseq {
+		mailbox.Prunedmodseq = modseq
+	}
+	return nil
+}
+
+/**
+ * Moves the messages between two of a user's mailboxes without copying
+ * them, so they keep their ids as JMAP needs. They get new UIDs, and
+ * IMAP clients see them expunged from the source.
+ */
+func MoveMessages(tx *sql.Tx, source, dest *models.Mailbox, messages ...*models.Message) error {
+	sourceModseq := NextModseq(source)
+	destModseq := NextModseq(dest)
+	for _, msg := range messages {
+		expunge := &models.Expunge{
+			Mailboxid: source.ID,
+			UID:       msg.UID,
+			Modseq:    sourceModseq,
+			Messageid: msg.ID,
+		}
+		e := expunge.Save(tx)
+		if e != nil {
+			return e
+		}
+		msg.Mailboxid = dest.ID
+		msg.UID = dest.Uidnext
+		msg.Modseq = destModseq
+		dest.Uidnext += 1
+		_, e = tx.Exec("UPDATE messages SET mailboxid = ?, uid = ?, modseq = ? WHERE id = ?",
+			msg.Mailboxid, msg.UID, msg.Modseq, msg.ID)
+		if e != nil {
+			return e
+		}
+	}
+	e := pruneExpunges(tx, source)
+	if e != nil {
+		return e
+	}
+	e = source.Save(tx)
+	if e != nil {
+		return e
+	}
+	return dest.Save(tx)
+}
+
+/**
+ * Each change to a mailbox's messages gets a new modification sequence
+ * (see RFC 7162). The mailbox must be saved afterwards.
+ */
+func NextModseq(mailbox *models.Mailbox) int {
+	mailbox.Highestmodseq += 1
+	return mailbox.Highestmodseq
+}
@@ -0,0 +1,105 @@
+package logic
+
+import (
+	"database/sql"
+	"github.com/xo/xoutil"
+	"henrymail/database"
+	"henrymail/models"
+	"strings"
+	"time"
+)
+
+/**
+ * Outbound queue functions
+ */
+
+const (
+	// Waiting for its next delivery attempt
+	DeliveryPending = "pending"
+	// Given up on, kept around so an administrator can see why
+	DeliveryFailed = "failed"
+)
+
+/**
+ * Stores a message for later delivery, with one delivery per recipient
+ */
+func Enqueue(db *sql.DB, queue *models.Queue, deliveries []*models.Delivery) error {
+	return database.Transact(db, func(tx *sql.Tx) error {
+		now := time.Now()
+		queue.Ts = xoutil.SqTime{Time: now}
+		e := queue.Save(tx)
+		if e != nil {
+			return e
+		}
+		for _, delivery := range deliveries {
+			delivery.Queueid = queue.ID
+			delivery.Status = DeliveryPending
+			delivery.Nextattempt = xoutil.SqTime{Time: now}
+			e = delivery.Save(tx)
+			if e != nil {
+				return e
+			}
+		}
+		return nil
+	})
+}
+
+/**
+ * Schedules a delivery to be attempted again straight away
+ */
+func RetryDelivery(db *sql.DB, id int) error {
+	delivery, e := models.DeliveryByID(db, id)
+	if e != nil {
+		return e
+	}
+	delivery.Status = DeliveryPending
+	delivery.Nextattempt = xoutil.SqTime{Time: time.Now()}
+	return delivery.Save(db)
+}
+
+/**
+ * Removes a delivery, and the queued message too
+ * if nobody else is waiting for it.
+ */
+func DeleteDelivery(db *sql.DB, id int) error {
+	return database.Transact(db, func(tx *sql.Tx) error {
+		delivery, e := models.DeliveryByID(tx, id)
+		if e != nil {
+			return e
+		}
+		e = delivery.Delete(tx)
+		if e != nil {
+			return e
+		}
+
+		remaining, e := models.DeliveriesByQueueid(tx, delivery.Queueid)
+		if e != nil {
+			return e
+		}
+		if len(remaining) > 0 {
+			return nil
+		}
+		queue, e := delivery.Queue(tx)
+		if e != nil {
+			return e
+		}
+		return queue.Delete(tx)
+	})
+}
+
+/**
+ * Whether the sender asked to be told about this kind of event
+ * (SUCCESS, FAILURE or DELAY). Without a NOTIFY parameter they
+ * only hear about failures and delays.
+ */
+func WantsNotification(delivery *models.Delivery, event string) bool {
+	if delivery.Notify == "" {
+		return event != "SUCCESS"
+	}
+	for _, n := range strings.Split(delivery.Notify, ",") {
+		if n == event {
+			return true
+		}
+	}
+	return false
+}
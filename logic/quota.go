@@ -0,0 +1,107 @@
+package logic
+
+import (
+	"errors"
+	"henrymail/config"
+	"henrymail/models"
+)
+
+/**
+ * Storage quotas, counted across all of a user's mailboxes. Users have
+ * the default quota from the config unless they've been given their own.
+ */
+
+// Stored on users to mean they aren't limited, 0 means they get the default
+const QuotaUnlimited = -1
+
+var (
+	ErrOverQuota           = errors.New("mailbox is full")
+	ErrMessageExceedsQuota = errors.New("message is bigger than the mailbox quota")
+)
+
+/**
+ * Limits of 0 mean unlimited
+ */
+type Quota struct {
+	Bytes        int
+	Messages     int
+	UsedBytes    int
+	UsedMessages int
+}
+
+func GetQuota(db models.XODB, user *models.User) (*Quota, error) {
+	q := &Quota{
+		Bytes:    quotaLimit(user.Quotabytes, config.DefaultQuotaBytes),
+		Messages: quotaLimit(user.Quotamessages, config.DefaultQuotaMessages),
+	}
+	// The size is kept with each message, so this needn't read their content
+	e := db.QueryRow(`SELECT coalesce(sum(m.size), 0), count(m.id)
+		FROM messages m JOIN mailboxes mb ON m.mailboxid = mb.id
+		WHERE mb.userid = ?`, user.ID).Scan(&q.UsedBytes, &q.UsedMessages)
+	if e != nil {
+		return nil, e
+	}
+	return q, nil
+}
+
+func quotaLimit(limit int, defaultKey string) int {
+	if limit == 0 {
+		return config.GetInt(defaultKey)
+	}
+	if limit < 0 {
+		return 0
+	}
+	return limit
+}
+
+/**
+ * True if the user can't be given any more mail
+ */
+func (q *Quota) Full() bool {
+	return (q.Bytes > 0 && q.UsedBytes >= q.Bytes) || (q.Messages > 0 && q.UsedMessages >= q.Messages)
+}
+
+/**
+ * Checks there's room for more messages
+ */
+func (q *Quota) Check(bytes, messages int) error {
+	if (q.Bytes > 0 && bytes > q.Bytes) || (q.Messages > 0 && messages > q.Messages) {
+		return ErrMessageExceedsQuota
+	}
+	if (q.Bytes > 0 && q.UsedBytes+bytes > q.Bytes) || (q.Messages > 0 && q.UsedMessages+messages > q.Messages) {
+		return ErrOverQuota
+	}
+	return nil
+}
+
+/**
+ * Limits of 0 use the default, QuotaUnlimited for none
+ */
+func SetQuota(db models.XODB, user *models.User, bytes, messages int) error {
+	user.Quotabytes = bytes
+	user.Quotamessages = messages
+	return user.Save(db)
+}
+
+/**
+ * Checks the user has room for more messages
+ */
+func CheckQuota(db models.XODB, userid, bytes, messages int) error {
+	user, e := models.UserByID(db, userid)
+	if e != nil {
+		return e
+	}
+	q, e := GetQuota(db, user)
+	if e != nil {
+		return e
+	}
+	return q.Check(bytes, messages)
+}
+
+func checkQuota(db models.XODB, userid int, messages []*models.Message) error {
+	bytes := 0
+	for _, msg := range messages {
+		bytes += len(msg.Content)
+	}
+	return CheckQuota(db, userid, bytes, len(messages))
+}
@@ -0,0 +1,63 @@
+package logic
+
+import (
+	"database/sql"
+	"henrymail/database"
+	"henrymail/models"
+	"testing"
+)
+
+func TestQuotaCheck(t *testing.T) {
+	q := &Quota{Bytes: 100, Messages: 3, UsedBytes: 50, UsedMessages: 2}
+	tests := []struct {
+		bytes, messages int
+		e               error
+	}{
+		{50, 1, nil},
+		{51, 1, ErrOverQuota},
+		{10, 2, ErrOverQuota},
+		{101, 1, ErrMessageExceedsQuota},
+		{10, 4, ErrMessageExceedsQuota},
+	}
+	for _, test := range tests {
+		if e := q.Check(test.bytes, test.messages); e != test.e {
+			t.Errorf("Check(%d, %d) = %v, expected %v", test.bytes, test.messages, e, test.e)
+		}
+	}
+	unlimited := &Quota{UsedBytes: 1000, UsedMessages: 1000}
+	if e := unlimited.Check(1000, 1000); e != nil || unlimited.Full() {
+		t.Errorf("a quota without limits was full: %v", e)
+	}
+}
+
+func TestSaveNotices(t *testing.T) {
+	db := testDb(t)
+	defer db.Close()
+	_, e := db.Exec("UPDATE users SET quotamessages = 1 WHERE id = 1")
+	if e != nil {
+		t.Fatal(e)
+	}
+	inbox, e := CreateMailbox(db, 1, "INBOX")
+	if e != nil {
+		t.Fatal(e)
+	}
+	save := func(f func(*sql.Tx, *models.Mailbox, ...*models.Message) error) error {
+		return database.Transact(db, func(tx *sql.Tx) error {
+			inbox, e := models.MailboxByID(tx, inbox.ID)
+			if e != nil {
+				return e
+			}
+			return f(tx, inbox, &models.Message{Content: []byte("Subject: Hi\r\n\r\n"), Flagsjson: []byte("[]")})
+		})
+	}
+	if e = save(SaveMessages); e != nil {
+		t.Fatal(e)
+	}
+	if e = save(SaveMessages); e != ErrOverQuota {
+		t.Errorf("saving a message over quota gave %v, expected %v", e, ErrOverQuota)
+	}
+	// Notices are saved regardless
+	if e = save(SaveNotices); e != nil {
+		t.Errorf("saving a notice over quota gave %v", e)
+	}
+}
@@ -0,0 +1,244 @@
+package logic
+
+import (
+	"bytes"
+	"database/sql"
+	"github.com/emersion/go-message"
+	"henrymail/models"
+	"io"
+	"io/ioutil"
+	"log"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+/**
+ * The full-text index of messages, see database/search_index.sql. Messages
+ * are indexed when they're saved, and searched by word rather than by
+ * substring, like other mail servers with full-text search.
+ */
+
+// Index columns which can be searched on their own
+const (
+	SearchFrom    = "fromhdr"
+	SearchTo      = "tohdr"
+	SearchCc      = "cchdr"
+	SearchBcc     = "bcchdr"
+	SearchSubject = "subject"
+	SearchBody    = "body"
+	SearchAny     = "" // TEXT, the headers and the body
+)
+
+var htmlTag = regexp.MustCompile(`<[^>]*>`)
+
+/**
+ * A query for the index, matching messages which have all the strings added to it
+ */
+type SearchQuery struct {
+	terms []searchTerm
+}
+
+type searchTerm struct {
+	column string
+	phrase string
+}
+
+/**
+ * Returns false if the text has no words the index could find
+ */
+func (q *SearchQuery) Add(column, text string) bool {
+	words := strings.FieldsFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	if len(words) == 0 {
+		return false
+	}
+	// The last word may be cut short, e.g. searching for "hel" should find "hello"
+	q.terms = append(q.terms, searchTerm{column, `"` + strings.Join(words, " ") + `*"`})
+	return true
+}
+
+/**
+ * For IMAP, which searches by substring. The first word may be the end
+ * of a longer one, which the index can't find, so it's left out if
+ * there's more than one. Returns true if the index finds just the
+ * messages that have the text, apart from in the middle of a word,
+ * otherwise the messages it finds have to be checked for the text.
+ */
+func (q *SearchQuery) AddSubstring(column, text string) bool {
+	words := strings.FieldsFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	if len(words) == 1 && wholeWord(text) {
+		return q.Add(column, text)
+	}
+	first, _ := utf8.DecodeRuneInString(text)
+	if len(words) > 1 && (unicode.IsLetter(first) || unicode.IsDigit(first)) {
+		words = words[1:]
+	}
+	q.Add(column, strings.Join(words, " "))
+	return false
+}
+
+/**
+ * A word the index sees just as it's written. It doesn't see accents.
+ */
+func wholeWord(text string) bool {
+	for _, r := range text {
+		if r > unicode.MaxASCII || (!unicode.IsLetter(r) && !unicode.IsDigit(r)) {
+			return false
+		}
+	}
+	return true
+}
+
+func (q *SearchQuery) Empty() bool {
+	return len(q.terms) == 0
+}
+
+/**
+ * The IDs of the messages in the mailbox which match the query. FTS4 can't
+ * restrict phrases to a column within a query, so each term is matched
+ * on its own.
+ */
+func SearchIndex(db models.XODB, mailboxid int, q *SearchQuery) (map[int]bool, error) {
+	var matches []string
+	args := []interface{}{mailboxid}
+	for _, term := range q.terms {
+		column := term.column
+		if column == SearchAny {
+			column = "messages_fts"
+		}
+		matches = append(matches, "SELECT docid FROM messages_fts WHERE "+column+" MATCH ?")
+		args = append(args, term.phrase)
+	}
+	rows, e := db.Query("SELECT id FROM messages WHERE mailboxid = ? AND id IN ("+
+		strings.Join(matches, " INTERSECT ")+")", args...)
+	if e != nil {
+		return nil, e
+	}
+	defer rows.Close()
+	ids := map[int]bool{}
+	for rows.Next() {
+		var id int
+		e = rows.Scan(&id)
+		if e != nil {
+			return nil, e
+		}
+		ids[id] = true
+	}
+	return ids, rows.Err()
+}
+
+/**
+ * Messages that can't be parsed are indexed as well as they can be,
+ * it's no reason to refuse them.
+ */
+func IndexMessage(db models.XODB, msg *models.Message) error {
+	ent, e := message.Read(bytes.NewReader(msg.Content))
+	if e != nil && !message.IsUnknownCharset(e) {
+		log.Printf("Unable to index message %v: %v", msg.ID, e)
+		_, e = db.Exec(`INSERT OR REPLACE INTO messages_fts (docid, body) VALUES (?, ?)`, msg.ID, string(msg.Content))
+		return e
+	}
+	var headers strings.Builder
+	fields := ent.Header.Fields()
+	for fields.Next() {
+		value, _ := fields.Text()
+		headers.WriteString(fields.Key() + ": " + value + "\n")
+	}
+	var body strings.Builder
+	e = appendText(ent, &body)
+	if e != nil {
+		log.Printf("Unable to index all of message %v: %v", msg.ID, e)
+	}
+	text := func(key string) string {
+		value, _ := ent.Header.Text(key)
+		return value
+	}
+	_, e = db.Exec(`INSERT OR REPLACE INTO messages_fts (docid, fromhdr, tohdr, cchdr, bcchdr, subject, headers, body)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`, msg.ID, text("From"), text("To"), text("Cc"), text("Bcc"),
+		text("Subject"), headers.String(), body.String())
+	return e
+}
+
+/**
+ * Decoded text from each text part, and from attached messages
+ */
+func appendText(ent *message.Entity, body *strings.Builder) error {
+	if mr := ent.MultipartReader(); mr != nil {
+		for {
+			part, e := mr.NextPart()
+			if e == io.EOF {
+				return nil
+			}
+			if e != nil && !message.IsUnknownCharset(e) {
+				return e
+			}
+			e = appendText(part, body)
+			if e != nil {
+				return e
+			}
+		}
+	}
+	contentType, _, _ := ent.Header.ContentType()
+	switch {
+	case contentType == "message/rfc822":
+		attached, e := message.Read(ent.Body)
+		if e != nil && !message.IsUnknownCharset(e) {
+			return e
+		}
+		return appendText(attached, body)
+	case contentType == "text/html":
+		content, e := ioutil.ReadAll(ent.Body)
+		body.WriteString(htmlTag.ReplaceAllString(string(content), " "))
+		body.WriteString("\n")
+		return e
+	case contentType == "" || strings.HasPrefix(contentType, "text/"):
+		content, e := ioutil.ReadAll(ent.Body)
+		body.Write(content)
+		body.WriteString("\n")
+		return e
+	}
+	return nil
+}
+
+/**
+ * Indexes messages saved before there was an index. Safe to run every time we start.
+ */
+func SetupSearchIndex(db *sql.DB) error {
+	rows, e := db.Query(`SELECT id FROM messages WHERE id NOT IN (SELECT docid FROM messages_fts)`)
+	if e != nil {
+		return e
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		e = rows.Scan(&id)
+		if e != nil {
+			rows.Close()
+			return e
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if e = rows.Err(); e != nil {
+		return e
+	}
+	if len(ids) > 0 {
+		log.Printf("Adding %v messages to the search index", len(ids))
+	}
+	for _, id := range ids {
+		msg, e := models.MessageByID(db, id)
+		if e != nil {
+			return e
+		}
+		e = IndexMessage(db, msg)
+		if e != nil {
+			return e
+		}
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package logic
+
+import (
+	"database/sql"
+	"errors"
+	"henrymail/database"
+	"henrymail/models"
+	"henrymail/sieve"
+)
+
+/**
+ * Management of users' Sieve filtering scripts. Each user can have
+ * many scripts, but only the active one is run on their mail.
+ */
+
+var (
+	ErrNoSuchScript      = errors.New("no such script")
+	ErrScriptActive      = errors.New("the active script can't be deleted")
+	ErrScriptExists      = errors.New("a script with that name already exists")
+	ErrInvalidScriptName = errors.New("invalid script name")
+)
+
+func ListScripts(db models.XODB, userid int) ([]*models.Sievescript, error) {
+	return models.SievescriptsByUserid(db, userid)
+}
+
+func GetScript(db models.XODB, userid int, name string) (*models.Sievescript, error) {
+	script, e := models.SievescriptByUseridName(db, userid, name)
+	if e == sql.ErrNoRows {
+		return nil, ErrNoSuchScript
+	}
+	return script, e
+}
+
+/**
+ * The script the user's mail is filtered with, or nil if they don't have one
+ */
+func ActiveScript(db models.XODB, userid int) (*models.Sievescript, error) {
+	scripts, e := models.SievescriptsByUserid(db, userid)
+	if e != nil {
+		return nil, e
+	}
+	for _, s := range scripts {
+		if s.Active {
+			return s, nil
+		}
+	}
+	return nil, nil
+}
+
+/**
+ * Creates or replaces a script, as long as it's valid
+ */
+func PutScript(db models.XODB, userid int, name, content string) error {
+	if name == "" {
+		return ErrInvalidScriptName
+	}
+	_, e := sieve.Parse(content)
+	if e != nil {
+		return e
+	}
+	script, e := models.SievescriptByUseridName(db, userid, name)
+	if e == sql.ErrNoRows {
+		script = &models.Sievescript{
+			Userid: userid,
+			Name:   name,
+		}
+	} else if e != nil {
+		return e
+	}
+	script.Content = content
+	return script.Save(db)
+}
+
+/**
+ * Makes a script the active one, or deactivates them all if the name is empty
+ */
+func SetActiveScript(db *sql.DB, userid int, name string) error {
+	return database.Transact(db, func(tx *sql.Tx) error {
+		scripts, e := models.SievescriptsByUserid(tx, userid)
+		if e != nil {
+			return e
+		}
+		found := name == ""
+		for _, s := range scripts {
+			found = found || s.Name == name
+		}
+		if !found {
+			return ErrNoSuchScript
+		}
+		for _, s := range scripts {
+			if s.Active != (s.Name == name) {
+				s.Active = s.Name == name
+				e = s.Save(tx)
+				if e != nil {
+					return e
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func DeleteScript(db models.XODB, userid int, name string) error {
+	script, e := GetScript(db, userid, name)
+	if e != nil {
+		return e
+	}
+	if script.Active {
+		return ErrScriptActive
+	}
+	return script.Delete(db)
+}
+
+func RenameScript(db models.XODB, userid int, oldName, newName string) error {
+	if newName == "" {
+		return ErrInvalidScriptName
+	}
+	script, e := GetScript(db, userid, oldName)
+	if e != nil {
+		return e
+	}
+	_, e = models.SievescriptByUseridName(db, userid, newName)
+	if e == nil {
+		return ErrScriptExists
+	} else if e != sql.ErrNoRows {
+		return e
+	}
+	script.Name = newName
+	return script.Save(db)
+}
@@ -0,0 +1,162 @@
+package logic
+
+import (
+	"database/sql"
+	"errors"
+	"henrymail/config"
+	"henrymail/database"
+	"henrymail/models"
+	"log"
+	"strings"
+)
+
+/**
+ * Special-use mailboxes, see RFC 6154. Each user has at most one
+ * mailbox for each use, so the server and clients can agree on
+ * where sent mail, drafts etc. go.
+ */
+
+const (
+	SpecialUseArchive = `\Archive`
+	SpecialUseDrafts  = `\Drafts`
+	SpecialUseJunk    = `\Junk`
+	SpecialUseSent    = `\Sent`
+	SpecialUseTrash   = `\Trash`
+)
+
+var SpecialUses = []string{SpecialUseArchive, SpecialUseDrafts, SpecialUseJunk, SpecialUseSent, SpecialUseTrash}
+
+var (
+	ErrInvalidSpecialUse = errors.New("unknown special use")
+	ErrSpecialUseTaken   = errors.New("there's already a mailbox with that special use")
+)
+
+/**
+ * The name we give the mailbox for a special use when we create it,
+ * and recognise in mailboxes made before there were special uses.
+ */
+func specialUseName(use string) string {
+	if use == SpecialUseJunk {
+		return config.GetString(config.QuarantineMailbox)
+	}
+	return strings.TrimPrefix(use, `\`)
+}
+
+/**
+ * The special use a mailbox with this name would have, if any
+ */
+func SpecialUseByName(name string) string {
+	for _, use := range SpecialUses {
+		if strings.EqualFold(name, specialUseName(use)) {
+			return use
+		}
+	}
+	return ""
+}
+
+func canonicalSpecialUse(use string) (string, error) {
+	for _, u := range SpecialUses {
+		if strings.EqualFold(use, u) {
+			return u, nil
+		}
+	}
+	return "", ErrInvalidSpecialUse
+}
+
+/**
+ * Returns sql.ErrNoRows if the user doesn't have a mailbox for the use
+ */
+func FindSpecialMailbox(db models.XODB, userid int, use string) (*models.Mailbox, error) {
+	mailboxes, e := models.MailboxesByUserid(db, userid)
+	if e != nil {
+		return nil, e
+	}
+	for _, mailbox := range mailboxes {
+		if mailbox.Specialuse == use {
+			return mailbox, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+/**
+ * Finds the recipient's mailbox for the use. If they don't have one, their
+ * mailbox with the usual name for it is used, or created.
+ */
+func FindOrCreateSpecialMailbox(db models.XODB, emailaddress, use string) (*models.Mailbox, error) {
+	user, e := FindRecipient(db, emailaddress)
+	if e != nil {
+		return nil, e
+	}
+	mailbox, e := FindSpecialMailbox(db, user.ID, use)
+	if e != sql.ErrNoRows {
+		return mailbox, e
+	}
+	mailbox, e = models.MailboxByUseridName(db, user.ID, specialUseName(use))
+	if e == sql.ErrNoRows || (e == nil && mailbox.Noselect) {
+		mailbox, e = CreateMailbox(db, user.ID, specialUseName(use))
+	}
+	if e != nil {
+		return nil, e
+	}
+	mailbox.Specialuse = use
+	return mailbox, mailbox.Save(db)
+}
+
+/**
+ * An empty use clears it
+ */
+func SetSpecialUse(db models.XODB, mailbox *models.Mailbox, use string) error {
+	if use != "" {
+		var e error
+		use, e = canonicalSpecialUse(use)
+		if e != nil {
+			return e
+		}
+		existing, e := FindSpecialMailbox(db, mailbox.Userid, use)
+		if e == nil && existing.ID != mailbox.ID {
+			return ErrSpecialUseTaken
+		} else if e != nil && e != sql.ErrNoRows {
+			return e
+		}
+	}
+	mailbox.Specialuse = use
+	return mailbox.Save(db)
+}
+
+/**
+ * Gives mailboxes from before there were special uses the use their
+ * name suggests. Safe to run every time we start.
+ */
+func SetupSpecialUse(db *sql.DB) error {
+	return database.Transact(db, func(tx *sql.Tx) error {
+		users, e := models.GetAllUser(tx)
+		if e != nil {
+			return e
+		}
+		for _, user := range users {
+			mailboxes, e := models.MailboxesByUserid(tx, user.ID)
+			if e != nil {
+				return e
+			}
+			taken := map[string]bool{}
+			for _, mailbox := range mailboxes {
+				taken[mailbox.Specialuse] = true
+			}
+			for _, mailbox := range mailboxes {
+				use := SpecialUseByName(mailbox.Name)
+				if mailbox.Specialuse != "" || use == "" || taken[use] {
+					continue
+				}
+				log.Printf("Using %v's mailbox %v for %v", user.Username, mailbox.Name, use)
+				mailbox.Specialuse = use
+				taken[use] = true
+				e = mailbox.Save(tx)
+				if e != nil {
+					return e
+				}
+			}
+		}
+		return nil
+	})
+}
@@ -4,12 +4,15 @@ import (
 	"database/sql"
 	"henrymail/config"
 	"henrymail/database"
-	"henrymail/dkim"
+	"henrymail/dmarc"
 	"henrymail/dns"
 	"henrymail/imap"
 	"henrymail/logic"
+	"henrymail/managesieve"
+	"henrymail/pop3"
 	"henrymail/process"
 	"henrymail/smtp"
+	"henrymail/spf"
 	"henrymail/web"
 	"log"
 	"math/rand"
@@ -26,31 +29,68 @@ func main() {
 	db := database.OpenDatabase()
 
 	// submission agent processing chain
-	var msaChain process.MsgProcessor = process.NewSender(db)
+	sender := process.NewSender(db)
+	sender.Start()
+	var msaChain process.MsgProcessor = sender
+	msaChain = process.NewReceivedHeader(msaChain)
 	if config.GetBool(config.DkimSign) {
-		msaChain = process.NewDkimSigner(dkim.GetOrCreateDkim(db), msaChain)
+		msaChain = process.NewDkimSigner(db, msaChain)
 	}
 
 	// transfer agent processing chain
-	mtaChain := process.NewSaver(db)
+	mtaChain := process.NewSaver(db, msaChain)
+	// Redirected and forwarded messages aren't ours, so they're not DKIM signed
+	mtaChain = process.NewSieveFilter(db, sender, mtaChain)
+	mtaChain = process.NewAliasExpander(db, sender, mtaChain)
+	// Received is added first, so Authentication-Results ends up at the top
+	mtaChain = process.NewAuthResultsHeader(mtaChain)
+	mtaChain = process.NewReceivedHeader(mtaChain)
+	if config.GetBool(config.DmarcVerify) {
+		// Needs the DKIM and SPF results, so it comes after them
+		mtaChain = process.NewDmarcVerifier(db, dmarc.NewChecker(), mtaChain)
+	}
 	if config.GetBool(config.DkimVerify) {
 		mtaChain = process.NewDkimVerifier(mtaChain)
 	}
+	if config.GetBool(config.SpfVerify) {
+		mtaChain = process.NewSpfVerifier(spf.NewChecker(), mtaChain)
+	}
 
-	// SPF checker
 	// Virus scanner
 	// Spam filter
+	e := logic.SetupDomains(db)
+	if e != nil {
+		log.Fatal(e)
+	}
+	e = logic.SetupSpecialUse(db)
+	if e != nil {
+		log.Fatal(e)
+	}
+	e = logic.SetupSearchIndex(db)
+	if e != nil {
+		log.Fatal(e)
+	}
+	e = logic.SetupMessageMetadata(db)
+	if e != nil {
+		log.Fatal(e)
+	}
 	seedData(db)
 
 	smtp.StartMsa(db, msaChain, tlsConfig)
 	smtp.StartMta(db, mtaChain, tlsConfig)
 	imap.StartImap(db, tlsConfig)
-	web.StartWebAdmin(db, tlsConfig)
+	managesieve.StartManageSieve(db, tlsConfig)
+	pop3.StartPop3(db, tlsConfig)
+	web.StartWebAdmin(db, msaChain, tlsConfig)
 
 	if config.GetBool(config.FakeDns) {
 		dns.StartFakeDNS(db, config.GetString(config.FakeDnsAddress), "udp")
 	}
 
+	if config.GetBool(config.DmarcReports) {
+		process.NewDmarcReporter(db, dmarc.NewChecker(), msaChain).Start()
+	}
+
 	// Wait for exit
 	select {}
 }
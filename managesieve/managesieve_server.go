@@ -0,0 +1,531 @@
+package managesieve
+
+import (
+	"bufio"
+	"crypto/tls"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/emersion/go-sasl"
+	"henrymail/config"
+	"henrymail/logic"
+	"henrymail/models"
+	"henrymail/sieve"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/**
+ * Lets users manage their Sieve scripts with the ManageSieve protocol, see RFC 5804.
+ */
+
+const (
+	maxLineBytes   = 8192
+	maxScriptBytes = 1024 * 1024
+	// Enough for PUTSCRIPT with the biggest script, however it's split into literals
+	maxCommandBytes = maxScriptBytes + maxLineBytes
+)
+
+var (
+	errLogout   = errors.New("logout")
+	errTooLarge = errors.New("command too large")
+)
+
+func StartManageSieve(db *sql.DB, tls *tls.Config) {
+	addr := config.GetString(config.ManageSieveAddress)
+	l, e := net.Listen("tcp", addr)
+	if e != nil {
+		log.Fatal(e)
+	}
+	go func() {
+		log.Println("Starting ManageSieve server at ", addr)
+		for {
+			c, e := l.Accept()
+			if e != nil {
+				log.Fatal(e)
+			}
+			s := &session{
+				db:     db,
+				tls:    tls,
+				conn:   c,
+				reader: bufio.NewReader(c),
+			}
+			go s.serve()
+		}
+	}()
+}
+
+type session struct {
+	db        *sql.DB
+	tls       *tls.Config
+	conn      net.Conn
+	reader    *bufio.Reader
+	encrypted bool
+	user      *models.User
+}
+
+/**
+ * A response, with an optional response code like (NONEXISTENT) and a human readable message
+ */
+type response struct {
+	code    string
+	message string
+}
+
+func no(code, message string) *response {
+	return &response{code: code, message: message}
+}
+
+func (s *session) serve() {
+	defer s.conn.Close()
+	e := s.capabilities()
+	if e == nil {
+		e = s.ok("", "henrymail ready")
+	}
+	for e == nil {
+		e = s.command()
+	}
+	if e != errLogout && e != io.EOF {
+		log.Printf("ManageSieve connection from %v closed: %v", s.conn.RemoteAddr(), e)
+	}
+}
+
+func (s *session) command() error {
+	_ = s.conn.SetReadDeadline(time.Now().Add(time.Duration(config.GetInt(config.MaxIdleSeconds)) * time.Second))
+	args, e := s.readArgs()
+	if e != nil {
+		if _, ok := e.(syntaxError); ok {
+			return s.no("", e.Error())
+		}
+		if e == errTooLarge {
+			// The rest of it is still coming, so there's no telling where the next command starts
+			_ = s.write(formatResponse("BYE", "QUOTA/MAXSIZE", "Command too large"))
+		}
+		return e
+	}
+	if len(args) == 0 {
+		return s.no("", "Empty command")
+	}
+	name, args := strings.ToUpper(args[0]), args[1:]
+
+	switch name {
+	case "CAPABILITY":
+		e = s.capabilities()
+		if e != nil {
+			return e
+		}
+		return s.ok("", "")
+	case "LOGOUT":
+		e = s.ok("", "Bye")
+		if e == nil {
+			e = errLogout
+		}
+		return e
+	case "NOOP":
+		if len(args) > 0 {
+			return s.ok("TAG "+quote(args[0]), "Done")
+		}
+		return s.ok("", "Done")
+	case "STARTTLS":
+		return s.startTls()
+	case "AUTHENTICATE":
+		if s.user != nil {
+			return s.no("", "Already authenticated")
+		}
+		return s.authenticate(args)
+	}
+
+	if s.user == nil {
+		return s.no("", "Authenticate first")
+	}
+	r := s.userCommand(name, args)
+	if r != nil {
+		return s.no(r.code, r.message)
+	}
+	return nil
+}
+
+/**
+ * Commands that need an authenticated user. Commands that succeed write their own responses.
+ */
+func (s *session) userCommand(name string, args []string) *response {
+	userid := s.user.ID
+	switch name {
+	case "UNAUTHENTICATE":
+		if len(args) != 0 {
+			return no("", "UNAUTHENTICATE takes no arguments")
+		}
+		s.user = nil
+		return s.respond(nil, "")
+	case "HAVESPACE":
+		if len(args) != 2 {
+			return no("", "HAVESPACE needs a script name and size")
+		}
+		size, e := strconv.Atoi(args[1])
+		if e != nil {
+			return no("", "Invalid size")
+		}
+		if size > maxScriptBytes {
+			return no("QUOTA/MAXSIZE", fmt.Sprintf("Scripts can be at most %d bytes", maxScriptBytes))
+		}
+		return s.respond(nil, "")
+	case "CHECKSCRIPT":
+		if len(args) != 1 {
+			return no("", "CHECKSCRIPT needs a script")
+		}
+		_, e := sieve.Parse(args[0])
+		return s.respond(e, "Script is valid")
+	case "PUTSCRIPT":
+		if len(args) != 2 {
+			return no("", "PUTSCRIPT needs a script name and script")
+		}
+		if len(args[1]) > maxScriptBytes {
+			return no("QUOTA/MAXSIZE", fmt.Sprintf("Scripts can be at most %d bytes", maxScriptBytes))
+		}
+		return s.respond(logic.PutScript(s.db, userid, args[0], args[1]), "Script saved")
+	case "LISTSCRIPTS":
+		if len(args) != 0 {
+			return no("", "LISTSCRIPTS takes no arguments")
+		}
+		scripts, e := logic.ListScripts(s.db, userid)
+		if e != nil {
+			return s.respond(e, "")
+		}
+		b := &strings.Builder{}
+		for _, script := range scripts {
+			b.WriteString(quote(script.Name))
+			if script.Active {
+				b.WriteString(" ACTIVE")
+			}
+			b.WriteString("\r\n")
+		}
+		if e = s.write(b.String()); e != nil {
+			return s.respond(e, "")
+		}
+		return s.respond(nil, "")
+	case "GETSCRIPT":
+		if len(args) != 1 {
+			return no("", "GETSCRIPT needs a script name")
+		}
+		script, e := logic.GetScript(s.db, userid, args[0])
+		if e != nil {
+			return s.respond(e, "")
+		}
+		if e = s.write(literal(script.Content) + "\r\n"); e != nil {
+			return s.respond(e, "")
+		}
+		return s.respond(nil, "")
+	case "SETACTIVE":
+		if len(args) != 1 {
+			return no("", "SETACTIVE needs a script name")
+		}
+		return s.respond(logic.SetActiveScript(s.db, userid, args[0]), "")
+	case "DELETESCRIPT":
+		if len(args) != 1 {
+			return no("", "DELETESCRIPT needs a script name")
+		}
+		return s.respond(logic.DeleteScript(s.db, userid, args[0]), "")
+	case "RENAMESCRIPT":
+		if len(args) != 2 {
+			return no("", "RENAMESCRIPT needs the old and new script names")
+		}
+		return s.respond(logic.RenameScript(s.db, userid, args[0], args[1]), "")
+	}
+	return no("", "Unknown command "+name)
+}
+
+/**
+ * Writes OK for a nil error, otherwise turns the error into a NO response
+ */
+func (s *session) respond(e error, message string) *response {
+	if e != nil {
+		switch e {
+		case logic.ErrNoSuchScript:
+			return no("NONEXISTENT", e.Error())
+		case logic.ErrScriptActive:
+			return no("ACTIVE", e.Error())
+		case logic.ErrScriptExists:
+			return no("ALREADYEXISTS", e.Error())
+		}
+		return no("", e.Error())
+	}
+	e = s.ok("", message)
+	if e != nil {
+		return no("", e.Error())
+	}
+	return nil
+}
+
+func (s *session) capabilities() error {
+	b := &strings.Builder{}
+	b.WriteString("\"IMPLEMENTATION\" \"henrymail\"\r\n")
+	fmt.Fprintf(b, "\"SIEVE\" %v\r\n", quote(strings.Join(sieve.Extensions, " ")))
+	if s.canAuthenticate() {
+		b.WriteString("\"SASL\" \"PLAIN\"\r\n")
+	} else {
+		b.WriteString("\"SASL\" \"\"\r\n")
+	}
+	if s.tls != nil && !s.encrypted {
+		b.WriteString("\"STARTTLS\"\r\n")
+	}
+	fmt.Fprintf(b, "\"MAXREDIRECTS\" \"%d\"\r\n", sieve.MaxRedirects)
+	b.WriteString("\"VERSION\" \"1.0\"\r\n")
+	return s.write(b.String())
+}
+
+/**
+ * Passwords are only accepted over TLS, unless it's turned off for IMAP too
+ */
+func (s *session) canAuthenticate() bool {
+	return s.encrypted || !config.GetBool(config.ImapUseTls)
+}
+
+func (s *session) startTls() error {
+	if s.tls == nil || s.encrypted {
+		return s.no("", "TLS isn't available")
+	}
+	// Anything sent after STARTTLS but before the handshake could have been
+	// injected by someone in the middle, so it mustn't be taken as coming over TLS
+	if s.reader.Buffered() > 0 {
+		_ = s.write(formatResponse("BYE", "", "Commands sent after STARTTLS"))
+		return errors.New("commands sent after STARTTLS")
+	}
+	e := s.ok("", "Begin TLS negotiation")
+	if e != nil {
+		return e
+	}
+	tlsConn := tls.Server(s.conn, s.tls)
+	e = tlsConn.Handshake()
+	if e != nil {
+		return e
+	}
+	s.conn = tlsConn
+	s.reader = bufio.NewReader(tlsConn)
+	s.encrypted = true
+	// Capabilities might have changed now the connection is secure
+	e = s.capabilities()
+	if e == nil {
+		e = s.ok("", "TLS negotiation successful")
+	}
+	return e
+}
+
+func (s *session) authenticate(args []string) error {
+	if len(args) == 0 || len(args) > 2 {
+		return s.no("", "AUTHENTICATE needs a mechanism")
+	}
+	if !strings.EqualFold(args[0], sasl.Plain) {
+		return s.no("", "Unsupported authentication mechanism")
+	}
+	if !s.canAuthenticate() {
+		return s.no("ENCRYPT-NEEDED", "Use STARTTLS first")
+	}
+
+	var user *models.User
+	server := sasl.NewPlainServer(func(identity, username, password string) error {
+		if identity != "" && identity != username {
+			return errors.New("can't authenticate as another user")
+		}
+		var e error
+		user, e = logic.Login(s.db, username, password)
+		return e
+	})
+
+	var initial []byte
+	if len(args) == 2 {
+		decoded, e := base64.StdEncoding.DecodeString(args[1])
+		if e != nil {
+			return s.no("", "Invalid base64")
+		}
+		initial = decoded
+	}
+	for {
+		challenge, done, e := server.Next(initial)
+		if e != nil {
+			return s.no("", "Authentication failed")
+		}
+		if done {
+			break
+		}
+		e = s.write(quote(base64.StdEncoding.EncodeToString(challenge)) + "\r\n")
+		if e != nil {
+			return e
+		}
+		reply, e := s.readArgs()
+		if e != nil {
+			return e
+		}
+		if len(reply) != 1 || reply[0] == "*" {
+			return s.no("", "Authentication cancelled")
+		}
+		initial, e = base64.StdEncoding.DecodeString(reply[0])
+		if e != nil {
+			return s.no("", "Invalid base64")
+		}
+	}
+	s.user = user
+	return s.ok("", "Logged in")
+}
+
+func (s *session) ok(code, message string) error {
+	return s.write(formatResponse("OK", code, message))
+}
+
+func (s *session) no(code, message string) error {
+	return s.write(formatResponse("NO", code, message))
+}
+
+func formatResponse(status, code, message string) string {
+	b := &strings.Builder{}
+	b.WriteString(status)
+	if code != "" {
+		fmt.Fprintf(b, " (%v)", code)
+	}
+	if message != "" {
+		b.WriteString(" " + quote(message))
+	}
+	b.WriteString("\r\n")
+	return b.String()
+}
+
+func (s *session) write(str string) error {
+	_, e := io.WriteString(s.conn, str)
+	return e
+}
+
+/**
+ * Strings are quoted if they can be, otherwise sent as literals
+ */
+func quote(str string) string {
+	if len(str) > 1024 || strings.ContainsAny(str, "\r\n\x00") {
+		return literal(str)
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(str) + `"`
+}
+
+func literal(str string) string {
+	return fmt.Sprintf("{%d}\r\n%v", len(str), str)
+}
+
+/**
+ * A problem with what the client sent, which doesn't end the session
+ */
+type syntaxError string
+
+func (e syntaxError) Error() string {
+	return string(e)
+}
+
+/**
+ * Reads a line of atoms, quoted strings and literals. Literals carry
+ * on after the end of the line, and the line continues after them.
+ * The whole command can be at most maxCommandBytes.
+ */
+func (s *session) readArgs() ([]string, error) {
+	var args []string
+	total := 0
+	for {
+		line, e := s.readLine()
+		if e != nil {
+			return nil, e
+		}
+		total += len(line)
+		for {
+			line = strings.TrimLeft(line, " ")
+			if line == "" {
+				return args, nil
+			}
+			switch line[0] {
+			case '"':
+				str, rest, e := unquote(line)
+				if e != nil {
+					return nil, e
+				}
+				args, line = append(args, str), rest
+				continue
+			case '{':
+				size, e := literalSize(line)
+				if e != nil {
+					return nil, e
+				}
+				total += size
+				if total > maxCommandBytes {
+					return nil, errTooLarge
+				}
+				buf := make([]byte, size)
+				_, e = io.ReadFull(s.reader, buf)
+				if e != nil {
+					return nil, e
+				}
+				args = append(args, string(buf))
+			default:
+				ix := strings.IndexByte(line, ' ')
+				if ix < 0 {
+					ix = len(line)
+				}
+				args, line = append(args, line[:ix]), line[ix:]
+				continue
+			}
+			// The rest of the command follows the literal
+			break
+		}
+	}
+}
+
+func (s *session) readLine() (string, error) {
+	var line []byte
+	for {
+		chunk, isPrefix, e := s.reader.ReadLine()
+		if e != nil {
+			return "", e
+		}
+		line = append(line, chunk...)
+		if len(line) > maxLineBytes {
+			return "", errors.New("line too long")
+		}
+		if !isPrefix {
+			return string(line), nil
+		}
+	}
+}
+
+func unquote(line string) (string, string, error) {
+	b := &strings.Builder{}
+	for i := 1; i < len(line); i++ {
+		switch line[i] {
+		case '"':
+			return b.String(), line[i+1:], nil
+		case '\\':
+			i++
+			if i < len(line) {
+				b.WriteByte(line[i])
+			}
+		default:
+			b.WriteByte(line[i])
+		}
+	}
+	return "", "", syntaxError("Unterminated string")
+}
+
+/**
+ * Literals are {size} or {size+}, at the end of a line. ManageSieve
+ * clients don't wait for the server before sending either kind.
+ */
+func literalSize(line string) (int, error) {
+	if !strings.HasSuffix(line, "}") {
+		return 0, syntaxError("Literals must end the line")
+	}
+	size, e := strconv.Atoi(strings.TrimSuffix(line[1:len(line)-1], "+"))
+	if e != nil || size < 0 {
+		return 0, syntaxError("Invalid literal")
+	}
+	if size > maxScriptBytes {
+		return 0, errTooLarge
+	}
+	return size, nil
+}
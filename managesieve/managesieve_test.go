@@ -0,0 +1,311 @@
+package managesieve
+
+import (
+	"bufio"
+	"crypto/tls"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/bcrypt"
+	"henrymail/config"
+	"henrymail/sieve"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadArgs(t *testing.T) {
+	tests := []struct {
+		input string
+		args  []string
+	}{
+		{"LISTSCRIPTS\r\n", []string{"LISTSCRIPTS"}},
+		{"\r\n", nil},
+		{"  havespace  \"my script\"  100\r\n", []string{"havespace", "my script", "100"}},
+		{`GETSCRIPT "a \"quoted\" \\ name"` + "\r\n", []string{"GETSCRIPT", `a "quoted" \ name`}},
+		{"GETSCRIPT \"\"\r\n", []string{"GETSCRIPT", ""}},
+		// Literals carry on past the end of the line, with or without a +
+		{"PUTSCRIPT \"s\" {12+}\r\nkeep;\r\nstop;\r\n", []string{"PUTSCRIPT", "s", "keep;\r\nstop;"}},
+		{"PUTSCRIPT \"s\" {5}\r\nkeep;\r\n", []string{"PUTSCRIPT", "s", "keep;"}},
+		{"PUTSCRIPT {1+}\r\ns {0}\r\n\r\n", []string{"PUTSCRIPT", "s", ""}},
+		{"RENAMESCRIPT {3+}\r\nold \"new\"\r\n", []string{"RENAMESCRIPT", "old", "new"}},
+		// A bare newline ends the line as well
+		{"NOOP\n", []string{"NOOP"}},
+	}
+	for _, test := range tests {
+		s := &session{reader: bufio.NewReader(strings.NewReader(test.input))}
+		args, e := s.readArgs()
+		if e != nil || !reflect.DeepEqual(args, test.args) {
+			t.Errorf("readArgs(%q) = %q %v, expected %q", test.input, args, e, test.args)
+		}
+	}
+
+	for _, test := range []struct {
+		input  string
+		syntax bool // If it's a problem with the command, rather than the connection
+	}{
+		{"GETSCRIPT \"unterminated\r\n", true},
+		{"PUTSCRIPT \"s\" {5} keep;\r\n", true},
+		{"PUTSCRIPT \"s\" {five}\r\n", true},
+		{"PUTSCRIPT \"s\" {-1}\r\n", true},
+		{fmt.Sprintf("PUTSCRIPT \"s\" {%d+}\r\n", maxScriptBytes+1), false},
+		// Each literal is small enough, but not all of them together
+		{fmt.Sprintf("PUTSCRIPT {%d+}\r\n%v {%d+}\r\n%v\r\n", maxLineBytes+1, strings.Repeat("x", maxLineBytes+1),
+			maxScriptBytes, strings.Repeat("x", maxScriptBytes)), false},
+		{"PUTSCRIPT \"s\" {10+}\r\nkeep;", false},
+		{"NOOP " + strings.Repeat("x", maxLineBytes) + "\r\n", false},
+	} {
+		s := &session{reader: bufio.NewReader(strings.NewReader(test.input))}
+		args, e := s.readArgs()
+		if _, ok := e.(syntaxError); e == nil || ok != test.syntax {
+			t.Errorf("readArgs(%.40q) = %q %v, expected a syntax error: %v", test.input, args, e, test.syntax)
+		}
+	}
+}
+
+func TestQuote(t *testing.T) {
+	tests := []struct {
+		str, quoted string
+	}{
+		{"", `""`},
+		{"name", `"name"`},
+		{`a "b" \c`, `"a \"b\" \\c"`},
+		{"keep;\r\n", "{7}\r\nkeep;\r\n"},
+		{strings.Repeat("x", 1025), "{1025}\r\n" + strings.Repeat("x", 1025)},
+	}
+	for _, test := range tests {
+		if quoted := quote(test.str); quoted != test.quoted {
+			t.Errorf("quote(%.20q) = %.20q, expected %.20q", test.str, quoted, test.quoted)
+		}
+	}
+	if r := formatResponse("NO", "NONEXISTENT", "no such script"); r != "NO (NONEXISTENT) \"no such script\"\r\n" {
+		t.Errorf("unexpected response %q", r)
+	}
+	if r := formatResponse("OK", "", ""); r != "OK\r\n" {
+		t.Errorf("unexpected response %q", r)
+	}
+}
+
+/**
+ * An empty database in memory, with the user bob@example.com whose password is pw
+ */
+func testDb(t *testing.T) *sql.DB {
+	db, e := sql.Open("sqlite3", ":memory:")
+	if e != nil {
+		t.Fatal(e)
+	}
+	// Each connection would have a database of its own
+	db.SetMaxOpenConns(1)
+	schema, e := ioutil.ReadFile("../database/generate_schema.sql")
+	if e != nil {
+		t.Fatal(e)
+	}
+	_, e = db.Exec(string(schema))
+	if e != nil {
+		t.Fatal(e)
+	}
+	password, e := bcrypt.GenerateFromPassword([]byte("pw"), bcrypt.MinCost)
+	if e != nil {
+		t.Fatal(e)
+	}
+	_, e = db.Exec("INSERT INTO users (username, passwordBytes, admin) VALUES ('bob@example.com', ?, 0)", password)
+	if e != nil {
+		t.Fatal(e)
+	}
+	return db
+}
+
+/**
+ * The client's end of a connection to a session
+ */
+type testClient struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func (c *testClient) send(command string) {
+	_ = c.conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, e := c.conn.Write([]byte(command + "\r\n"))
+	if e != nil {
+		c.t.Fatalf("sending %.40q: %v", command, e)
+	}
+}
+
+/**
+ * The lines of the response, up to the one with the status
+ */
+func (c *testClient) response() []string {
+	var lines []string
+	for {
+		_ = c.conn.SetDeadline(time.Now().Add(5 * time.Second))
+		line, e := c.reader.ReadString('\n')
+		if e != nil {
+			c.t.Fatalf("reading response after %q: %v", lines, e)
+		}
+		line = strings.TrimRight(line, "\r\n")
+		lines = append(lines, line)
+		if strings.HasPrefix(line, "OK") || strings.HasPrefix(line, "NO") || strings.HasPrefix(line, "BYE") {
+			return lines
+		}
+	}
+}
+
+/**
+ * Reads a line the server sends in the middle of a command, which has
+ * to be read before the client can carry on
+ */
+func (c *testClient) challenge(expected string) {
+	_ = c.conn.SetDeadline(time.Now().Add(5 * time.Second))
+	line, e := c.reader.ReadString('\n')
+	if e != nil {
+		c.t.Fatal(e)
+	}
+	if line = strings.TrimRight(line, "\r\n"); line != expected {
+		c.t.Errorf("got %q, expected %q", line, expected)
+	}
+}
+
+func (c *testClient) expect(command string, expected ...string) {
+	if command != "" {
+		c.send(command)
+	}
+	if lines := c.response(); !reflect.DeepEqual(lines, expected) {
+		c.t.Errorf("%.40q gave %q, expected %q", command, lines, expected)
+	}
+}
+
+func TestSession(t *testing.T) {
+	viper.Set(config.MaxIdleSeconds, 60)
+	viper.Set(config.ImapUseTls, true)
+	viper.Set(config.Domain, "example.com")
+	cert, e := config.GenerateCert("localhost", time.Hour, false, 1024)
+	if e != nil {
+		t.Fatal(e)
+	}
+	db := testDb(t)
+	defer db.Close()
+	server, conn := net.Pipe()
+	s := &session{
+		db:     db,
+		tls:    &tls.Config{Certificates: []tls.Certificate{cert}},
+		conn:   server,
+		reader: bufio.NewReader(server),
+	}
+	done := make(chan bool)
+	go func() {
+		s.serve()
+		close(done)
+	}()
+	c := &testClient{t: t, conn: conn, reader: bufio.NewReader(conn)}
+	defer conn.Close()
+
+	capabilities := []string{
+		`"IMPLEMENTATION" "henrymail"`,
+		`"SIEVE" ` + quote(strings.Join(sieve.Extensions, " ")),
+	}
+	maxRedirects := fmt.Sprintf(`"MAXREDIRECTS" "%d"`, sieve.MaxRedirects)
+	c.expect("", append(capabilities, `"SASL" ""`, `"STARTTLS"`, maxRedirects, `"VERSION" "1.0"`,
+		`OK "henrymail ready"`)...)
+	plain := base64.StdEncoding.EncodeToString([]byte("\x00bob\x00pw"))
+	c.expect(`AUTHENTICATE "PLAIN" "`+plain+`"`, `NO (ENCRYPT-NEEDED) "Use STARTTLS first"`)
+	c.expect("LISTSCRIPTS", `NO "Authenticate first"`)
+	c.expect(`NOOP "tag"`, `OK (TAG "tag") "Done"`)
+
+	// Capabilities are sent again once TLS is set up
+	c.expect("STARTTLS", `OK "Begin TLS negotiation"`)
+	encrypted := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+	c.conn, c.reader = encrypted, bufio.NewReader(encrypted)
+	c.expect("", append(capabilities, `"SASL" "PLAIN"`, maxRedirects, `"VERSION" "1.0"`,
+		`OK "TLS negotiation successful"`)...)
+	c.expect("STARTTLS", `NO "TLS isn't available"`)
+
+	wrong := base64.StdEncoding.EncodeToString([]byte("\x00bob\x00wrong"))
+	c.expect(`AUTHENTICATE "PLAIN" "`+wrong+`"`, `NO "Authentication failed"`)
+	c.expect(`AUTHENTICATE "LOGIN"`, `NO "Unsupported authentication mechanism"`)
+	c.expect(`AUTHENTICATE "PLAIN" "not base64!"`, `NO "Invalid base64"`)
+	// Without an initial response, the server asks for one
+	c.send(`AUTHENTICATE "PLAIN"`)
+	c.challenge(`""`)
+	c.expect(`"*"`, `NO "Authentication cancelled"`)
+	c.send(`AUTHENTICATE "PLAIN"`)
+	c.challenge(`""`)
+	c.expect(`"`+plain+`"`, `OK "Logged in"`)
+	c.expect(`AUTHENTICATE "PLAIN" "`+plain+`"`, `NO "Already authenticated"`)
+
+	script := "require \"fileinto\";\r\nfileinto \"Lists\";"
+	c.expect("CHECKSCRIPT "+quote(script), `OK "Script is valid"`)
+	c.expect(`CHECKSCRIPT "fileinto \"Lists\";"`, `NO "line 1: fileinto needs require \"fileinto\""`)
+	c.expect(fmt.Sprintf("PUTSCRIPT \"lists\" {%d+}\r\n%v", len(script), script), `OK "Script saved"`)
+	c.expect(`PUTSCRIPT "bad" "keep"`, `NO "line 1: expected ; or { after keep but found end of script"`)
+	c.expect(`HAVESPACE "lists" 100`, `OK`)
+	c.expect(fmt.Sprintf(`HAVESPACE "lists" %d`, maxScriptBytes+1),
+		fmt.Sprintf(`NO (QUOTA/MAXSIZE) "Scripts can be at most %d bytes"`, maxScriptBytes))
+	c.expect("LISTSCRIPTS", `"lists"`, `OK`)
+	c.expect(`SETACTIVE "lists"`, `OK`)
+	c.expect("LISTSCRIPTS", `"lists" ACTIVE`, `OK`)
+	c.expect(`GETSCRIPT "lists"`, fmt.Sprintf("{%d}", len(script)), `require "fileinto";`, `fileinto "Lists";`, `OK`)
+	c.expect(`GETSCRIPT "other"`, `NO (NONEXISTENT) "no such script"`)
+	c.expect(`DELETESCRIPT "lists"`, `NO (ACTIVE) "the active script can't be deleted"`)
+	c.expect(`RENAMESCRIPT "lists" "mail"`, `OK`)
+	c.expect(`SETACTIVE ""`, `OK`)
+	c.expect(`DELETESCRIPT "mail"`, `OK`)
+	c.expect("LISTSCRIPTS", `OK`)
+	c.expect("BOGUS", `NO "Unknown command BOGUS"`)
+	c.expect(`GETSCRIPT "unterminated`, `NO "Unterminated string"`)
+
+	c.expect("UNAUTHENTICATE", `OK`)
+	c.expect("LISTSCRIPTS", `NO "Authenticate first"`)
+	c.expect("LOGOUT", `OK "Bye"`)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("the session didn't end after LOGOUT")
+	}
+}
+
+func TestSessionClosed(t *testing.T) {
+	viper.Set(config.MaxIdleSeconds, 60)
+	cert, e := config.GenerateCert("localhost", time.Hour, false, 1024)
+	if e != nil {
+		t.Fatal(e)
+	}
+	db := testDb(t)
+	defer db.Close()
+	for _, test := range []struct {
+		command string
+		bye     string
+	}{
+		// Someone in the middle could have added the NOOP, so it mustn't run once TLS is up
+		{"STARTTLS\r\nNOOP", `BYE "Commands sent after STARTTLS"`},
+		{fmt.Sprintf("PUTSCRIPT {%d+}\r\n%v {%d+}", maxLineBytes, strings.Repeat("x", maxLineBytes), maxScriptBytes),
+			`BYE (QUOTA/MAXSIZE) "Command too large"`},
+	} {
+		server, conn := net.Pipe()
+		s := &session{
+			db:     db,
+			tls:    &tls.Config{Certificates: []tls.Certificate{cert}},
+			conn:   server,
+			reader: bufio.NewReader(server),
+		}
+		done := make(chan bool)
+		go func() {
+			s.serve()
+			close(done)
+		}()
+		c := &testClient{t: t, conn: conn, reader: bufio.NewReader(conn)}
+		c.response()
+		c.expect(test.command, test.bye)
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Errorf("the session didn't end after %.40q", test.command)
+		}
+		conn.Close()
+	}
+}
@@ -0,0 +1,716 @@
+package pop3
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-sasl"
+	"henrymail/config"
+	"henrymail/database"
+	"henrymail/events"
+	"henrymail/logic"
+	"henrymail/models"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**
+ * POP3 from RFC 1939, for clients and fetch services that don't speak IMAP,
+ * with CAPA (RFC 2449), STLS (RFC 2595) and AUTH PLAIN (RFC 5034). Users
+ * see the messages in their INBOX when they logged in, and each message's
+ * UIDL is its IMAP UID. DELE flags a message \Deleted, and the messages
+ * deleted that way are expunged on QUIT. A user can have one session at a
+ * time.
+ */
+
+const (
+	maxLineBytes = 1024
+	// RFC 1939 says at least 10 minutes
+	idleTimeout = 10 * time.Minute
+)
+
+var errQuit = errors.New("quit")
+
+/**
+ * The users with a POP3 session, which has the maildrop to itself until it
+ * ends, see RFC 1939 section 8
+ */
+var maildrops = struct {
+	sync.Mutex
+	locked map[int]bool
+}{locked: map[int]bool{}}
+
+func lockMaildrop(userid int) bool {
+	maildrops.Lock()
+	defer maildrops.Unlock()
+	if maildrops.locked[userid] {
+		return false
+	}
+	maildrops.locked[userid] = true
+	return true
+}
+
+func unlockMaildrop(userid int) {
+	maildrops.Lock()
+	defer maildrops.Unlock()
+	delete(maildrops.locked, userid)
+}
+
+func StartPop3(db *sql.DB, tlsConfig *tls.Config) {
+	listen(db, tlsConfig, config.GetString(config.Pop3Address), false)
+	if config.GetBool(config.Pop3UseTls) {
+		listen(db, tlsConfig, config.GetString(config.Pop3ImplicitTLSAddress), true)
+	}
+}
+
+func listen(db *sql.DB, tlsConfig *tls.Config, addr string, implicitTls bool) {
+	l, e := net.Listen("tcp", addr)
+	if e != nil {
+		log.Fatal(e)
+	}
+	if implicitTls {
+		l = tls.NewListener(l, tlsConfig)
+	}
+	go func() {
+		if implicitTls {
+			log.Println("Starting POP3 server with implicit TLS at ", addr)
+		} else {
+			log.Println("Starting POP3 server at ", addr)
+		}
+		for {
+			c, e := l.Accept()
+			if e != nil {
+				log.Fatal(e)
+			}
+			s := &session{
+				db:        db,
+				tls:       tlsConfig,
+				conn:      c,
+				reader:    bufio.NewReader(c),
+				encrypted: implicitTls,
+			}
+			go s.serve()
+		}
+	}()
+}
+
+type session struct {
+	db        *sql.DB
+	tls       *tls.Config
+	conn      net.Conn
+	reader    *bufio.Reader
+	encrypted bool
+	username  string // From USER, until PASS
+	user      *models.User
+	inboxid   int
+	messages  []*message
+}
+
+/**
+ * A message in the maildrop, which is numbered from 1 in UID order and
+ * doesn't change during the session
+ */
+type message struct {
+	id      int
+	uid     int
+	size    int // As RETR sends it, with CRLF line endings
+	deleted bool
+	flagged bool // If DELE added \Deleted, so RSET should take it away
+}
+
+func (s *session) serve() {
+	defer s.conn.Close()
+	e := s.ok("henrymail POP3 server ready")
+	for e == nil {
+		e = s.command()
+	}
+	if e != errQuit {
+		// Without a QUIT nothing's deleted, see RFC 1939 section 6
+		s.undelete()
+		if e != io.EOF {
+			log.Printf("POP3 connection from %v closed: %v", s.conn.RemoteAddr(), e)
+		}
+	}
+	if s.user != nil {
+		unlockMaildrop(s.user.ID)
+	}
+}
+
+func (s *session) command() error {
+	_ = s.conn.SetReadDeadline(time.Now().Add(idleTimeout))
+	line, e := s.readLine()
+	if e != nil {
+		return e
+	}
+	args := strings.Fields(line)
+	if len(args) == 0 {
+		return s.err("Empty command")
+	}
+	name, args := strings.ToUpper(args[0]), args[1:]
+
+	switch name {
+	case "CAPA":
+		return s.capabilities()
+	case "QUIT":
+		return s.quit()
+	}
+	if s.user == nil {
+		return s.authorization(name, args, line)
+	}
+	return s.transaction(name, args)
+}
+
+func (s *session) capabilities() error {
+	lines := []string{"TOP", "UIDL", "RESP-CODES", "AUTH-RESP-CODE", "PIPELINING"}
+	if s.user == nil {
+		if s.canAuthenticate() {
+			lines = append(lines, "USER", "SASL "+sasl.Plain)
+		}
+		if s.tls != nil && !s.encrypted {
+			lines = append(lines, "STLS")
+		}
+	}
+	lines = append(lines, "IMPLEMENTATION henrymail")
+	return s.multiline("Capability list follows", lines)
+}
+
+/**
+ * Passwords are only accepted over TLS, unless it's turned off for POP3
+ */
+func (s *session) canAuthenticate() bool {
+	return s.encrypted || !config.GetBool(config.Pop3UseTls)
+}
+
+/**
+ * Commands before the user has logged in
+ */
+func (s *session) authorization(name string, args []string, line string) error {
+	switch name {
+	case "STLS":
+		return s.startTls()
+	case "USER", "PASS", "AUTH":
+		if !s.canAuthenticate() {
+			return s.err("Use STLS first")
+		}
+	default:
+		return s.err("Log in first")
+	}
+	switch name {
+	case "USER":
+		if len(args) != 1 {
+			return s.err("USER needs a username")
+		}
+		s.username = args[0]
+		return s.ok("Send your password")
+	case "PASS":
+		if s.username == "" {
+			return s.err("Send USER first")
+		}
+		username := s.username
+		s.username = ""
+		// The password can have spaces in it
+		parts := strings.SplitN(line, " ", 2)
+		if len(parts) != 2 {
+			return s.err("PASS needs a password")
+		}
+		return s.login(username, parts[1])
+	}
+	return s.authenticate(args)
+}
+
+func (s *session) startTls() error {
+	if s.tls == nil || s.encrypted {
+		return s.err("TLS isn't available")
+	}
+	e := s.ok("Begin TLS negotiation")
+	if e != nil {
+		return e
+	}
+	tlsConn := tls.Server(s.conn, s.tls)
+	e = tlsConn.Handshake()
+	if e != nil {
+		return e
+	}
+	s.conn = tlsConn
+	s.reader = bufio.NewReader(tlsConn)
+	s.encrypted = true
+	return nil
+}
+
+func (s *session) authenticate(args []string) error {
+	if len(args) == 0 {
+		return s.multiline("Mechanisms follow", []string{sasl.Plain})
+	}
+	if len(args) > 2 {
+		return s.err("AUTH needs a mechanism")
+	}
+	if !strings.EqualFold(args[0], sasl.Plain) {
+		return s.err("Unsupported authentication mechanism")
+	}
+	var username, password string
+	server := sasl.NewPlainServer(func(identity, u, p string) error {
+		if identity != "" && identity != u {
+			return errors.New("can't authenticate as another user")
+		}
+		username, password = u, p
+		return nil
+	})
+	var response []byte
+	if len(args) == 2 && args[1] != "=" {
+		decoded, e := base64.StdEncoding.DecodeString(args[1])
+		if e != nil {
+			return s.err("Invalid base64")
+		}
+		response = decoded
+	}
+	for {
+		challenge, done, e := server.Next(response)
+		if e != nil {
+			return s.err("[AUTH] Authentication failed")
+		}
+		if done {
+			break
+		}
+		e = s.write("+ " + base64.StdEncoding.EncodeToString(challenge) + "\r\n")
+		if e != nil {
+			return e
+		}
+		line, e := s.readLine()
+		if e != nil {
+			return e
+		}
+		if line == "*" {
+			return s.err("Authentication cancelled")
+		}
+		response, e = base64.StdEncoding.DecodeString(line)
+		if e != nil {
+			return s.err("Invalid base64")
+		}
+	}
+	return s.login(username, password)
+}
+
+/**
+ * Takes a snapshot of the user's INBOX, which is what they'll see until they
+ * log out. Only one session at a time can have it.
+ */
+func (s *session) login(username, password string) error {
+	user, e := logic.Login(s.db, username, password)
+	if e != nil {
+		return s.err("[AUTH] Invalid username or password")
+	}
+	if !lockMaildrop(user.ID) {
+		return s.err("[IN-USE] Maildrop is already in use")
+	}
+	messages, inbox, e := s.snapshot(user)
+	if e != nil {
+		unlockMaildrop(user.ID)
+		return s.sysErr(e)
+	}
+	s.user = user
+	s.inboxid = inbox.ID
+	s.messages = messages
+	count, size := s.stat()
+	return s.ok(fmt.Sprintf("%v has %d messages (%d octets)", user.Username, count, size))
+}
+
+func (s *session) snapshot(user *models.User) ([]*message, *models.Mailbox, error) {
+	inbox, e := models.MailboxByUseridName(s.db, user.ID, imap.InboxName)
+	if e != nil {
+		return nil, nil, e
+	}
+	// The stored size is of the message as it came, which might not have had CRLFs
+	rows, e := s.db.Query("SELECT id, uid, content FROM messages WHERE mailboxid = ? ORDER BY uid", inbox.ID)
+	if e != nil {
+		return nil, nil, e
+	}
+	defer rows.Close()
+	var messages []*message
+	for rows.Next() {
+		m := &message{}
+		var content []byte
+		e = rows.Scan(&m.id, &m.uid, &content)
+		if e != nil {
+			return nil, nil, e
+		}
+		m.size = linesSize(messageLines(content))
+		messages = append(messages, m)
+	}
+	return messages, inbox, rows.Err()
+}
+
+func (s *session) stat() (count, size int) {
+	for _, m := range s.messages {
+		if !m.deleted {
+			count++
+			size += m.size
+		}
+	}
+	return count, size
+}
+
+/**
+ * Commands once the user has logged in
+ */
+func (s *session) transaction(name string, args []string) error {
+	switch name {
+	case "STAT":
+		count, size := s.stat()
+		return s.ok(fmt.Sprintf("%d %d", count, size))
+	case "LIST", "UIDL":
+		show := func(n int, m *message) string {
+			if name == "LIST" {
+				return fmt.Sprintf("%d %d", n, m.size)
+			}
+			return fmt.Sprintf("%d %d", n, m.uid)
+		}
+		if len(args) > 0 {
+			n, m, e := s.message(args[0])
+			if e != nil {
+				return s.err(e.Error())
+			}
+			return s.ok(show(n, m))
+		}
+		var lines []string
+		for i, m := range s.messages {
+			if !m.deleted {
+				lines = append(lines, show(i+1, m))
+			}
+		}
+		return s.multiline("Listing follows", lines)
+	case "RETR":
+		if len(args) != 1 {
+			return s.err("RETR needs a message number")
+		}
+		return s.retrieve(args[0], -1)
+	case "TOP":
+		if len(args) != 2 {
+			return s.err("TOP needs a message number and a number of lines")
+		}
+		lines, e := strconv.Atoi(args[1])
+		if e != nil || lines < 0 {
+			return s.err("Invalid number of lines")
+		}
+		return s.retrieve(args[0], lines)
+	case "DELE":
+		if len(args) != 1 {
+			return s.err("DELE needs a message number")
+		}
+		n, m, e := s.message(args[0])
+		if e != nil {
+			return s.err(e.Error())
+		}
+		m.flagged, e = s.setDeleted(m, true)
+		if e != nil {
+			return s.sysErr(e)
+		}
+		m.deleted = true
+		return s.ok(fmt.Sprintf("Message %d deleted", n))
+	case "RSET":
+		e := s.undelete()
+		if e != nil {
+			return s.sysErr(e)
+		}
+		count, size := s.stat()
+		return s.ok(fmt.Sprintf("Maildrop has %d messages (%d octets)", count, size))
+	case "NOOP":
+		return s.ok("")
+	}
+	return s.err("Unknown command " + name)
+}
+
+/**
+ * The message with the given number, which mustn't have been deleted
+ */
+func (s *session) message(arg string) (int, *message, error) {
+	n, e := strconv.Atoi(arg)
+	if e != nil || n < 1 || n > len(s.messages) {
+		return 0, nil, errors.New("No such message")
+	}
+	m := s.messages[n-1]
+	if m.deleted {
+		return 0, nil, fmt.Errorf("Message %d has been deleted", n)
+	}
+	return n, m, nil
+}
+
+/**
+ * Sends the message, or its header and the first lines of its body
+ * if lines isn't negative
+ */
+func (s *session) retrieve(arg string, lines int) error {
+	_, m, e := s.message(arg)
+	if e != nil {
+		return s.err(e.Error())
+	}
+	var content []byte
+	e = s.db.QueryRow("SELECT content FROM messages WHERE id = ?", m.id).Scan(&content)
+	if e == sql.ErrNoRows {
+		return s.err("Message has been removed by another client")
+	} else if e != nil {
+		return s.sysErr(e)
+	}
+	msgLines := messageLines(content)
+	if lines >= 0 {
+		msgLines = headerAndLines(msgLines, lines)
+	}
+	return s.multiline(fmt.Sprintf("%d octets", m.size), msgLines)
+}
+
+/**
+ * The message's lines, without their line endings, which can be CRLF or LF
+ */
+func messageLines(content []byte) []string {
+	msgLines := strings.Split(string(bytes.TrimSuffix(bytes.TrimSuffix(content, []byte("\n")), []byte("\r"))), "\n")
+	for i, line := range msgLines {
+		msgLines[i] = strings.TrimSuffix(line, "\r")
+	}
+	return msgLines
+}
+
+/**
+ * The size of the lines with CRLFs, which is how RFC 1939 counts messages.
+ * The dots added to lines that start with one aren't counted.
+ */
+func linesSize(lines []string) int {
+	size := 0
+	for _, line := range lines {
+		size += len(line) + 2
+	}
+	return size
+}
+
+func headerAndLines(msgLines []string, lines int) []string {
+	for i, line := range msgLines {
+		if line == "" {
+			end := i + 1 + lines
+			if end > len(msgLines) {
+				end = len(msgLines)
+			}
+			return msgLines[:end]
+		}
+	}
+	return msgLines
+}
+
+/**
+ * Adds or takes away the message's \Deleted flag, telling IMAP sessions.
+ * Returns false if it already had the flag, or had already gone.
+ */
+func (s *session) setDeleted(m *message, deleted bool) (bool, error) {
+	var changes []events.Event
+	e := database.Transact(s.db, func(tx *sql.Tx) error {
+		var flagsJson []byte
+		e := tx.QueryRow("SELECT flagsjson FROM messages WHERE id = ?", m.id).Scan(&flagsJson)
+		if e == sql.ErrNoRows {
+			return nil
+		} else if e != nil {
+			return e
+		}
+		var flags []string
+		e = json.Unmarshal(flagsJson, &flags)
+		if e != nil {
+			return e
+		}
+		var updated []string
+		for _, flag := range flags {
+			if flag != imap.DeletedFlag {
+				updated = append(updated, flag)
+			}
+		}
+		if len(updated) != len(flags) == deleted {
+			return nil
+		}
+		if deleted {
+			updated = append(updated, imap.DeletedFlag)
+		}
+		if updated == nil {
+			updated = []string{}
+		}
+		flagsJson, e = json.Marshal(updated)
+		if e != nil {
+			return e
+		}
+		mailbox, e := models.MailboxByID(tx, s.inboxid)
+		if e != nil {
+			return e
+		}
+		modseq := logic.NextModseq(mailbox)
+		_, e = tx.Exec("UPDATE messages SET flagsjson = ?, modseq = ? WHERE id = ?", flagsJson, modseq, m.id)
+		if e != nil {
+			return e
+		}
+		changes = append(changes, events.Event{
+			Type:      events.Flags,
+			Userid:    s.user.ID,
+			Mailboxid: s.inboxid,
+			UID:       m.uid,
+			Flags:     updated,
+			Modseq:    modseq,
+		})
+		return mailbox.Save(tx)
+	})
+	if e != nil {
+		return false, e
+	}
+	events.PublishAndWait(changes...)
+	return len(changes) > 0, nil
+}
+
+/**
+ * Puts back the flags of messages deleted in this session
+ */
+func (s *session) undelete() error {
+	for _, m := range s.messages {
+		if m.flagged {
+			_, e := s.setDeleted(m, false)
+			if e != nil {
+				return e
+			}
+		}
+		m.deleted = false
+		m.flagged = false
+	}
+	return nil
+}
+
+/**
+ * Expunges the messages deleted in this session, see RFC 1939 section 6
+ */
+func (s *session) quit() error {
+	if s.user == nil {
+		e := s.ok("Bye")
+		if e == nil {
+			e = errQuit
+		}
+		return e
+	}
+	deleted := map[int]bool{}
+	for _, m := range s.messages {
+		if m.deleted {
+			deleted[m.id] = true
+		}
+	}
+	var expunged []events.Event
+	e := database.Transact(s.db, func(tx *sql.Tx) error {
+		if len(deleted) == 0 {
+			return nil
+		}
+		mailbox, e := models.MailboxByID(tx, s.inboxid)
+		if e != nil {
+			return e
+		}
+		rows, e := tx.Query("SELECT id, uid FROM messages WHERE mailboxid = ? ORDER BY uid", s.inboxid)
+		if e != nil {
+			return e
+		}
+		var gone []*models.Message
+		for rows.Next() {
+			msg := &models.Message{}
+			e = rows.Scan(&msg.ID, &msg.UID)
+			if e != nil {
+				rows.Close()
+				return e
+			}
+			if !deleted[msg.ID] {
+				continue
+			}
+			expunged = append(expunged, events.Event{
+				Type:      events.Expunge,
+				Userid:    s.user.ID,
+				Mailboxid: s.inboxid,
+				UID:       msg.UID,
+			})
+			gone = append(gone, msg)
+		}
+		rows.Close()
+		if e = rows.Err(); e != nil {
+			return e
+		}
+		if len(gone) == 0 {
+			return nil
+		}
+		return logic.ExpungeMessages(tx, mailbox, gone...)
+	})
+	if e != nil {
+		// The session's over either way, but the messages are left as they were
+		expunged = nil
+		if undeleteErr := s.undelete(); undeleteErr != nil {
+			log.Printf("Unable to undelete messages for POP3 user %v: %v", s.user.Username, undeleteErr)
+		}
+		e = s.err("[SYS/TEMP] Unable to delete messages: " + e.Error())
+	} else {
+		count, _ := s.stat()
+		e = s.ok(fmt.Sprintf("Bye, %d messages left", count))
+	}
+	events.PublishAndWait(expunged...)
+	if e == nil {
+		e = errQuit
+	}
+	return e
+}
+
+func (s *session) ok(message string) error {
+	if message == "" {
+		return s.write("+OK\r\n")
+	}
+	return s.write("+OK " + message + "\r\n")
+}
+
+func (s *session) err(message string) error {
+	return s.write("-ERR " + message + "\r\n")
+}
+
+func (s *session) sysErr(e error) error {
+	log.Printf("POP3 error for %v: %v", s.conn.RemoteAddr(), e)
+	return s.err("[SYS/TEMP] " + e.Error())
+}
+
+/**
+ * +OK and lines ending with a ".", where lines starting with "." get another
+ */
+func (s *session) multiline(message string, lines []string) error {
+	b := &strings.Builder{}
+	b.WriteString("+OK " + message + "\r\n")
+	for _, line := range lines {
+		if strings.HasPrefix(line, ".") {
+			b.WriteString(".")
+		}
+		b.WriteString(line + "\r\n")
+	}
+	b.WriteString(".\r\n")
+	return s.write(b.String())
+}
+
+func (s *session) write(str string) error {
+	_, e := io.WriteString(s.conn, str)
+	return e
+}
+
+func (s *session) readLine() (string, error) {
+	var line []byte
+	for {
+		chunk, isPrefix, e := s.reader.ReadLine()
+		if e != nil {
+			return "", e
+		}
+		line = append(line, chunk...)
+		if len(line) > maxLineBytes {
+			return "", errors.New("line too long")
+		}
+		if !isPrefix {
+			return string(line), nil
+		}
+	}
+}
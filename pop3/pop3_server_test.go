@@ -0,0 +1,167 @@
+package pop3
+
+import (
+	"bufio"
+	"database/sql"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/bcrypt"
+	"henrymail/config"
+	"henrymail/database"
+	"henrymail/logic"
+	"henrymail/models"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+/**
+ * An empty database in memory, with the user bob@example.com whose
+ * password is pw, and these messages in his INBOX
+ */
+func testDb(t *testing.T, contents ...string) *sql.DB {
+	db, e := sql.Open("sqlite3", ":memory:")
+	if e != nil {
+		t.Fatal(e)
+	}
+	// Each connection would have a database of its own
+	db.SetMaxOpenConns(1)
+	for _, file := range []string{"generate_schema.sql", "search_index.sql"} {
+		schema, e := ioutil.ReadFile("../database/" + file)
+		if e != nil {
+			t.Fatal(e)
+		}
+		_, e = db.Exec(string(schema))
+		if e != nil {
+			t.Fatal(e)
+		}
+	}
+	password, e := bcrypt.GenerateFromPassword([]byte("pw"), bcrypt.MinCost)
+	if e != nil {
+		t.Fatal(e)
+	}
+	_, e = db.Exec("INSERT INTO users (id, username, passwordBytes, admin) VALUES (1, 'bob@example.com', ?, 0)", password)
+	if e != nil {
+		t.Fatal(e)
+	}
+	inbox, e := logic.CreateMailbox(db, 1, "INBOX")
+	if e != nil {
+		t.Fatal(e)
+	}
+	e = database.Transact(db, func(tx *sql.Tx) error {
+		for _, content := range contents {
+			e := logic.SaveMessages(tx, inbox, &models.Message{Content: []byte(content), Flagsjson: []byte("[]")})
+			if e != nil {
+				return e
+			}
+		}
+		return nil
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+	return db
+}
+
+/**
+ * The client's end of a connection to a session
+ */
+type testClient struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+	done   chan bool
+}
+
+func dial(t *testing.T, db *sql.DB) *testClient {
+	server, conn := net.Pipe()
+	s := &session{db: db, conn: server, reader: bufio.NewReader(server)}
+	c := &testClient{t: t, conn: conn, reader: bufio.NewReader(conn), done: make(chan bool)}
+	go func() {
+		s.serve()
+		close(c.done)
+	}()
+	c.expect("", "+OK henrymail POP3 server ready")
+	return c
+}
+
+/**
+ * Sends the command, unless it's empty, and checks the lines that come back
+ */
+func (c *testClient) expect(command string, expected ...string) {
+	_ = c.conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if command != "" {
+		_, e := c.conn.Write([]byte(command + "\r\n"))
+		if e != nil {
+			c.t.Fatalf("sending %q: %v", command, e)
+		}
+	}
+	var lines []string
+	for range expected {
+		line, e := c.reader.ReadString('\n')
+		if e != nil {
+			c.t.Fatalf("reading response to %q after %q: %v", command, lines, e)
+		}
+		lines = append(lines, line)
+	}
+	if got := strings.Join(lines, ""); got != strings.Join(expected, "\r\n")+"\r\n" {
+		c.t.Errorf("%q gave %q, expected %q", command, got, expected)
+	}
+}
+
+func TestSession(t *testing.T) {
+	viper.Set(config.Pop3UseTls, false)
+	db := testDb(t,
+		// Sizes count CRLFs, even when the message didn't have them, but not the dots RETR adds
+		"Subject: One\n\n.hidden\nbody\n",
+		"Subject: Two\r\n\r\nhello\r\n",
+		"Subject: Three\r\n\r\nbye\r\n")
+	defer db.Close()
+
+	c := dial(t, db)
+	c.expect("STAT", "-ERR Log in first")
+	c.expect("PASS pw", "-ERR Send USER first")
+	c.expect("USER bob@example.com", "+OK Send your password")
+	c.expect("PASS wrong", "-ERR [AUTH] Invalid username or password")
+	c.expect("USER bob@example.com", "+OK Send your password")
+	c.expect("PASS pw", "+OK bob@example.com has 3 messages (77 octets)")
+
+	// Only one session can have the maildrop
+	other := dial(t, db)
+	other.expect("USER bob@example.com", "+OK Send your password")
+	other.expect("PASS pw", "-ERR [IN-USE] Maildrop is already in use")
+	other.expect("QUIT", "+OK Bye")
+
+	c.expect("STAT", "+OK 3 77")
+	c.expect("LIST", "+OK Listing follows", "1 31", "2 23", "3 23", ".")
+	c.expect("LIST 2", "+OK 2 23")
+	c.expect("LIST 4", "-ERR No such message")
+	c.expect("UIDL", "+OK Listing follows", "1 1", "2 2", "3 3", ".")
+	c.expect("RETR 1", "+OK 31 octets", "Subject: One", "", "..hidden", "body", ".")
+	c.expect("TOP 2 0", "+OK 23 octets", "Subject: Two", "", ".")
+
+	c.expect("DELE 3", "+OK Message 3 deleted")
+	c.expect("STAT", "+OK 2 54")
+	c.expect("LIST", "+OK Listing follows", "1 31", "2 23", ".")
+	c.expect("RETR 3", "-ERR Message 3 has been deleted")
+	c.expect("DELE 3", "-ERR Message 3 has been deleted")
+	c.expect("RSET", "+OK Maildrop has 3 messages (77 octets)")
+	c.expect("RETR 3", "+OK 23 octets", "Subject: Three", "", "bye", ".")
+
+	c.expect("DELE 1", "+OK Message 1 deleted")
+	c.expect("QUIT", "+OK Bye, 2 messages left")
+	select {
+	case <-c.done:
+	case <-time.After(5 * time.Second):
+		t.Error("the session didn't end after QUIT")
+	}
+
+	// QUIT expunged the message, and the maildrop is free again
+	c = dial(t, db)
+	c.expect("USER bob@example.com", "+OK Send your password")
+	c.expect("PASS pw", "+OK bob@example.com has 2 messages (46 octets)")
+	c.expect("UIDL", "+OK Listing follows", "1 2", "2 3", ".")
+	c.expect("QUIT", "+OK Bye, 2 messages left")
+}
@@ -0,0 +1,93 @@
+package process
+
+import (
+	"bytes"
+	"database/sql"
+	"henrymail/logic"
+	"log"
+	"time"
+)
+
+// Give up forwarding messages that have passed through this many servers, they're probably looping
+const maxForwardHops = 30
+
+/**
+ * Replaces each recipient with wherever their aliases say the message
+ * should go. Our own users get it through the rest of the chain, and
+ * copies for other servers are sent on once it's been saved.
+ */
+type aliasExpander struct {
+	db      *sql.DB
+	forward MsgProcessor
+	next    MsgProcessor
+}
+
+func (a aliasExpander) Process(msg *ReceivedMsg) error {
+	var local, external []string
+	for _, to := range msg.To {
+		destinations, e := logic.ExpandAddress(a.db, to)
+		if e != nil {
+			return e
+		}
+		for _, d := range destinations {
+			if d.User != nil {
+				local = appendMissing(local, d.Address)
+			} else {
+				external = appendMissing(external, d.Address)
+			}
+		}
+	}
+
+	msg.To = local
+	if len(local) > 0 {
+		e := a.next.Process(msg)
+		if e != nil {
+			return e
+		}
+	}
+	forwardCopy(a.forward, msg, external)
+	return nil
+}
+
+/**
+ * Sends a copy of a message we've already accepted on to other servers,
+ * keeping the original envelope sender. Failing now would only get
+ * the message delivered twice, so errors are logged.
+ */
+func forwardCopy(forward MsgProcessor, msg *ReceivedMsg, to []string) {
+	if len(to) == 0 {
+		return
+	}
+	header := append([]byte("\n"), headers(msg.Content)...)
+	if hops := bytes.Count(header, []byte("\nReceived:")); hops > maxForwardHops {
+		log.Printf("Not forwarding message %v, it has been through %v servers", msg.Id, hops)
+		return
+	}
+	e := forward.Process(&ReceivedMsg{
+		Id:        msg.Id,
+		From:      msg.From,
+		To:        to,
+		Content:   msg.Content,
+		Timestamp: time.Now(),
+	})
+	if e != nil {
+		log.Printf("Failed to forward message %v to %v: %v", msg.Id, to, e)
+	}
+}
+
+func appendMissing(list []string, s string) []string {
+	for _, l := range list {
+		if l == s {
+			return list
+		}
+	}
+	return append(list, s)
+}
+
+func NewAliasExpander(db *sql.DB, forward MsgProcessor, next MsgProcessor) MsgProcessor {
+	return &aliasExpander{
+		db:      db,
+		forward: forward,
+		next:    next,
+	}
+}
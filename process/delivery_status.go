@@ -0,0 +1,217 @@
+package process
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-smtp"
+	"github.com/xo/xoutil"
+	"henrymail/config"
+	"henrymail/database"
+	"henrymail/events"
+	"henrymail/logic"
+	"henrymail/models"
+	"log"
+	"mime/multipart"
+	"net/textproto"
+	"time"
+)
+
+/**
+ * Delivery status notifications (RFC 3464), which tell our own users
+ * what happened to the messages they sent.
+ */
+
+const (
+	actionFailed  = "failed"
+	actionDelayed = "delayed"
+	actionRelayed = "relayed"
+)
+
+/**
+ * Puts a delivery status notification in the INBOX of the user who sent
+ * the message. The reverse-path is only who they said they were, so it
+ * isn't used to find them. Failing to do so shouldn't stop the queue, so
+ * errors are only logged.
+ */
+func (s *sender) notify(queue *models.Queue, delivery *models.Delivery, action string, cause error) {
+	// Null reverse-path, or passing through rather than sent by one of our users
+	if queue.Sender == "" || queue.Userid == 0 {
+		return
+	}
+	var inbox *models.Mailbox
+	content, e := buildDsn(queue, delivery, action, cause)
+	if e == nil {
+		e = database.Transact(s.db, func(tx *sql.Tx) error {
+			inbox, e = models.MailboxByUseridName(tx, queue.Userid, imap.InboxName)
+			if e != nil {
+				return e
+			}
+			return logic.SaveNotices(tx, inbox, &models.Message{
+				Ts:        xoutil.SqTime{Time: time.Now()},
+				Flagsjson: []byte("[]"),
+				Content:   content,
+			})
+		})
+	}
+	if e != nil {
+		log.Printf("Unable to notify %v about delivery to %v: %v", queue.Sender, delivery.Recipient, e)
+		return
+	}
+	events.Publish(events.Event{Type: events.Exists, Userid: inbox.Userid, Mailboxid: inbox.ID})
+}
+
+/**
+ * Builds a multipart/report message, made up of a human readable
+ * explanation, the machine readable status, and the original message.
+ */
+func buildDsn(queue *models.Queue, delivery *models.Delivery, action string, cause error) ([]byte, error) {
+	now := time.Now()
+	serverName := config.GetString(config.ServerName)
+
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+
+	// Human readable part
+	explanation, e := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {"text/plain; charset=utf-8"},
+	})
+	if e != nil {
+		return nil, e
+	}
+	switch action {
+	case actionFailed:
+		_, e = fmt.Fprintf(explanation, "Your message could not be delivered to %v.\r\n"+
+			"No further attempts will be made.\r\n\r\n%v\r\n", delivery.Recipient, cause)
+	case actionDelayed:
+		_, e = fmt.Fprintf(explanation, "Your message has not yet been delivered to %v.\r\n"+
+			"Delivery will be attempted until %v. You don't need to send it again.\r\n\r\n%v\r\n",
+			delivery.Recipient, retryUntil(queue).Format(time.RFC1123Z), cause)
+	case actionRelayed:
+		_, e = fmt.Fprintf(explanation, "Your message has been passed on to the server for %v.\r\n"+
+			"That server doesn't report delivery status, so you might not hear any more about it.\r\n",
+			delivery.Recipient)
+	}
+	if e != nil {
+		return nil, e
+	}
+
+	// Machine readable part
+	status, e := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {"message/delivery-status"},
+	})
+	if e != nil {
+		return nil, e
+	}
+	fmt.Fprintf(status, "Reporting-MTA: dns; %v\r\n", serverName)
+	if queue.Envid != "" {
+		fmt.Fprintf(status, "Original-Envelope-Id: %v\r\n", queue.Envid)
+	}
+	fmt.Fprintf(status, "Arrival-Date: %v\r\n", queue.Ts.Time.Format(time.RFC1123Z))
+	fmt.Fprint(status, "\r\n")
+	if delivery.Orcpt != "" {
+		fmt.Fprintf(status, "Original-Recipient: rfc822; %v\r\n", delivery.Orcpt)
+	}
+	fmt.Fprintf(status, "Final-Recipient: rfc822; %v\r\n", delivery.Recipient)
+	fmt.Fprintf(status, "Action: %v\r\n", action)
+	fmt.Fprintf(status, "Status: %v\r\n", statusCode(action, cause))
+	if cause != nil {
+		fmt.Fprintf(status, "Diagnostic-Code: smtp; %v\r\n", oneLine(cause.Error()))
+		fmt.Fprintf(status, "Last-Attempt-Date: %v\r\n", now.Format(time.RFC1123Z))
+	}
+	if action == actionDelayed {
+		fmt.Fprintf(status, "Will-Retry-Until: %v\r\n", retryUntil(queue).Format(time.RFC1123Z))
+	}
+
+	// The original message, or just its headers if that's all the sender wanted
+	var original []byte
+	var originalType string
+	if queue.Ret == "HDRS" {
+		original, originalType = headers(queue.Content), "text/rfc822-headers"
+	} else {
+		original, originalType = queue.Content, "message/rfc822"
+	}
+	returned, e := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {originalType},
+	})
+	if e != nil {
+		return nil, e
+	}
+	_, e = returned.Write(original)
+	if e != nil {
+		return nil, e
+	}
+	e = mw.Close()
+	if e != nil {
+		return nil, e
+	}
+
+	var subject string
+	switch action {
+	case actionFailed:
+		subject = "Undelivered Mail Returned to Sender"
+	case actionDelayed:
+		subject = "Delayed Mail (still being retried)"
+	case actionRelayed:
+		subject = "Successful Mail Delivery Report"
+	}
+
+	msg := &bytes.Buffer{}
+	fmt.Fprintf(msg, "From: Mail Delivery System <MAILER-DAEMON@%v>\r\n", serverName)
+	fmt.Fprintf(msg, "To: %v\r\n", queue.Sender)
+	fmt.Fprintf(msg, "Subject: %v\r\n", subject)
+	fmt.Fprintf(msg, "Date: %v\r\n", now.Format(time.RFC1123Z))
+	fmt.Fprintf(msg, "Message-Id: <%d.%d.dsn@%v>\r\n", now.UnixNano(), delivery.ID, serverName)
+	fmt.Fprint(msg, "Auto-Submitted: auto-replied\r\n")
+	fmt.Fprint(msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(msg, "Content-Type: multipart/report; report-type=delivery-status; boundary=%q\r\n", mw.Boundary())
+	fmt.Fprint(msg, "\r\n")
+	_, e = msg.Write(body.Bytes())
+	return msg.Bytes(), e
+}
+
+func retryUntil(queue *models.Queue) time.Time {
+	return queue.Ts.Time.Add(time.Duration(config.GetInt(config.QueueLifetimeHours)) * time.Hour)
+}
+
+func statusCode(action string, cause error) string {
+	if de, ok := cause.(*deliveryError); ok {
+		code := de.status
+		// A delay is always transient, whatever the last server said
+		if action == actionDelayed {
+			code[0] = 4
+		}
+		// Failed because we ran out of time, rather than being refused
+		if action == actionFailed && code[0] == 4 {
+			code = smtp.EnhancedCode{4, 4, 7}
+		}
+		return fmt.Sprintf("%d.%d.%d", code[0], code[1], code[2])
+	}
+	switch action {
+	case actionFailed:
+		return "5.0.0"
+	case actionDelayed:
+		return "4.0.0"
+	}
+	return "2.0.0"
+}
+
+/**
+ * Header fields can't contain line breaks
+ */
+func oneLine(s string) string {
+	return string(bytes.Join(bytes.Fields([]byte(s)), []byte(" ")))
+}
+
+/**
+ * Just the header section of a message, up to the first blank line
+ */
+func headers(content []byte) []byte {
+	for _, sep := range [][]byte{[]byte("\r\n\r\n"), []byte("\n\n")} {
+		if ix := bytes.Index(content, sep); ix >= 0 {
+			return content[:ix+len(sep)]
+		}
+	}
+	return content
+}
@@ -2,34 +2,59 @@ package process
 
 import (
 	"bytes"
-	"crypto/rsa"
+	"database/sql"
 	"github.com/emersion/go-dkim"
-	"henrymail/config"
+	henrydkim "henrymail/dkim"
+	"henrymail/logic"
+	"log"
+	"strings"
 )
 
+/**
+ * Signs messages with the key of the domain they're from, which is the one
+ * in the From: header if we host it, otherwise the envelope sender's.
+ */
 type dkimSigner struct {
-	dkim *rsa.PrivateKey
+	db   *sql.DB
 	next MsgProcessor
 }
 
 func (d dkimSigner) Process(msg *ReceivedMsg) error {
-	options := &dkim.SignOptions{
-		Domain:   config.GetString(config.Domain),
-		Selector: "mx",
-		Signer:   d.dkim,
+	candidates := []string{envelopeDomain(msg)}
+	if headerFrom, e := headerFromDomain(msg.Content); e == nil {
+		candidates = append([]string{headerFrom}, candidates...)
 	}
-	var b bytes.Buffer
-	e := dkim.Sign(&b, bytes.NewReader(msg.Content), options)
-	if e != nil {
-		return e
+	for _, name := range candidates {
+		domain, e := logic.FindDomain(d.db, name)
+		if e == sql.ErrNoRows {
+			continue
+		} else if e != nil {
+			return e
+		}
+		key, e := henrydkim.DecodeKey(domain.Dkimkey)
+		if e != nil {
+			return e
+		}
+		options := &dkim.SignOptions{
+			Domain:   domain.Name,
+			Selector: domain.Dkimselector,
+			Signer:   key,
+		}
+		var b bytes.Buffer
+		e = dkim.Sign(&b, bytes.NewReader(msg.Content), options)
+		if e != nil {
+			return e
+		}
+		msg.Content = b.Bytes()
+		return d.next.Process(msg)
 	}
-	msg.Content = b.Bytes()
+	log.Printf("Not signing message %v, it isn't from any of our domains (%v)", msg.Id, strings.Join(candidates, ", "))
 	return d.next.Process(msg)
 }
 
-func NewDkimSigner(dkim *rsa.PrivateKey, next MsgProcessor) MsgProcessor {
+func NewDkimSigner(db *sql.DB, next MsgProcessor) MsgProcessor {
 	return &dkimSigner{
-		dkim: dkim,
+		db:   db,
 		next: next,
 	}
 }
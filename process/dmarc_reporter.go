@@ -0,0 +1,284 @@
+package process
+
+import (
+	"bytes"
+	"compress/gzip"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"henrymail/config"
+	"henrymail/database"
+	"henrymail/dmarc"
+	"henrymail/models"
+	"log"
+	"mime/multipart"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+/**
+ * Sends daily DMARC aggregate reports (RFC 7489 section 7.2) to the
+ * domains that asked for them, made from the results the dmarcVerifier
+ * recorded. Reports go out through the submission chain so they're
+ * signed and queued like any other message.
+ */
+type dmarcReporter struct {
+	db      *sql.DB
+	checker *dmarc.Checker
+	proc    MsgProcessor
+}
+
+/**
+ * Looks for a finished day to report on every hour
+ */
+func (r *dmarcReporter) Start() {
+	go func() {
+		ticker := time.NewTicker(time.Hour)
+		for {
+			r.sendReports()
+			<-ticker.C
+		}
+	}()
+}
+
+/**
+ * Reports everything from before the start of today (UTC)
+ */
+func (r *dmarcReporter) sendReports() {
+	end := time.Now().UTC().Truncate(24 * time.Hour)
+	results, e := models.GetAllDmarcresult(r.db)
+	if e != nil {
+		log.Print(e)
+		return
+	}
+	byDomain := make(map[string][]*models.Dmarcresult)
+	for _, result := range results {
+		if result.Ts.Time.Before(end) {
+			byDomain[result.Domain] = append(byDomain[result.Domain], result)
+		}
+	}
+	for domain, results := range byDomain {
+		e = r.sendReport(domain, results, end)
+		if e != nil {
+			log.Printf("Unable to send DMARC report for %v: %v", domain, e)
+		}
+	}
+}
+
+func (r *dmarcReporter) sendReport(domain string, results []*models.Dmarcresult, end time.Time) error {
+	// The most recent result has the most recent policy
+	latest, earliest := results[0], results[0]
+	for _, result := range results {
+		if result.Ts.Time.After(latest.Ts.Time) {
+			latest = result
+		}
+		if result.Ts.Time.Before(earliest.Ts.Time) {
+			earliest = result
+		}
+	}
+	var rua []string
+	for _, address := range strings.Split(latest.Rua, ",") {
+		if r.checker.AcceptsReportsFor(address, domain) {
+			rua = append(rua, address)
+		} else {
+			log.Printf("Not sending DMARC report for %v to %v, it hasn't agreed to receive them", domain, address)
+		}
+	}
+
+	if len(rua) > 0 {
+		begin := earliest.Ts.Time.UTC().Truncate(24 * time.Hour)
+		content, e := buildDmarcReport(domain, rua, latest, results, begin, end)
+		if e != nil {
+			return e
+		}
+		e = r.proc.Process(&ReceivedMsg{
+			From:      "postmaster@" + config.GetString(config.Domain),
+			To:        rua,
+			Content:   content,
+			Timestamp: time.Now(),
+		})
+		if e != nil {
+			return e
+		}
+	}
+
+	return database.Transact(r.db, func(tx *sql.Tx) error {
+		for _, result := range results {
+			e := result.Delete(tx)
+			if e != nil {
+				return e
+			}
+		}
+		return nil
+	})
+}
+
+/**
+ * The aggregate report format, see RFC 7489 appendix C
+ */
+type feedback struct {
+	XMLName  xml.Name        `xml:"feedback"`
+	Metadata reportMetadata  `xml:"report_metadata"`
+	Policy   policyPublished `xml:"policy_published"`
+	Records  []*reportRecord `xml:"record"`
+}
+
+type reportMetadata struct {
+	OrgName  string `xml:"org_name"`
+	Email    string `xml:"email"`
+	ReportId string `xml:"report_id"`
+	Begin    int64  `xml:"date_range>begin"`
+	End      int64  `xml:"date_range>end"`
+}
+
+type policyPublished struct {
+	Domain string `xml:"domain"`
+	Adkim  string `xml:"adkim"`
+	Aspf   string `xml:"aspf"`
+	P      string `xml:"p"`
+	Sp     string `xml:"sp"`
+	Pct    int    `xml:"pct"`
+}
+
+type reportRecord struct {
+	SourceIp     string           `xml:"row>source_ip"`
+	Count        int              `xml:"row>count"`
+	Disposition  string           `xml:"row>policy_evaluated>disposition"`
+	Dkim         string           `xml:"row>policy_evaluated>dkim"`
+	Spf          string           `xml:"row>policy_evaluated>spf"`
+	EnvelopeFrom string           `xml:"identifiers>envelope_from"`
+	HeaderFrom   string           `xml:"identifiers>header_from"`
+	DkimResults  []dkimAuthResult `xml:"auth_results>dkim"`
+	SpfDomain    string           `xml:"auth_results>spf>domain"`
+	SpfScope     string           `xml:"auth_results>spf>scope"`
+	SpfResult    string           `xml:"auth_results>spf>result"`
+}
+
+func buildDmarcReport(domain string, rua []string, latest *models.Dmarcresult, results []*models.Dmarcresult, begin, end time.Time) ([]byte, error) {
+	receiver := config.GetString(config.Domain)
+	report := &feedback{
+		Metadata: reportMetadata{
+			OrgName:  receiver,
+			Email:    "postmaster@" + receiver,
+			ReportId: fmt.Sprintf("%d.%v@%v", end.Unix(), domain, receiver),
+			Begin:    begin.Unix(),
+			End:      end.Unix(),
+		},
+		Policy: policyPublished{
+			Domain: domain,
+			Adkim:  latest.Adkim,
+			Aspf:   latest.Aspf,
+			P:      latest.P,
+			Sp:     latest.Sp,
+			Pct:    latest.Pct,
+		},
+	}
+
+	// Identical results are counted together
+	records := make(map[string]*reportRecord)
+	for _, result := range results {
+		key := strings.Join([]string{result.Sourceip, result.Disposition, passOrFail(result.Dkimaligned),
+			passOrFail(result.Spfaligned), result.Envelopefrom, result.Headerfrom, string(result.Dkimjson),
+			result.Spfdomain, result.Spfresult}, "\x00")
+		if record, ok := records[key]; ok {
+			record.Count++
+			continue
+		}
+		record := &reportRecord{
+			SourceIp:     result.Sourceip,
+			Count:        1,
+			Disposition:  result.Disposition,
+			Dkim:         passOrFail(result.Dkimaligned),
+			Spf:          passOrFail(result.Spfaligned),
+			EnvelopeFrom: result.Envelopefrom,
+			HeaderFrom:   result.Headerfrom,
+			SpfDomain:    result.Spfdomain,
+			SpfScope:     "mfrom",
+			SpfResult:    result.Spfresult,
+		}
+		e := json.Unmarshal(result.Dkimjson, &record.DkimResults)
+		if e != nil {
+			return nil, e
+		}
+		records[key] = record
+		report.Records = append(report.Records, record)
+	}
+
+	compressed := &bytes.Buffer{}
+	gz := gzip.NewWriter(compressed)
+	_, e := gz.Write([]byte(xml.Header))
+	if e != nil {
+		return nil, e
+	}
+	enc := xml.NewEncoder(gz)
+	enc.Indent("", "  ")
+	e = enc.Encode(report)
+	if e != nil {
+		return nil, e
+	}
+	e = gz.Close()
+	if e != nil {
+		return nil, e
+	}
+
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	text, e := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {"text/plain; charset=utf-8"},
+	})
+	if e != nil {
+		return nil, e
+	}
+	fmt.Fprintf(text, "This is a DMARC aggregate report for %v from %v.\r\n", domain, receiver)
+	filename := fmt.Sprintf("%v!%v!%d!%d.xml.gz", receiver, domain, begin.Unix(), end.Unix())
+	attachment, e := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {fmt.Sprintf("application/gzip; name=%q", filename)},
+		"Content-Disposition":       {fmt.Sprintf("attachment; filename=%q", filename)},
+		"Content-Transfer-Encoding": {"base64"},
+	})
+	if e != nil {
+		return nil, e
+	}
+	encoded := base64.StdEncoding.EncodeToString(compressed.Bytes())
+	for len(encoded) > 76 {
+		fmt.Fprintf(attachment, "%v\r\n", encoded[:76])
+		encoded = encoded[76:]
+	}
+	fmt.Fprintf(attachment, "%v\r\n", encoded)
+	e = mw.Close()
+	if e != nil {
+		return nil, e
+	}
+
+	now := time.Now()
+	msg := &bytes.Buffer{}
+	fmt.Fprintf(msg, "From: DMARC Aggregate Report <postmaster@%v>\r\n", receiver)
+	fmt.Fprintf(msg, "To: %v\r\n", strings.Join(rua, ", "))
+	fmt.Fprintf(msg, "Subject: Report Domain: %v Submitter: %v Report-ID: <%v>\r\n", domain, receiver, report.Metadata.ReportId)
+	fmt.Fprintf(msg, "Date: %v\r\n", now.Format(time.RFC1123Z))
+	fmt.Fprintf(msg, "Message-Id: <%d.dmarc@%v>\r\n", now.UnixNano(), config.GetString(config.ServerName))
+	fmt.Fprint(msg, "Auto-Submitted: auto-generated\r\n")
+	fmt.Fprint(msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(msg, "Content-Type: multipart/mixed; boundary=%q\r\n", mw.Boundary())
+	fmt.Fprint(msg, "\r\n")
+	_, e = msg.Write(body.Bytes())
+	return msg.Bytes(), e
+}
+
+func passOrFail(b bool) string {
+	if b {
+		return "pass"
+	}
+	return "fail"
+}
+
+func NewDmarcReporter(db *sql.DB, checker *dmarc.Checker, proc MsgProcessor) *dmarcReporter {
+	return &dmarcReporter{
+		db:      db,
+		checker: checker,
+		proc:    proc,
+	}
+}
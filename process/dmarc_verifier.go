@@ -0,0 +1,181 @@
+package process
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/emersion/go-dkim"
+	"github.com/emersion/go-smtp"
+	"github.com/xo/xoutil"
+	"henrymail/config"
+	"henrymail/dmarc"
+	"henrymail/models"
+	"henrymail/spf"
+	"log"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+/**
+ * Applies the DMARC policy of the domain in the From: header, using the
+ * DKIM and SPF results from earlier in the chain. Results are recorded
+ * for the daily aggregate reports.
+ */
+type dmarcVerifier struct {
+	db      *sql.DB
+	checker *dmarc.Checker
+	next    MsgProcessor
+}
+
+type dkimAuthResult struct {
+	Domain string `json:"domain" xml:"domain"`
+	Result string `json:"result" xml:"result"`
+}
+
+func (d dmarcVerifier) Process(msg *ReceivedMsg) error {
+	headerFrom, e := headerFromDomain(msg.Content)
+	if e != nil {
+		log.Printf("Unable to check DMARC policy for message from %v: %v", msg.From, e)
+		msg.Dmarc = &dmarc.Evaluation{Result: dmarc.PermError, Disposition: dmarc.PolicyNone}
+		return d.next.Process(msg)
+	}
+
+	var dkimDomains []string
+	for _, v := range msg.Verifications {
+		if v.Err == nil {
+			dkimDomains = append(dkimDomains, v.Domain)
+		}
+	}
+	spfDomain := ""
+	if msg.SpfResult == spf.Pass {
+		spfDomain = envelopeDomain(msg)
+	}
+	eval := d.checker.Evaluate(headerFrom, dkimDomains, spfDomain)
+	msg.Dmarc = eval
+
+	if eval.Record != nil && len(eval.Record.Rua) > 0 && config.GetBool(config.DmarcReports) {
+		e = d.record(msg, eval)
+		if e != nil {
+			// Not worth losing the message over
+			log.Printf("Unable to record DMARC result: %v", e)
+		}
+	}
+
+	switch eval.Disposition {
+	case dmarc.PolicyReject:
+		return &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+			Message:      fmt.Sprintf("Rejected by DMARC policy for %v", headerFrom),
+		}
+	case dmarc.PolicyQuarantine:
+		msg.Quarantine = true
+	}
+	return d.next.Process(msg)
+}
+
+/**
+ * Keeps what the aggregate report needs to know about this message
+ */
+func (d dmarcVerifier) record(msg *ReceivedMsg, eval *dmarc.Evaluation) error {
+	var dkimResults []dkimAuthResult
+	for _, v := range msg.Verifications {
+		dkimResults = append(dkimResults, dkimAuthResult{Domain: v.Domain, Result: dkimResult(v)})
+	}
+	dkimJson, e := json.Marshal(dkimResults)
+	if e != nil {
+		return e
+	}
+	envelopeFrom := ""
+	if ix := strings.LastIndex(msg.From, "@"); ix >= 0 {
+		envelopeFrom = msg.From[ix+1:]
+	}
+	r := eval.Record
+	result := &models.Dmarcresult{
+		Ts:           xoutil.SqTime{Time: time.Now()},
+		Domain:       r.Domain,
+		Rua:          strings.Join(r.Rua, ","),
+		Adkim:        string(r.Adkim),
+		Aspf:         string(r.Aspf),
+		P:            string(r.P),
+		Sp:           string(r.Sp),
+		Pct:          r.Pct,
+		Sourceip:     msg.ClientIp.String(),
+		Headerfrom:   eval.HeaderFrom,
+		Envelopefrom: envelopeFrom,
+		Dkimjson:     dkimJson,
+		Spfdomain:    envelopeDomain(msg),
+		Spfresult:    string(msg.SpfResult),
+		Dkimaligned:  eval.DkimAligned,
+		Spfaligned:   eval.SpfAligned,
+		Disposition:  string(eval.Disposition),
+	}
+	return result.Save(d.db)
+}
+
+/**
+ * The domain SPF was checked for, which is the HELO name for bounces
+ */
+func envelopeDomain(msg *ReceivedMsg) string {
+	if ix := strings.LastIndex(msg.From, "@"); ix >= 0 {
+		return strings.ToLower(msg.From[ix+1:])
+	}
+	return strings.ToLower(msg.Helo)
+}
+
+/**
+ * The result of a DKIM signature check, as named in RFC 8601
+ */
+func dkimResult(v *dkim.Verification) string {
+	switch {
+	case v.Err == nil:
+		return "pass"
+	case dkim.IsTempFail(v.Err):
+		return "temperror"
+	case dkim.IsPermFail(v.Err):
+		return "permerror"
+	default:
+		return "fail"
+	}
+}
+
+/**
+ * DMARC needs exactly one author domain, see RFC 7489 section 6.6.1
+ */
+func headerFromDomain(content []byte) (string, error) {
+	m, e := mail.ReadMessage(bytes.NewReader(content))
+	if e != nil {
+		return "", e
+	}
+	froms := m.Header["From"]
+	if len(froms) != 1 {
+		return "", errors.New("message must have exactly one From: header")
+	}
+	addresses, e := mail.ParseAddressList(froms[0])
+	if e != nil {
+		return "", e
+	}
+	domain := ""
+	for _, address := range addresses {
+		d := strings.ToLower(address.Address[strings.LastIndex(address.Address, "@")+1:])
+		if domain != "" && d != domain {
+			return "", errors.New("From: header has addresses in more than one domain")
+		}
+		domain = d
+	}
+	if domain == "" {
+		return "", errors.New("From: header has no domain")
+	}
+	return domain, nil
+}
+
+func NewDmarcVerifier(db *sql.DB, checker *dmarc.Checker, next MsgProcessor) MsgProcessor {
+	return &dmarcVerifier{
+		db:      db,
+		checker: checker,
+		next:    next,
+	}
+}
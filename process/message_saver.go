@@ -2,49 +2,173 @@ package process
 
 import (
 	"database/sql"
-	"github.com/emersion/go-imap"
+	"encoding/json"
+	"github.com/emersion/go-smtp"
 	"github.com/xo/xoutil"
 	"henrymail/database"
+	"henrymail/events"
 	"henrymail/logic"
 	"henrymail/models"
-	"strings"
+	"log"
 	"time"
 )
 
 /**
- * Saves which are intended for our own users into their inboxes.
+ * Saves which are intended for our own users into the mailboxes their
+ * Sieve scripts chose, otherwise their inboxes (or subaddress mailboxes),
+ * or their quarantine mailboxes if DMARC policy says so. Recipients who
+ * don't have room for it are sent a delivery status notification,
+ * unless none of them do, when the client is refused instead.
  */
 type saver struct {
 	db *sql.DB
+	// Sends the notifications
+	notify MsgProcessor
 }
 
 func (s *saver) Process(wrap *ReceivedMsg) error {
-	return database.Transact(s.db, func(tx *sql.Tx) error {
+	// One event per mailbox, published once the messages are committed
+	delivered := map[int]events.Event{}
+	var full []string
+	var refused error
+	e := database.Transact(s.db, func(tx *sql.Tx) error {
 		for _, to := range wrap.To {
-			username := strings.Split(to, "@")[0]
-			user, e := models.UserByUsername(tx, username)
-			if e != nil {
-				return e
+			filings, ok := wrap.Filings[to]
+			if !ok {
+				filings = []Filing{{}}
 			}
-
-			inbox, e := models.MailboxByUseridName(tx, user.ID, imap.InboxName)
-			if e != nil {
-				return e
+			var mailboxes []*models.Mailbox
+			for _, filing := range filings {
+				mailbox, e := s.mailbox(tx, wrap, to, filing.Mailbox)
+				if e != nil {
+					return e
+				}
+				mailboxes = append(mailboxes, mailbox)
+			}
+			if len(mailboxes) > 0 {
+				// Aliases and subaddresses can give a user the message more than once
+				e := logic.CheckQuota(tx, mailboxes[0].Userid, len(wrap.Content)*len(mailboxes), len(mailboxes))
+				if e == logic.ErrOverQuota || e == logic.ErrMessageExceedsQuota {
+					full = append(full, to)
+					refused = e
+					continue
+				}
+				if e != nil {
+					return e
+				}
 			}
+			for i, mailbox := range mailboxes {
+				flags := filings[i].Flags
+				if flags == nil {
+					flags = []string{}
+				}
+				flagsJson, e := json.Marshal(flags)
+				if e != nil {
+					return e
+				}
 
-			e = logic.SaveMessages(tx, inbox, &models.Message{
-				Ts:        xoutil.SqTime{Time: time.Now()},
-				Flagsjson: []byte("[]"),
-				Content:   wrap.Content,
-			})
-			if e != nil {
-				return e
+				e = logic.SaveMessages(tx, mailbox, &models.Message{
+					Ts:        xoutil.SqTime{Time: time.Now()},
+					Flagsjson: flagsJson,
+					Content:   wrap.Content,
+				})
+				if e != nil {
+					return e
+				}
+				delivered[mailbox.ID] = events.Event{Type: events.Exists, Userid: mailbox.Userid, Mailboxid: mailbox.ID}
 			}
 		}
+		if len(full) == len(wrap.To) {
+			return refused
+		}
 		return nil
 	})
+	switch e {
+	case nil:
+	case logic.ErrOverQuota:
+		return &smtp.SMTPError{
+			Code:         452,
+			EnhancedCode: smtp.EnhancedCode{4, 2, 2},
+			Message:      "Mailbox full",
+		}
+	case logic.ErrMessageExceedsQuota:
+		return &smtp.SMTPError{
+			Code:         552,
+			EnhancedCode: smtp.EnhancedCode{5, 2, 2},
+			Message:      "Message is bigger than the mailbox quota",
+		}
+	default:
+		return e
+	}
+	for _, ev := range delivered {
+		events.Publish(ev)
+	}
+	for _, to := range full {
+		s.notifyFull(wrap, to, refused)
+	}
+	return nil
+}
+
+/**
+ * The message has been accepted for the other recipients, so it's too late to
+ * refuse it for this one. Failing to tell the sender is only logged.
+ */
+func (s *saver) notifyFull(wrap *ReceivedMsg, to string, cause error) {
+	// Null reverse-path, nobody to tell
+	if wrap.From == "" {
+		return
+	}
+	queue := &models.Queue{
+		Sender:  wrap.From,
+		Content: wrap.Content,
+		Ts:      xoutil.SqTime{Time: wrap.Timestamp},
+		Ret:     wrap.Ret,
+		Envid:   wrap.EnvId,
+	}
+	delivery := &models.Delivery{
+		Recipient: to,
+		Notify:    wrap.Notify[to],
+		Orcpt:     wrap.Orcpt[to],
+	}
+	if !logic.WantsNotification(delivery, "FAILURE") {
+		return
+	}
+	// Mail doesn't wait for room, so it's permanent either way
+	content, e := buildDsn(queue, delivery, actionFailed,
+		&deliveryError{msg: cause.Error(), permanent: true, status: smtp.EnhancedCode{5, 2, 2}})
+	if e == nil {
+		e = s.notify.Process(&ReceivedMsg{
+			Id:        NewQueueId(),
+			To:        []string{wrap.From},
+			Content:   content,
+			Timestamp: time.Now(),
+		})
+	}
+	if e != nil {
+		log.Printf("Unable to notify %v that %v is over quota: %v", wrap.From, to, e)
+	}
+}
+
+func (s *saver) mailbox(tx *sql.Tx, wrap *ReceivedMsg, to, name string) (*models.Mailbox, error) {
+	if name == "" && wrap.Quarantine {
+		return logic.FindOrCreateSpecialMailbox(tx, to, logic.SpecialUseJunk)
+	}
+	if name == "" {
+		return logic.FindDeliveryMailbox(tx, to)
+	}
+	user, e := logic.FindRecipient(tx, to)
+	if e != nil {
+		return nil, e
+	}
+	mailbox, e := models.MailboxByUseridName(tx, user.ID, name)
+	if e == sql.ErrNoRows || (e == nil && mailbox.Noselect) {
+		// Better in the inbox than lost
+		log.Printf("Sieve script for %v filed into missing mailbox %v, using the inbox instead", to, name)
+		return logic.FindInbox(tx, to)
+	}
+	return mailbox, e
 }
 
-func NewSaver(db *sql.DB) MsgProcessor {
-	return &saver{db: db}
+func NewSaver(db *sql.DB, notify MsgProcessor) MsgProcessor {
+	return &saver{db: db, notify: notify}
 }
@@ -3,78 +3,229 @@ package process
 import (
 	"crypto/tls"
 	"database/sql"
-	"errors"
 	"fmt"
+	"github.com/emersion/go-smtp"
 	"henrymail/config"
+	"henrymail/logic"
+	"henrymail/models"
+	"log"
 	"net"
-	"net/smtp"
 	"strings"
+	"time"
 )
 
 /**
  * Forward messages on to their destinations by acting as an SMTP client.
- * Store messages and retry them later
+ * Messages are stored in the queue, and retried later if they can't be
+ * delivered straight away.
  */
 type sender struct {
-	db *sql.DB
+	db   *sql.DB
+	wake chan struct{}
 }
 
+/**
+ * Queues the message, the client doesn't have to wait for it to be delivered.
+ */
 func (s *sender) Process(w *ReceivedMsg) error {
-	errs := make([]string, 0)
+	queue := &models.Queue{
+		Sender:  w.From,
+		Content: w.Content,
+		Ret:     w.Ret,
+		Envid:   w.EnvId,
+		Userid:  w.Userid,
+	}
+	var deliveries []*models.Delivery
 	for _, to := range w.To {
-		err := s.sendTo(to, w.From, w.Content)
-		if err != nil {
-			errs = append(errs, err.Error())
+		deliveries = append(deliveries, &models.Delivery{
+			Recipient: to,
+			Notify:    w.Notify[to],
+			Orcpt:     w.Orcpt[to],
+		})
+	}
+	e := logic.Enqueue(s.db, queue, deliveries)
+	if e != nil {
+		return e
+	}
+	// Try to send it now, unless the worker is already busy
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+/**
+ * Starts delivering messages from the queue in the background
+ */
+func (s *sender) Start() {
+	go func() {
+		ticker := time.NewTicker(time.Duration(config.GetInt(config.QueuePollSeconds)) * time.Second)
+		for {
+			s.deliverQueue()
+			select {
+			case <-ticker.C:
+			case <-s.wake:
+			}
 		}
+	}()
+}
+
+/**
+ * Attempts every pending delivery that's due
+ */
+func (s *sender) deliverQueue() {
+	deliveries, e := models.DeliveriesByStatus(s.db, logic.DeliveryPending)
+	if e != nil {
+		log.Print(e)
+		return
+	}
+	for _, delivery := range deliveries {
+		if delivery.Nextattempt.Time.After(time.Now()) {
+			continue
+		}
+		e = s.attempt(delivery)
+		if e != nil {
+			log.Print(e)
+		}
+	}
+}
+
+/**
+ * Sends a single delivery, and records the outcome
+ */
+func (s *sender) attempt(delivery *models.Delivery) error {
+	queue, e := delivery.Queue(s.db)
+	if e != nil {
+		return e
 	}
-	if len(errs) > 0 {
-		return errors.New(strings.Join(errs, "\n"))
+
+	relayed, e := s.sendTo(queue, delivery)
+	if e == nil {
+		// If the other server understood DSN, it's responsible for telling the sender
+		if !relayed && logic.WantsNotification(delivery, "SUCCESS") {
+			s.notify(queue, delivery, actionRelayed, nil)
+		}
+		return logic.DeleteDelivery(s.db, delivery.ID)
+	}
+
+	now := time.Now()
+	delivery.Attempts += 1
+	delivery.Lasterror = e.Error()
+	lifetime := time.Duration(config.GetInt(config.QueueLifetimeHours)) * time.Hour
+	warning := time.Duration(config.GetInt(config.QueueWarningHours)) * time.Hour
+	if isPermanent(e) || now.Sub(queue.Ts.Time) > lifetime {
+		log.Printf("Giving up delivering to %v: %v", delivery.Recipient, e)
+		delivery.Status = logic.DeliveryFailed
+		if logic.WantsNotification(delivery, "FAILURE") {
+			s.notify(queue, delivery, actionFailed, e)
+		}
 	} else {
-		return nil
+		delivery.Nextattempt.Time = now.Add(retryDelay(delivery.Attempts))
+		if !delivery.Warned && now.Sub(queue.Ts.Time) > warning && logic.WantsNotification(delivery, "DELAY") {
+			delivery.Warned = true
+			s.notify(queue, delivery, actionDelayed, e)
+		}
+	}
+	return delivery.Save(s.db)
+}
+
+/**
+ * Exponential backoff, starting from the configured retry delay
+ */
+func retryDelay(attempts int) time.Duration {
+	delay := time.Duration(config.GetInt(config.QueueRetrySeconds)) * time.Second
+	max := time.Duration(config.GetInt(config.QueueMaxRetrySeconds)) * time.Second
+	for i := 1; i < attempts && delay < max; i++ {
+		delay *= 2
 	}
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
+
+/**
+ * A failure to deliver, which might be worth retrying later
+ */
+type deliveryError struct {
+	msg       string
+	permanent bool
+	// Enhanced status code (RFC 3463) from the last server tried, if it sent one
+	status smtp.EnhancedCode
+}
+
+func (e *deliveryError) Error() string {
+	return e.msg
+}
+
+func isPermanent(e error) bool {
+	de, ok := e.(*deliveryError)
+	return ok && de.permanent
 }
 
 /**
- * Look for SMTP servers to send to,
+ * Look for SMTP servers to send to. Reports whether
+ * the server that accepted the message supports DSN.
  */
-func (s *sender) sendTo(to, from string, content []byte) error {
+func (s *sender) sendTo(queue *models.Queue, delivery *models.Delivery) (bool, error) {
+	to := delivery.Recipient
 	parts := strings.Split(to, "@")
+	if len(parts) != 2 {
+		return false, &deliveryError{msg: "invalid address " + to, permanent: true, status: smtp.EnhancedCode{5, 1, 3}}
+	}
 	domain := parts[1]
 	mxes, e := net.LookupMX(domain)
 	if e != nil {
-		return e
+		dnsErr, ok := e.(*net.DNSError)
+		if ok && dnsErr.IsNotFound {
+			return false, &deliveryError{msg: e.Error(), permanent: true, status: smtp.EnhancedCode{5, 1, 2}}
+		}
+		return false, &deliveryError{msg: e.Error(), status: smtp.EnhancedCode{4, 4, 3}}
 	}
 
 	if len(mxes) == 0 {
-		return errors.New("no MX records found for domain " + domain)
+		return false, &deliveryError{msg: "no MX records found for domain " + domain, permanent: true, status: smtp.EnhancedCode{5, 1, 2}}
 	}
 
 	errs := make([]string, 0)
+	permanent := true
+	status := smtp.EnhancedCode{4, 4, 1}
 	for _, mx := range mxes {
 		mailServer := strings.TrimRight(mx.Host, ".")
-		e = s.sendToHost(to, from, mailServer, content)
+		relayed, e := s.sendToHost(queue, delivery, mailServer)
 		if e == nil {
 			// If any server accepted the message then discard any errors,
-			return nil
+			return relayed, nil
 		} else {
 			errs = append(errs, fmt.Sprintf("Host %v Error %v", mx.Host, e.Error()))
+			// Only give up if every server refused the message outright
+			smtpErr, ok := e.(*smtp.SMTPError)
+			permanent = permanent && ok && smtpErr.Code >= 500
+			if ok && smtpErr.EnhancedCode[0] > 0 {
+				status = smtpErr.EnhancedCode
+			}
 		}
 	}
-	return errors.New(strings.Join(errs, "\n"))
+	if permanent && status[0] != 5 {
+		status = smtp.EnhancedCode{5, 0, 0}
+	}
+	return false, &deliveryError{msg: strings.Join(errs, "\n"), permanent: permanent, status: status}
 }
 
 /**
  * Dials the other SMTP server and actually sends
  * the message. Error if anything went wrong.
  */
-func (s *sender) sendToHost(to, from, host string, content []byte) error {
+func (s *sender) sendToHost(queue *models.Queue, delivery *models.Delivery, host string) (bool, error) {
 	client, err := smtp.Dial(host + config.GetString(config.MtaSendPort))
 	if err != nil {
-		return err
+		return false, err
 	}
+	defer client.Close()
 	err = client.Hello(config.GetString(config.ServerName))
 	if err != nil {
-		return err
+		return false, err
 	}
 	b, _ := client.Extension("STARTTLS")
 	if b {
@@ -83,34 +234,51 @@ func (s *sender) sendToHost(to, from, host string, content []byte) error {
 		})
 	}
 	if err != nil {
-		return err
+		return false, err
 	}
-	err = client.Mail(from)
+
+	// Pass on the sender's DSN request, in case the other server supports it
+	dsn, _ := client.Extension("DSN")
+	err = client.Mail(queue.Sender, &smtp.MailOptions{
+		Return:     smtp.DSNReturn(queue.Ret),
+		EnvelopeID: queue.Envid,
+	})
 	if err != nil {
-		return err
+		return false, err
+	}
+	rcptOptions := &smtp.RcptOptions{}
+	if delivery.Notify != "" {
+		for _, n := range strings.Split(delivery.Notify, ",") {
+			rcptOptions.Notify = append(rcptOptions.Notify, smtp.DSNNotify(n))
+		}
+	}
+	if delivery.Orcpt != "" {
+		rcptOptions.OriginalRecipientType = smtp.DSNAddressTypeRFC822
+		rcptOptions.OriginalRecipient = delivery.Orcpt
 	}
-	err = client.Rcpt(to)
+	err = client.Rcpt(delivery.Recipient, rcptOptions)
 	if err != nil {
-		return err
+		return false, err
 	}
 	writeCloser, err := client.Data()
 	if err != nil {
-		return err
+		return false, err
 	}
-	_, err = writeCloser.Write(content)
+	_, err = writeCloser.Write(queue.Content)
 	if err != nil {
-		return err
+		return false, err
 	}
 	err = writeCloser.Close()
 	if err != nil {
-		return err
+		return false, err
 	}
-	return client.Quit()
+	return dsn, client.Quit()
 }
 
 func NewSender(db *sql.DB) *sender {
 	sender := &sender{
-		db: db,
+		db:   db,
+		wake: make(chan struct{}, 1),
 	}
 	return sender
 }
@@ -1,19 +1,61 @@
 package process
 
 import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
 	"github.com/emersion/go-dkim"
+	"henrymail/dmarc"
+	"henrymail/spf"
+	"net"
 	"time"
 )
 
 type ReceivedMsg struct {
+	Id        string // Queue ID, for tracing the message through the logs
 	From      string
 	To        []string
 	Content   []byte
 	Timestamp time.Time
 
+	// Where the message came from
+	ClientIp      net.IP
+	Helo          string
+	Protocol      string               // For messages that didn't come by SMTP, like HTTP
+	Tls           *tls.ConnectionState // Nil if the connection wasn't encrypted
+	Authenticated bool                 // Submitted by one of our users
+	Userid        int                  // Which one, if it was
+
 	Verifications []*dkim.Verification
+	SpfResult     spf.Result
+	Dmarc         *dmarc.Evaluation
+	// Deliver to the quarantine mailbox instead of the inbox
+	Quarantine bool
+	// Where each recipient's Sieve script filed the message. Recipients
+	// without an entry get it in their inbox, an empty list means discarded.
+	Filings map[string][]Filing
+
+	// Delivery status notifications requested by the client, see RFC 3461
+	Ret    string            // FULL or HDRS
+	EnvId  string            // Envelope identifier
+	Notify map[string]string // Comma separated NOTIFY values, by recipient
+	Orcpt  map[string]string // Original recipient, by recipient
+}
+
+type Filing struct {
+	Mailbox string // Empty for the inbox
+	Flags   []string
 }
 
 type MsgProcessor interface {
 	Process(*ReceivedMsg) error
 }
+
+/**
+ * A random identifier, so a message can be found in the logs
+ */
+func NewQueueId() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
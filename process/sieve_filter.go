@@ -0,0 +1,100 @@
+package process
+
+import (
+	"bytes"
+	"database/sql"
+	"henrymail/logic"
+	"henrymail/sieve"
+	"log"
+	"net/mail"
+)
+
+/**
+ * Runs each recipient's active Sieve script, deciding which of their
+ * mailboxes the message is saved to. Redirects are sent on once the
+ * message has been saved.
+ */
+type sieveFilter struct {
+	db      *sql.DB
+	forward MsgProcessor
+	next    MsgProcessor
+}
+
+func (s sieveFilter) Process(msg *ReceivedMsg) error {
+	var redirects []string
+	for _, to := range msg.To {
+		actions, filtered := s.filter(msg, to)
+		if !filtered {
+			continue
+		}
+		if msg.Filings == nil {
+			msg.Filings = make(map[string][]Filing)
+		}
+		filings := []Filing{}
+		for _, a := range actions {
+			switch a.Type {
+			case sieve.ActionKeep:
+				filings = append(filings, Filing{Flags: a.Flags})
+			case sieve.ActionFileInto:
+				filings = append(filings, Filing{Mailbox: a.Mailbox, Flags: a.Flags})
+			case sieve.ActionRedirect:
+				redirects = appendMissing(redirects, a.Address)
+			}
+		}
+		msg.Filings[to] = filings
+	}
+
+	e := s.next.Process(msg)
+	if e != nil {
+		return e
+	}
+	forwardCopy(s.forward, msg, redirects)
+	return nil
+}
+
+/**
+ * Works out what to do with the message for one recipient, if they have a script
+ */
+func (s sieveFilter) filter(msg *ReceivedMsg, to string) ([]sieve.Action, bool) {
+	user, e := logic.FindRecipient(s.db, to)
+	if e != nil {
+		// Let the saver deal with it
+		return nil, false
+	}
+	script, e := logic.ActiveScript(s.db, user.ID)
+	if e != nil {
+		log.Printf("Unable to load Sieve script for %v: %v", user.Username, e)
+		return nil, false
+	}
+	if script == nil {
+		return nil, false
+	}
+	compiled, e := sieve.Parse(script.Content)
+	if e != nil {
+		log.Printf("Invalid Sieve script %v for %v: %v", script.Name, user.Username, e)
+		return nil, false
+	}
+	m, e := mail.ReadMessage(bytes.NewReader(msg.Content))
+	if e != nil {
+		log.Printf("Unable to filter message %v: %v", msg.Id, e)
+		return nil, false
+	}
+	actions, e := compiled.Execute(&sieve.Message{
+		Header:       m.Header,
+		Size:         len(msg.Content),
+		EnvelopeFrom: msg.From,
+		EnvelopeTo:   to,
+	})
+	if e != nil {
+		log.Printf("Sieve script %v for %v failed, keeping message %v: %v", script.Name, user.Username, msg.Id, e)
+	}
+	return actions, true
+}
+
+func NewSieveFilter(db *sql.DB, forward MsgProcessor, next MsgProcessor) MsgProcessor {
+	return &sieveFilter{
+		db:      db,
+		forward: forward,
+		next:    next,
+	}
+}
@@ -0,0 +1,64 @@
+package process
+
+import (
+	"github.com/emersion/go-smtp"
+	"henrymail/config"
+	"henrymail/spf"
+	"log"
+)
+
+/**
+ * Checks the sending server is allowed to send mail for the sender's domain.
+ * Servers the domain says are not allowed are only rejected if configured to
+ * be, otherwise the result is recorded for DMARC to apply the domain's own
+ * policy. Anything short of a pass is rejected if SPF is mandatory.
+ */
+type spfVerifier struct {
+	checker *spf.Checker
+	next    MsgProcessor
+}
+
+func (s spfVerifier) Process(msg *ReceivedMsg) error {
+	result, e := s.checker.Check(msg.ClientIp, msg.From, msg.Helo)
+	if e != nil {
+		log.Printf("SPF %v for %v from %v: %v", result, msg.From, msg.ClientIp, e)
+	}
+	msg.SpfResult = result
+
+	mandatory := config.GetBool(config.SpfMandatory)
+	switch {
+	case result == spf.Fail && (mandatory || config.GetBool(config.SpfRejectFail)):
+		return &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 7, 23},
+			Message:      "SPF validation failed",
+		}
+	case result == spf.TempError && mandatory:
+		return &smtp.SMTPError{
+			Code:         451,
+			EnhancedCode: smtp.EnhancedCode{4, 7, 24},
+			Message:      "SPF validation error, try again later",
+		}
+	case result == spf.PermError && mandatory:
+		return &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 7, 24},
+			Message:      "SPF validation error",
+		}
+	case result != spf.Pass && mandatory:
+		return &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 7, 23},
+			Message:      "SPF validation required",
+		}
+	}
+
+	return s.next.Process(msg)
+}
+
+func NewSpfVerifier(checker *spf.Checker, next MsgProcessor) MsgProcessor {
+	return &spfVerifier{
+		checker: checker,
+		next:    next,
+	}
+}
@@ -0,0 +1,209 @@
+package process
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"henrymail/config"
+	"strings"
+	"time"
+)
+
+/**
+ * Trace headers, which record how a message reached us (RFC 5321 section 4.4)
+ * and what we found out about who sent it (RFC 8601).
+ */
+
+type receivedHeader struct {
+	next MsgProcessor
+}
+
+func (r receivedHeader) Process(msg *ReceivedMsg) error {
+	msg.Content = append([]byte(received(msg)), msg.Content...)
+	return r.next.Process(msg)
+}
+
+func received(msg *ReceivedMsg) string {
+	b := &strings.Builder{}
+	b.WriteString("Received:")
+	// Messages we made ourselves, like reports, didn't come from anywhere
+	if msg.ClientIp != nil && msg.Helo != "" {
+		fmt.Fprintf(b, " from %v ([%v])\r\n\t", msg.Helo, msg.ClientIp)
+	} else if msg.ClientIp != nil {
+		fmt.Fprintf(b, " from [%v]\r\n\t", msg.ClientIp)
+	} else {
+		b.WriteString(" ")
+	}
+	fmt.Fprintf(b, "by %v (henrymail)", config.GetString(config.ServerName))
+	if msg.ClientIp != nil {
+		// Protocol names from RFC 3848
+		protocol := msg.Protocol
+		if protocol == "" {
+			protocol = "ESMTP"
+			if msg.Tls != nil {
+				protocol += "S"
+			}
+			if msg.Authenticated {
+				protocol += "A"
+			}
+		}
+		fmt.Fprintf(b, " with %v", protocol)
+	}
+	if msg.Id != "" {
+		fmt.Fprintf(b, " id %v", msg.Id)
+	}
+	b.WriteString("\r\n")
+	if msg.Tls != nil {
+		fmt.Fprintf(b, "\t(version=%v cipher=%v)\r\n", tlsVersion(msg.Tls.Version), tls.CipherSuiteName(msg.Tls.CipherSuite))
+	}
+	// Listing more than one recipient would tell each of them about the others
+	if len(msg.To) == 1 {
+		fmt.Fprintf(b, "\tfor <%v>\r\n", msg.To[0])
+	}
+	fmt.Fprintf(b, "\t; %v\r\n", msg.Timestamp.Format(time.RFC1123Z))
+	return b.String()
+}
+
+func tlsVersion(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLS1.0"
+	case tls.VersionTLS11:
+		return "TLS1.1"
+	case tls.VersionTLS12:
+		return "TLS1.2"
+	case tls.VersionTLS13:
+		return "TLS1.3"
+	}
+	return fmt.Sprintf("0x%04x", version)
+}
+
+func NewReceivedHeader(next MsgProcessor) MsgProcessor {
+	return &receivedHeader{
+		next: next,
+	}
+}
+
+type authResultsHeader struct {
+	next MsgProcessor
+}
+
+/**
+ * Replaces any Authentication-Results headers claiming to be from us,
+ * which can't be trusted, with our own.
+ */
+func (a authResultsHeader) Process(msg *ReceivedMsg) error {
+	content := removeHeaders(msg.Content, func(name, value string) bool {
+		return strings.EqualFold(name, "Authentication-Results") && strings.EqualFold(authServId(value), config.GetString(config.ServerName))
+	})
+	msg.Content = append([]byte(authenticationResults(msg)), content...)
+	return a.next.Process(msg)
+}
+
+func authenticationResults(msg *ReceivedMsg) string {
+	var results []string
+	if config.GetBool(config.DkimVerify) {
+		if len(msg.Verifications) == 0 {
+			results = append(results, "dkim=none")
+		}
+		for _, v := range msg.Verifications {
+			result := fmt.Sprintf("dkim=%v header.d=%v", dkimResult(v), v.Domain)
+			if v.Identifier != "" {
+				result += " header.i=" + v.Identifier
+			}
+			results = append(results, result)
+		}
+	}
+	if msg.SpfResult != "" {
+		if msg.From == "" {
+			results = append(results, fmt.Sprintf("spf=%v smtp.helo=%v", msg.SpfResult, msg.Helo))
+		} else {
+			results = append(results, fmt.Sprintf("spf=%v smtp.mailfrom=%v", msg.SpfResult, envelopeDomain(msg)))
+		}
+	}
+	if msg.Dmarc != nil {
+		result := fmt.Sprintf("dmarc=%v", msg.Dmarc.Result)
+		if msg.Dmarc.Record != nil {
+			result += fmt.Sprintf(" (p=%v dis=%v)", msg.Dmarc.Record.P, msg.Dmarc.Disposition)
+		}
+		if msg.Dmarc.HeaderFrom != "" {
+			result += " header.from=" + msg.Dmarc.HeaderFrom
+		}
+		results = append(results, result)
+	}
+	if len(results) == 0 {
+		results = append(results, "none")
+	}
+	return fmt.Sprintf("Authentication-Results: %v;\r\n\t%v\r\n", config.GetString(config.ServerName), strings.Join(results, ";\r\n\t"))
+}
+
+/**
+ * The authserv-id is the first thing in the header, before any version and the first ;
+ */
+func authServId(value string) string {
+	ix := strings.Index(value, ";")
+	if ix >= 0 {
+		value = value[:ix]
+	}
+	// Drop comments
+	for {
+		start := strings.Index(value, "(")
+		end := strings.Index(value, ")")
+		if start < 0 || end < start {
+			break
+		}
+		value = value[:start] + " " + value[end+1:]
+	}
+	fields := strings.Fields(value)
+	if len(fields) == 0 {
+		return ""
+	}
+	return fields[0]
+}
+
+/**
+ * Removes header fields matching a filter, without touching
+ * anything else about the message.
+ */
+func removeHeaders(content []byte, remove func(name, value string) bool) []byte {
+	header := headers(content)
+	body := content[len(header):]
+	out := &bytes.Buffer{}
+	var field []byte
+	flush := func() {
+		if len(field) == 0 {
+			return
+		}
+		keep := true
+		if ix := bytes.IndexByte(field, ':'); ix > 0 {
+			keep = !remove(string(bytes.TrimSpace(field[:ix])), string(field[ix+1:]))
+		}
+		if keep {
+			out.Write(field)
+		}
+		field = nil
+	}
+	for len(header) > 0 {
+		line := header
+		if ix := bytes.IndexByte(header, '\n'); ix >= 0 {
+			line = header[:ix+1]
+		}
+		header = header[len(line):]
+		// Lines starting with whitespace continue the previous field
+		if len(line) > 0 && (line[0] == ' ' || line[0] == '\t') {
+			field = append(field, line...)
+			continue
+		}
+		flush()
+		field = append(field, line...)
+	}
+	flush()
+	out.Write(body)
+	return out.Bytes()
+}
+
+func NewAuthResultsHeader(next MsgProcessor) MsgProcessor {
+	return &authResultsHeader{
+		next: next,
+	}
+}
@@ -0,0 +1,281 @@
+package sieve
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+/**
+ * Splits a script into tokens, see RFC 5228 section 8.1
+ */
+
+type tokenType int
+
+const (
+	tEOF tokenType = iota
+	tIdentifier
+	tTag
+	tNumber
+	tString
+	tLeftBracket
+	tRightBracket
+	tLeftParen
+	tRightParen
+	tLeftBrace
+	tRightBrace
+	tComma
+	tSemicolon
+)
+
+type token struct {
+	typ    tokenType
+	text   string
+	number int64
+	line   int
+}
+
+func (t token) String() string {
+	switch t.typ {
+	case tEOF:
+		return "end of script"
+	case tString:
+		return strconv.Quote(t.text)
+	case tNumber:
+		return strconv.FormatInt(t.number, 10)
+	}
+	return t.text
+}
+
+type lexer struct {
+	src  string
+	pos  int
+	line int
+}
+
+func lex(src string) ([]token, error) {
+	l := &lexer{src: src, line: 1}
+	var tokens []token
+	for {
+		t, e := l.next()
+		if e != nil {
+			return nil, fmt.Errorf("line %d: %v", l.line, e)
+		}
+		tokens = append(tokens, t)
+		if t.typ == tEOF {
+			return tokens, nil
+		}
+	}
+}
+
+func (l *lexer) next() (token, error) {
+	e := l.skipWhitespace()
+	if e != nil {
+		return token{}, e
+	}
+	if l.pos >= len(l.src) {
+		return token{typ: tEOF, line: l.line}, nil
+	}
+	line := l.line
+	c := l.src[l.pos]
+	switch c {
+	case '[':
+		l.pos++
+		return token{typ: tLeftBracket, text: "[", line: line}, nil
+	case ']':
+		l.pos++
+		return token{typ: tRightBracket, text: "]", line: line}, nil
+	case '(':
+		l.pos++
+		return token{typ: tLeftParen, text: "(", line: line}, nil
+	case ')':
+		l.pos++
+		return token{typ: tRightParen, text: ")", line: line}, nil
+	case '{':
+		l.pos++
+		return token{typ: tLeftBrace, text: "{", line: line}, nil
+	case '}':
+		l.pos++
+		return token{typ: tRightBrace, text: "}", line: line}, nil
+	case ',':
+		l.pos++
+		return token{typ: tComma, text: ",", line: line}, nil
+	case ';':
+		l.pos++
+		return token{typ: tSemicolon, text: ";", line: line}, nil
+	case '"':
+		s, e := l.quotedString()
+		return token{typ: tString, text: s, line: line}, e
+	case ':':
+		l.pos++
+		id := l.identifier()
+		if id == "" {
+			return token{}, fmt.Errorf("expected a tag name after :")
+		}
+		return token{typ: tTag, text: ":" + strings.ToLower(id), line: line}, nil
+	}
+	if isDigit(c) {
+		n, e := l.number()
+		return token{typ: tNumber, number: n, line: line}, e
+	}
+	id := l.identifier()
+	if id == "" {
+		return token{}, fmt.Errorf("unexpected character %q", c)
+	}
+	if strings.EqualFold(id, "text") && l.pos < len(l.src) && l.src[l.pos] == ':' {
+		l.pos++
+		s, e := l.multiLine()
+		return token{typ: tString, text: s, line: line}, e
+	}
+	return token{typ: tIdentifier, text: strings.ToLower(id), line: line}, nil
+}
+
+func (l *lexer) skipWhitespace() error {
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		switch {
+		case c == '\n':
+			l.line++
+			l.pos++
+		case c == ' ' || c == '\t' || c == '\r':
+			l.pos++
+		case c == '#':
+			for l.pos < len(l.src) && l.src[l.pos] != '\n' {
+				l.pos++
+			}
+		case strings.HasPrefix(l.src[l.pos:], "/*"):
+			end := strings.Index(l.src[l.pos+2:], "*/")
+			if end < 0 {
+				return fmt.Errorf("unterminated comment")
+			}
+			comment := l.src[l.pos : l.pos+2+end+2]
+			l.line += strings.Count(comment, "\n")
+			l.pos += len(comment)
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+func (l *lexer) identifier() string {
+	start := l.pos
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		if c == '_' || isAlpha(c) || (l.pos > start && isDigit(c)) {
+			l.pos++
+		} else {
+			break
+		}
+	}
+	return l.src[start:l.pos]
+}
+
+/**
+ * Numbers can have a K, M or G suffix
+ */
+func (l *lexer) number() (int64, error) {
+	start := l.pos
+	for l.pos < len(l.src) && isDigit(l.src[l.pos]) {
+		l.pos++
+	}
+	n, e := strconv.ParseInt(l.src[start:l.pos], 10, 64)
+	if e != nil {
+		return 0, fmt.Errorf("invalid number %v", l.src[start:l.pos])
+	}
+	if l.pos < len(l.src) {
+		shift := uint(0)
+		switch l.src[l.pos] {
+		case 'k', 'K':
+			shift = 10
+		case 'm', 'M':
+			shift = 20
+		case 'g', 'G':
+			shift = 30
+		}
+		if shift > 0 {
+			l.pos++
+			if n > (1<<62)>>shift {
+				return 0, fmt.Errorf("number too large")
+			}
+			n <<= shift
+		}
+	}
+	return n, nil
+}
+
+func (l *lexer) quotedString() (string, error) {
+	l.pos++
+	b := &strings.Builder{}
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		l.pos++
+		switch c {
+		case '"':
+			return b.String(), nil
+		case '\\':
+			if l.pos < len(l.src) {
+				c = l.src[l.pos]
+				l.pos++
+			}
+		case '\n':
+			l.line++
+		}
+		b.WriteByte(c)
+	}
+	return "", fmt.Errorf("unterminated string")
+}
+
+/**
+ * text: strings run until a line containing only a dot,
+ * with any other lines starting with a dot having it doubled.
+ */
+func (l *lexer) multiLine() (string, error) {
+	// Only whitespace or a comment can follow text:
+	for l.pos < len(l.src) && (l.src[l.pos] == ' ' || l.src[l.pos] == '\t') {
+		l.pos++
+	}
+	if l.pos < len(l.src) && l.src[l.pos] == '#' {
+		for l.pos < len(l.src) && l.src[l.pos] != '\n' {
+			l.pos++
+		}
+	}
+	if l.pos < len(l.src) && l.src[l.pos] == '\r' {
+		l.pos++
+	}
+	if l.pos >= len(l.src) || l.src[l.pos] != '\n' {
+		return "", fmt.Errorf("expected a new line after text:")
+	}
+	l.pos++
+	l.line++
+
+	b := &strings.Builder{}
+	for l.pos < len(l.src) {
+		end := strings.IndexByte(l.src[l.pos:], '\n')
+		var line string
+		if end < 0 {
+			line = l.src[l.pos:]
+			l.pos = len(l.src)
+		} else {
+			line = l.src[l.pos : l.pos+end+1]
+			l.pos += end + 1
+			l.line++
+		}
+		if strings.TrimRight(line, "\r\n") == "." {
+			return b.String(), nil
+		}
+		if strings.HasPrefix(line, "..") {
+			line = line[1:]
+		}
+		b.WriteString(line)
+	}
+	return "", fmt.Errorf("unterminated text: string")
+}
+
+func isAlpha(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
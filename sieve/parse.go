@@ -0,0 +1,205 @@
+package sieve
+
+import (
+	"fmt"
+)
+
+/**
+ * Parses tokens into the generic command structure from RFC 5228 section 8.2.
+ * Whether the commands make sense is checked when they're compiled.
+ */
+
+type argument struct {
+	tag     string
+	number  int64
+	strings []string
+	isNum   bool
+	isList  bool // Strings written as a [list], rather than a single string
+}
+
+func (a argument) isString() bool {
+	return a.tag == "" && !a.isNum
+}
+
+type testNode struct {
+	name  string
+	args  []argument
+	tests []*testNode
+	line  int
+}
+
+type commandNode struct {
+	name  string
+	args  []argument
+	tests []*testNode
+	block []*commandNode
+	// Whether there was a block, which might be empty
+	hasBlock bool
+	line     int
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func parse(src string) ([]*commandNode, error) {
+	tokens, e := lex(src)
+	if e != nil {
+		return nil, e
+	}
+	p := &parser{tokens: tokens}
+	commands, e := p.commands()
+	if e != nil {
+		return nil, e
+	}
+	if t := p.peek(); t.typ != tEOF {
+		return nil, p.errorf(t, "unexpected %v", t)
+	}
+	return commands, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) take() token {
+	t := p.tokens[p.pos]
+	if t.typ != tEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) errorf(t token, format string, args ...interface{}) error {
+	return fmt.Errorf("line %d: %v", t.line, fmt.Sprintf(format, args...))
+}
+
+func (p *parser) commands() ([]*commandNode, error) {
+	var commands []*commandNode
+	for p.peek().typ == tIdentifier {
+		c, e := p.command()
+		if e != nil {
+			return nil, e
+		}
+		commands = append(commands, c)
+	}
+	return commands, nil
+}
+
+func (p *parser) command() (*commandNode, error) {
+	t := p.take()
+	c := &commandNode{name: t.text, line: t.line}
+	var e error
+	c.args, c.tests, e = p.arguments()
+	if e != nil {
+		return nil, e
+	}
+	t = p.take()
+	switch t.typ {
+	case tSemicolon:
+	case tLeftBrace:
+		c.hasBlock = true
+		c.block, e = p.commands()
+		if e != nil {
+			return nil, e
+		}
+		if t := p.take(); t.typ != tRightBrace {
+			return nil, p.errorf(t, "expected } but found %v", t)
+		}
+	default:
+		return nil, p.errorf(t, "expected ; or { after %v but found %v", c.name, t)
+	}
+	return c, nil
+}
+
+/**
+ * Arguments, followed by a single test or a list of them
+ */
+func (p *parser) arguments() ([]argument, []*testNode, error) {
+	var args []argument
+	for {
+		t := p.peek()
+		switch t.typ {
+		case tTag:
+			p.take()
+			args = append(args, argument{tag: t.text})
+			continue
+		case tNumber:
+			p.take()
+			args = append(args, argument{number: t.number, isNum: true})
+			continue
+		case tString, tLeftBracket:
+			list, isList, e := p.stringList()
+			if e != nil {
+				return nil, nil, e
+			}
+			args = append(args, argument{strings: list, isList: isList})
+			continue
+		case tIdentifier:
+			test, e := p.test()
+			if e != nil {
+				return nil, nil, e
+			}
+			return args, []*testNode{test}, nil
+		case tLeftParen:
+			tests, e := p.testList()
+			return args, tests, e
+		}
+		return args, nil, nil
+	}
+}
+
+func (p *parser) stringList() ([]string, bool, error) {
+	t := p.take()
+	if t.typ == tString {
+		return []string{t.text}, false, nil
+	}
+	var list []string
+	for {
+		t = p.take()
+		if t.typ != tString {
+			return nil, false, p.errorf(t, "expected a string but found %v", t)
+		}
+		list = append(list, t.text)
+		t = p.take()
+		switch t.typ {
+		case tComma:
+		case tRightBracket:
+			return list, true, nil
+		default:
+			return nil, false, p.errorf(t, "expected , or ] but found %v", t)
+		}
+	}
+}
+
+func (p *parser) test() (*testNode, error) {
+	t := p.take()
+	if t.typ != tIdentifier {
+		return nil, p.errorf(t, "expected a test but found %v", t)
+	}
+	test := &testNode{name: t.text, line: t.line}
+	var e error
+	test.args, test.tests, e = p.arguments()
+	return test, e
+}
+
+func (p *parser) testList() ([]*testNode, error) {
+	p.take()
+	var tests []*testNode
+	for {
+		test, e := p.test()
+		if e != nil {
+			return nil, e
+		}
+		tests = append(tests, test)
+		t := p.take()
+		switch t.typ {
+		case tComma:
+		case tRightParen:
+			return tests, nil
+		default:
+			return nil, p.errorf(t, "expected , or ) but found %v", t)
+		}
+	}
+}
@@ -0,0 +1,906 @@
+package sieve
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"net/mail"
+	"strings"
+)
+
+/**
+ * A Sieve mail filtering language interpreter, see RFC 5228.
+ * Supports the fileinto, envelope, copy (RFC 3894) and imap4flags
+ * (RFC 5232) extensions.
+ */
+
+// Extensions scripts can require, as advertised by ManageSieve
+var Extensions = []string{"fileinto", "envelope", "copy", "imap4flags", "comparator-i;octet", "comparator-i;ascii-casemap"}
+
+// Scripts can't send a message on to more addresses than this
+const MaxRedirects = 4
+
+const (
+	ActionKeep     = "keep"
+	ActionFileInto = "fileinto"
+	ActionRedirect = "redirect"
+)
+
+/**
+ * Something to do with the message once the script has finished
+ */
+type Action struct {
+	Type    string
+	Mailbox string   // For fileinto
+	Address string   // For redirect
+	Flags   []string // IMAP flags to store the message with, for keep and fileinto
+}
+
+/**
+ * What a script can find out about the message it's filtering
+ */
+type Message struct {
+	Header       mail.Header
+	Size         int
+	EnvelopeFrom string
+	EnvelopeTo   string
+}
+
+type Script struct {
+	commands []command
+}
+
+/**
+ * Parses and checks a script, so errors are found before it's ever run
+ */
+func Parse(src string) (*Script, error) {
+	nodes, e := parse(src)
+	if e != nil {
+		return nil, e
+	}
+	c := &compiler{required: make(map[string]bool)}
+	commands, e := c.commands(nodes, true)
+	if e != nil {
+		return nil, e
+	}
+	return &Script{commands: commands}, nil
+}
+
+/**
+ * Runs the script against a message. If anything goes wrong the
+ * message is kept, as if there were no script.
+ */
+func (s *Script) Execute(msg *Message) ([]Action, error) {
+	in := &interpreter{msg: msg, implicitKeep: true}
+	e := runCommands(in, s.commands)
+	if e == errStop {
+		e = nil
+	}
+	if e != nil {
+		return []Action{{Type: ActionKeep}}, e
+	}
+	if in.implicitKeep {
+		in.add(Action{Type: ActionKeep, Flags: in.flags})
+	}
+	return in.actions, nil
+}
+
+/**
+ * Compiling turns the generic command structure into specific commands and
+ * tests, checking they have the right arguments on the way.
+ */
+type compiler struct {
+	required map[string]bool
+}
+
+func (c *compiler) commands(nodes []*commandNode, topLevel bool) ([]command, error) {
+	var commands []command
+	requireAllowed := topLevel
+	for _, n := range nodes {
+		if n.name == "require" {
+			if !requireAllowed {
+				return nil, fmt.Errorf("line %d: require must come before other commands", n.line)
+			}
+			e := c.require(n)
+			if e != nil {
+				return nil, e
+			}
+			continue
+		}
+		requireAllowed = false
+
+		// elsif and else belong to the if before them
+		if n.name == "elsif" || n.name == "else" {
+			var last *ifCommand
+			if len(commands) > 0 {
+				last, _ = commands[len(commands)-1].(*ifCommand)
+			}
+			if last == nil || last.hasElse {
+				return nil, fmt.Errorf("line %d: %v without if", n.line, n.name)
+			}
+			e := c.branch(n, last)
+			if e != nil {
+				return nil, e
+			}
+			continue
+		}
+
+		cmd, e := c.command(n)
+		if e != nil {
+			return nil, e
+		}
+		commands = append(commands, cmd)
+	}
+	return commands, nil
+}
+
+func (c *compiler) require(n *commandNode) error {
+	a, e := splitArgs(n.line, n.name, n.args, nil)
+	if e != nil {
+		return e
+	}
+	if len(a.positional) != 1 || !a.positional[0].isString() || len(n.tests) > 0 || n.hasBlock {
+		return fmt.Errorf("line %d: require needs a list of extensions", n.line)
+	}
+	for _, ext := range a.positional[0].strings {
+		supported := false
+		for _, s := range Extensions {
+			supported = supported || s == ext
+		}
+		if !supported {
+			return fmt.Errorf("line %d: unsupported extension %q", n.line, ext)
+		}
+		c.required[ext] = true
+	}
+	return nil
+}
+
+func (c *compiler) needs(line int, name, extension string) error {
+	if !c.required[extension] {
+		return fmt.Errorf("line %d: %v needs require \"%v\"", line, name, extension)
+	}
+	return nil
+}
+
+func (c *compiler) branch(n *commandNode, cmd *ifCommand) error {
+	if !n.hasBlock {
+		return fmt.Errorf("line %d: %v needs a block", n.line, n.name)
+	}
+	if len(n.args) > 0 {
+		return fmt.Errorf("line %d: unexpected arguments to %v", n.line, n.name)
+	}
+	block, e := c.commands(n.block, false)
+	if e != nil {
+		return e
+	}
+	if n.name == "else" {
+		if len(n.tests) > 0 {
+			return fmt.Errorf("line %d: else can't have a test", n.line)
+		}
+		cmd.hasElse = true
+		cmd.elseBlock = block
+		return nil
+	}
+	if len(n.tests) != 1 {
+		return fmt.Errorf("line %d: %v needs exactly one test", n.line, n.name)
+	}
+	test, e := c.test(n.tests[0])
+	if e != nil {
+		return e
+	}
+	cmd.tests = append(cmd.tests, test)
+	cmd.blocks = append(cmd.blocks, block)
+	return nil
+}
+
+func (c *compiler) command(n *commandNode) (command, error) {
+	if n.name == "if" {
+		cmd := &ifCommand{}
+		return cmd, c.branch(n, cmd)
+	}
+	if n.hasBlock || len(n.tests) > 0 {
+		return nil, fmt.Errorf("line %d: unexpected test or block after %v", n.line, n.name)
+	}
+
+	spec := tagSpec{}
+	switch n.name {
+	case "keep", "fileinto":
+		if c.required["imap4flags"] {
+			spec[":flags"] = true
+		}
+		if n.name == "fileinto" && c.required["copy"] {
+			spec[":copy"] = false
+		}
+	case "redirect":
+		if c.required["copy"] {
+			spec[":copy"] = false
+		}
+	}
+	a, e := splitArgs(n.line, n.name, n.args, spec)
+	if e != nil {
+		return nil, e
+	}
+	flags, hasFlags := a.tags[":flags"]
+	_, hasCopy := a.tags[":copy"]
+
+	switch n.name {
+	case "stop":
+		return &stopCommand{}, a.expect(0)
+	case "discard":
+		return &discardCommand{}, a.expect(0)
+	case "keep":
+		return &keepCommand{hasFlags: hasFlags, flags: flags.strings}, a.expect(0)
+	case "fileinto":
+		e = c.needs(n.line, n.name, "fileinto")
+		if e == nil {
+			e = a.expectString(0)
+		}
+		if e != nil {
+			return nil, e
+		}
+		return &fileIntoCommand{mailbox: a.positional[0].strings[0], copy: hasCopy, hasFlags: hasFlags, flags: flags.strings}, nil
+	case "redirect":
+		e = a.expectString(0)
+		if e != nil {
+			return nil, e
+		}
+		address := a.positional[0].strings[0]
+		if _, e := mail.ParseAddress(address); e != nil {
+			return nil, fmt.Errorf("line %d: invalid redirect address %q", n.line, address)
+		}
+		return &redirectCommand{address: address, copy: hasCopy}, nil
+	case "setflag", "addflag", "removeflag":
+		e = c.needs(n.line, n.name, "imap4flags")
+		if e == nil {
+			e = a.expectStrings(1)
+		}
+		if e != nil {
+			return nil, e
+		}
+		return &flagCommand{op: n.name, flags: a.positional[0].strings}, nil
+	}
+	return nil, fmt.Errorf("line %d: unknown command %v", n.line, n.name)
+}
+
+func (c *compiler) test(n *testNode) (test, error) {
+	switch n.name {
+	case "true", "false", "not", "allof", "anyof":
+		if len(n.args) > 0 {
+			return nil, fmt.Errorf("line %d: unexpected arguments to %v", n.line, n.name)
+		}
+	default:
+		if len(n.tests) > 0 {
+			return nil, fmt.Errorf("line %d: unexpected test after %v", n.line, n.name)
+		}
+	}
+
+	switch n.name {
+	case "true":
+		return constTest(true), nil
+	case "false":
+		return constTest(false), nil
+	case "not":
+		if len(n.tests) != 1 {
+			return nil, fmt.Errorf("line %d: not needs exactly one test", n.line)
+		}
+		t, e := c.test(n.tests[0])
+		return &notTest{t}, e
+	case "allof", "anyof":
+		if len(n.tests) == 0 {
+			return nil, fmt.Errorf("line %d: %v needs a list of tests", n.line, n.name)
+		}
+		var tests []test
+		for _, tn := range n.tests {
+			t, e := c.test(tn)
+			if e != nil {
+				return nil, e
+			}
+			tests = append(tests, t)
+		}
+		return &listTest{all: n.name == "allof", tests: tests}, nil
+	case "exists":
+		a, e := splitArgs(n.line, n.name, n.args, nil)
+		if e == nil {
+			e = a.expectStrings(1)
+		}
+		if e != nil {
+			return nil, e
+		}
+		return &existsTest{headers: a.positional[0].strings}, nil
+	case "size":
+		a, e := splitArgs(n.line, n.name, n.args, tagSpec{":over": false, ":under": false})
+		if e != nil {
+			return nil, e
+		}
+		_, over := a.tags[":over"]
+		_, under := a.tags[":under"]
+		if over == under || len(a.positional) != 1 || !a.positional[0].isNum {
+			return nil, fmt.Errorf("line %d: size needs :over or :under and a number", n.line)
+		}
+		return &sizeTest{over: over, limit: a.positional[0].number}, nil
+	case "header", "address", "envelope", "hasflag":
+		spec := tagSpec{":comparator": true, ":is": false, ":contains": false, ":matches": false}
+		if n.name == "address" || n.name == "envelope" {
+			spec[":all"], spec[":localpart"], spec[":domain"] = false, false, false
+		}
+		a, e := splitArgs(n.line, n.name, n.args, spec)
+		if e != nil {
+			return nil, e
+		}
+		m, e := compileMatcher(n.line, a)
+		if e != nil {
+			return nil, e
+		}
+		if n.name == "hasflag" {
+			e = c.needs(n.line, n.name, "imap4flags")
+			if e == nil {
+				e = a.expectStrings(1)
+			}
+			if e != nil {
+				return nil, e
+			}
+			return &hasFlagTest{matcher: m, flags: a.positional[0].strings}, nil
+		}
+		e = a.expectStrings(2)
+		if e != nil {
+			return nil, e
+		}
+		names, keys := a.positional[0].strings, a.positional[1].strings
+		if n.name == "header" {
+			return &headerTest{matcher: m, headers: names, keys: keys}, nil
+		}
+		part, e := addressPart(n.line, a)
+		if e != nil {
+			return nil, e
+		}
+		if n.name == "address" {
+			return &addressTest{matcher: m, part: part, headers: names, keys: keys}, nil
+		}
+		e = c.needs(n.line, n.name, "envelope")
+		if e != nil {
+			return nil, e
+		}
+		for ix, name := range names {
+			names[ix] = strings.ToLower(name)
+			if names[ix] != "from" && names[ix] != "to" {
+				return nil, fmt.Errorf("line %d: unsupported envelope part %q", n.line, name)
+			}
+		}
+		return &envelopeTest{matcher: m, part: part, parts: names, keys: keys}, nil
+	}
+	return nil, fmt.Errorf("line %d: unknown test %v", n.line, n.name)
+}
+
+/**
+ * Which tags a command or test accepts, and whether each takes a value
+ */
+type tagSpec map[string]bool
+
+type splitArguments struct {
+	line       int
+	name       string
+	tags       map[string]argument
+	positional []argument
+}
+
+func splitArgs(line int, name string, list []argument, spec tagSpec) (*splitArguments, error) {
+	a := &splitArguments{line: line, name: name, tags: make(map[string]argument)}
+	for i := 0; i < len(list); i++ {
+		arg := list[i]
+		if arg.tag == "" {
+			a.positional = append(a.positional, arg)
+			continue
+		}
+		if len(a.positional) > 0 {
+			return nil, fmt.Errorf("line %d: %v must come before other arguments to %v", line, arg.tag, name)
+		}
+		takesValue, ok := spec[arg.tag]
+		if !ok {
+			return nil, fmt.Errorf("line %d: unexpected %v for %v", line, arg.tag, name)
+		}
+		if _, dup := a.tags[arg.tag]; dup {
+			return nil, fmt.Errorf("line %d: %v given twice", line, arg.tag)
+		}
+		var value argument
+		if takesValue {
+			i++
+			if i >= len(list) || list[i].tag != "" {
+				return nil, fmt.Errorf("line %d: %v needs a value", line, arg.tag)
+			}
+			value = list[i]
+		}
+		a.tags[arg.tag] = value
+	}
+	return a, nil
+}
+
+func (a *splitArguments) expect(count int) error {
+	if len(a.positional) != count {
+		return fmt.Errorf("line %d: wrong number of arguments to %v", a.line, a.name)
+	}
+	return nil
+}
+
+/**
+ * Expects count string lists
+ */
+func (a *splitArguments) expectStrings(count int) error {
+	e := a.expect(count)
+	if e != nil {
+		return e
+	}
+	for _, arg := range a.positional {
+		if !arg.isString() {
+			return fmt.Errorf("line %d: %v expects strings", a.line, a.name)
+		}
+	}
+	return nil
+}
+
+/**
+ * Expects a single string, not a list
+ */
+func (a *splitArguments) expectString(count int) error {
+	e := a.expectStrings(count + 1)
+	if e == nil && (a.positional[count].isList || len(a.positional[count].strings) != 1) {
+		e = fmt.Errorf("line %d: %v expects a single string", a.line, a.name)
+	}
+	return e
+}
+
+func compileMatcher(line int, a *splitArguments) (matcher, error) {
+	m := matcher{comparator: "i;ascii-casemap", matchType: ":is"}
+	if c, ok := a.tags[":comparator"]; ok {
+		if !c.isString() || len(c.strings) != 1 {
+			return m, fmt.Errorf("line %d: :comparator needs a single string", line)
+		}
+		m.comparator = c.strings[0]
+		if m.comparator != "i;ascii-casemap" && m.comparator != "i;octet" {
+			return m, fmt.Errorf("line %d: unsupported comparator %q", line, m.comparator)
+		}
+	}
+	count := 0
+	for _, t := range []string{":is", ":contains", ":matches"} {
+		if _, ok := a.tags[t]; ok {
+			m.matchType = t
+			count++
+		}
+	}
+	if count > 1 {
+		return m, fmt.Errorf("line %d: only one match type is allowed", line)
+	}
+	return m, nil
+}
+
+func addressPart(line int, a *splitArguments) (string, error) {
+	part, count := ":all", 0
+	for _, t := range []string{":all", ":localpart", ":domain"} {
+		if _, ok := a.tags[t]; ok {
+			part = t
+			count++
+		}
+	}
+	if count > 1 {
+		return "", fmt.Errorf("line %d: only one address part is allowed", line)
+	}
+	return part, nil
+}
+
+/**
+ * Running a script
+ */
+
+var errStop = errors.New("stop")
+
+type interpreter struct {
+	msg          *Message
+	actions      []Action
+	flags        []string
+	implicitKeep bool
+	redirects    int
+}
+
+/**
+ * Adds an action, unless the same thing is already going to happen
+ */
+func (in *interpreter) add(action Action) {
+	for _, a := range in.actions {
+		if a.Type == action.Type && a.Mailbox == action.Mailbox && a.Address == action.Address {
+			return
+		}
+	}
+	in.actions = append(in.actions, action)
+}
+
+type command interface {
+	run(in *interpreter) error
+}
+
+func runCommands(in *interpreter, commands []command) error {
+	for _, c := range commands {
+		e := c.run(in)
+		if e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+type ifCommand struct {
+	tests     []test
+	blocks    [][]command
+	hasElse   bool
+	elseBlock []command
+}
+
+func (c *ifCommand) run(in *interpreter) error {
+	for ix, t := range c.tests {
+		if t.eval(in) {
+			return runCommands(in, c.blocks[ix])
+		}
+	}
+	return runCommands(in, c.elseBlock)
+}
+
+type stopCommand struct{}
+
+func (*stopCommand) run(in *interpreter) error {
+	return errStop
+}
+
+type discardCommand struct{}
+
+func (*discardCommand) run(in *interpreter) error {
+	in.implicitKeep = false
+	return nil
+}
+
+type keepCommand struct {
+	hasFlags bool
+	flags    []string
+}
+
+func (c *keepCommand) run(in *interpreter) error {
+	flags := in.flags
+	if c.hasFlags {
+		flags = flagSet(nil, c.flags)
+	}
+	in.add(Action{Type: ActionKeep, Flags: flags})
+	in.implicitKeep = false
+	return nil
+}
+
+type fileIntoCommand struct {
+	mailbox  string
+	copy     bool
+	hasFlags bool
+	flags    []string
+}
+
+func (c *fileIntoCommand) run(in *interpreter) error {
+	flags := in.flags
+	if c.hasFlags {
+		flags = flagSet(nil, c.flags)
+	}
+	in.add(Action{Type: ActionFileInto, Mailbox: c.mailbox, Flags: flags})
+	if !c.copy {
+		in.implicitKeep = false
+	}
+	return nil
+}
+
+type redirectCommand struct {
+	address string
+	copy    bool
+}
+
+func (c *redirectCommand) run(in *interpreter) error {
+	in.redirects++
+	if in.redirects > MaxRedirects {
+		return fmt.Errorf("more than %d redirects", MaxRedirects)
+	}
+	in.add(Action{Type: ActionRedirect, Address: c.address})
+	if !c.copy {
+		in.implicitKeep = false
+	}
+	return nil
+}
+
+type flagCommand struct {
+	op    string
+	flags []string
+}
+
+func (c *flagCommand) run(in *interpreter) error {
+	switch c.op {
+	case "setflag":
+		in.flags = flagSet(nil, c.flags)
+	case "addflag":
+		in.flags = flagSet(in.flags, c.flags)
+	case "removeflag":
+		var remaining []string
+		for _, f := range in.flags {
+			if !containsFold(flagSet(nil, c.flags), f) {
+				remaining = append(remaining, f)
+			}
+		}
+		in.flags = remaining
+	}
+	return nil
+}
+
+/**
+ * Flag lists can have several flags in each string, separated by spaces
+ */
+func flagSet(existing []string, lists []string) []string {
+	flags := append([]string(nil), existing...)
+	for _, list := range lists {
+		for _, f := range strings.Fields(list) {
+			if !containsFold(flags, f) {
+				flags = append(flags, f)
+			}
+		}
+	}
+	return flags
+}
+
+func containsFold(list []string, s string) bool {
+	for _, l := range list {
+		if strings.EqualFold(l, s) {
+			return true
+		}
+	}
+	return false
+}
+
+type test interface {
+	eval(in *interpreter) bool
+}
+
+type constTest bool
+
+func (t constTest) eval(in *interpreter) bool {
+	return bool(t)
+}
+
+type notTest struct {
+	test test
+}
+
+func (t *notTest) eval(in *interpreter) bool {
+	return !t.test.eval(in)
+}
+
+type listTest struct {
+	all   bool
+	tests []test
+}
+
+func (t *listTest) eval(in *interpreter) bool {
+	for _, test := range t.tests {
+		if test.eval(in) != t.all {
+			return !t.all
+		}
+	}
+	return t.all
+}
+
+type existsTest struct {
+	headers []string
+}
+
+func (t *existsTest) eval(in *interpreter) bool {
+	for _, h := range t.headers {
+		if len(in.msg.Header[canonical(h)]) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+type sizeTest struct {
+	over  bool
+	limit int64
+}
+
+func (t *sizeTest) eval(in *interpreter) bool {
+	if t.over {
+		return int64(in.msg.Size) > t.limit
+	}
+	return int64(in.msg.Size) < t.limit
+}
+
+type headerTest struct {
+	matcher matcher
+	headers []string
+	keys    []string
+}
+
+func (t *headerTest) eval(in *interpreter) bool {
+	for _, h := range t.headers {
+		for _, value := range in.msg.Header[canonical(h)] {
+			if t.matcher.any(decodeHeader(value), t.keys) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type addressTest struct {
+	matcher matcher
+	part    string
+	headers []string
+	keys    []string
+}
+
+func (t *addressTest) eval(in *interpreter) bool {
+	for _, h := range t.headers {
+		for _, value := range in.msg.Header[canonical(h)] {
+			addresses, e := mail.ParseAddressList(value)
+			if e != nil {
+				// Not much we can do with something that isn't an address
+				if t.part == ":all" && t.matcher.any(strings.TrimSpace(value), t.keys) {
+					return true
+				}
+				continue
+			}
+			for _, a := range addresses {
+				if t.matcher.any(addressPartOf(a.Address, t.part), t.keys) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+type envelopeTest struct {
+	matcher matcher
+	part    string
+	parts   []string
+	keys    []string
+}
+
+func (t *envelopeTest) eval(in *interpreter) bool {
+	for _, p := range t.parts {
+		address := in.msg.EnvelopeTo
+		if p == "from" {
+			address = in.msg.EnvelopeFrom
+		}
+		if t.matcher.any(addressPartOf(address, t.part), t.keys) {
+			return true
+		}
+	}
+	return false
+}
+
+type hasFlagTest struct {
+	matcher matcher
+	flags   []string
+}
+
+func (t *hasFlagTest) eval(in *interpreter) bool {
+	keys := flagSet(nil, t.flags)
+	for _, f := range in.flags {
+		if t.matcher.any(f, keys) {
+			return true
+		}
+	}
+	return false
+}
+
+func canonical(header string) string {
+	return strings.Title(strings.ToLower(header))
+}
+
+func decodeHeader(value string) string {
+	decoded, e := new(mime.WordDecoder).DecodeHeader(value)
+	if e != nil {
+		return value
+	}
+	return decoded
+}
+
+func addressPartOf(address, part string) string {
+	ix := strings.LastIndex(address, "@")
+	switch {
+	case part == ":localpart" && ix >= 0:
+		return address[:ix]
+	case part == ":domain" && ix >= 0:
+		return address[ix+1:]
+	case part == ":domain":
+		return ""
+	}
+	return address
+}
+
+/**
+ * Comparators and match types, see RFC 5228 section 2.7
+ */
+type matcher struct {
+	comparator string
+	matchType  string
+}
+
+func (m matcher) any(value string, keys []string) bool {
+	for _, key := range keys {
+		if m.match(value, key) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m matcher) match(value, key string) bool {
+	if m.comparator == "i;ascii-casemap" {
+		value, key = asciiLower(value), asciiLower(key)
+	}
+	switch m.matchType {
+	case ":contains":
+		return strings.Contains(value, key)
+	case ":matches":
+		return glob(key, value)
+	}
+	return value == key
+}
+
+func asciiLower(s string) string {
+	b := []byte(s)
+	for ix, c := range b {
+		if c >= 'A' && c <= 'Z' {
+			b[ix] = c + 'a' - 'A'
+		}
+	}
+	return string(b)
+}
+
+/**
+ * Wildcard matching, where * matches anything, ? matches a
+ * single character and \ escapes the character after it.
+ */
+func glob(pattern, s string) bool {
+	type part struct {
+		r    rune
+		kind byte // 0 for a literal, or ? or *
+	}
+	var parts []part
+	escaped := false
+	for _, r := range pattern {
+		switch {
+		case escaped:
+			parts = append(parts, part{r: r})
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '*' || r == '?':
+			parts = append(parts, part{kind: byte(r)})
+		default:
+			parts = append(parts, part{r: r})
+		}
+	}
+
+	text := []rune(s)
+	p, t := 0, 0
+	starP, starT := -1, 0
+	for t < len(text) {
+		switch {
+		case p < len(parts) && (parts[p].kind == '?' || (parts[p].kind == 0 && parts[p].r == text[t])):
+			p++
+			t++
+		case p < len(parts) && parts[p].kind == '*':
+			starP, starT = p, t
+			p++
+		case starP >= 0:
+			// Let the last * swallow one more character
+			starT++
+			p, t = starP+1, starT
+		default:
+			return false
+		}
+	}
+	for p < len(parts) && parts[p].kind == '*' {
+		p++
+	}
+	return p == len(parts)
+}
@@ -0,0 +1,135 @@
+package sieve
+
+import (
+	"net/mail"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testMessage = "From: \"Alice\" <alice@example.com>\r\n" +
+	"To: bob@example.org, list@lists.example.net\r\n" +
+	"Subject: =?utf-8?q?Caf=C3=A9_meeting?=\r\n" +
+	"X-Spam: yes\r\n" +
+	"\r\n" +
+	"Hello\r\n"
+
+func testMsg(t *testing.T) *Message {
+	m, e := mail.ReadMessage(strings.NewReader(testMessage))
+	if e != nil {
+		t.Fatal(e)
+	}
+	return &Message{Header: m.Header, Size: len(testMessage), EnvelopeFrom: "bounce@example.com", EnvelopeTo: "bob+lists@example.org"}
+}
+
+func TestExecute(t *testing.T) {
+	for _, c := range []struct {
+		script  string
+		actions []Action
+	}{
+		{``, []Action{{Type: ActionKeep}}},
+		{`discard;`, nil},
+		{`require "fileinto"; if header :contains "subject" "café" { fileinto "Meetings"; }`,
+			[]Action{{Type: ActionFileInto, Mailbox: "Meetings"}}},
+		{`require ["fileinto", "copy"]; fileinto :copy "Archive";`,
+			[]Action{{Type: ActionFileInto, Mailbox: "Archive"}, {Type: ActionKeep}}},
+		{`require "fileinto";
+		  if address :domain :is "to" "lists.example.net" { fileinto "Lists"; stop; }
+		  keep;`,
+			[]Action{{Type: ActionFileInto, Mailbox: "Lists"}}},
+		{`if address :localpart "from" "bob" { discard; } elsif exists ["X-Spam", "From"] { redirect "carol@example.com"; } else { keep; }`,
+			[]Action{{Type: ActionRedirect, Address: "carol@example.com"}}},
+		{`require "envelope"; if envelope :matches "to" "*+lists@*.org" { discard; }`, nil},
+		{`if allof(size :under 1K, not header :is "x-spam" "no", true) { discard; }`, nil},
+		{`if anyof(false, size :over 1M) { discard; }`, []Action{{Type: ActionKeep}}},
+		{`require "imap4flags"; addflag "\\Seen"; addflag ["\\Flagged \\Seen"]; removeflag "\\seen";
+		  if hasflag "\\flagged" { keep :flags "$Important"; }`,
+			[]Action{{Type: ActionKeep, Flags: []string{"$Important"}}}},
+		{`require ["imap4flags", "fileinto"]; setflag "\\Seen"; fileinto "Read";`,
+			[]Action{{Type: ActionFileInto, Mailbox: "Read", Flags: []string{"\\Seen"}}}},
+		{`if header :comparator "i;octet" :is "X-Spam" "YES" { discard; }`, []Action{{Type: ActionKeep}}},
+	} {
+		s, e := Parse(c.script)
+		if e != nil {
+			t.Errorf("%v: %v", c.script, e)
+			continue
+		}
+		actions, e := s.Execute(testMsg(t))
+		if e != nil {
+			t.Errorf("%v: %v", c.script, e)
+			continue
+		}
+		if !reflect.DeepEqual(actions, c.actions) {
+			t.Errorf("%v: expected %v but got %v", c.script, c.actions, actions)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, script := range []string{
+		`fileinto "Junk";`,
+		`keep; require "fileinto";`,
+		`require "vacation";`,
+		`else { keep; }`,
+		`if true { keep; } else { keep; } else { keep; }`,
+		`if true keep;`,
+		`if header "subject" { keep; }`,
+		`if header :is :contains "subject" "x" { keep; }`,
+		`if size 100 { keep; }`,
+		`redirect "not an address";`,
+		`discard`,
+		`keep "x";`,
+		`if header :comparator "i;unknown" "a" "b" { keep; }`,
+		`require "envelope"; if envelope "cc" "x" { keep; }`,
+		`/* unterminated`,
+		`if true { keep; `,
+	} {
+		if _, e := Parse(script); e == nil {
+			t.Errorf("%v: expected an error", script)
+		}
+	}
+}
+
+func TestRedirectLimit(t *testing.T) {
+	s, e := Parse(`redirect "a@example.com"; redirect "b@example.com"; redirect "c@example.com";
+		redirect "d@example.com"; redirect "e@example.com";`)
+	if e != nil {
+		t.Fatal(e)
+	}
+	actions, e := s.Execute(testMsg(t))
+	if e == nil || !reflect.DeepEqual(actions, []Action{{Type: ActionKeep}}) {
+		t.Errorf("expected an error and keep, got %v %v", actions, e)
+	}
+}
+
+func TestGlob(t *testing.T) {
+	for _, c := range []struct {
+		pattern, s string
+		match      bool
+	}{
+		{"*", "", true},
+		{"a*c", "abbbc", true},
+		{"a?c", "abc", true},
+		{"a?c", "ac", false},
+		{"*@example.com", "x@example.com", true},
+		{"a\\*", "a*", true},
+		{"a\\*", "ab", false},
+		{"*a*b", "xaxxab", true},
+		{"*a*b", "xaxxa", false},
+	} {
+		if glob(c.pattern, c.s) != c.match {
+			t.Errorf("glob(%q, %q) should be %v", c.pattern, c.s, c.match)
+		}
+	}
+}
+
+func TestMultiLine(t *testing.T) {
+	s, e := Parse("if header :is \"subject\" text:\r\n..dot\r\n.\r\n{ discard; }")
+	if e != nil {
+		t.Fatal(e)
+	}
+	cmd := s.commands[0].(*ifCommand)
+	if keys := cmd.tests[0].(*headerTest).keys; keys[0] != ".dot\r\n" {
+		t.Errorf("unexpected text: string %q", keys[0])
+	}
+}
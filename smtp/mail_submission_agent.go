@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"crypto/tls"
 	"database/sql"
+	"fmt"
 	"github.com/emersion/go-message"
 	"github.com/emersion/go-smtp"
 	"henrymail/config"
@@ -12,7 +13,9 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
+	"net/mail"
 	"os"
+	"strings"
 )
 
 /**
@@ -28,9 +31,10 @@ func StartMsa(db *sql.DB, proc process.MsgProcessor, tls *tls.Config) {
 	s.Domain = config.GetString(config.ServerName)
 	//TODO come back to this
 	// s.ReadTimeout = time.Duration config.GetInt(config.MaxIdleSeconds)
-	s.MaxMessageBytes = config.GetInt(config.MaxMessageBytes)
+	s.MaxMessageBytes = int64(config.GetInt(config.MaxMessageBytes))
 	s.MaxRecipients = config.GetInt(config.MaxRecipients)
 	s.AllowInsecureAuth = !config.GetBool(config.MsaUseTls)
+	s.EnableDSN = true
 	s.Debug = os.Stdout
 	s.TLSConfig = tls
 	go func() {
@@ -47,9 +51,10 @@ func StartMsa(db *sql.DB, proc process.MsgProcessor, tls *tls.Config) {
 		s.Domain = config.GetString(config.ServerName)
 		//TODO come back to this
 		// s.ReadTimeout = time.Duration config.GetInt(config.MaxIdleSeconds)
-		s.MaxMessageBytes = config.GetInt(config.MaxMessageBytes)
+		s.MaxMessageBytes = int64(config.GetInt(config.MaxMessageBytes))
 		s.MaxRecipients = config.GetInt(config.MaxRecipients)
 		s.AllowInsecureAuth = !config.GetBool(config.MsaUseTls)
+		s.EnableDSN = true
 		s.Debug = os.Stdout
 		s.TLSConfig = tls
 		go func() {
@@ -66,40 +71,75 @@ type smtpSubmissionBackend struct {
 	proc process.MsgProcessor
 }
 
-func (b *smtpSubmissionBackend) Login(state *smtp.ConnectionState, username, password string) (smtp.Session, error) {
-	user, e := logic.Login(b.db, username, password)
-	if e != nil {
-		return nil, e
+func (b *smtpSubmissionBackend) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	session := &smtpSubmissionSession{
+		db:   b.db,
+		proc: b.proc,
+		conn: c,
 	}
-	return &smtpSubmissionSession{
-		proc:   b.proc,
-		userid: user.ID,
-	}, nil
-}
-
-func (b *smtpSubmissionBackend) AnonymousLogin(state *smtp.ConnectionState) (smtp.Session, error) {
-	return nil, smtp.ErrAuthRequired
+	session.Reset()
+	return session, nil
 }
 
 type smtpSubmissionSession struct {
-	proc   process.MsgProcessor
-	userid int
+	db          *sql.DB
+	proc        process.MsgProcessor
+	conn        *smtp.Conn
+	userid      int
 	currentFrom string
-	currentTo []string
+	currentTo   []string
+
+	// Delivery status notification parameters
+	currentRet    string
+	currentEnvId  string
+	currentNotify map[string]string
+	currentOrcpt  map[string]string
+}
+
+func (u *smtpSubmissionSession) AuthPlain(username, password string) error {
+	user, e := logic.Login(u.db, username, password)
+	if e != nil {
+		return smtp.ErrAuthFailed
+	}
+	u.userid = user.ID
+	return nil
 }
 
 func (u *smtpSubmissionSession) Reset() {
 	u.currentFrom = ""
 	u.currentTo = make([]string, 0)
+	u.currentRet = ""
+	u.currentEnvId = ""
+	u.currentNotify = make(map[string]string)
+	u.currentOrcpt = make(map[string]string)
 }
 
-func (u *smtpSubmissionSession) Mail(from string, options smtp.MailOptions) error {
+func (u *smtpSubmissionSession) Mail(from string, options *smtp.MailOptions) error {
+	if u.userid == 0 {
+		return smtp.ErrAuthRequired
+	}
+	e := u.checkSender(from)
+	if e != nil {
+		return e
+	}
 	u.currentFrom = from
+	u.currentRet = string(options.Return)
+	u.currentEnvId = options.EnvelopeID
 	return nil
 }
 
-func (u *smtpSubmissionSession) Rcpt(to string) error {
+func (u *smtpSubmissionSession) Rcpt(to string, options *smtp.RcptOptions) error {
 	u.currentTo = append(u.currentTo, to)
+	if len(options.Notify) > 0 {
+		notify := make([]string, len(options.Notify))
+		for ix, n := range options.Notify {
+			notify[ix] = string(n)
+		}
+		u.currentNotify[to] = strings.Join(notify, ",")
+	}
+	if options.OriginalRecipient != "" {
+		u.currentOrcpt[to] = options.OriginalRecipient
+	}
 	return nil
 }
 
@@ -115,12 +155,82 @@ func (u *smtpSubmissionSession) Data(r io.Reader) error {
 		return e
 	}
 
+	// Check it's from the user, since it'll be signed for their domain
+	e = u.checkHeaderSenders(content)
+	if e != nil {
+		return e
+	}
+
 	// Pass it on
-	return u.proc.Process(&process.ReceivedMsg{
-		From:    u.currentFrom,
-		To:      u.currentTo,
-		Content: content,
-	})
+	msg := newReceivedMsg(u.conn)
+	msg.Authenticated = true
+	msg.Userid = u.userid
+	msg.From = u.currentFrom
+	msg.To = u.currentTo
+	msg.Content = content
+	msg.Ret = u.currentRet
+	msg.EnvId = u.currentEnvId
+	msg.Notify = u.currentNotify
+	msg.Orcpt = u.currentOrcpt
+	return u.proc.Process(msg)
+}
+
+/**
+ * Users can only send as themselves, see logic.MaySendAs
+ */
+func (u *smtpSubmissionSession) checkSender(address string) error {
+	ok, e := logic.MaySendAs(u.db, u.userid, address)
+	if e != nil {
+		return e
+	}
+	if !ok {
+		return &smtp.SMTPError{
+			Code:         553,
+			EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+			Message:      fmt.Sprintf("Not allowed to send as <%v>", address),
+		}
+	}
+	return nil
+}
+
+/**
+ * Every address in the From: and Sender: headers has to be the user's
+ */
+func (u *smtpSubmissionSession) checkHeaderSenders(content []byte) error {
+	m, e := mail.ReadMessage(bytes.NewReader(content))
+	if e != nil {
+		return e
+	}
+	var senders []string
+	for _, field := range []string{"From", "Sender"} {
+		for _, value := range m.Header[field] {
+			addresses, e := mail.ParseAddressList(value)
+			if e != nil {
+				return &smtp.SMTPError{
+					Code:         550,
+					EnhancedCode: smtp.EnhancedCode{5, 6, 0},
+					Message:      fmt.Sprintf("Invalid %v: header", field),
+				}
+			}
+			for _, address := range addresses {
+				senders = append(senders, address.Address)
+			}
+		}
+	}
+	if len(senders) == 0 {
+		return &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 6, 0},
+			Message:      "Message has no From: header",
+		}
+	}
+	for _, sender := range senders {
+		e = u.checkSender(sender)
+		if e != nil {
+			return e
+		}
+	}
+	return nil
 }
 
 func (*smtpSubmissionSession) Logout() error {
@@ -7,6 +7,7 @@ import (
 	"github.com/emersion/go-message"
 	"github.com/emersion/go-smtp"
 	"henrymail/config"
+	"henrymail/logic"
 	"henrymail/process"
 	"io"
 	"io/ioutil"
@@ -26,7 +27,7 @@ func StartMta(db *sql.DB, proc process.MsgProcessor, tls *tls.Config) {
 	s.Addr = config.GetString(config.MtaAddress)
 	s.Domain = config.GetString(config.ServerName)
 	// s.MaxIdleSeconds = config.GetInt(config.MaxIdleSeconds)
-	s.MaxMessageBytes = config.GetInt(config.MaxMessageBytes)
+	s.MaxMessageBytes = int64(config.GetInt(config.MaxMessageBytes))
 	s.MaxRecipients = config.GetInt(config.MaxRecipients)
 	s.AuthDisabled = true
 	s.Debug = os.Stdout
@@ -45,31 +46,105 @@ type smtpTransferBackend struct {
 	proc process.MsgProcessor
 }
 
-func (b *smtpTransferBackend) Login(state *smtp.ConnectionState, username, password string) (smtp.Session, error) {
-	return nil, smtp.ErrAuthUnsupported
-}
-
-func (b *smtpTransferBackend) AnonymousLogin(state *smtp.ConnectionState) (smtp.Session, error) {
-	return &smtpSession{proc: b.proc}, nil
+func (b *smtpTransferBackend) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	return &smtpSession{db: b.db, proc: b.proc, conn: c}, nil
 }
 
 type smtpSession struct {
+	db   *sql.DB
 	proc process.MsgProcessor
+	conn *smtp.Conn
 
 	currentFrom string
 	currentTo []string
+	// From the SIZE parameter (RFC 1870), 0 if the client didn't say
+	currentSize int
 }
 
-func (s *smtpSession) Mail(from string, options smtp.MailOptions) error {
+func (s *smtpSession) AuthPlain(username, password string) error {
+	return smtp.ErrAuthUnsupported
+}
+
+func (s *smtpSession) Mail(from string, options *smtp.MailOptions) error {
 	s.currentFrom = from
+	s.currentSize = int(options.Size)
 	return nil
 }
 
-func (s *smtpSession) Rcpt(to string) error {
+/**
+ * Only accept mail for our own users and aliases, so we don't have
+ * to bounce anything after the message has been accepted.
+ */
+func (s *smtpSession) Rcpt(to string, options *smtp.RcptOptions) error {
+	destinations, e := logic.ExpandAddress(s.db, to)
+	if e == nil {
+		e = checkQuotas(s.db, destinations, s.currentSize)
+	}
+	switch e {
+	case nil:
+	case logic.ErrForeignDomain:
+		return &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+			Message:      "Relay access denied",
+		}
+	case logic.ErrOverQuota:
+		return &smtp.SMTPError{
+			Code:         452,
+			EnhancedCode: smtp.EnhancedCode{4, 2, 2},
+			Message:      "Mailbox full",
+		}
+	case logic.ErrMessageExceedsQuota:
+		return &smtp.SMTPError{
+			Code:         552,
+			EnhancedCode: smtp.EnhancedCode{5, 2, 2},
+			Message:      "Message is bigger than the mailbox quota",
+		}
+	case logic.ErrUnknownRecipient:
+		return &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+			Message:      "No such user here",
+		}
+	default:
+		log.Print(e)
+		return &smtp.SMTPError{
+			Code:         451,
+			EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+			Message:      "Unable to check recipient, try again later",
+		}
+	}
 	s.currentTo = append(s.currentTo, to)
 	return nil
 }
 
+/**
+ * Refuse mail for users who are already full up front, or who don't have
+ * room for a message of the size the client gave, rather than after it's
+ * been sent. Aliases to other servers aren't our problem.
+ */
+func checkQuotas(db *sql.DB, destinations []*logic.Destination, size int) error {
+	for _, dest := range destinations {
+		if dest.User == nil {
+			continue
+		}
+		q, e := logic.GetQuota(db, dest.User)
+		if e != nil {
+			return e
+		}
+		if q.Full() {
+			return logic.ErrOverQuota
+		}
+		if size > 0 {
+			e = q.Check(size, 1)
+			if e != nil {
+				return e
+			}
+		}
+	}
+	return nil
+}
+
 func (s *smtpSession) Data(r io.Reader) error {
 	content, e := ioutil.ReadAll(r)
 	// Check we can read all the content
@@ -83,16 +158,17 @@ func (s *smtpSession) Data(r io.Reader) error {
 	}
 
 	// Pass it on
-	return s.proc.Process(&process.ReceivedMsg{
-		From:    s.currentFrom,
-		To:      s.currentTo,
-		Content: content,
-	})
+	msg := newReceivedMsg(s.conn)
+	msg.From = s.currentFrom
+	msg.To = s.currentTo
+	msg.Content = content
+	return s.proc.Process(msg)
 }
 
 func (s *smtpSession) Reset() {
 	s.currentFrom = ""
 	s.currentTo = make([]string, 0)
+	s.currentSize = 0
 }
 
 func (*smtpSession) Logout() error {
@@ -0,0 +1,27 @@
+package smtp
+
+import (
+	"github.com/emersion/go-smtp"
+	"henrymail/process"
+	"net"
+	"time"
+)
+
+/**
+ * Starts a message with what we know about the connection it came in on,
+ * which ends up in its Received header.
+ */
+func newReceivedMsg(c *smtp.Conn) *process.ReceivedMsg {
+	msg := &process.ReceivedMsg{
+		Id:        process.NewQueueId(),
+		Timestamp: time.Now(),
+		Helo:      c.Hostname(),
+	}
+	if addr, ok := c.Conn().RemoteAddr().(*net.TCPAddr); ok {
+		msg.ClientIp = addr.IP
+	}
+	if state, ok := c.TLSConnectionState(); ok {
+		msg.Tls = &state
+	}
+	return msg
+}
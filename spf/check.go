@@ -0,0 +1,520 @@
+package spf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/**
+ * Sender Policy Framework evaluation, see RFC 7208
+ */
+
+// The result of an SPF check, see RFC 7208 section 2.6
+type Result string
+
+const (
+	None      Result = "none"
+	Neutral   Result = "neutral"
+	Pass      Result = "pass"
+	Fail      Result = "fail"
+	SoftFail  Result = "softfail"
+	TempError Result = "temperror"
+	PermError Result = "permerror"
+)
+
+// Processing limits from RFC 7208 section 4.6.4
+const (
+	maxLookups     = 10
+	maxVoidLookups = 2
+	maxNames       = 10
+	timeout        = 20 * time.Second
+)
+
+// The DNS queries that an SPF check needs. *net.Resolver does the job.
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+}
+
+type Checker struct {
+	Resolver Resolver
+}
+
+func NewChecker() *Checker {
+	return &Checker{Resolver: net.DefaultResolver}
+}
+
+/**
+ * Checks whether the client at ip is allowed to send mail for the
+ * sender's domain. Messages with an empty sender (e.g. bounces) are
+ * checked against the HELO name instead. The error explains any
+ * temperror or permerror result.
+ */
+func (ch *Checker) Check(ip net.IP, sender, helo string) (Result, error) {
+	if sender == "" {
+		sender = "postmaster@" + helo
+	}
+	if !strings.Contains(sender, "@") {
+		sender = "postmaster@" + sender
+	}
+	ix := strings.LastIndex(sender, "@")
+	if ix == 0 {
+		sender = "postmaster" + sender
+		ix = len("postmaster")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	c := &check{
+		ctx:      ctx,
+		resolver: ch.Resolver,
+		ip:       ip,
+		sender:   sender,
+		local:    sender[:ix],
+		domain:   sender[ix+1:],
+		helo:     helo,
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		c.ip = ip4
+	}
+	return c.checkHost(c.domain)
+}
+
+/**
+ * State for a single evaluation, including nested include: and redirect=
+ */
+type check struct {
+	ctx      context.Context
+	resolver Resolver
+	ip       net.IP
+	sender   string
+	local    string
+	domain   string
+	helo     string
+	lookups  int
+	voids    int
+}
+
+/**
+ * The check_host() function from RFC 7208 section 4
+ */
+func (c *check) checkHost(domain string) (Result, error) {
+	domain = strings.TrimSuffix(domain, ".")
+	if !validDomain(domain) {
+		return None, nil
+	}
+
+	record, result, e := c.record(domain)
+	if record == "" {
+		return result, e
+	}
+
+	terms, redirect, e := c.parse(record, domain)
+	if e != nil {
+		return PermError, e
+	}
+
+	for _, t := range terms {
+		matched, e := c.matches(t)
+		if e != nil {
+			return resultFor(e), e
+		}
+		if matched {
+			return t.qualifier, nil
+		}
+	}
+
+	if redirect != "" {
+		e = c.countLookup()
+		if e != nil {
+			return PermError, e
+		}
+		result, e = c.checkHost(redirect)
+		if result == None {
+			return PermError, fmt.Errorf("no SPF record for redirect to %v", redirect)
+		}
+		return result, e
+	}
+	return Neutral, nil
+}
+
+/**
+ * Finds the single SPF record for a domain
+ */
+func (c *check) record(domain string) (string, Result, error) {
+	txts, e := c.resolver.LookupTXT(c.ctx, domain)
+	if isNotFound(e) {
+		return "", None, nil
+	} else if e != nil {
+		return "", TempError, e
+	}
+	var records []string
+	for _, txt := range txts {
+		lower := strings.ToLower(txt)
+		if lower == "v=spf1" || strings.HasPrefix(lower, "v=spf1 ") {
+			records = append(records, txt)
+		}
+	}
+	switch len(records) {
+	case 0:
+		return "", None, nil
+	case 1:
+		return records[0], "", nil
+	default:
+		return "", PermError, fmt.Errorf("%v has more than one SPF record", domain)
+	}
+}
+
+type term struct {
+	qualifier Result
+	mechanism string
+	target    string
+	cidr4     int
+	cidr6     int
+	network   *net.IPNet
+}
+
+/**
+ * Checks the whole record for syntax errors before anything is evaluated,
+ * as required by RFC 7208 section 4.6
+ */
+func (c *check) parse(record, domain string) ([]term, string, error) {
+	var terms []term
+	var redirect string
+	exp := false
+	for _, field := range strings.Fields(record)[1:] {
+		// Modifiers are name=value, mechanisms can't have an = before any : or /
+		if ix := strings.IndexAny(field, "=:/"); ix > 0 && field[ix] == '=' {
+			name, value := strings.ToLower(field[:ix]), field[ix+1:]
+			switch name {
+			case "redirect":
+				if redirect != "" {
+					return nil, "", errors.New("more than one redirect modifier")
+				}
+				var e error
+				redirect, e = c.expand(value, domain)
+				if e != nil {
+					return nil, "", e
+				}
+			case "exp":
+				// Explanations are only for rejection messages, we don't fetch them
+				if exp {
+					return nil, "", errors.New("more than one exp modifier")
+				}
+				exp = true
+			default:
+				// Unknown modifiers are ignored
+			}
+			continue
+		}
+
+		t := term{qualifier: Pass, cidr4: 32, cidr6: 128}
+		switch field[0] {
+		case '+':
+			t.qualifier, field = Pass, field[1:]
+		case '-':
+			t.qualifier, field = Fail, field[1:]
+		case '~':
+			t.qualifier, field = SoftFail, field[1:]
+		case '?':
+			t.qualifier, field = Neutral, field[1:]
+		}
+
+		name, arg, hasArg := field, "", false
+		if ix := strings.IndexAny(field, ":/"); ix >= 0 {
+			name, arg, hasArg = field[:ix], field[ix:], true
+		}
+		t.mechanism = strings.ToLower(name)
+
+		var e error
+		switch t.mechanism {
+		case "all":
+			if hasArg {
+				e = fmt.Errorf("unexpected argument to all: %v", arg)
+			}
+		case "include", "exists":
+			if !strings.HasPrefix(arg, ":") || len(arg) < 2 {
+				e = fmt.Errorf("%v requires a domain", t.mechanism)
+			} else {
+				t.target, e = c.expand(arg[1:], domain)
+			}
+		case "a", "mx":
+			spec := arg
+			if ix := strings.Index(arg, "/"); ix >= 0 {
+				spec = arg[:ix]
+				t.cidr4, t.cidr6, e = parseDualCidr(arg[ix:])
+			}
+			t.target = domain
+			if e == nil && spec != "" {
+				t.target, e = c.expand(strings.TrimPrefix(spec, ":"), domain)
+				if spec == ":" {
+					e = fmt.Errorf("%v has an empty domain", t.mechanism)
+				}
+			}
+		case "ptr":
+			t.target = domain
+			if hasArg {
+				if !strings.HasPrefix(arg, ":") || len(arg) < 2 {
+					e = errors.New("ptr has an invalid domain")
+				} else {
+					t.target, e = c.expand(arg[1:], domain)
+				}
+			}
+		case "ip4", "ip6":
+			t.network, e = parseNetwork(t.mechanism, strings.TrimPrefix(arg, ":"))
+		default:
+			e = fmt.Errorf("unknown mechanism %v", name)
+		}
+		if e != nil {
+			return nil, "", e
+		}
+		terms = append(terms, t)
+	}
+	return terms, redirect, nil
+}
+
+func parseDualCidr(s string) (int, int, error) {
+	cidr4, cidr6 := 32, 128
+	v4, v6 := s, ""
+	if ix := strings.Index(s, "//"); ix >= 0 {
+		v4, v6 = s[:ix], s[ix+2:]
+	}
+	var e error
+	if v4 != "" {
+		cidr4, e = parseCidr(strings.TrimPrefix(v4, "/"), 32)
+		if e != nil {
+			return 0, 0, e
+		}
+	}
+	if v6 != "" {
+		cidr6, e = parseCidr(v6, 128)
+	}
+	return cidr4, cidr6, e
+}
+
+func parseCidr(s string, max int) (int, error) {
+	n, e := strconv.Atoi(s)
+	// No leading zeros allowed
+	if e != nil || n < 0 || n > max || (len(s) > 1 && s[0] == '0') {
+		return 0, fmt.Errorf("invalid CIDR length %v", s)
+	}
+	return n, nil
+}
+
+func parseNetwork(mechanism, s string) (*net.IPNet, error) {
+	addr, length := s, ""
+	if ix := strings.Index(s, "/"); ix >= 0 {
+		addr, length = s[:ix], s[ix+1:]
+	}
+	ip := net.ParseIP(addr)
+	max := 128
+	if mechanism == "ip4" {
+		max = 32
+		ip = ip.To4()
+	} else if strings.Contains(addr, ".") && !strings.Contains(addr, ":") {
+		ip = nil
+	}
+	if ip == nil {
+		return nil, fmt.Errorf("invalid %v address %v", mechanism, addr)
+	}
+	bits := max
+	if length != "" {
+		var e error
+		bits, e = parseCidr(length, max)
+		if e != nil {
+			return nil, e
+		}
+	}
+	return &net.IPNet{IP: ip.Mask(net.CIDRMask(bits, max)), Mask: net.CIDRMask(bits, max)}, nil
+}
+
+/**
+ * Evaluates a single mechanism against the client's IP address
+ */
+func (c *check) matches(t term) (bool, error) {
+	switch t.mechanism {
+	case "all":
+		return true, nil
+	case "ip4", "ip6":
+		return t.network.Contains(c.ip), nil
+	}
+
+	// Everything else costs a DNS lookup
+	e := c.countLookup()
+	if e != nil {
+		return false, e
+	}
+	switch t.mechanism {
+	case "include":
+		result, e := c.checkHost(t.target)
+		switch result {
+		case Pass:
+			return true, nil
+		case Fail, SoftFail, Neutral:
+			return false, nil
+		case TempError:
+			return false, &tempError{e}
+		case None:
+			return false, fmt.Errorf("no SPF record for include of %v", t.target)
+		default:
+			return false, e
+		}
+	case "a":
+		ips, e := c.lookupIPs(t.target)
+		if e != nil {
+			return false, e
+		}
+		return c.anyContains(ips, t), nil
+	case "mx":
+		mxes, e := c.resolver.LookupMX(c.ctx, t.target)
+		e = c.checkVoid(e, len(mxes))
+		if e != nil {
+			return false, e
+		}
+		if len(mxes) > maxNames {
+			return false, fmt.Errorf("too many MX records for %v", t.target)
+		}
+		for _, mx := range mxes {
+			ips, e := c.lookupIPs(mx.Host)
+			if e != nil {
+				return false, e
+			}
+			if c.anyContains(ips, t) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case "ptr":
+		names, e := c.resolver.LookupAddr(c.ctx, c.ip.String())
+		if isNotFound(e) {
+			return false, nil
+		}
+		if e != nil {
+			return false, &tempError{e}
+		}
+		target := strings.ToLower(strings.TrimSuffix(t.target, "."))
+		for ix, name := range names {
+			if ix == maxNames {
+				break
+			}
+			name = strings.ToLower(strings.TrimSuffix(name, "."))
+			if name != target && !strings.HasSuffix(name, "."+target) {
+				continue
+			}
+			// The name must resolve back to the client
+			addrs, e := c.resolver.LookupIPAddr(c.ctx, name)
+			if e != nil {
+				continue
+			}
+			for _, addr := range addrs {
+				if addr.IP.Equal(c.ip) {
+					return true, nil
+				}
+			}
+		}
+		return false, nil
+	case "exists":
+		ips, e := c.lookupIPs(t.target)
+		if e != nil {
+			return false, e
+		}
+		// Only A records count, whatever kind of address the client has
+		for _, ip := range ips {
+			if ip.To4() != nil {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	return false, fmt.Errorf("unknown mechanism %v", t.mechanism)
+}
+
+func (c *check) anyContains(ips []net.IP, t term) bool {
+	for _, ip := range ips {
+		var network net.IPNet
+		if ip4 := ip.To4(); ip4 != nil {
+			network = net.IPNet{IP: ip4.Mask(net.CIDRMask(t.cidr4, 32)), Mask: net.CIDRMask(t.cidr4, 32)}
+		} else {
+			network = net.IPNet{IP: ip.Mask(net.CIDRMask(t.cidr6, 128)), Mask: net.CIDRMask(t.cidr6, 128)}
+		}
+		if network.Contains(c.ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *check) lookupIPs(host string) ([]net.IP, error) {
+	addrs, e := c.resolver.LookupIPAddr(c.ctx, host)
+	e = c.checkVoid(e, len(addrs))
+	if e != nil {
+		return nil, e
+	}
+	ips := make([]net.IP, len(addrs))
+	for ix, addr := range addrs {
+		ips[ix] = addr.IP
+	}
+	return ips, nil
+}
+
+func (c *check) countLookup() error {
+	c.lookups++
+	if c.lookups > maxLookups {
+		return fmt.Errorf("more than %d DNS lookups", maxLookups)
+	}
+	return nil
+}
+
+/**
+ * Lookups that find nothing are limited too, to stop records
+ * being used to make us query nonsense.
+ */
+func (c *check) checkVoid(e error, answers int) error {
+	if e != nil && !isNotFound(e) {
+		return &tempError{e}
+	}
+	if e != nil || answers == 0 {
+		c.voids++
+		if c.voids > maxVoidLookups {
+			return fmt.Errorf("more than %d void DNS lookups", maxVoidLookups)
+		}
+	}
+	return nil
+}
+
+/**
+ * DNS failures that might go away if we try later
+ */
+type tempError struct {
+	error
+}
+
+func resultFor(e error) Result {
+	if _, ok := e.(*tempError); ok {
+		return TempError
+	}
+	return PermError
+}
+
+func isNotFound(e error) bool {
+	dnsErr, ok := e.(*net.DNSError)
+	return ok && dnsErr.IsNotFound
+}
+
+func validDomain(domain string) bool {
+	if len(domain) == 0 || len(domain) > 253 || !strings.Contains(domain, ".") {
+		return false
+	}
+	for _, label := range strings.Split(domain, ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,188 @@
+package spf
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+)
+
+type fakeResolver struct {
+	txt  map[string][]string
+	ips  map[string][]string
+	mx   map[string][]string
+	ptr  map[string][]string
+	fail map[string]bool
+}
+
+func (f *fakeResolver) err(name string) error {
+	if f.fail[name] {
+		return &net.DNSError{Err: "server misbehaving", Name: name, IsTemporary: true}
+	}
+	return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (f *fakeResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if txt, ok := f.txt[strings.TrimSuffix(name, ".")]; ok {
+		return txt, nil
+	}
+	return nil, f.err(name)
+}
+
+func (f *fakeResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	ips, ok := f.ips[strings.TrimSuffix(host, ".")]
+	if !ok {
+		return nil, f.err(host)
+	}
+	var addrs []net.IPAddr
+	for _, ip := range ips {
+		addrs = append(addrs, net.IPAddr{IP: net.ParseIP(ip)})
+	}
+	return addrs, nil
+}
+
+func (f *fakeResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	hosts, ok := f.mx[strings.TrimSuffix(name, ".")]
+	if !ok {
+		return nil, f.err(name)
+	}
+	var mxes []*net.MX
+	for _, host := range hosts {
+		mxes = append(mxes, &net.MX{Host: host})
+	}
+	return mxes, nil
+}
+
+func (f *fakeResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	if names, ok := f.ptr[addr]; ok {
+		return names, nil
+	}
+	return nil, f.err(addr)
+}
+
+func TestCheck(t *testing.T) {
+	resolver := &fakeResolver{
+		txt: map[string][]string{
+			"example.com":          {"some other record", "v=spf1 a mx ip4:192.0.2.0/24 include:_spf.example.net -all"},
+			"_spf.example.net":     {"v=spf1 ip6:2001:db8::/32 ~all"},
+			"soft.example.org":     {"v=spf1 ~all"},
+			"neutral.example.org":  {"v=spf1 ip4:10.0.0.1"},
+			"redirect.example.org": {"v=spf1 redirect=example.com"},
+			"two.example.org":      {"v=spf1 -all", "v=spf1 +all"},
+			"broken.example.org":   {"v=spf1 +all foo:bar"},
+			"cidr.example.org":     {"v=spf1 a:mail.example.org/24 -all"},
+			"exists.example.org":   {"v=spf1 exists:%{ir}.%{l1r+-}._spf.%{d} -all"},
+			"ptr.example.org":      {"v=spf1 ptr -all"},
+			"temp.example.org":     {"v=spf1 a:broken.example.net -all"},
+			"voids.example.org":    {"v=spf1 a:a.invalid a:b.invalid a:c.invalid +all"},
+			"loop.example.org":     {"v=spf1 include:loop.example.org -all"},
+			"missing.example.org":  {"v=spf1 include:nothing.example.org -all"},
+		},
+		ips: map[string][]string{
+			"example.com":                           {"198.51.100.1"},
+			"mx.example.com":                        {"203.0.113.7"},
+			"mail.example.org":                      {"198.51.100.20"},
+			"host.ptr.example.org":                  {"198.51.100.30"},
+			"2.2.0.192.foo._spf.exists.example.org": {"127.0.0.2"},
+		},
+		mx: map[string][]string{
+			"example.com": {"mx.example.com."},
+		},
+		ptr: map[string][]string{
+			"198.51.100.30": {"host.ptr.example.org."},
+		},
+		fail: map[string]bool{
+			"broken.example.net": true,
+		},
+	}
+	checker := &Checker{Resolver: resolver}
+
+	tests := []struct {
+		ip     string
+		sender string
+		helo   string
+		result Result
+	}{
+		{"198.51.100.1", "someone@example.com", "", Pass},
+		{"203.0.113.7", "someone@example.com", "", Pass},
+		{"192.0.2.99", "someone@example.com", "", Pass},
+		{"::ffff:192.0.2.99", "someone@example.com", "", Pass},
+		{"2001:db8::1", "someone@example.com", "", Pass},
+		{"198.51.100.2", "someone@example.com", "", Fail},
+		{"198.51.100.2", "", "example.com", Fail},
+		{"198.51.100.1", "", "example.com", Pass},
+		{"198.51.100.2", "someone@nothing.example.org", "", None},
+		{"198.51.100.2", "someone@soft.example.org", "", SoftFail},
+		{"198.51.100.2", "someone@neutral.example.org", "", Neutral},
+		{"198.51.100.1", "someone@redirect.example.org", "", Pass},
+		{"198.51.100.2", "someone@redirect.example.org", "", Fail},
+		{"198.51.100.2", "someone@two.example.org", "", PermError},
+		{"198.51.100.2", "someone@broken.example.org", "", PermError},
+		{"198.51.100.200", "someone@cidr.example.org", "", Pass},
+		{"198.51.101.1", "someone@cidr.example.org", "", Fail},
+		{"192.0.2.2", "foo@exists.example.org", "", Pass},
+		{"192.0.2.2", "bar@exists.example.org", "", Fail},
+		{"198.51.100.30", "someone@ptr.example.org", "", Pass},
+		{"198.51.100.31", "someone@ptr.example.org", "", Fail},
+		{"198.51.100.2", "someone@temp.example.org", "", TempError},
+		{"198.51.100.2", "someone@voids.example.org", "", PermError},
+		{"198.51.100.2", "someone@loop.example.org", "", PermError},
+		{"198.51.100.2", "someone@missing.example.org", "", PermError},
+	}
+	for _, test := range tests {
+		result, e := checker.Check(net.ParseIP(test.ip), test.sender, test.helo)
+		if result != test.result {
+			t.Errorf("Check(%v, %q, %q) = %v (%v), expected %v", test.ip, test.sender, test.helo, result, e, test.result)
+		}
+	}
+}
+
+func TestMacros(t *testing.T) {
+	c := &check{
+		ip:     net.ParseIP("192.0.2.3").To4(),
+		sender: "strong-bad@email.example.com",
+		local:  "strong-bad",
+		domain: "email.example.com",
+		helo:   "mx.example.org",
+	}
+	tests := map[string]string{
+		"%{s}":                              "strong-bad@email.example.com",
+		"%{o}":                              "email.example.com",
+		"%{d}":                              "email.example.com",
+		"%{d4}":                             "email.example.com",
+		"%{d3}":                             "email.example.com",
+		"%{d2}":                             "example.com",
+		"%{d1}":                             "com",
+		"%{dr}":                             "com.example.email",
+		"%{d2r}":                            "example.email",
+		"%{l}":                              "strong-bad",
+		"%{l-}":                             "strong.bad",
+		"%{lr}":                             "strong-bad",
+		"%{lr-}":                            "bad.strong",
+		"%{l1r-}":                           "strong",
+		"%{ir}.%{v}._spf.%{d2}":             "3.2.0.192.in-addr._spf.example.com",
+		"%{lr-}.lp._spf.%{d2}":              "bad.strong.lp._spf.example.com",
+		"%{d2}.trusted-domains.example.net": "example.com.trusted-domains.example.net",
+		"%{h}%%%_%-":                        "mx.example.org% %20",
+		"%{S}":                              "strong-bad%40email.example.com",
+	}
+	for macro, expected := range tests {
+		expanded, e := c.expand(macro, c.domain)
+		if e != nil || expanded != expected {
+			t.Errorf("expand(%q) = %q (%v), expected %q", macro, expanded, e, expected)
+		}
+	}
+
+	c.ip = net.ParseIP("2001:db8::cb01")
+	expanded, _ := c.expand("%{ir}.%{v}._spf.%{d2}", c.domain)
+	expected := "1.0.b.c.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6._spf.example.com"
+	if expanded != expected {
+		t.Errorf("IPv6 expansion = %q, expected %q", expanded, expected)
+	}
+
+	for _, bad := range []string{"%{x}", "%{d0}", "%{c}", "%", "%{d", "%a"} {
+		if _, e := c.expand(bad, c.domain); e == nil {
+			t.Errorf("expand(%q) should have failed", bad)
+		}
+	}
+}
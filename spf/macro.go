@@ -0,0 +1,168 @@
+package spf
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+/**
+ * Expands the macros in a domain-spec, see RFC 7208 section 7.
+ * Explanations aren't used, so neither are the c, r and t macros.
+ */
+func (c *check) expand(s, domain string) (string, error) {
+	out := &strings.Builder{}
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		if ch != '%' {
+			if ch < 0x21 || ch > 0x7e {
+				return "", fmt.Errorf("invalid character in %q", s)
+			}
+			out.WriteByte(ch)
+			continue
+		}
+		if i+1 == len(s) {
+			return "", fmt.Errorf("incomplete macro in %q", s)
+		}
+		i++
+		switch s[i] {
+		case '%':
+			out.WriteByte('%')
+		case '_':
+			out.WriteByte(' ')
+		case '-':
+			out.WriteString("%20")
+		case '{':
+			end := strings.IndexByte(s[i:], '}')
+			if end < 0 {
+				return "", fmt.Errorf("unterminated macro in %q", s)
+			}
+			value, e := c.macro(s[i+1:i+end], domain)
+			if e != nil {
+				return "", e
+			}
+			out.WriteString(value)
+			i += end
+		default:
+			return "", fmt.Errorf("invalid macro in %q", s)
+		}
+	}
+	return truncate(out.String()), nil
+}
+
+/**
+ * Expands the inside of a single %{...}
+ */
+func (c *check) macro(m, domain string) (string, error) {
+	if m == "" {
+		return "", fmt.Errorf("empty macro")
+	}
+	letter := m[0]
+	var value string
+	switch letter | 0x20 {
+	case 's':
+		value = c.sender
+	case 'l':
+		value = c.local
+	case 'o':
+		value = c.domain
+	case 'd':
+		value = domain
+	case 'i':
+		value = c.dottedIp()
+	case 'p':
+		// Validating the client's name takes more lookups than it's worth,
+		// RFC 7208 section 7.3 allows "unknown" instead
+		value = "unknown"
+	case 'v':
+		if c.ip.To4() != nil {
+			value = "in-addr"
+		} else {
+			value = "ip6"
+		}
+	case 'h':
+		value = c.helo
+	default:
+		return "", fmt.Errorf("invalid macro letter %c", letter)
+	}
+
+	// Transformers: how many parts to keep, and whether to reverse them
+	rest := m[1:]
+	digits := 0
+	for digits < len(rest) && rest[digits] >= '0' && rest[digits] <= '9' {
+		digits++
+	}
+	keep := 0
+	if digits > 0 {
+		n, e := strconv.Atoi(rest[:digits])
+		if e != nil || n == 0 {
+			return "", fmt.Errorf("invalid macro transformer %q", m)
+		}
+		keep = n
+	}
+	rest = rest[digits:]
+	reverse := false
+	if strings.HasPrefix(rest, "r") || strings.HasPrefix(rest, "R") {
+		reverse = true
+		rest = rest[1:]
+	}
+	delimiters := "."
+	if rest != "" {
+		if strings.Trim(rest, ".-+,/_=") != "" {
+			return "", fmt.Errorf("invalid macro delimiter %q", m)
+		}
+		delimiters = rest
+	}
+
+	if digits > 0 || reverse || rest != "" {
+		parts := strings.FieldsFunc(value, func(r rune) bool {
+			return strings.ContainsRune(delimiters, r)
+		})
+		if reverse {
+			for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+				parts[i], parts[j] = parts[j], parts[i]
+			}
+		}
+		if keep > 0 && keep < len(parts) {
+			parts = parts[len(parts)-keep:]
+		}
+		value = strings.Join(parts, ".")
+	}
+
+	// Upper case letters mean the value should be URL escaped
+	if letter >= 'A' && letter <= 'Z' {
+		value = strings.Replace(url.QueryEscape(value), "+", "%20", -1)
+	}
+	return value, nil
+}
+
+/**
+ * The client IP for the i macro, with IPv6 addresses written
+ * as dot separated nibbles so they can be used in DNS names.
+ */
+func (c *check) dottedIp() string {
+	if ip4 := c.ip.To4(); ip4 != nil {
+		return ip4.String()
+	}
+	ip := c.ip.To16()
+	nibbles := make([]string, 0, 32)
+	for _, b := range ip {
+		nibbles = append(nibbles, fmt.Sprintf("%x", b>>4), fmt.Sprintf("%x", b&0xf))
+	}
+	return strings.Join(nibbles, ".")
+}
+
+/**
+ * Expanded domain names that are too long lose labels from the left
+ */
+func truncate(domain string) string {
+	for len(domain) > 253 {
+		ix := strings.IndexByte(domain, '.')
+		if ix < 0 {
+			return domain[len(domain)-253:]
+		}
+		domain = domain[ix+1:]
+	}
+	return domain
+}
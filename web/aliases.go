@@ -0,0 +1,88 @@
+package web
+
+import (
+	"henrymail/config"
+	"henrymail/logic"
+	"henrymail/models"
+	"net/http"
+	"strconv"
+)
+
+func (wa *wa) aliases(w http.ResponseWriter, r *http.Request, u *models.User) {
+	ld, e := wa.layoutData(u)
+	if e != nil {
+		wa.renderError(w, e)
+		return
+	}
+	aliases, e := models.GetAllAlias(wa.db)
+	if e != nil {
+		wa.renderError(w, e)
+		return
+	}
+	data := struct {
+		layoutData
+		Aliases []*models.Alias
+		Domain  string
+	}{
+		*ld,
+		aliases,
+		config.GetString(config.Domain),
+	}
+	wa.aliasesView.render(w, data)
+}
+
+func (wa *wa) addAlias(w http.ResponseWriter, r *http.Request, u *models.User) {
+	err := logic.AddAlias(wa.db, r.FormValue("address"), r.FormValue("destination"))
+	if err != nil {
+		wa.renderError(w, err)
+		return
+	}
+	http.Redirect(w, r, "aliases", http.StatusFound)
+}
+
+func (wa *wa) deleteAlias(w http.ResponseWriter, r *http.Request, u *models.User) {
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		wa.renderError(w, err)
+		return
+	}
+	err = logic.DeleteAlias(wa.db, id)
+	if err != nil {
+		wa.renderError(w, err)
+		return
+	}
+	http.Redirect(w, r, "aliases", http.StatusFound)
+}
+
+/**
+ * Shows a user the addresses they get mail from
+ */
+func (wa *wa) myAliases(w http.ResponseWriter, r *http.Request, u *models.User) {
+	ld, e := wa.layoutData(u)
+	if e != nil {
+		wa.renderError(w, e)
+		return
+	}
+	aliases, e := logic.AliasesForUser(wa.db, u)
+	if e != nil {
+		wa.renderError(w, e)
+		return
+	}
+	localPart, domain := logic.SplitAddress(u.Username)
+	data := struct {
+		layoutData
+		Aliases             []*models.Alias
+		LocalPart           string
+		Domain              string
+		SubaddressSeparator string
+		SubaddressFolders   bool
+	}{
+		*ld,
+		aliases,
+		localPart,
+		domain,
+		config.GetString(config.SubaddressSeparator),
+		config.GetBool(config.SubaddressFolders),
+	}
+	wa.myAliasesView.render(w, data)
+}
@@ -1,7 +1,10 @@
 package web
 
 import (
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"github.com/dgrijalva/jwt-go"
@@ -10,6 +13,7 @@ import (
 	"henrymail/models"
 	"log"
 	"net/http"
+	"strings"
 	"time"
 )
 
@@ -84,6 +88,7 @@ func (wa *wa) login(w http.ResponseWriter, r *http.Request) {
 		Secure:   config.GetBool(config.WebAdminUseTls),
 		Domain:   config.GetCookieDomain(),
 		Expires:  time.Now().Add(time.Hour * 240),
+		SameSite: http.SameSiteLaxMode,
 	})
 	http.Redirect(w, r, "/", http.StatusFound)
 }
@@ -96,6 +101,7 @@ func (wa *wa) logout(w http.ResponseWriter, r *http.Request) {
 		HttpOnly: true,
 		Secure:   config.GetBool(config.WebAdminUseTls),
 		Domain:   config.GetCookieDomain(),
+		SameSite: http.SameSiteLaxMode,
 	})
 	wa.loginView.render(w, nil)
 }
@@ -117,22 +123,99 @@ func (wa *wa) checkLogin(next AuthenticatedHandler) http.Handler {
 			http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
 			return
 		}
-		var claims UserClaims
-		_, err := jwt.ParseWithClaims(cookie.Value, &claims, func(token *jwt.Token) (interface{}, error) {
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-			}
-			return wa.jwtSecret(), nil
-		})
+		user, err := wa.tokenUser(cookie.Value)
 		if err != nil {
 			http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
 			return
 		}
-		err = claims.Valid()
+		next(w, r, user)
+	})
+}
+
+/**
+ * Forms that do anything carry a token that only pages of this site
+ * know, so other sites can't get the user's browser to submit them
+ */
+func (wa *wa) formToken(r *http.Request) string {
+	cookie, e := r.Cookie(config.GetString(config.JwtCookieName))
+	if e != nil {
+		return ""
+	}
+	mac := hmac.New(sha256.New, wa.jwtSecret())
+	mac.Write([]byte("form " + cookie.Value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (wa *wa) checkForm(next AuthenticatedHandler) http.Handler {
+	return wa.checkLogin(func(w http.ResponseWriter, r *http.Request, user *models.User) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		// Big enough for a message's attachments, which are only encoded once they're in it
+		r.Body = http.MaxBytesReader(w, r.Body, int64(config.GetInt(config.MaxMessageBytes)))
+		e := r.ParseMultipartForm(1 << 20)
+		if e != nil && e != http.ErrNotMultipart {
+			wa.renderError(w, e)
+			return
+		}
+		token := r.FormValue("token")
+		if token == "" || !hmac.Equal([]byte(token), []byte(wa.formToken(r))) {
+			wa.renderError(w, errors.New("The form has expired, please go back and try again"))
+			return
+		}
+		next(w, r, user)
+	})
+}
+
+/**
+ * For API clients, which can't follow a redirect to the login page. They
+ * can send a username and password with each request, or the token from
+ * the login cookie as a bearer token. The cookie itself is only good for
+ * reading: any site can get the browser to POST with it, and the API has
+ * no form token to tell those requests apart.
+ */
+func (wa *wa) checkApiLogin(next AuthenticatedHandler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var user *models.User
+		var err error
+		if username, password, ok := r.BasicAuth(); ok {
+			user, err = logic.Login(wa.db, username, password)
+		} else if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+			user, err = wa.tokenUser(strings.TrimPrefix(auth, "Bearer "))
+		} else if cookie, e := r.Cookie(config.GetString(config.JwtCookieName)); e == nil && safeMethod(r.Method) {
+			user, err = wa.tokenUser(cookie.Value)
+		} else {
+			err = errors.New("no credentials")
+		}
 		if err != nil {
-			http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
+			w.Header().Set("WWW-Authenticate", `Basic realm="henrymail"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
-		next(w, r, claims.User)
+		next(w, r, user)
 	})
 }
+
+func safeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead
+}
+
+func (wa *wa) tokenUser(token string) (*models.User, error) {
+	var claims UserClaims
+	_, err := jwt.ParseWithClaims(token, &claims, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return wa.jwtSecret(), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = claims.Valid()
+	if err != nil {
+		return nil, err
+	}
+	return claims.User, nil
+}
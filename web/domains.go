@@ -0,0 +1,52 @@
+package web
+
+import (
+	"henrymail/logic"
+	"henrymail/models"
+	"net/http"
+	"strconv"
+)
+
+func (wa *wa) domains(w http.ResponseWriter, r *http.Request, u *models.User) {
+	ld, e := wa.layoutData(u)
+	if e != nil {
+		wa.renderError(w, e)
+		return
+	}
+	domains, e := models.GetAllDomain(wa.db)
+	if e != nil {
+		wa.renderError(w, e)
+		return
+	}
+	data := struct {
+		layoutData
+		Domains []*models.Domain
+	}{
+		*ld,
+		domains,
+	}
+	wa.domainsView.render(w, data)
+}
+
+func (wa *wa) addDomain(w http.ResponseWriter, r *http.Request, u *models.User) {
+	_, err := logic.AddDomain(wa.db, r.FormValue("name"), r.FormValue("selector"))
+	if err != nil {
+		wa.renderError(w, err)
+		return
+	}
+	http.Redirect(w, r, "domains", http.StatusFound)
+}
+
+func (wa *wa) deleteDomain(w http.ResponseWriter, r *http.Request, u *models.User) {
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		wa.renderError(w, err)
+		return
+	}
+	err = logic.DeleteDomain(wa.db, id)
+	if err != nil {
+		wa.renderError(w, err)
+		return
+	}
+	http.Redirect(w, r, "domains", http.StatusFound)
+}
@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"henrymail/config"
 	"henrymail/dkim"
+	"henrymail/dmarc"
+	"henrymail/logic"
 	"henrymail/models"
 	"henrymail/spf"
 	"net"
@@ -18,34 +20,57 @@ func (wa *wa) healthChecks(w http.ResponseWriter, r *http.Request, u *models.Use
 		return
 	}
 
+	// Each domain has its own records to check
+	domainName := r.FormValue("domain")
+	if domainName == "" {
+		domainName = config.GetString(config.Domain)
+	}
+	domain, e := logic.FindDomain(wa.db, domainName)
+	if e != nil {
+		wa.renderError(w, e)
+		return
+	}
+	domains, e := models.GetAllDomain(wa.db)
+	if e != nil {
+		wa.renderError(w, e)
+		return
+	}
+
 	spfExpected := spf.GetSpfRecordString()
-	spfActual := fetchSpfActual()
+	spfActual := fetchSpfActual(domain.Name)
+
+	dmarcExpected := dmarc.GetDmarcRecordString(domain.Name)
+	dmarcActual := fetchDmarcActual(domain.Name)
 
-	dkimExpected, e := dkim.GetDkimRecordString(wa.db)
+	dkimExpected, e := dkim.GetDkimRecordString(domain)
 	if e != nil {
 		wa.renderError(w, e)
 		return
 	}
-	dkimActual := fetchDkimActual()
-	mxActual := fetchMxActual()
+	dkimActual := fetchDkimActual(domain)
+	mxActual := fetchMxActual(domain.Name)
 	mxExpected := config.GetString(config.ServerName) + "."
 
 	imapSrvTargetExpected, imapSrvPortExpected := config.GetString(config.ServerName)+".", config.GetString(config.ImapAddress)
-	imapSrvTargetActual, imapSrvPortActualInteger := fetchSrvTargetAndPort("imap", "tcp")
+	imapSrvTargetActual, imapSrvPortActualInteger := fetchSrvTargetAndPort("imap", "tcp", domain.Name)
 	imapSrvPortActual := fmt.Sprintf(":%d", imapSrvPortActualInteger)
 	imapSrvCorrect := imapSrvTargetExpected == imapSrvTargetActual && imapSrvPortExpected == imapSrvPortActual
 
 	submissionSrvTargetExpected, submissionSrvPortExpected := config.GetString(config.ServerName)+".", config.GetString(config.MsaAddress)
-	submissionSrvTargetActual, submissionSrvPortActualInteger := fetchSrvTargetAndPort("submission", "tcp")
+	submissionSrvTargetActual, submissionSrvPortActualInteger := fetchSrvTargetAndPort("submission", "tcp", domain.Name)
 	submissionSrvPortActual := fmt.Sprintf(":%d", submissionSrvPortActualInteger)
 	submissionSrvCorrect := submissionSrvTargetExpected == submissionSrvTargetActual && submissionSrvPortExpected == submissionSrvPortActual
 
 	data := struct {
 		layoutData
+		Domain                      *models.Domain
+		Domains                     []*models.Domain
 		DkimRecordIs                string
 		DkimRecordShouldBe          string
 		SpfRecordIs                 string
 		SpfRecordShouldBe           string
+		DmarcRecordIs               string
+		DmarcRecordShouldBe         string
 		MxRecordIs                  string
 		MxRecordShouldBe            string
 		ImapSrvCorrect              bool
@@ -57,10 +82,14 @@ func (wa *wa) healthChecks(w http.ResponseWriter, r *http.Request, u *models.Use
 		FailingPorts                string
 	}{
 		layoutData:                  *ld,
+		Domain:                      domain,
+		Domains:                     domains,
 		DkimRecordIs:                dkimActual,
 		DkimRecordShouldBe:          dkimExpected,
 		SpfRecordIs:                 spfActual,
 		SpfRecordShouldBe:           spfExpected,
+		DmarcRecordIs:               dmarcActual,
+		DmarcRecordShouldBe:         dmarcExpected,
 		MxRecordIs:                  mxActual,
 		MxRecordShouldBe:            mxExpected,
 		ImapSrvCorrect:              imapSrvCorrect,
@@ -74,9 +103,9 @@ func (wa *wa) healthChecks(w http.ResponseWriter, r *http.Request, u *models.Use
 	wa.healthChecksView.render(w, data)
 }
 
-func fetchDkimActual() string {
+func fetchDkimActual(domain *models.Domain) string {
 	dkimActual := ""
-	dkimRecords, e := net.LookupTXT("mx._domainkey." + config.GetString(config.Domain))
+	dkimRecords, e := net.LookupTXT(domain.Dkimselector + "._domainkey." + domain.Name)
 	if e != nil {
 		dkimActual = e.Error()
 	} else {
@@ -86,9 +115,9 @@ func fetchDkimActual() string {
 	return dkimActual
 }
 
-func fetchSpfActual() string {
+func fetchSpfActual(domain string) string {
 	spfActual := ""
-	spfRecords, e := net.LookupTXT(config.GetString(config.Domain))
+	spfRecords, e := net.LookupTXT(domain)
 	if e != nil {
 		spfActual = e.Error()
 	} else {
@@ -101,9 +130,24 @@ func fetchSpfActual() string {
 	return spfActual
 }
 
-func fetchMxActual() string {
+func fetchDmarcActual(domain string) string {
+	dmarcActual := ""
+	dmarcRecords, e := net.LookupTXT("_dmarc." + domain)
+	if e != nil {
+		dmarcActual = e.Error()
+	} else {
+		for _, s := range dmarcRecords {
+			if strings.HasPrefix(s, "v=DMARC1") {
+				dmarcActual = s
+			}
+		}
+	}
+	return dmarcActual
+}
+
+func fetchMxActual(domain string) string {
 	mxActual := ""
-	mxes, e := net.LookupMX(config.GetString(config.Domain))
+	mxes, e := net.LookupMX(domain)
 	if e != nil {
 		mxActual = e.Error()
 	} else {
@@ -119,8 +163,8 @@ func fetchMxActual() string {
 	return mxActual
 }
 
-func fetchSrvTargetAndPort(service, proto string) (string, int) {
-	cname, addrs, err := net.LookupSRV(service, proto, config.GetString(config.Domain))
+func fetchSrvTargetAndPort(service, proto, domain string) (string, int) {
+	cname, addrs, err := net.LookupSRV(service, proto, domain)
 	srvActual := ""
 	srvPort := 0
 	if err != nil {
@@ -0,0 +1,784 @@
+package web
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"henrymail/config"
+	"henrymail/models"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/**
+ * JMAP, from RFC 8620 with mail from RFC 8621, for clients that would
+ * rather sync by id and state than by IMAP sequence numbers. Each user has
+ * one account holding their own mailboxes. It's all kept in the same
+ * tables IMAP uses, and changes are published the same way, so IMAP and
+ * JMAP clients see each other's changes straight away.
+ *
+ * Mailboxes other users share through IMAP ACLs (RFC 4314) aren't offered.
+ * JMAP would put them in accounts of their own, with rights from the ACL,
+ * and that isn't done yet, so they're only available over IMAP.
+ */
+
+const (
+	jmapCore       = "urn:ietf:params:jmap:core"
+	jmapMail       = "urn:ietf:params:jmap:mail"
+	jmapSubmission = "urn:ietf:params:jmap:submission"
+	// Describes how this server differs, clients that don't know it ignore it
+	jmapHenrymail = "https://github.com/MFAshby/henrymail/jmap"
+
+	jmapMaxCalls       = 64
+	jmapMaxObjects     = 500
+	jmapMaxRequestSize = 10 * 1024 * 1024
+)
+
+type jmapHandler = func(c *jmapCall, args json.RawMessage) (interface{}, error)
+
+type jmapMethod struct {
+	capability string // Which the request must be using to call it
+	handler    jmapHandler
+}
+
+var jmapMethods map[string]jmapMethod
+
+func init() {
+	jmapMethods = map[string]jmapMethod{
+		"Core/echo":               {jmapCore, jmapEcho},
+		"Mailbox/get":             {jmapMail, (*jmapCall).mailboxGet},
+		"Mailbox/changes":         {jmapMail, (*jmapCall).mailboxChanges},
+		"Mailbox/query":           {jmapMail, (*jmapCall).mailboxQuery},
+		"Mailbox/queryChanges":    {jmapMail, jmapQueryChanges},
+		"Mailbox/set":             {jmapMail, (*jmapCall).mailboxSet},
+		"Thread/get":              {jmapMail, (*jmapCall).threadGet},
+		"Thread/changes":          {jmapMail, (*jmapCall).threadChanges},
+		"Email/get":               {jmapMail, (*jmapCall).emailGet},
+		"Email/changes":           {jmapMail, (*jmapCall).emailChanges},
+		"Email/query":             {jmapMail, (*jmapCall).emailQuery},
+		"Email/queryChanges":      {jmapMail, jmapQueryChanges},
+		"Email/set":               {jmapMail, (*jmapCall).emailSet},
+		"Email/import":            {jmapMail, (*jmapCall).emailImport},
+		"SearchSnippet/get":       {jmapMail, (*jmapCall).searchSnippetGet},
+		"Identity/get":            {jmapSubmission, (*jmapCall).identityGet},
+		"EmailSubmission/get":     {jmapSubmission, (*jmapCall).emailSubmissionGet},
+		"EmailSubmission/changes": {jmapSubmission, (*jmapCall).emailSubmissionChanges},
+		"EmailSubmission/set":     {jmapSubmission, (*jmapCall).emailSubmissionSet},
+	}
+}
+
+/**
+ * A method call's name, arguments and id, which is sent as a JSON array
+ */
+type jmapInvocation struct {
+	name   string
+	args   json.RawMessage
+	callId string
+}
+
+func (i *jmapInvocation) UnmarshalJSON(b []byte) error {
+	var parts []json.RawMessage
+	e := json.Unmarshal(b, &parts)
+	if e != nil {
+		return e
+	}
+	if len(parts) != 3 {
+		return errors.New("invocations must have a name, arguments and a call id")
+	}
+	e = json.Unmarshal(parts[0], &i.name)
+	if e != nil {
+		return e
+	}
+	i.args = parts[1]
+	return json.Unmarshal(parts[2], &i.callId)
+}
+
+func (i jmapInvocation) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]interface{}{i.name, i.args, i.callId})
+}
+
+type jmapRequest struct {
+	Using       []string          `json:"using"`
+	MethodCalls []jmapInvocation  `json:"methodCalls"`
+	CreatedIds  map[string]string `json:"createdIds"`
+}
+
+/**
+ * A method call's error, or the reason one object in a /set call
+ * couldn't be changed
+ */
+type jmapError struct {
+	Type        string   `json:"type"`
+	Description string   `json:"description,omitempty"`
+	Properties  []string `json:"properties,omitempty"`
+}
+
+func (e *jmapError) Error() string {
+	return e.Type + ": " + e.Description
+}
+
+func jmapErr(typ, description string) *jmapError {
+	return &jmapError{Type: typ, Description: description}
+}
+
+func invalidProperties(description string, properties ...string) *jmapError {
+	return &jmapError{Type: "invalidProperties", Description: description, Properties: properties}
+}
+
+/**
+ * What a method call needs to know about the request it's part of
+ */
+type jmapCall struct {
+	wa      *wa
+	user    *models.User
+	r       *http.Request
+	callId  string
+	created map[string]string // Ids of objects created in this request, by creation id
+	extra   []jmapInvocation  // Responses from methods called implicitly, like Email/set after EmailSubmission/set
+}
+
+func jmapAccountId(u *models.User) string {
+	return "A" + strconv.Itoa(u.ID)
+}
+
+/**
+ * Ids are a letter for the kind of object and a database id,
+ * so they're never reused
+ */
+func jmapId(prefix string, id int) string {
+	return prefix + strconv.Itoa(id)
+}
+
+func parseJmapId(prefix, id string) (int, bool) {
+	if !strings.HasPrefix(id, prefix) {
+		return 0, false
+	}
+	n, e := strconv.Atoi(id[len(prefix):])
+	return n, e == nil && n > 0
+}
+
+/**
+ * Ids starting with # refer to objects created earlier in the request
+ */
+func (c *jmapCall) resolveId(id string) string {
+	if strings.HasPrefix(id, "#") {
+		if created, ok := c.created[id[1:]]; ok {
+			return created
+		}
+	}
+	return id
+}
+
+func (c *jmapCall) checkAccount(accountId string) error {
+	if accountId != jmapAccountId(c.user) {
+		return jmapErr("accountNotFound", "")
+	}
+	return nil
+}
+
+/**
+ * Unknown arguments are an error, so clients find out they aren't supported
+ */
+func parseArgs(args json.RawMessage, v interface{}) error {
+	d := json.NewDecoder(bytes.NewReader(args))
+	d.DisallowUnknownFields()
+	e := d.Decode(v)
+	if e != nil {
+		return jmapErr("invalidArguments", e.Error())
+	}
+	return nil
+}
+
+func jmapEcho(c *jmapCall, args json.RawMessage) (interface{}, error) {
+	return args, nil
+}
+
+func jmapQueryChanges(c *jmapCall, args json.RawMessage) (interface{}, error) {
+	return nil, jmapErr("cannotCalculateChanges", "Run the query again instead")
+}
+
+/**
+ * The state of the session, which only changes if the user is renamed
+ */
+func jmapSessionState(u *models.User) string {
+	h := fnv.New32a()
+	_, _ = io.WriteString(h, u.Username)
+	return fmt.Sprintf("%x", h.Sum32())
+}
+
+func jmapBaseUrl(r *http.Request) string {
+	if r.TLS != nil {
+		return "https://" + r.Host
+	}
+	return "http://" + r.Host
+}
+
+func writeJson(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	w.WriteHeader(status)
+	e := json.NewEncoder(w).Encode(v)
+	if e != nil {
+		log.Print(e)
+	}
+}
+
+/**
+ * Request level errors are problem details, see RFC 7807
+ */
+func jmapProblem(w http.ResponseWriter, status int, typ, detail string) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"type":   "urn:ietf:params:jmap:error:" + typ,
+		"status": status,
+		"detail": detail,
+	})
+}
+
+func (wa *wa) jmapSession(w http.ResponseWriter, r *http.Request, u *models.User) {
+	base := jmapBaseUrl(r)
+	accountId := jmapAccountId(u)
+	maxUpload := config.GetInt(config.MaxMessageBytes)
+	writeJson(w, http.StatusOK, map[string]interface{}{
+		"capabilities": map[string]interface{}{
+			jmapCore: map[string]interface{}{
+				"maxSizeUpload":         maxUpload,
+				"maxConcurrentUpload":   4,
+				"maxSizeRequest":        jmapMaxRequestSize,
+				"maxConcurrentRequests": 4,
+				"maxCallsInRequest":     jmapMaxCalls,
+				"maxObjectsInGet":       jmapMaxObjects,
+				"maxObjectsInSet":       jmapMaxObjects,
+				"collationAlgorithms":   []string{"i;unicode-casemap"},
+			},
+			jmapMail:       map[string]interface{}{},
+			jmapSubmission: map[string]interface{}{},
+			jmapHenrymail: map[string]interface{}{
+				// Only the user's own mailboxes are here, not ones shared with them
+				"sharedMailboxes": false,
+			},
+		},
+		"accounts": map[string]interface{}{
+			accountId: map[string]interface{}{
+				"name":       u.Username,
+				"isPersonal": true,
+				"isReadOnly": false,
+				"accountCapabilities": map[string]interface{}{
+					jmapMail: map[string]interface{}{
+						"maxMailboxesPerEmail":       1,
+						"maxMailboxDepth":            nil,
+						"maxSizeMailboxName":         255,
+						"maxSizeAttachmentsPerEmail": maxUpload,
+						"emailQuerySortOptions":      emailSortProperties,
+						"mayCreateTopLevelMailbox":   true,
+					},
+					jmapSubmission: map[string]interface{}{
+						"maxDelayedSend":       0,
+						"submissionExtensions": map[string]interface{}{},
+					},
+				},
+			},
+		},
+		"primaryAccounts": map[string]interface{}{
+			jmapMail:       accountId,
+			jmapSubmission: accountId,
+		},
+		"username":       u.Username,
+		"apiUrl":         base + "/jmap/api",
+		"downloadUrl":    base + "/jmap/download/{accountId}/{blobId}/{name}?accept={type}",
+		"uploadUrl":      base + "/jmap/upload/{accountId}/",
+		"eventSourceUrl": base + "/jmap/eventsource?types={types}&closeafter={closeafter}&ping={ping}",
+		"state":          jmapSessionState(u),
+	})
+}
+
+func (wa *wa) jmapApi(w http.ResponseWriter, r *http.Request, u *models.User) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, e := ioutil.ReadAll(io.LimitReader(r.Body, jmapMaxRequestSize+1))
+	if e != nil {
+		jmapProblem(w, http.StatusBadRequest, "notRequest", e.Error())
+		return
+	}
+	if len(body) > jmapMaxRequestSize {
+		jmapProblem(w, http.StatusBadRequest, "limit", "The request is bigger than maxSizeRequest")
+		return
+	}
+	if !json.Valid(body) {
+		jmapProblem(w, http.StatusBadRequest, "notJSON", "The request isn't JSON")
+		return
+	}
+	var req jmapRequest
+	e = json.Unmarshal(body, &req)
+	if e != nil || req.Using == nil || req.MethodCalls == nil {
+		jmapProblem(w, http.StatusBadRequest, "notRequest", "The request isn't a JMAP request")
+		return
+	}
+	using := map[string]bool{}
+	for _, capability := range req.Using {
+		if capability != jmapCore && capability != jmapMail && capability != jmapSubmission {
+			jmapProblem(w, http.StatusBadRequest, "unknownCapability", "Unknown capability "+capability)
+			return
+		}
+		using[capability] = true
+	}
+	if len(req.MethodCalls) > jmapMaxCalls {
+		jmapProblem(w, http.StatusBadRequest, "limit", "There are more than maxCallsInRequest method calls")
+		return
+	}
+
+	c := &jmapCall{wa: wa, user: u, r: r, created: req.CreatedIds}
+	if c.created == nil {
+		c.created = map[string]string{}
+	}
+	var responses []jmapInvocation
+	for _, call := range req.MethodCalls {
+		responses = append(responses, c.invoke(call, using, responses))
+		responses = append(responses, c.extra...)
+		c.extra = nil
+	}
+	response := map[string]interface{}{
+		"methodResponses": responses,
+		"sessionState":    jmapSessionState(u),
+	}
+	if req.CreatedIds != nil {
+		response["createdIds"] = c.created
+	}
+	writeJson(w, http.StatusOK, response)
+}
+
+func (c *jmapCall) invoke(call jmapInvocation, using map[string]bool, responses []jmapInvocation) jmapInvocation {
+	var result interface{}
+	method, ok := jmapMethods[call.name]
+	args, e := resolveReferences(call.args, responses)
+	if e == nil && (!ok || !using[method.capability]) {
+		e = jmapErr("unknownMethod", call.name)
+	}
+	if e == nil {
+		c.callId = call.callId
+		result, e = method.handler(c, args)
+	}
+	if e != nil {
+		jerr, ok := e.(*jmapError)
+		if !ok {
+			log.Printf("JMAP %v for %v failed: %v", call.name, c.user.Username, e)
+			jerr = jmapErr("serverFail", e.Error())
+		}
+		return c.response("error", call.callId, jerr)
+	}
+	return c.response(call.name, call.callId, result)
+}
+
+func (c *jmapCall) response(name, callId string, result interface{}) jmapInvocation {
+	args, e := json.Marshal(result)
+	if e != nil {
+		log.Printf("Unable to encode JMAP %v response: %v", name, e)
+		args, _ = json.Marshal(jmapErr("serverFail", e.Error()))
+		name = "error"
+	}
+	return jmapInvocation{name: name, args: args, callId: callId}
+}
+
+/**
+ * An argument with a # in front of its name is taken from the result
+ * of an earlier call in the same request, see RFC 8620 section 3.7
+ */
+type jmapResultReference struct {
+	ResultOf string `json:"resultOf"`
+	Name     string `json:"name"`
+	Path     string `json:"path"`
+}
+
+func resolveReferences(args json.RawMessage, responses []jmapInvocation) (json.RawMessage, error) {
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(args, &fields) != nil {
+		return nil, jmapErr("invalidArguments", "Arguments must be an object")
+	}
+	resolved := false
+	for key, value := range fields {
+		if !strings.HasPrefix(key, "#") {
+			continue
+		}
+		if _, ok := fields[key[1:]]; ok {
+			return nil, jmapErr("invalidArguments", "Both "+key+" and "+key[1:]+" were given")
+		}
+		var ref jmapResultReference
+		e := json.Unmarshal(value, &ref)
+		if e != nil {
+			return nil, jmapErr("invalidResultReference", e.Error())
+		}
+		var found *jmapInvocation
+		for i := range responses {
+			if responses[i].callId == ref.ResultOf && responses[i].name == ref.Name {
+				found = &responses[i]
+				break
+			}
+		}
+		if found == nil {
+			return nil, jmapErr("invalidResultReference", "No "+ref.Name+" response for "+ref.ResultOf)
+		}
+		var doc interface{}
+		e = json.Unmarshal(found.args, &doc)
+		if e != nil {
+			return nil, e
+		}
+		result, e := jsonPointer(doc, ref.Path)
+		if e != nil {
+			return nil, jmapErr("invalidResultReference", e.Error())
+		}
+		fields[key[1:]], e = json.Marshal(result)
+		if e != nil {
+			return nil, e
+		}
+		delete(fields, key)
+		resolved = true
+	}
+	if !resolved {
+		return args, nil
+	}
+	return json.Marshal(fields)
+}
+
+/**
+ * RFC 6901 JSON pointers, where * in place of an array index means every
+ * item, and lists found that way are joined together
+ */
+func jsonPointer(doc interface{}, path string) (interface{}, error) {
+	if path == "" {
+		return doc, nil
+	}
+	if !strings.HasPrefix(path, "/") {
+		return nil, fmt.Errorf("Invalid path %v", path)
+	}
+	return evalPointer(doc, strings.Split(path[1:], "/"))
+}
+
+func evalPointer(doc interface{}, tokens []string) (interface{}, error) {
+	for i, token := range tokens {
+		token = strings.Replace(strings.Replace(token, "~1", "/", -1), "~0", "~", -1)
+		switch v := doc.(type) {
+		case map[string]interface{}:
+			value, ok := v[token]
+			if !ok {
+				return nil, fmt.Errorf("No %v in result", token)
+			}
+			doc = value
+		case []interface{}:
+			if token == "*" {
+				result := []interface{}{}
+				for _, item := range v {
+					value, e := evalPointer(item, tokens[i+1:])
+					if e != nil {
+						return nil, e
+					}
+					if list, ok := value.([]interface{}); ok {
+						result = append(result, list...)
+					} else {
+						result = append(result, value)
+					}
+				}
+				return result, nil
+			}
+			n, e := strconv.Atoi(token)
+			if e != nil || n < 0 || n >= len(v) {
+				return nil, fmt.Errorf("No item %v in result", token)
+			}
+			doc = v[n]
+		default:
+			return nil, fmt.Errorf("Can't find %v in result", token)
+		}
+	}
+	return doc, nil
+}
+
+/**
+ * Arguments and results for the standard methods, see RFC 8620 section 5
+ */
+
+type jmapGetArgs struct {
+	AccountId  string    `json:"accountId"`
+	Ids        *[]string `json:"ids"` // nil for all of them
+	Properties *[]string `json:"properties"`
+}
+
+type jmapGetResponse struct {
+	AccountId string        `json:"accountId"`
+	State     string        `json:"state"`
+	List      []interface{} `json:"list"`
+	NotFound  []string      `json:"notFound"`
+}
+
+/**
+ * Only the properties asked for, and always the id
+ */
+func pickProperties(object map[string]interface{}, properties []string) map[string]interface{} {
+	picked := map[string]interface{}{"id": object["id"]}
+	for _, property := range properties {
+		picked[property] = object[property]
+	}
+	return picked
+}
+
+func checkProperties(properties *[]string, known []string) ([]string, error) {
+	if properties == nil {
+		return known, nil
+	}
+	for _, property := range *properties {
+		if !stringIn(property, known) {
+			return nil, jmapErr("invalidArguments", "Unknown property "+property)
+		}
+	}
+	return *properties, nil
+}
+
+func stringIn(s string, list []string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+type jmapChangesArgs struct {
+	AccountId  string `json:"accountId"`
+	SinceState string `json:"sinceState"`
+	MaxChanges *int   `json:"maxChanges"`
+}
+
+type jmapChangesResponse struct {
+	AccountId      string   `json:"accountId"`
+	OldState       string   `json:"oldState"`
+	NewState       string   `json:"newState"`
+	HasMoreChanges bool     `json:"hasMoreChanges"`
+	Created        []string `json:"created"`
+	Updated        []string `json:"updated"`
+	Destroyed      []string `json:"destroyed"`
+}
+
+func newChangesResponse(args *jmapChangesArgs, newState string) *jmapChangesResponse {
+	return &jmapChangesResponse{
+		AccountId: args.AccountId,
+		OldState:  args.SinceState,
+		NewState:  newState,
+		Created:   []string{},
+		Updated:   []string{},
+		Destroyed: []string{},
+	}
+}
+
+/**
+ * Changes are worked out all at once, so if there are too many the
+ * client has to start again
+ */
+func (r *jmapChangesResponse) checkMax(args *jmapChangesArgs) error {
+	if args.MaxChanges != nil && len(r.Created)+len(r.Updated)+len(r.Destroyed) > *args.MaxChanges {
+		return jmapErr("cannotCalculateChanges", "There are more than maxChanges changes")
+	}
+	return nil
+}
+
+type jmapSetArgs struct {
+	AccountId string                     `json:"accountId"`
+	IfInState *string                    `json:"ifInState"`
+	Create    map[string]json.RawMessage `json:"create"`
+	Update    map[string]json.RawMessage `json:"update"`
+	Destroy   []string                   `json:"destroy"`
+}
+
+func (args *jmapSetArgs) check(state string) error {
+	if len(args.Create)+len(args.Update)+len(args.Destroy) > jmapMaxObjects {
+		return jmapErr("requestTooLarge", "More than maxObjectsInSet objects")
+	}
+	if args.IfInState != nil && *args.IfInState != state {
+		return jmapErr("stateMismatch", "")
+	}
+	return nil
+}
+
+type jmapSetResponse struct {
+	AccountId    string                 `json:"accountId"`
+	OldState     string                 `json:"oldState"`
+	NewState     string                 `json:"newState"`
+	Created      map[string]interface{} `json:"created"`
+	Updated      map[string]interface{} `json:"updated"`
+	Destroyed    []string               `json:"destroyed"`
+	NotCreated   map[string]*jmapError  `json:"notCreated"`
+	NotUpdated   map[string]*jmapError  `json:"notUpdated"`
+	NotDestroyed map[string]*jmapError  `json:"notDestroyed"`
+}
+
+/**
+ * Errors for single objects are reported with them, anything else
+ * fails the whole call
+ */
+func (r *jmapSetResponse) failed(errs *map[string]*jmapError, id string, e error) error {
+	jerr, ok := e.(*jmapError)
+	if !ok {
+		return e
+	}
+	if *errs == nil {
+		*errs = map[string]*jmapError{}
+	}
+	(*errs)[id] = jerr
+	return nil
+}
+
+func (r *jmapSetResponse) created(c *jmapCall, creationId, id string, object map[string]interface{}) {
+	if r.Created == nil {
+		r.Created = map[string]interface{}{}
+	}
+	r.Created[creationId] = object
+	c.created[creationId] = id
+}
+
+func (r *jmapSetResponse) updated(id string) {
+	if r.Updated == nil {
+		r.Updated = map[string]interface{}{}
+	}
+	r.Updated[id] = nil
+}
+
+type jmapQueryArgs struct {
+	AccountId      string           `json:"accountId"`
+	Filter         json.RawMessage  `json:"filter"`
+	Sort           []jmapComparator `json:"sort"`
+	Position       int              `json:"position"`
+	Anchor         *string          `json:"anchor"`
+	AnchorOffset   int              `json:"anchorOffset"`
+	Limit          *int             `json:"limit"`
+	CalculateTotal bool             `json:"calculateTotal"`
+}
+
+type jmapComparator struct {
+	Property    string `json:"property"`
+	IsAscending *bool  `json:"isAscending"`
+	Collation   string `json:"collation"`
+	Keyword     string `json:"keyword"`
+}
+
+func (c jmapComparator) ascending() bool {
+	return c.IsAscending == nil || *c.IsAscending
+}
+
+type jmapQueryResponse struct {
+	AccountId           string   `json:"accountId"`
+	QueryState          string   `json:"queryState"`
+	CanCalculateChanges bool     `json:"canCalculateChanges"`
+	Position            int      `json:"position"`
+	Ids                 []string `json:"ids"`
+	Total               *int     `json:"total,omitempty"`
+	Limit               *int     `json:"limit,omitempty"`
+}
+
+/**
+ * The window of the sorted results the client asked for, by position
+ * or relative to an anchor
+ */
+func queryPage(args *jmapQueryArgs, ids []string, state string) (*jmapQueryResponse, error) {
+	position := args.Position
+	if args.Anchor != nil {
+		position = -1
+		for i, id := range ids {
+			if id == *args.Anchor {
+				position = i + args.AnchorOffset
+				break
+			}
+		}
+		if position == -1 {
+			return nil, jmapErr("anchorNotFound", "")
+		}
+		if position < 0 {
+			position = 0
+		}
+	} else if position < 0 {
+		position += len(ids)
+		if position < 0 {
+			position = 0
+		}
+	}
+	if position > len(ids) {
+		position = len(ids)
+	}
+	end := len(ids)
+	response := &jmapQueryResponse{
+		AccountId:  args.AccountId,
+		QueryState: state,
+		Position:   position,
+	}
+	if args.Limit != nil {
+		if *args.Limit < 0 {
+			return nil, jmapErr("invalidArguments", "limit can't be negative")
+		}
+		if position+*args.Limit < end {
+			end = position + *args.Limit
+		}
+	}
+	response.Ids = append([]string{}, ids[position:end]...)
+	if args.CalculateTotal {
+		total := len(ids)
+		response.Total = &total
+	}
+	return response, nil
+}
+
+/**
+ * Where each of the user's mailboxes is up to. Every change to the
+ * messages in a mailbox gives it a new modseq, and new messages get UIDs
+ * from uidnext up, so that's enough to work out what changed since.
+ */
+type mailboxPosition struct {
+	modseq  int
+	uidnext int
+}
+
+type jmapState map[int]mailboxPosition
+
+func newJmapState(mailboxes []*models.Mailbox) jmapState {
+	s := jmapState{}
+	for _, mailbox := range mailboxes {
+		s[mailbox.ID] = mailboxPosition{mailbox.Highestmodseq, mailbox.Uidnext}
+	}
+	return s
+}
+
+func (s jmapState) String() string {
+	var ids []int
+	for id := range s {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	var parts []string
+	for _, id := range ids {
+		parts = append(parts, fmt.Sprintf("%d-%d-%d", id, s[id].modseq, s[id].uidnext))
+	}
+	return "s" + strings.Join(parts, "_")
+}
+
+func parseJmapState(str string) (jmapState, error) {
+	invalid := jmapErr("cannotCalculateChanges", "Unknown state")
+	if !strings.HasPrefix(str, "s") {
+		return nil, invalid
+	}
+	s := jmapState{}
+	for _, part := range strings.Split(str[1:], "_") {
+		var id int
+		var p mailboxPosition
+		if _, e := fmt.Sscanf(part, "%d-%d-%d", &id, &p.modseq, &p.uidnext); e != nil {
+			return nil, invalid
+		}
+		s[id] = p
+	}
+	return s, nil
+}
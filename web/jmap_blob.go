@@ -0,0 +1,263 @@
+package web
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/xo/xoutil"
+	"henrymail/config"
+	"henrymail/events"
+	"henrymail/models"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+/**
+ * Uploads, downloads and push, see RFC 8620 sections 6 and 7.3. Blobs are
+ * files the user uploaded, whole messages, and parts of messages.
+ */
+
+// Uploads not used by then are deleted
+const uploadLifetime = 24 * time.Hour
+
+type jmapBlob struct {
+	typ     string
+	content []byte
+}
+
+func (wa *wa) messageContent(db models.XODB, u *models.User, msgid int) ([]byte, error) {
+	var content []byte
+	e := db.QueryRow(`SELECT content FROM messages WHERE id = ? AND mailboxid IN
+		(SELECT id FROM mailboxes WHERE userid = ?)`, msgid, u.ID).Scan(&content)
+	return content, e
+}
+
+/**
+ * Returns sql.ErrNoRows if the user hasn't got the blob
+ */
+func (wa *wa) blob(db models.XODB, u *models.User, blobId string) (*jmapBlob, error) {
+	if id, ok := parseJmapId("B", blobId); ok {
+		upload, e := models.UploadByID(db, id)
+		if e != nil {
+			return nil, e
+		}
+		if upload.Userid != u.ID {
+			return nil, sql.ErrNoRows
+		}
+		return &jmapBlob{upload.Type, upload.Content}, nil
+	}
+	if id, ok := parseJmapId("R", blobId); ok {
+		content, e := wa.messageContent(db, u, id)
+		if e != nil {
+			return nil, e
+		}
+		return &jmapBlob{"message/rfc822", content}, nil
+	}
+	if strings.HasPrefix(blobId, "P") {
+		parts := strings.SplitN(blobId[1:], "-", 2)
+		id, e := strconv.Atoi(parts[0])
+		if e != nil || len(parts) != 2 {
+			return nil, sql.ErrNoRows
+		}
+		content, e := wa.messageContent(db, u, id)
+		if e != nil {
+			return nil, e
+		}
+		root, _ := parseBody(id, content)
+		part := root.find(strings.Replace(parts[1], "-", ".", -1))
+		if part == nil {
+			return nil, sql.ErrNoRows
+		}
+		return &jmapBlob{part.typ, part.content}, nil
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (wa *wa) jmapUpload(w http.ResponseWriter, r *http.Request, u *models.User) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	accountId := mux.Vars(r)["accountId"]
+	if accountId != jmapAccountId(u) {
+		jmapProblem(w, http.StatusNotFound, "accountNotFound", "No such account")
+		return
+	}
+	maxSize := config.GetInt(config.MaxMessageBytes)
+	content, e := ioutil.ReadAll(io.LimitReader(r.Body, int64(maxSize)+1))
+	if e != nil {
+		jmapProblem(w, http.StatusBadRequest, "notRequest", e.Error())
+		return
+	}
+	if len(content) > maxSize {
+		jmapProblem(w, http.StatusRequestEntityTooLarge, "limit", "The upload is bigger than maxSizeUpload")
+		return
+	}
+	typ := r.Header.Get("Content-Type")
+	if typ == "" {
+		typ = "application/octet-stream"
+	}
+	_, e = wa.db.Exec("DELETE FROM uploads WHERE ts < ?", time.Now().Add(-uploadLifetime))
+	if e != nil {
+		log.Printf("Unable to delete old uploads: %v", e)
+	}
+	upload := &models.Upload{
+		Userid:  u.ID,
+		Type:    typ,
+		Content: content,
+		Ts:      xoutil.SqTime{Time: time.Now()},
+	}
+	e = upload.Save(wa.db)
+	if e != nil {
+		log.Print(e)
+		jmapProblem(w, http.StatusInternalServerError, "serverFail", e.Error())
+		return
+	}
+	writeJson(w, http.StatusCreated, map[string]interface{}{
+		"accountId": accountId,
+		"blobId":    jmapId("B", upload.ID),
+		"type":      typ,
+		"size":      len(content),
+	})
+}
+
+func (wa *wa) jmapDownload(w http.ResponseWriter, r *http.Request, u *models.User) {
+	vars := mux.Vars(r)
+	if vars["accountId"] != jmapAccountId(u) {
+		http.NotFound(w, r)
+		return
+	}
+	blob, e := wa.blob(wa.db, u, vars["blobId"])
+	if e == sql.ErrNoRows {
+		http.NotFound(w, r)
+		return
+	} else if e != nil {
+		log.Print(e)
+		http.Error(w, e.Error(), http.StatusInternalServerError)
+		return
+	}
+	typ := r.URL.Query().Get("accept")
+	if typ == "" {
+		typ = blob.typ
+	}
+	// Never shown as a page of this site, which could run scripts in it
+	w.Header().Set("Content-Type", typ)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": vars["name"]}))
+	w.Header().Set("Cache-Control", "private, immutable, max-age=31536000")
+	_, _ = w.Write(blob.content)
+}
+
+/**
+ * Tells the client when the user's emails or mailboxes change, as
+ * server-sent events
+ */
+func (wa *wa) jmapEventSource(w http.ResponseWriter, r *http.Request, u *models.User) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming isn't supported", http.StatusInternalServerError)
+		return
+	}
+	query := r.URL.Query()
+	types := map[string]bool{}
+	for _, typ := range strings.Split(query.Get("types"), ",") {
+		types[typ] = true
+	}
+	closeAfterState := query.Get("closeafter") == "state"
+	ping, _ := strconv.Atoi(query.Get("ping"))
+
+	changed := make(chan struct{}, 1)
+	var delivered int32 // Set when new messages arrive
+	unsubscribe := events.Subscribe(func(ev events.Event) {
+		if ev.Userid != u.ID {
+			return
+		}
+		if ev.Type == events.Exists {
+			atomic.StoreInt32(&delivered, 1)
+		}
+		select {
+		case changed <- struct{}{}:
+		default:
+			// Already waiting to tell the client, which gets the latest states
+		}
+	})
+	defer unsubscribe()
+
+	c := &jmapCall{wa: wa, user: u, r: r}
+	states := func() (map[string]string, error) {
+		mailboxes, e := c.mailboxes(wa.db)
+		if e != nil {
+			return nil, e
+		}
+		email := newJmapState(mailboxes).String()
+		return map[string]string{"Email": email, "Thread": email, "Mailbox": mailboxState(mailboxes)}, nil
+	}
+	last, e := states()
+	if e != nil {
+		log.Print(e)
+		http.Error(w, e.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	var pings <-chan time.Time
+	if ping > 0 {
+		ticker := time.NewTicker(time.Duration(ping) * time.Second)
+		defer ticker.Stop()
+		pings = ticker.C
+	}
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-pings:
+			fmt.Fprintf(w, "event: ping\ndata: {\"interval\":%d}\n\n", ping)
+			flusher.Flush()
+			continue
+		case <-changed:
+		}
+		current, e := states()
+		if e != nil {
+			log.Print(e)
+			return
+		}
+		changes := map[string]string{}
+		for typ, state := range current {
+			if state != last[typ] && (types["*"] || types[typ]) {
+				changes[typ] = state
+			}
+		}
+		if atomic.SwapInt32(&delivered, 0) == 1 && current["Email"] != last["Email"] && (types["*"] || types["EmailDelivery"]) {
+			changes["EmailDelivery"] = current["Email"]
+		}
+		last = current
+		if len(changes) == 0 {
+			continue
+		}
+		data, e := json.Marshal(map[string]interface{}{
+			"@type":   "StateChange",
+			"changed": map[string]interface{}{jmapAccountId(u): changes},
+		})
+		if e != nil {
+			log.Print(e)
+			return
+		}
+		fmt.Fprintf(w, "event: state\ndata: %s\n\n", data)
+		flusher.Flush()
+		if closeAfterState {
+			return
+		}
+	}
+}
@@ -0,0 +1,662 @@
+package web
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/mail"
+	"henrymail/config"
+	"henrymail/logic"
+	"henrymail/process"
+	"html"
+	"io"
+	"io/ioutil"
+	"mime"
+	netmail "net/mail"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+/**
+ * Email bodies, see RFC 8621 section 4.1.4. Only what IMAP needs is kept
+ * with each message, so bodies are parsed when a client asks for them.
+ * Parts are numbered like IMAP body sections.
+ */
+
+type emailBodyPart struct {
+	partId          string // Empty for multiparts, which have no content of their own
+	blobId          string
+	size            int
+	headers         []emailHeader
+	name            string
+	typ             string
+	charset         string
+	disposition     string
+	cid             string
+	language        []string
+	location        string
+	subParts        []*emailBodyPart
+	content         []byte // Decoded, and converted to UTF-8 if it's text
+	encodingProblem bool
+}
+
+type emailHeader struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+var bodyPartProperties = []string{"partId", "blobId", "size", "headers", "name", "type", "charset",
+	"disposition", "cid", "language", "location", "subParts"}
+
+var defaultBodyPartProperties = []string{"partId", "blobId", "size", "name", "type", "charset",
+	"disposition", "cid", "language", "location"}
+
+func partBlobId(msgid int, partId string) string {
+	return fmt.Sprintf("P%d-%v", msgid, strings.Replace(partId, ".", "-", -1))
+}
+
+/**
+ * Messages that can't be parsed are treated as plain text, as they are
+ * for IMAP's BODYSTRUCTURE
+ */
+func parseBody(msgid int, content []byte) (*emailBodyPart, message.Header) {
+	ent, e := message.Read(bytes.NewReader(content))
+	if e != nil && !message.IsUnknownCharset(e) {
+		return &emailBodyPart{
+			partId:          "1",
+			blobId:          partBlobId(msgid, "1"),
+			size:            len(content),
+			headers:         []emailHeader{},
+			typ:             "text/plain",
+			charset:         "us-ascii",
+			content:         content,
+			encodingProblem: true,
+		}, message.Header{}
+	}
+	return readBodyPart(ent, msgid, "", e != nil), ent.Header
+}
+
+func readBodyPart(ent *message.Entity, msgid int, section string, problem bool) *emailBodyPart {
+	typ, params, e := ent.Header.ContentType()
+	if e != nil || typ == "" {
+		typ, params = "text/plain", map[string]string{}
+	}
+	p := &emailBodyPart{typ: typ, headers: headerList(ent.Header)}
+	disposition, dispositionParams, _ := ent.Header.ContentDisposition()
+	p.disposition = strings.ToLower(disposition)
+	p.name = dispositionParams["filename"]
+	if p.name == "" {
+		p.name = params["name"]
+	}
+	p.name = decodeWords(p.name)
+	if strings.HasPrefix(typ, "text/") {
+		p.charset = strings.ToLower(params["charset"])
+		if p.charset == "" {
+			p.charset = "us-ascii"
+		}
+	}
+	p.cid = strings.Trim(ent.Header.Get("Content-Id"), "<> ")
+	p.location = ent.Header.Get("Content-Location")
+	for _, language := range strings.Split(ent.Header.Get("Content-Language"), ",") {
+		if language = strings.TrimSpace(language); language != "" {
+			p.language = append(p.language, language)
+		}
+	}
+
+	if mr := ent.MultipartReader(); mr != nil {
+		p.subParts = []*emailBodyPart{}
+		for i := 1; ; i++ {
+			part, e := mr.NextPart()
+			if e == io.EOF || (e != nil && !message.IsUnknownCharset(e)) {
+				break
+			}
+			p.subParts = append(p.subParts, readBodyPart(part, msgid, subSection(section, i), e != nil))
+		}
+		return p
+	}
+	p.partId = section
+	if p.partId == "" {
+		p.partId = "1"
+	}
+	p.blobId = partBlobId(msgid, p.partId)
+	p.content, e = ioutil.ReadAll(ent.Body)
+	p.size = len(p.content)
+	p.encodingProblem = problem || e != nil
+	return p
+}
+
+func subSection(section string, i int) string {
+	if section == "" {
+		return fmt.Sprint(i)
+	}
+	return fmt.Sprintf("%v.%d", section, i)
+}
+
+func headerList(h message.Header) []emailHeader {
+	headers := []emailHeader{}
+	fields := h.Fields()
+	for fields.Next() {
+		headers = append(headers, emailHeader{fields.Key(), fields.Value()})
+	}
+	return headers
+}
+
+/**
+ * The part with this id, which is a leaf
+ */
+func (p *emailBodyPart) find(partId string) *emailBodyPart {
+	if p.partId == partId {
+		return p
+	}
+	for _, sub := range p.subParts {
+		if found := sub.find(partId); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+func (p *emailBodyPart) leaves() []*emailBodyPart {
+	if p.subParts == nil {
+		return []*emailBodyPart{p}
+	}
+	var leaves []*emailBodyPart
+	for _, sub := range p.subParts {
+		leaves = append(leaves, sub.leaves()...)
+	}
+	return leaves
+}
+
+func nullable(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+func (p *emailBodyPart) object(properties []string) map[string]interface{} {
+	object := map[string]interface{}{}
+	for _, property := range properties {
+		switch property {
+		case "partId":
+			object[property] = nullable(p.partId)
+		case "blobId":
+			object[property] = nullable(p.blobId)
+		case "size":
+			object[property] = p.size
+		case "headers":
+			object[property] = p.headers
+		case "name":
+			object[property] = nullable(p.name)
+		case "type":
+			object[property] = p.typ
+		case "charset":
+			object[property] = nullable(p.charset)
+		case "disposition":
+			object[property] = nullable(p.disposition)
+		case "cid":
+			object[property] = nullable(p.cid)
+		case "language":
+			if p.language != nil {
+				object[property] = p.language
+			} else {
+				object[property] = nil
+			}
+		case "location":
+			object[property] = nullable(p.location)
+		case "subParts":
+			if p.subParts != nil {
+				object[property] = partObjects(p.subParts, properties)
+			} else {
+				object[property] = nil
+			}
+		}
+	}
+	return object
+}
+
+func partObjects(parts []*emailBodyPart, properties []string) []interface{} {
+	objects := []interface{}{}
+	for _, p := range parts {
+		objects = append(objects, p.object(properties))
+	}
+	return objects
+}
+
+/**
+ * The parts to show as text, as HTML, and as attachments
+ */
+type emailBodies struct {
+	text, html, attachments []*emailBodyPart
+}
+
+func splitBodies(root *emailBodyPart) *emailBodies {
+	b := &emailBodies{text: []*emailBodyPart{}, html: []*emailBodyPart{}, attachments: []*emailBodyPart{}}
+	parseStructure([]*emailBodyPart{root}, "mixed", false, &b.text, &b.html, &b.attachments)
+	return b
+}
+
+func isInlineMediaType(typ string) bool {
+	return strings.HasPrefix(typ, "image/") || strings.HasPrefix(typ, "audio/") || strings.HasPrefix(typ, "video/")
+}
+
+/**
+ * The algorithm from RFC 8621 section 4.1.4. Inside an alternative, a
+ * nil list means the parts for it have already been found.
+ */
+func parseStructure(parts []*emailBodyPart, multipartType string, inAlternative bool,
+	textBody, htmlBody, attachments *[]*emailBodyPart) {
+	textLength, htmlLength := -1, -1
+	if textBody != nil {
+		textLength = len(*textBody)
+	}
+	if htmlBody != nil {
+		htmlLength = len(*htmlBody)
+	}
+	for i, part := range parts {
+		isInline := part.disposition != "attachment" &&
+			(part.typ == "text/plain" || part.typ == "text/html" || isInlineMediaType(part.typ)) &&
+			(i == 0 || (multipartType != "related" && (isInlineMediaType(part.typ) || part.name == "")))
+		if part.subParts != nil {
+			subType := strings.TrimPrefix(part.typ, "multipart/")
+			parseStructure(part.subParts, subType, inAlternative || subType == "alternative",
+				textBody, htmlBody, attachments)
+		} else if isInline {
+			if multipartType == "alternative" {
+				switch {
+				case part.typ == "text/plain" && textBody != nil:
+					*textBody = append(*textBody, part)
+				case part.typ == "text/html" && htmlBody != nil:
+					*htmlBody = append(*htmlBody, part)
+				case part.typ != "text/plain" && part.typ != "text/html":
+					*attachments = append(*attachments, part)
+				}
+				continue
+			} else if inAlternative {
+				if part.typ == "text/plain" {
+					htmlBody = nil
+				}
+				if part.typ == "text/html" {
+					textBody = nil
+				}
+			}
+			if textBody != nil {
+				*textBody = append(*textBody, part)
+			}
+			if htmlBody != nil {
+				*htmlBody = append(*htmlBody, part)
+			}
+			if (textBody == nil || htmlBody == nil) && isInlineMediaType(part.typ) {
+				*attachments = append(*attachments, part)
+			}
+		} else {
+			*attachments = append(*attachments, part)
+		}
+	}
+	if multipartType == "alternative" && textBody != nil && htmlBody != nil {
+		if textLength == len(*textBody) && htmlLength != len(*htmlBody) {
+			*textBody = append(*textBody, (*htmlBody)[htmlLength:]...)
+		}
+		if htmlLength == len(*htmlBody) && textLength != len(*textBody) {
+			*htmlBody = append(*htmlBody, (*textBody)[textLength:]...)
+		}
+	}
+}
+
+type emailBodyValue struct {
+	Value             string `json:"value"`
+	IsEncodingProblem bool   `json:"isEncodingProblem"`
+	IsTruncated       bool   `json:"isTruncated"`
+}
+
+/**
+ * Cut at maxBytes if that's more than zero, without splitting a character
+ */
+func (p *emailBodyPart) value(maxBytes int) emailBodyValue {
+	v := emailBodyValue{
+		Value:             strings.ToValidUTF8(string(p.content), "�"),
+		IsEncodingProblem: p.encodingProblem || !utf8.Valid(p.content),
+	}
+	if maxBytes > 0 && len(v.Value) > maxBytes {
+		cut := maxBytes
+		for cut > 0 && !utf8.RuneStart(v.Value[cut]) {
+			cut--
+		}
+		v.Value = v.Value[:cut]
+		v.IsTruncated = true
+	}
+	return v
+}
+
+var (
+	htmlHidden   = regexp.MustCompile(`(?is)<(style|script|head)\b.*?</(style|script|head)\s*>`)
+	htmlTag      = regexp.MustCompile(`<[^>]*>`)
+	previewChars = 256
+)
+
+/**
+ * The text of an HTML part, roughly
+ */
+func htmlText(s string) string {
+	return html.UnescapeString(htmlTag.ReplaceAllString(htmlHidden.ReplaceAllString(s, " "), " "))
+}
+
+/**
+ * The message's text, on one line
+ */
+func (b *emailBodies) plainText() string {
+	for _, parts := range [][]*emailBodyPart{b.text, b.html} {
+		for _, p := range parts {
+			var text string
+			switch p.typ {
+			case "text/plain":
+				text = p.value(0).Value
+			case "text/html":
+				text = htmlText(p.value(0).Value)
+			default:
+				continue
+			}
+			if text = strings.Join(strings.Fields(text), " "); text != "" {
+				return text
+			}
+		}
+	}
+	return ""
+}
+
+func (b *emailBodies) preview() string {
+	text := b.plainText()
+	if utf8.RuneCountInString(text) > previewChars {
+		text = string([]rune(text)[:previewChars])
+	}
+	return text
+}
+
+/**
+ * Attachments are anything that isn't text, since they can be found
+ * from the body structure without reading the message
+ */
+func hasAttachment(structure *imap.BodyStructure) bool {
+	if strings.EqualFold(structure.MIMEType, "multipart") {
+		for _, part := range structure.Parts {
+			if hasAttachment(part) {
+				return true
+			}
+		}
+		return false
+	}
+	return strings.EqualFold(structure.Disposition, "attachment") || !strings.EqualFold(structure.MIMEType, "text")
+}
+
+func decodeWords(s string) string {
+	decoder := &mime.WordDecoder{CharsetReader: message.CharsetReader}
+	if decoded, e := decoder.DecodeHeader(s); e == nil {
+		return decoded
+	}
+	return s
+}
+
+type emailAddress struct {
+	Name  *string `json:"name"`
+	Email string  `json:"email"`
+}
+
+func newEmailAddress(name, email string) emailAddress {
+	a := emailAddress{Email: email}
+	if name != "" {
+		a.Name = &name
+	}
+	return a
+}
+
+/**
+ * Null if there are none. Group names are left out.
+ */
+func envelopeAddresses(list []*imap.Address) interface{} {
+	var addresses []emailAddress
+	for _, a := range list {
+		if a.HostName == "" {
+			continue
+		}
+		addresses = append(addresses, newEmailAddress(decodeWords(a.PersonalName), a.MailboxName+"@"+a.HostName))
+	}
+	if addresses == nil {
+		return nil
+	}
+	return addresses
+}
+
+func parseAddresses(value string) []emailAddress {
+	addresses := []emailAddress{}
+	parser := netmail.AddressParser{WordDecoder: &mime.WordDecoder{CharsetReader: message.CharsetReader}}
+	list, e := parser.ParseList(value)
+	if e != nil {
+		return addresses
+	}
+	for _, a := range list {
+		addresses = append(addresses, newEmailAddress(a.Name, a.Address))
+	}
+	return addresses
+}
+
+/**
+ * Message ids without their angle brackets, or null if there are none
+ */
+func jmapMessageIds(ids []string) interface{} {
+	if len(ids) == 0 {
+		return nil
+	}
+	stripped := make([]string, len(ids))
+	for i, id := range ids {
+		stripped[i] = strings.Trim(id, "<>")
+	}
+	return stripped
+}
+
+func utcDate(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t.UTC().Format("2006-01-02T15:04:05Z")
+}
+
+var headerForms = []string{"asRaw", "asText", "asAddresses", "asGroupedAddresses", "asMessageIds", "asDate", "asURLs"}
+
+/**
+ * Checks a header:{name}[:{form}][:all] property, see RFC 8621 section 4.1.3
+ */
+func parseHeaderProperty(property string) (name, form string, all bool, ok bool) {
+	parts := strings.Split(property, ":")
+	if len(parts) < 2 || len(parts) > 4 || parts[0] != "header" || parts[1] == "" {
+		return "", "", false, false
+	}
+	name, form = parts[1], "asRaw"
+	rest := parts[2:]
+	if len(rest) > 0 && rest[len(rest)-1] == "all" {
+		all = true
+		rest = rest[:len(rest)-1]
+	}
+	if len(rest) == 1 {
+		form = rest[0]
+	} else if len(rest) > 1 {
+		return "", "", false, false
+	}
+	return name, form, all, stringIn(form, headerForms)
+}
+
+func headerProperty(h message.Header, property string) interface{} {
+	name, form, all, _ := parseHeaderProperty(property)
+	var values []interface{}
+	fields := h.FieldsByKey(name)
+	for fields.Next() {
+		values = append(values, headerValue(fields.Value(), form))
+	}
+	if all {
+		if values == nil {
+			return []interface{}{}
+		}
+		return values
+	}
+	if len(values) == 0 {
+		return nil
+	}
+	return values[len(values)-1]
+}
+
+func headerValue(raw, form string) interface{} {
+	switch form {
+	case "asText":
+		return strings.Join(strings.Fields(decodeWords(raw)), " ")
+	case "asAddresses":
+		return parseAddresses(raw)
+	case "asGroupedAddresses":
+		return []interface{}{map[string]interface{}{"name": nil, "addresses": parseAddresses(raw)}}
+	case "asMessageIds":
+		return jmapMessageIds(logic.MessageIds(raw))
+	case "asDate":
+		t, e := netmail.ParseDate(raw)
+		if e != nil {
+			return nil
+		}
+		return utcDate(t)
+	case "asURLs":
+		var urls []string
+		for _, url := range angleBrackets.FindAllString(raw, -1) {
+			urls = append(urls, strings.Trim(url, "<>"))
+		}
+		if urls == nil {
+			return nil
+		}
+		return urls
+	}
+	return raw
+}
+
+var angleBrackets = regexp.MustCompile(`<[^<>]+>`)
+
+/**
+ * A message written by one of our users, from JMAP or webmail
+ */
+type composedEmail struct {
+	header      mail.Header
+	text        string
+	html        string // Sent alongside the text if it isn't empty
+	attachments []composedAttachment
+}
+
+type composedAttachment struct {
+	typ     string
+	name    string
+	cid     string
+	content []byte
+}
+
+func newMessageId() string {
+	return fmt.Sprintf("<%d.%v@%v>", time.Now().UnixNano(), process.NewQueueId(), config.GetString(config.ServerName))
+}
+
+func inlineHeader(typ string) mail.InlineHeader {
+	h := mail.InlineHeader{}
+	h.SetContentType(typ, map[string]string{"charset": "utf-8"})
+	return h
+}
+
+func writeInline(w io.Writer, text string) error {
+	_, e := io.WriteString(w, text)
+	return e
+}
+
+func (m *composedEmail) bytes() ([]byte, error) {
+	h := mail.Header{Header: message.Header{Header: m.header.Copy()}}
+	if !h.Has("Date") {
+		h.SetDate(time.Now())
+	}
+	if !h.Has("Message-Id") {
+		h.Set("Message-Id", newMessageId())
+	}
+	h.Set("MIME-Version", "1.0")
+	var b bytes.Buffer
+
+	if len(m.attachments) == 0 && m.html == "" {
+		h.SetContentType("text/plain", map[string]string{"charset": "utf-8"})
+		w, e := mail.CreateSingleInlineWriter(&b, h)
+		if e != nil {
+			return nil, e
+		}
+		if e = writeInline(w, m.text); e != nil {
+			return nil, e
+		}
+		if e = w.Close(); e != nil {
+			return nil, e
+		}
+		return b.Bytes(), nil
+	}
+
+	mw, e := mail.CreateWriter(&b, h)
+	if e != nil {
+		return nil, e
+	}
+	if m.html == "" {
+		w, e := mw.CreateSingleInline(inlineHeader("text/plain"))
+		if e != nil {
+			return nil, e
+		}
+		if e = writeInline(w, m.text); e != nil {
+			return nil, e
+		}
+		if e = w.Close(); e != nil {
+			return nil, e
+		}
+	} else {
+		iw, e := mw.CreateInline()
+		if e != nil {
+			return nil, e
+		}
+		for _, part := range []struct{ typ, text string }{{"text/plain", m.text}, {"text/html", m.html}} {
+			w, e := iw.CreatePart(inlineHeader(part.typ))
+			if e != nil {
+				return nil, e
+			}
+			if e = writeInline(w, part.text); e != nil {
+				return nil, e
+			}
+			if e = w.Close(); e != nil {
+				return nil, e
+			}
+		}
+		if e = iw.Close(); e != nil {
+			return nil, e
+		}
+	}
+	for _, a := range m.attachments {
+		ah := mail.AttachmentHeader{}
+		ah.SetContentType(a.typ, nil)
+		if a.name != "" {
+			ah.SetFilename(a.name)
+		}
+		if a.cid != "" {
+			ah.Set("Content-Id", "<"+a.cid+">")
+		}
+		// Messages can't be base64 encoded, see RFC 2046 section 5.2.1
+		if strings.EqualFold(a.typ, "message/rfc822") {
+			ah.Set("Content-Transfer-Encoding", "8bit")
+		}
+		w, e := mw.CreateAttachment(ah)
+		if e != nil {
+			return nil, e
+		}
+		if _, e = w.Write(a.content); e != nil {
+			return nil, e
+		}
+		if e = w.Close(); e != nil {
+			return nil, e
+		}
+	}
+	if e = mw.Close(); e != nil {
+		return nil, e
+	}
+	return b.Bytes(), nil
+}
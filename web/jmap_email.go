@@ -0,0 +1,1451 @@
+package web
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/mail"
+	"github.com/xo/xoutil"
+	"henrymail/database"
+	"henrymail/events"
+	"henrymail/logic"
+	"henrymail/models"
+	"html"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+/**
+ * Emails, see RFC 8621 section 4. An email is a message in one of the
+ * user's mailboxes, and keeps its id when it's moved to another one.
+ * Keywords are IMAP flags.
+ */
+
+var emailProperties = []string{"id", "blobId", "threadId", "mailboxIds", "keywords", "size", "receivedAt",
+	"messageId", "inReplyTo", "references", "sender", "from", "to", "cc", "bcc", "replyTo", "subject",
+	"sentAt", "hasAttachment", "preview", "bodyValues", "textBody", "htmlBody", "attachments"}
+
+// Only given when they're asked for
+var extraEmailProperties = []string{"headers", "bodyStructure"}
+
+// The envelope IMAP keeps doesn't say if there was a Sender or Reply-To
+// header, so those need the message too
+var emailContentProperties = []string{"headers", "bodyStructure", "bodyValues", "textBody", "htmlBody",
+	"attachments", "preview", "sender", "replyTo"}
+
+var emailSortProperties = []string{"receivedAt", "sentAt", "size", "from", "to", "subject", "hasKeyword"}
+
+// IMAP's system flags have keywords of their own, other flags are keywords already
+var flagKeywords = map[string]string{
+	imap.SeenFlag:     "$seen",
+	imap.FlaggedFlag:  "$flagged",
+	imap.AnsweredFlag: "$answered",
+	imap.DraftFlag:    "$draft",
+}
+
+const emailColumns = "id, mailboxid, uid, ts, flagsjson, modseq, size, envelopejson, bodystructurejson, " +
+	"referencesjson, messageidhdr, threadid"
+
+/**
+ * The messages in the user's own mailboxes that meet the condition, which
+ * can be followed by an ORDER BY. Their content is only loaded if it's needed.
+ */
+func (c *jmapCall) loadEmails(db models.XODB, withContent bool, condition string, args ...interface{}) ([]*models.Message, error) {
+	columns := emailColumns
+	if withContent {
+		columns += ", content"
+	}
+	rows, e := db.Query("SELECT "+columns+" FROM messages WHERE mailboxid IN (SELECT id FROM mailboxes WHERE userid = ?) AND "+
+		condition, append([]interface{}{c.user.ID}, args...)...)
+	if e != nil {
+		return nil, e
+	}
+	defer rows.Close()
+	var msgs []*models.Message
+	for rows.Next() {
+		msg := &models.Message{}
+		dest := []interface{}{&msg.ID, &msg.Mailboxid, &msg.UID, &msg.Ts, &msg.Flagsjson, &msg.Modseq, &msg.Size,
+			&msg.Envelopejson, &msg.Bodystructurejson, &msg.Referencesjson, &msg.Messageidhdr, &msg.Threadid}
+		if withContent {
+			dest = append(dest, &msg.Content)
+		}
+		e = rows.Scan(dest...)
+		if e != nil {
+			return nil, e
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, rows.Err()
+}
+
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+/**
+ * The user's messages with these JMAP ids, by their id
+ */
+func (c *jmapCall) emailsById(db models.XODB, withContent bool, ids []string) (map[string]*models.Message, error) {
+	var args []interface{}
+	for _, id := range ids {
+		if msgid, ok := parseJmapId("E", c.resolveId(id)); ok {
+			args = append(args, msgid)
+		}
+	}
+	found := map[string]*models.Message{}
+	if len(args) == 0 {
+		return found, nil
+	}
+	msgs, e := c.loadEmails(db, withContent, "id IN ("+placeholders(len(args))+")", args...)
+	if e != nil {
+		return nil, e
+	}
+	for _, msg := range msgs {
+		found[jmapId("E", msg.ID)] = msg
+	}
+	return found, nil
+}
+
+func (c *jmapCall) emailById(db models.XODB, id string) (*models.Message, error) {
+	msgs, e := c.emailsById(db, false, []string{id})
+	if e != nil {
+		return nil, e
+	}
+	msg, ok := msgs[c.resolveId(id)]
+	if !ok {
+		return nil, jmapErr("notFound", "")
+	}
+	return msg, nil
+}
+
+/**
+ * Emails and threads change whenever any of the user's mailboxes do
+ */
+func (c *jmapCall) emailState(db models.XODB) (string, error) {
+	mailboxes, e := c.mailboxes(db)
+	if e != nil {
+		return "", e
+	}
+	return newJmapState(mailboxes).String(), nil
+}
+
+func messageFlags(msg *models.Message) []string {
+	var flags []string
+	_ = json.Unmarshal(msg.Flagsjson, &flags)
+	return flags
+}
+
+func flagsToKeywords(flags []string) map[string]bool {
+	keywords := map[string]bool{}
+	for _, flag := range flags {
+		if keyword, ok := flagKeywords[imap.CanonicalFlag(flag)]; ok {
+			keywords[keyword] = true
+		} else if !strings.HasPrefix(flag, `\`) {
+			keywords[strings.ToLower(flag)] = true
+		}
+	}
+	return keywords
+}
+
+func validKeyword(keyword string) bool {
+	if keyword == "" || len(keyword) > 255 {
+		return false
+	}
+	for _, r := range keyword {
+		if r <= ' ' || r > '~' || strings.ContainsRune(`()]{%*"\`, r) {
+			return false
+		}
+	}
+	return true
+}
+
+/**
+ * The flags for the keywords, keeping any system flags that JMAP doesn't
+ * show, like \Deleted
+ */
+func keywordsToFlags(keywords map[string]bool, existing []string) ([]string, error) {
+	flags := []string{}
+	for _, flag := range existing {
+		if _, ok := flagKeywords[imap.CanonicalFlag(flag)]; !ok && strings.HasPrefix(flag, `\`) {
+			flags = append(flags, flag)
+		}
+	}
+	var sorted []string
+	for keyword, set := range keywords {
+		if !validKeyword(keyword) {
+			return nil, invalidProperties("Invalid keyword "+keyword, "keywords")
+		}
+		if set {
+			sorted = append(sorted, strings.ToLower(keyword))
+		}
+	}
+	sort.Strings(sorted)
+	for _, keyword := range sorted {
+		flag := keyword
+		for f, k := range flagKeywords {
+			if k == keyword {
+				flag = f
+			}
+		}
+		flags = append(flags, flag)
+	}
+	return flags, nil
+}
+
+func sameFlags(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	set := map[string]bool{}
+	for _, flag := range a {
+		set[flag] = true
+	}
+	for _, flag := range b {
+		if !set[flag] {
+			return false
+		}
+	}
+	return true
+}
+
+type emailGetArgs struct {
+	jmapGetArgs
+	BodyProperties      *[]string `json:"bodyProperties"`
+	FetchTextBodyValues bool      `json:"fetchTextBodyValues"`
+	FetchHTMLBodyValues bool      `json:"fetchHTMLBodyValues"`
+	FetchAllBodyValues  bool      `json:"fetchAllBodyValues"`
+	MaxBodyValueBytes   int       `json:"maxBodyValueBytes"`
+}
+
+func emailObject(msg *models.Message, properties []string, args *emailGetArgs, bodyProperties []string) (map[string]interface{}, error) {
+	envelope, e := logic.Envelope(msg)
+	if e != nil {
+		return nil, e
+	}
+	references, e := logic.References(msg)
+	if e != nil {
+		return nil, e
+	}
+	structure, e := logic.BodyStructure(msg)
+	if e != nil {
+		return nil, e
+	}
+	var root *emailBodyPart
+	var header message.Header
+	var bodies *emailBodies
+	if msg.Content != nil {
+		root, header = parseBody(msg.ID, msg.Content)
+		bodies = splitBodies(root)
+	}
+	object := map[string]interface{}{"id": jmapId("E", msg.ID)}
+	for _, property := range properties {
+		var value interface{}
+		switch property {
+		case "id":
+			continue
+		case "blobId":
+			value = jmapId("R", msg.ID)
+		case "threadId":
+			value = jmapId("T", msg.Threadid)
+		case "mailboxIds":
+			value = map[string]bool{jmapId("M", msg.Mailboxid): true}
+		case "keywords":
+			value = flagsToKeywords(messageFlags(msg))
+		case "size":
+			value = msg.Size
+		case "receivedAt":
+			value = utcDate(msg.Ts.Time)
+		case "messageId":
+			value = jmapMessageIds(logic.MessageIds(envelope.MessageId))
+		case "inReplyTo":
+			value = jmapMessageIds(logic.MessageIds(envelope.InReplyTo))
+		case "references":
+			value = jmapMessageIds(references)
+		case "sender":
+			value = headerProperty(header, "header:Sender:asAddresses")
+		case "from":
+			value = envelopeAddresses(envelope.From)
+		case "to":
+			value = envelopeAddresses(envelope.To)
+		case "cc":
+			value = envelopeAddresses(envelope.Cc)
+		case "bcc":
+			value = envelopeAddresses(envelope.Bcc)
+		case "replyTo":
+			value = headerProperty(header, "header:Reply-To:asAddresses")
+		case "subject":
+			value = nullable(decodeWords(envelope.Subject))
+		case "sentAt":
+			value = utcDate(envelope.Date)
+		case "hasAttachment":
+			value = hasAttachment(structure)
+		case "preview":
+			value = bodies.preview()
+		case "headers":
+			value = headerList(header)
+		case "bodyStructure":
+			// It's no structure without the parts
+			structureProperties := bodyProperties
+			if !stringIn("subParts", structureProperties) {
+				structureProperties = append(append([]string{}, bodyProperties...), "subParts")
+			}
+			value = root.object(structureProperties)
+		case "textBody":
+			value = partObjects(bodies.text, bodyProperties)
+		case "htmlBody":
+			value = partObjects(bodies.html, bodyProperties)
+		case "attachments":
+			value = partObjects(bodies.attachments, bodyProperties)
+		case "bodyValues":
+			values := map[string]emailBodyValue{}
+			add := func(parts []*emailBodyPart) {
+				for _, p := range parts {
+					if strings.HasPrefix(p.typ, "text/") {
+						values[p.partId] = p.value(args.MaxBodyValueBytes)
+					}
+				}
+			}
+			if args.FetchAllBodyValues {
+				add(root.leaves())
+			}
+			if args.FetchTextBodyValues {
+				add(bodies.text)
+			}
+			if args.FetchHTMLBodyValues {
+				add(bodies.html)
+			}
+			value = values
+		default:
+			value = headerProperty(header, property)
+		}
+		object[property] = value
+	}
+	return object, nil
+}
+
+func (c *jmapCall) emailGet(raw json.RawMessage) (interface{}, error) {
+	var args emailGetArgs
+	e := parseArgs(raw, &args)
+	if e != nil {
+		return nil, e
+	}
+	e = c.checkAccount(args.AccountId)
+	if e != nil {
+		return nil, e
+	}
+	properties := emailProperties
+	if args.Properties != nil {
+		properties = *args.Properties
+	}
+	withContent := false
+	for _, property := range properties {
+		_, _, _, isHeader := parseHeaderProperty(property)
+		if !isHeader && !stringIn(property, emailProperties) && !stringIn(property, extraEmailProperties) {
+			return nil, jmapErr("invalidArguments", "Unknown property "+property)
+		}
+		withContent = withContent || isHeader || stringIn(property, emailContentProperties)
+	}
+	bodyProperties := defaultBodyPartProperties
+	if args.BodyProperties != nil {
+		bodyProperties, e = checkProperties(args.BodyProperties, bodyPartProperties)
+		if e != nil {
+			return nil, e
+		}
+	}
+	if args.Ids == nil {
+		return nil, jmapErr("requestTooLarge", "Ask for emails by id")
+	}
+	if len(*args.Ids) > jmapMaxObjects {
+		return nil, jmapErr("requestTooLarge", "More than maxObjectsInGet ids")
+	}
+	state, e := c.emailState(c.wa.db)
+	if e != nil {
+		return nil, e
+	}
+	msgs, e := c.emailsById(c.wa.db, withContent, *args.Ids)
+	if e != nil {
+		return nil, e
+	}
+	response := &jmapGetResponse{AccountId: args.AccountId, State: state, List: []interface{}{}, NotFound: []string{}}
+	for _, id := range *args.Ids {
+		msg, ok := msgs[c.resolveId(id)]
+		if !ok {
+			response.NotFound = append(response.NotFound, id)
+			continue
+		}
+		object, e := emailObject(msg, properties, &args, bodyProperties)
+		if e != nil {
+			return nil, e
+		}
+		response.List = append(response.List, object)
+	}
+	return response, nil
+}
+
+/**
+ * The ids of the emails that changed since the state. In each mailbox
+ * that changed, messages with a higher modseq were changed, and those
+ * with a UID past the old uidnext were added. Expunges past the old
+ * uidnext were added and removed since, so they don't count, and a
+ * message that was removed from one mailbox and added to another moved.
+ */
+type emailChangeSet struct {
+	created, updated, destroyed map[int]bool
+}
+
+func (c *jmapCall) emailChangesSince(since string, mailboxes []*models.Mailbox) (*emailChangeSet, error) {
+	old, e := parseJmapState(since)
+	if e != nil {
+		return nil, e
+	}
+	current := newJmapState(mailboxes)
+	for id := range old {
+		if _, ok := current[id]; !ok {
+			return nil, jmapErr("cannotCalculateChanges", "A mailbox has been deleted since")
+		}
+	}
+	changes := &emailChangeSet{map[int]bool{}, map[int]bool{}, map[int]bool{}}
+	for _, m := range mailboxes {
+		position, ok := old[m.ID]
+		if ok && position == current[m.ID] {
+			continue
+		}
+		if ok && position.modseq < m.Prunedmodseq {
+			return nil, jmapErr("cannotCalculateChanges", "Too much has been expunged since")
+		}
+		e = scanIdsAndUids(c.wa.db, func(id, uid int) error {
+			if uid >= position.uidnext {
+				changes.created[id] = true
+			} else {
+				changes.updated[id] = true
+			}
+			return nil
+		}, "SELECT id, uid FROM messages WHERE mailboxid = ? AND modseq > ?", m.ID, position.modseq)
+		if e != nil {
+			return nil, e
+		}
+		e = scanIdsAndUids(c.wa.db, func(id, uid int) error {
+			if uid >= position.uidnext {
+				return nil
+			}
+			if id == 0 {
+				return jmapErr("cannotCalculateChanges", "Messages were expunged before JMAP was supported")
+			}
+			changes.destroyed[id] = true
+			return nil
+		}, "SELECT messageid, uid FROM expunges WHERE mailboxid = ? AND modseq > ?", m.ID, position.modseq)
+		if e != nil {
+			return nil, e
+		}
+	}
+	for id := range changes.destroyed {
+		if changes.created[id] {
+			delete(changes.created, id)
+			changes.updated[id] = true
+		}
+		if changes.updated[id] {
+			delete(changes.destroyed, id)
+		}
+	}
+	return changes, nil
+}
+
+func scanIdsAndUids(db models.XODB, f func(id, uid int) error, query string, args ...interface{}) error {
+	rows, e := db.Query(query, args...)
+	if e != nil {
+		return e
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id, uid int
+		e = rows.Scan(&id, &uid)
+		if e != nil {
+			return e
+		}
+		e = f(id, uid)
+		if e != nil {
+			return e
+		}
+	}
+	return rows.Err()
+}
+
+func sortedIds(prefix string, set map[int]bool) []string {
+	var ints []int
+	for id := range set {
+		ints = append(ints, id)
+	}
+	sort.Ints(ints)
+	ids := []string{}
+	for _, id := range ints {
+		ids = append(ids, jmapId(prefix, id))
+	}
+	return ids
+}
+
+func (c *jmapCall) emailChanges(raw json.RawMessage) (interface{}, error) {
+	var args jmapChangesArgs
+	e := parseArgs(raw, &args)
+	if e != nil {
+		return nil, e
+	}
+	e = c.checkAccount(args.AccountId)
+	if e != nil {
+		return nil, e
+	}
+	mailboxes, e := c.mailboxes(c.wa.db)
+	if e != nil {
+		return nil, e
+	}
+	response := newChangesResponse(&args, newJmapState(mailboxes).String())
+	if args.SinceState == response.NewState {
+		return response, nil
+	}
+	changes, e := c.emailChangesSince(args.SinceState, mailboxes)
+	if e != nil {
+		return nil, e
+	}
+	response.Created = sortedIds("E", changes.created)
+	response.Updated = sortedIds("E", changes.updated)
+	response.Destroyed = sortedIds("E", changes.destroyed)
+	return response, response.checkMax(&args)
+}
+
+/**
+ * An email with what queries look at worked out
+ */
+type queryEmail struct {
+	msg           *models.Message
+	envelope      *imap.Envelope
+	keywords      map[string]bool
+	hasAttachment bool
+}
+
+type emailCondition struct {
+	InMailbox               *string    `json:"inMailbox"`
+	InMailboxOtherThan      []string   `json:"inMailboxOtherThan"`
+	Before                  *time.Time `json:"before"`
+	After                   *time.Time `json:"after"`
+	MinSize                 *int       `json:"minSize"`
+	MaxSize                 *int       `json:"maxSize"`
+	AllInThreadHaveKeyword  *string    `json:"allInThreadHaveKeyword"`
+	SomeInThreadHaveKeyword *string    `json:"someInThreadHaveKeyword"`
+	NoneInThreadHaveKeyword *string    `json:"noneInThreadHaveKeyword"`
+	HasKeyword              *string    `json:"hasKeyword"`
+	NotKeyword              *string    `json:"notKeyword"`
+	HasAttachment           *bool      `json:"hasAttachment"`
+	Text                    *string    `json:"text"`
+	From                    *string    `json:"from"`
+	To                      *string    `json:"to"`
+	Cc                      *string    `json:"cc"`
+	Bcc                     *string    `json:"bcc"`
+	Subject                 *string    `json:"subject"`
+	Body                    *string    `json:"body"`
+	Header                  []string   `json:"header"`
+}
+
+/**
+ * What the conditions of a query need to know about all the user's emails
+ */
+type emailQueryContext struct {
+	c         *jmapCall
+	mailboxes []*models.Mailbox
+	threads   map[int][]*queryEmail
+}
+
+/**
+ * The ids of the messages the search index finds, or nil if the text
+ * has no words to look for, so matches everything
+ */
+func (q *emailQueryContext) search(column, text string) (map[int]bool, error) {
+	query := &logic.SearchQuery{}
+	if !query.Add(column, text) {
+		return nil, nil
+	}
+	found := map[int]bool{}
+	for _, m := range q.mailboxes {
+		ids, e := logic.SearchIndex(q.c.wa.db, m.ID, query)
+		if e != nil {
+			return nil, e
+		}
+		for id := range ids {
+			found[id] = true
+		}
+	}
+	return found, nil
+}
+
+/**
+ * Whether all, or otherwise any, of the emails in the thread have the keyword
+ */
+func (q *emailQueryContext) threadKeyword(email *queryEmail, keyword string, all bool) bool {
+	for _, other := range q.threads[email.msg.Threadid] {
+		if other.keywords[keyword] != all {
+			return !all
+		}
+	}
+	return all
+}
+
+func (q *emailQueryContext) condition(raw json.RawMessage) (jmapPredicate, error) {
+	var condition emailCondition
+	e := parseArgs(raw, &condition)
+	if e != nil {
+		return nil, jmapErr("unsupportedFilter", e.(*jmapError).Description)
+	}
+	if condition.Header != nil {
+		return nil, jmapErr("unsupportedFilter", "Can't filter on headers")
+	}
+	inMailbox := -1
+	if condition.InMailbox != nil {
+		if id, ok := parseJmapId("M", q.c.resolveId(*condition.InMailbox)); ok {
+			inMailbox = id
+		} else {
+			inMailbox = 0
+		}
+	}
+	notIn := map[int]bool{}
+	for _, mailbox := range condition.InMailboxOtherThan {
+		if id, ok := parseJmapId("M", q.c.resolveId(mailbox)); ok {
+			notIn[id] = true
+		}
+	}
+	var matches []map[int]bool
+	for _, text := range []struct {
+		column string
+		value  *string
+	}{
+		{logic.SearchAny, condition.Text},
+		{logic.SearchFrom, condition.From},
+		{logic.SearchTo, condition.To},
+		{logic.SearchCc, condition.Cc},
+		{logic.SearchBcc, condition.Bcc},
+		{logic.SearchSubject, condition.Subject},
+		{logic.SearchBody, condition.Body},
+	} {
+		if text.value == nil {
+			continue
+		}
+		found, e := q.search(text.column, *text.value)
+		if e != nil {
+			return nil, e
+		}
+		if found != nil {
+			matches = append(matches, found)
+		}
+	}
+	keyword := func(k *string) string {
+		return strings.ToLower(*k)
+	}
+	return func(v interface{}) bool {
+		email := v.(*queryEmail)
+		msg := email.msg
+		switch {
+		case inMailbox >= 0 && msg.Mailboxid != inMailbox,
+			notIn[msg.Mailboxid],
+			condition.Before != nil && !msg.Ts.Time.Before(*condition.Before),
+			condition.After != nil && msg.Ts.Time.Before(*condition.After),
+			condition.MinSize != nil && msg.Size < *condition.MinSize,
+			condition.MaxSize != nil && msg.Size >= *condition.MaxSize,
+			condition.HasKeyword != nil && !email.keywords[keyword(condition.HasKeyword)],
+			condition.NotKeyword != nil && email.keywords[keyword(condition.NotKeyword)],
+			condition.AllInThreadHaveKeyword != nil && !q.threadKeyword(email, keyword(condition.AllInThreadHaveKeyword), true),
+			condition.SomeInThreadHaveKeyword != nil && !q.threadKeyword(email, keyword(condition.SomeInThreadHaveKeyword), false),
+			condition.NoneInThreadHaveKeyword != nil && q.threadKeyword(email, keyword(condition.NoneInThreadHaveKeyword), false),
+			condition.HasAttachment != nil && email.hasAttachment != *condition.HasAttachment:
+			return false
+		}
+		for _, found := range matches {
+			if !found[msg.ID] {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+/**
+ * The name, or if there isn't one the address, of the first of the addresses
+ */
+func addressSortKey(list []*imap.Address) string {
+	for _, a := range list {
+		if a.HostName == "" {
+			continue
+		}
+		if name := decodeWords(a.PersonalName); name != "" {
+			return strings.ToLower(name)
+		}
+		return strings.ToLower(a.MailboxName + "@" + a.HostName)
+	}
+	return ""
+}
+
+/**
+ * Less than zero if a sorts before b when ascending
+ */
+func compareEmails(a, b *queryEmail, comparator jmapComparator) int {
+	compareStrings := func(x, y string) int {
+		return strings.Compare(x, y)
+	}
+	compareTimes := func(x, y time.Time) int {
+		switch {
+		case x.Before(y):
+			return -1
+		case y.Before(x):
+			return 1
+		}
+		return 0
+	}
+	switch comparator.Property {
+	case "receivedAt":
+		return compareTimes(a.msg.Ts.Time, b.msg.Ts.Time)
+	case "sentAt":
+		return compareTimes(a.envelope.Date, b.envelope.Date)
+	case "size":
+		return a.msg.Size - b.msg.Size
+	case "from":
+		return compareStrings(addressSortKey(a.envelope.From), addressSortKey(b.envelope.From))
+	case "to":
+		return compareStrings(addressSortKey(a.envelope.To), addressSortKey(b.envelope.To))
+	case "subject":
+		subjectA, _ := logic.BaseSubject(a.envelope.Subject)
+		subjectB, _ := logic.BaseSubject(b.envelope.Subject)
+		return compareStrings(subjectA, subjectB)
+	case "hasKeyword":
+		keyword := strings.ToLower(comparator.Keyword)
+		switch {
+		case a.keywords[keyword] == b.keywords[keyword]:
+			return 0
+		case b.keywords[keyword]:
+			return -1
+		}
+		return 1
+	}
+	return 0
+}
+
+/**
+ * All the user's messages are looked at, so there's no need to be
+ * clever about working out which ones to load
+ */
+func (c *jmapCall) emailQuery(raw json.RawMessage) (interface{}, error) {
+	var args struct {
+		jmapQueryArgs
+		CollapseThreads bool `json:"collapseThreads"`
+	}
+	e := parseArgs(raw, &args)
+	if e != nil {
+		return nil, e
+	}
+	e = c.checkAccount(args.AccountId)
+	if e != nil {
+		return nil, e
+	}
+	sorting := args.Sort
+	if len(sorting) == 0 {
+		descending := false
+		sorting = []jmapComparator{{Property: "receivedAt", IsAscending: &descending}}
+	}
+	for _, comparator := range sorting {
+		if !stringIn(comparator.Property, emailSortProperties) {
+			return nil, jmapErr("unsupportedSort", "Can't sort on "+comparator.Property)
+		}
+		if comparator.Property == "hasKeyword" && comparator.Keyword == "" {
+			return nil, jmapErr("unsupportedSort", "hasKeyword needs a keyword")
+		}
+	}
+	mailboxes, e := c.mailboxes(c.wa.db)
+	if e != nil {
+		return nil, e
+	}
+	msgs, e := c.loadEmails(c.wa.db, false, "1 = 1")
+	if e != nil {
+		return nil, e
+	}
+	context := &emailQueryContext{c: c, mailboxes: mailboxes, threads: map[int][]*queryEmail{}}
+	var emails []*queryEmail
+	for _, msg := range msgs {
+		envelope, e := logic.Envelope(msg)
+		if e != nil {
+			return nil, e
+		}
+		structure, e := logic.BodyStructure(msg)
+		if e != nil {
+			return nil, e
+		}
+		email := &queryEmail{
+			msg:           msg,
+			envelope:      envelope,
+			keywords:      flagsToKeywords(messageFlags(msg)),
+			hasAttachment: hasAttachment(structure),
+		}
+		emails = append(emails, email)
+		context.threads[msg.Threadid] = append(context.threads[msg.Threadid], email)
+	}
+	match, e := compileFilter(args.Filter, context.condition)
+	if e != nil {
+		return nil, e
+	}
+	var matched []*queryEmail
+	for _, email := range emails {
+		if match(email) {
+			matched = append(matched, email)
+		}
+	}
+	sort.SliceStable(matched, func(i, j int) bool {
+		for _, comparator := range sorting {
+			if n := compareEmails(matched[i], matched[j], comparator); n != 0 {
+				return (n < 0) == comparator.ascending()
+			}
+		}
+		return matched[i].msg.ID > matched[j].msg.ID
+	})
+	ids := []string{}
+	seenThreads := map[int]bool{}
+	for _, email := range matched {
+		if args.CollapseThreads {
+			if seenThreads[email.msg.Threadid] {
+				continue
+			}
+			seenThreads[email.msg.Threadid] = true
+		}
+		ids = append(ids, jmapId("E", email.msg.ID))
+	}
+	return queryPage(&args.jmapQueryArgs, ids, newJmapState(mailboxes).String())
+}
+
+type emailPartCreate struct {
+	PartId      *string         `json:"partId"`
+	BlobId      *string         `json:"blobId"`
+	Size        *int            `json:"size"`
+	Headers     json.RawMessage `json:"headers"`
+	Name        *string         `json:"name"`
+	Type        *string         `json:"type"`
+	Charset     *string         `json:"charset"`
+	Disposition *string         `json:"disposition"`
+	Cid         *string         `json:"cid"`
+	Language    json.RawMessage `json:"language"`
+	Location    *string         `json:"location"`
+}
+
+type emailCreate struct {
+	MailboxIds  map[string]bool           `json:"mailboxIds"`
+	Keywords    map[string]bool           `json:"keywords"`
+	ReceivedAt  *time.Time                `json:"receivedAt"`
+	MessageId   []string                  `json:"messageId"`
+	InReplyTo   []string                  `json:"inReplyTo"`
+	References  []string                  `json:"references"`
+	Sender      []emailAddress            `json:"sender"`
+	From        []emailAddress            `json:"from"`
+	To          []emailAddress            `json:"to"`
+	Cc          []emailAddress            `json:"cc"`
+	Bcc         []emailAddress            `json:"bcc"`
+	ReplyTo     []emailAddress            `json:"replyTo"`
+	Subject     *string                   `json:"subject"`
+	SentAt      *time.Time                `json:"sentAt"`
+	BodyValues  map[string]emailBodyValue `json:"bodyValues"`
+	TextBody    []emailPartCreate         `json:"textBody"`
+	HtmlBody    []emailPartCreate         `json:"htmlBody"`
+	Attachments []emailPartCreate         `json:"attachments"`
+}
+
+func mailAddresses(list []emailAddress) []*mail.Address {
+	var addresses []*mail.Address
+	for _, a := range list {
+		address := &mail.Address{Address: a.Email}
+		if a.Name != nil {
+			address.Name = *a.Name
+		}
+		addresses = append(addresses, address)
+	}
+	return addresses
+}
+
+func angleBracketed(ids []string) string {
+	var bracketed []string
+	for _, id := range ids {
+		bracketed = append(bracketed, "<"+id+">")
+	}
+	return strings.Join(bracketed, " ")
+}
+
+/**
+ * The text of the single text or HTML body, from the body values
+ */
+func (create *emailCreate) bodyText(parts []emailPartCreate, typ, property string) (string, error) {
+	if len(parts) == 0 {
+		return "", nil
+	}
+	if len(parts) > 1 || parts[0].PartId == nil || (parts[0].Type != nil && *parts[0].Type != typ) {
+		return "", invalidProperties("There must be one "+typ+" part, with a body value", property)
+	}
+	value, ok := create.BodyValues[*parts[0].PartId]
+	if !ok {
+		return "", invalidProperties("No body value for part "+*parts[0].PartId, property)
+	}
+	return value.Value, nil
+}
+
+/**
+ * Only emails made of a text body, an HTML body and attachments can be
+ * created, not any body structure
+ */
+func (c *jmapCall) composeEmail(create *emailCreate) ([]byte, error) {
+	m := &composedEmail{}
+	for _, addresses := range []struct {
+		key  string
+		list []emailAddress
+	}{
+		{"Sender", create.Sender}, {"From", create.From}, {"To", create.To},
+		{"Cc", create.Cc}, {"Bcc", create.Bcc}, {"Reply-To", create.ReplyTo},
+	} {
+		if len(addresses.list) > 0 {
+			m.header.SetAddressList(addresses.key, mailAddresses(addresses.list))
+		}
+	}
+	if create.Subject != nil {
+		m.header.SetSubject(*create.Subject)
+	}
+	if create.SentAt != nil {
+		m.header.SetDate(*create.SentAt)
+	}
+	if len(create.MessageId) > 1 {
+		return nil, invalidProperties("Emails have one message id", "messageId")
+	} else if len(create.MessageId) == 1 {
+		m.header.Set("Message-Id", angleBracketed(create.MessageId))
+	}
+	if len(create.InReplyTo) > 0 {
+		m.header.Set("In-Reply-To", angleBracketed(create.InReplyTo))
+	}
+	if len(create.References) > 0 {
+		m.header.Set("References", angleBracketed(create.References))
+	}
+	var e error
+	m.text, e = create.bodyText(create.TextBody, "text/plain", "textBody")
+	if e != nil {
+		return nil, e
+	}
+	m.html, e = create.bodyText(create.HtmlBody, "text/html", "htmlBody")
+	if e != nil {
+		return nil, e
+	}
+	if m.text == "" && m.html != "" {
+		m.text = htmlText(m.html)
+	}
+	for _, part := range create.Attachments {
+		if part.BlobId == nil {
+			return nil, invalidProperties("Attachments must be uploaded first", "attachments")
+		}
+		blob, e := c.wa.blob(c.wa.db, c.user, *part.BlobId)
+		if e == sql.ErrNoRows {
+			return nil, jmapErr("blobNotFound", *part.BlobId)
+		} else if e != nil {
+			return nil, e
+		}
+		a := composedAttachment{typ: blob.typ, content: blob.content}
+		if part.Type != nil {
+			a.typ = *part.Type
+		}
+		if part.Name != nil {
+			a.name = *part.Name
+		}
+		if part.Cid != nil {
+			a.cid = *part.Cid
+		}
+		m.attachments = append(m.attachments, a)
+	}
+	return m.bytes()
+}
+
+/**
+ * Saves a new message in the one mailbox it's meant to be in
+ */
+func (c *jmapCall) saveEmail(content []byte, mailboxIds, keywords map[string]bool, receivedAt time.Time) (map[string]interface{}, error) {
+	var mailboxId string
+	for id, in := range mailboxIds {
+		if in {
+			if mailboxId != "" {
+				return nil, invalidProperties("Emails can only be in one mailbox", "mailboxIds")
+			}
+			mailboxId = id
+		}
+	}
+	if mailboxId == "" {
+		return nil, invalidProperties("Emails must be in a mailbox", "mailboxIds")
+	}
+	flags, e := keywordsToFlags(keywords, nil)
+	if e != nil {
+		return nil, e
+	}
+	flagsJson, e := json.Marshal(flags)
+	if e != nil {
+		return nil, e
+	}
+	msg := &models.Message{Ts: xoutil.SqTime{Time: receivedAt}, Flagsjson: flagsJson, Content: content}
+	var mailbox *models.Mailbox
+	e = database.Transact(c.wa.db, func(tx *sql.Tx) error {
+		mailbox, e = c.mailbox(tx, mailboxId)
+		if e == sql.ErrNoRows || (e == nil && mailbox.Noselect) {
+			return invalidProperties("No such mailbox", "mailboxIds")
+		} else if e != nil {
+			return e
+		}
+		e = logic.SaveMessages(tx, mailbox, msg)
+		if e == logic.ErrOverQuota || e == logic.ErrMessageExceedsQuota {
+			return jmapErr("overQuota", e.Error())
+		}
+		return e
+	})
+	if e != nil {
+		return nil, e
+	}
+	events.Publish(events.Event{Type: events.Exists, Userid: mailbox.Userid, Mailboxid: mailbox.ID})
+	return map[string]interface{}{
+		"id":       jmapId("E", msg.ID),
+		"blobId":   jmapId("R", msg.ID),
+		"threadId": jmapId("T", msg.Threadid),
+		"size":     msg.Size,
+	}, nil
+}
+
+func (c *jmapCall) createEmail(raw json.RawMessage) (map[string]interface{}, error) {
+	var create emailCreate
+	e := parseArgs(raw, &create)
+	if e != nil {
+		return nil, invalidProperties(e.(*jmapError).Description)
+	}
+	content, e := c.composeEmail(&create)
+	if e != nil {
+		return nil, e
+	}
+	receivedAt := time.Now()
+	if create.ReceivedAt != nil {
+		receivedAt = *create.ReceivedAt
+	}
+	return c.saveEmail(content, create.MailboxIds, create.Keywords, receivedAt)
+}
+
+/**
+ * Patches set the whole of a property, or one key of it
+ */
+func patchSet(set map[string]bool, property, key string, value json.RawMessage) (map[string]bool, error) {
+	if key == property {
+		var replaced map[string]bool
+		if json.Unmarshal(value, &replaced) != nil {
+			return nil, invalidProperties(property+" must be an object", property)
+		}
+		return replaced, nil
+	}
+	var on *bool
+	if json.Unmarshal(value, &on) != nil || (on != nil && !*on) {
+		return nil, invalidProperties(key+" must be true or null", property)
+	}
+	item := strings.Replace(strings.Replace(key[len(property)+1:], "~1", "/", -1), "~0", "~", -1)
+	if on != nil {
+		set[item] = true
+	} else {
+		delete(set, item)
+	}
+	return set, nil
+}
+
+func (c *jmapCall) updateEmail(id string, raw json.RawMessage) error {
+	var patch map[string]json.RawMessage
+	if json.Unmarshal(raw, &patch) != nil {
+		return invalidProperties("Patches must be objects")
+	}
+	var published []events.Event
+	e := database.Transact(c.wa.db, func(tx *sql.Tx) error {
+		msg, e := c.emailById(tx, id)
+		if e != nil {
+			return e
+		}
+		flags := messageFlags(msg)
+		keywords := flagsToKeywords(flags)
+		mailboxIds := map[string]bool{jmapId("M", msg.Mailboxid): true}
+		var keys []string
+		for key := range patch {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			switch {
+			case key == "keywords" || strings.HasPrefix(key, "keywords/"):
+				keywords, e = patchSet(keywords, "keywords", key, patch[key])
+			case key == "mailboxIds" || strings.HasPrefix(key, "mailboxIds/"):
+				mailboxIds, e = patchSet(mailboxIds, "mailboxIds", key, patch[key])
+			default:
+				e = invalidProperties("Only keywords and mailboxIds can be changed", key)
+			}
+			if e != nil {
+				return e
+			}
+		}
+
+		mailbox, e := models.MailboxByID(tx, msg.Mailboxid)
+		if e != nil {
+			return e
+		}
+		newFlags, e := keywordsToFlags(keywords, flags)
+		if e != nil {
+			return e
+		}
+		if !sameFlags(flags, newFlags) {
+			msg.Flagsjson, e = json.Marshal(newFlags)
+			if e != nil {
+				return e
+			}
+			msg.Modseq = logic.NextModseq(mailbox)
+			_, e = tx.Exec("UPDATE messages SET flagsjson = ?, modseq = ? WHERE id = ?", msg.Flagsjson, msg.Modseq, msg.ID)
+			if e != nil {
+				return e
+			}
+			e = mailbox.Save(tx)
+			if e != nil {
+				return e
+			}
+			published = append(published, events.Event{Type: events.Flags, Userid: mailbox.Userid, Mailboxid: mailbox.ID,
+				UID: msg.UID, Flags: newFlags, Modseq: msg.Modseq})
+		}
+
+		var targets []string
+		for mailboxId, in := range mailboxIds {
+			if in {
+				targets = append(targets, mailboxId)
+			}
+		}
+		if len(targets) != 1 {
+			return invalidProperties("Emails must be in one mailbox", "mailboxIds")
+		}
+		dest, e := c.mailbox(tx, targets[0])
+		if e == sql.ErrNoRows || (e == nil && dest.Noselect) {
+			return invalidProperties("No such mailbox", "mailboxIds")
+		} else if e != nil {
+			return e
+		}
+		if dest.ID != mailbox.ID {
+			uid := msg.UID
+			e = logic.MoveMessages(tx, mailbox, dest, msg)
+			if e != nil {
+				return e
+			}
+			published = append(published,
+				events.Event{Type: events.Expunge, Userid: mailbox.Userid, Mailboxid: mailbox.ID, UID: uid},
+				events.Event{Type: events.Exists, Userid: dest.Userid, Mailboxid: dest.ID})
+		}
+		return nil
+	})
+	if e != nil {
+		return e
+	}
+	events.Publish(published...)
+	return nil
+}
+
+func (c *jmapCall) destroyEmail(id string) error {
+	var expunged events.Event
+	e := database.Transact(c.wa.db, func(tx *sql.Tx) error {
+		msg, e := c.emailById(tx, id)
+		if e != nil {
+			return e
+		}
+		mailbox, e := models.MailboxByID(tx, msg.Mailboxid)
+		if e != nil {
+			return e
+		}
+		expunged = events.Event{Type: events.Expunge, Userid: mailbox.Userid, Mailboxid: mailbox.ID, UID: msg.UID}
+		return logic.ExpungeMessages(tx, mailbox, msg)
+	})
+	if e != nil {
+		return e
+	}
+	events.Publish(expunged)
+	return nil
+}
+
+func (c *jmapCall) emailSet(raw json.RawMessage) (interface{}, error) {
+	var args jmapSetArgs
+	e := parseArgs(raw, &args)
+	if e != nil {
+		return nil, e
+	}
+	e = c.checkAccount(args.AccountId)
+	if e != nil {
+		return nil, e
+	}
+	oldState, e := c.emailState(c.wa.db)
+	if e != nil {
+		return nil, e
+	}
+	e = args.check(oldState)
+	if e != nil {
+		return nil, e
+	}
+	response := &jmapSetResponse{AccountId: args.AccountId, OldState: oldState}
+
+	var creationIds []string
+	for id := range args.Create {
+		creationIds = append(creationIds, id)
+	}
+	sort.Strings(creationIds)
+	for _, id := range creationIds {
+		object, e := c.createEmail(args.Create[id])
+		if e == nil {
+			response.created(c, id, object["id"].(string), object)
+		} else if e = response.failed(&response.NotCreated, id, e); e != nil {
+			return nil, e
+		}
+	}
+
+	for id, patch := range args.Update {
+		e := c.updateEmail(id, patch)
+		if e == nil {
+			response.updated(id)
+		} else if e = response.failed(&response.NotUpdated, id, e); e != nil {
+			return nil, e
+		}
+	}
+
+	for _, id := range args.Destroy {
+		e := c.destroyEmail(id)
+		if e == nil {
+			response.Destroyed = append(response.Destroyed, id)
+		} else if e = response.failed(&response.NotDestroyed, id, e); e != nil {
+			return nil, e
+		}
+	}
+	response.NewState, e = c.emailState(c.wa.db)
+	return response, e
+}
+
+type emailImportResponse struct {
+	AccountId  string                 `json:"accountId"`
+	OldState   string                 `json:"oldState"`
+	NewState   string                 `json:"newState"`
+	Created    map[string]interface{} `json:"created"`
+	NotCreated map[string]*jmapError  `json:"notCreated"`
+}
+
+func (c *jmapCall) emailImport(raw json.RawMessage) (interface{}, error) {
+	var args struct {
+		AccountId string                     `json:"accountId"`
+		IfInState *string                    `json:"ifInState"`
+		Emails    map[string]json.RawMessage `json:"emails"`
+	}
+	e := parseArgs(raw, &args)
+	if e != nil {
+		return nil, e
+	}
+	e = c.checkAccount(args.AccountId)
+	if e != nil {
+		return nil, e
+	}
+	oldState, e := c.emailState(c.wa.db)
+	if e != nil {
+		return nil, e
+	}
+	e = (&jmapSetArgs{IfInState: args.IfInState}).check(oldState)
+	if e != nil {
+		return nil, e
+	}
+	if len(args.Emails) > jmapMaxObjects {
+		return nil, jmapErr("requestTooLarge", "More than maxObjectsInSet emails")
+	}
+	response := &emailImportResponse{AccountId: args.AccountId, OldState: oldState}
+	var creationIds []string
+	for id := range args.Emails {
+		creationIds = append(creationIds, id)
+	}
+	sort.Strings(creationIds)
+	for _, id := range creationIds {
+		object, e := c.importEmail(args.Emails[id])
+		if e == nil {
+			if response.Created == nil {
+				response.Created = map[string]interface{}{}
+			}
+			response.Created[id] = object
+			c.created[id] = object["id"].(string)
+			continue
+		}
+		jerr, ok := e.(*jmapError)
+		if !ok {
+			return nil, e
+		}
+		if response.NotCreated == nil {
+			response.NotCreated = map[string]*jmapError{}
+		}
+		response.NotCreated[id] = jerr
+	}
+	response.NewState, e = c.emailState(c.wa.db)
+	return response, e
+}
+
+func (c *jmapCall) importEmail(raw json.RawMessage) (map[string]interface{}, error) {
+	var props struct {
+		BlobId     string          `json:"blobId"`
+		MailboxIds map[string]bool `json:"mailboxIds"`
+		Keywords   map[string]bool `json:"keywords"`
+		ReceivedAt *time.Time      `json:"receivedAt"`
+	}
+	e := parseArgs(raw, &props)
+	if e != nil {
+		return nil, invalidProperties(e.(*jmapError).Description)
+	}
+	blob, e := c.wa.blob(c.wa.db, c.user, c.resolveId(props.BlobId))
+	if e == sql.ErrNoRows {
+		return nil, jmapErr("blobNotFound", props.BlobId)
+	} else if e != nil {
+		return nil, e
+	}
+	if _, e := message.Read(bytes.NewReader(blob.content)); e != nil && !message.IsUnknownCharset(e) {
+		return nil, jmapErr("invalidEmail", e.Error())
+	}
+	receivedAt := time.Now()
+	if props.ReceivedAt != nil {
+		receivedAt = *props.ReceivedAt
+	}
+	return c.saveEmail(blob.content, props.MailboxIds, props.Keywords, receivedAt)
+}
+
+/**
+ * Search snippets, see RFC 8621 section 5. Words found by the search are
+ * marked in the subject, and in a piece of the text around the first one.
+ */
+
+var wordPattern = regexp.MustCompile(`[\pL\pN]+`)
+
+const snippetChars = 200
+
+/**
+ * The words the filter looks for, leaving out those it looks for
+ * messages without
+ */
+func filterWords(raw json.RawMessage, words *[]string) {
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(raw, &fields) != nil {
+		return
+	}
+	if operator, ok := fields["operator"]; ok {
+		var conditions []json.RawMessage
+		if string(operator) == `"NOT"` || json.Unmarshal(fields["conditions"], &conditions) != nil {
+			return
+		}
+		for _, condition := range conditions {
+			filterWords(condition, words)
+		}
+		return
+	}
+	for _, key := range []string{"text", "subject", "body"} {
+		var text string
+		if json.Unmarshal(fields[key], &text) == nil {
+			for _, word := range wordPattern.FindAllString(text, -1) {
+				*words = append(*words, strings.ToLower(word))
+			}
+		}
+	}
+}
+
+func matchesWord(word string, words []string) bool {
+	word = strings.ToLower(word)
+	for _, w := range words {
+		if strings.HasPrefix(word, w) {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+ * The text as HTML, with the words marked, or null if none were found
+ */
+func highlight(text string, words []string) interface{} {
+	var b strings.Builder
+	last := 0
+	for _, loc := range wordPattern.FindAllStringIndex(text, -1) {
+		if matchesWord(text[loc[0]:loc[1]], words) {
+			b.WriteString(html.EscapeString(text[last:loc[0]]))
+			b.WriteString("<mark>" + html.EscapeString(text[loc[0]:loc[1]]) + "</mark>")
+			last = loc[1]
+		}
+	}
+	if last == 0 {
+		return nil
+	}
+	b.WriteString(html.EscapeString(text[last:]))
+	return b.String()
+}
+
+func excerpt(text string, words []string) interface{} {
+	for _, loc := range wordPattern.FindAllStringIndex(text, -1) {
+		if !matchesWord(text[loc[0]:loc[1]], words) {
+			continue
+		}
+		runes := []rune(text)
+		start := utf8.RuneCountInString(text[:loc[0]]) - snippetChars/4
+		if start < 0 {
+			start = 0
+		}
+		end := start + snippetChars
+		if end > len(runes) {
+			end = len(runes)
+		}
+		return highlight(string(runes[start:end]), words)
+	}
+	return nil
+}
+
+func (c *jmapCall) searchSnippetGet(raw json.RawMessage) (interface{}, error) {
+	var args struct {
+		AccountId string          `json:"accountId"`
+		Filter    json.RawMessage `json:"filter"`
+		EmailIds  []string        `json:"emailIds"`
+	}
+	e := parseArgs(raw, &args)
+	if e != nil {
+		return nil, e
+	}
+	e = c.checkAccount(args.AccountId)
+	if e != nil {
+		return nil, e
+	}
+	if len(args.EmailIds) > jmapMaxObjects {
+		return nil, jmapErr("requestTooLarge", "More than maxObjectsInGet ids")
+	}
+	var words []string
+	filterWords(args.Filter, &words)
+	msgs, e := c.emailsById(c.wa.db, len(words) > 0, args.EmailIds)
+	if e != nil {
+		return nil, e
+	}
+	list := []interface{}{}
+	notFound := []string{}
+	for _, id := range args.EmailIds {
+		msg, ok := msgs[c.resolveId(id)]
+		if !ok {
+			notFound = append(notFound, id)
+			continue
+		}
+		snippet := map[string]interface{}{"emailId": id, "subject": nil, "preview": nil}
+		if len(words) > 0 {
+			envelope, e := logic.Envelope(msg)
+			if e != nil {
+				return nil, e
+			}
+			root, _ := parseBody(msg.ID, msg.Content)
+			snippet["subject"] = highlight(decodeWords(envelope.Subject), words)
+			snippet["preview"] = excerpt(splitBodies(root).plainText(), words)
+		}
+		list = append(list, snippet)
+	}
+	return map[string]interface{}{
+		"accountId": args.AccountId,
+		"filter":    args.Filter,
+		"list":      list,
+		"notFound":  notFound,
+	}, nil
+}
@@ -0,0 +1,80 @@
+package web
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestFlagsToKeywords(t *testing.T) {
+	got := flagsToKeywords([]string{`\Seen`, `\flagged`, `\Deleted`, `\Recent`, "Work", "$Junk"})
+	expected := map[string]bool{"$seen": true, "$flagged": true, "work": true, "$junk": true}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("got %v, expected %v", got, expected)
+	}
+	if got := flagsToKeywords(nil); len(got) != 0 {
+		t.Errorf("expected no keywords, got %v", got)
+	}
+}
+
+func TestKeywordsToFlags(t *testing.T) {
+	tests := []struct {
+		keywords map[string]bool
+		existing []string
+		expected []string // Nil if it should fail
+	}{
+		{map[string]bool{}, nil, []string{}},
+		{map[string]bool{"$seen": true, "$Answered": true, "$draft": true},
+			nil, []string{`\Answered`, `\Draft`, `\Seen`}},
+		// System flags JMAP doesn't show are kept, the others are replaced
+		{map[string]bool{"$flagged": true}, []string{`\Deleted`, `\Seen`, "old"}, []string{`\Deleted`, `\Flagged`}},
+		{map[string]bool{"Work": true, "$seen": false}, nil, []string{"work"}},
+		{map[string]bool{"two words": true}, nil, nil},
+		{map[string]bool{"(paren": true}, nil, nil},
+		{map[string]bool{"": true}, nil, nil},
+	}
+	for _, test := range tests {
+		got, e := keywordsToFlags(test.keywords, test.existing)
+		if test.expected == nil {
+			if err, ok := e.(*jmapError); !ok || err.Type != "invalidProperties" {
+				t.Errorf("keywordsToFlags(%v) should have failed, got %v %v", test.keywords, got, e)
+			}
+		} else if e != nil || !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("keywordsToFlags(%v, %v) = %v %v, expected %v", test.keywords, test.existing, got, e, test.expected)
+		}
+	}
+
+	// Back again
+	flags, _ := keywordsToFlags(map[string]bool{"$seen": true, "todo": true}, nil)
+	if keywords := flagsToKeywords(flags); !reflect.DeepEqual(keywords, map[string]bool{"$seen": true, "todo": true}) {
+		t.Errorf("keywords didn't survive being flags: %v", keywords)
+	}
+}
+
+func TestPatchSet(t *testing.T) {
+	tests := []struct {
+		key      string
+		value    string
+		expected map[string]bool // Nil if it should fail
+	}{
+		{"keywords", `{"$seen":true,"todo":true}`, map[string]bool{"$seen": true, "todo": true}},
+		{"keywords", `{}`, map[string]bool{}},
+		{"keywords", `["$seen"]`, nil},
+		{"keywords/$flagged", `true`, map[string]bool{"$draft": true, "$flagged": true}},
+		{"keywords/$draft", `null`, map[string]bool{}},
+		{"keywords/$seen", `null`, map[string]bool{"$draft": true}},
+		{"keywords/a~1b~0c", `true`, map[string]bool{"$draft": true, "a/b~c": true}},
+		{"keywords/$flagged", `false`, nil},
+		{"keywords/$flagged", `"yes"`, nil},
+	}
+	for _, test := range tests {
+		got, e := patchSet(map[string]bool{"$draft": true}, "keywords", test.key, json.RawMessage(test.value))
+		if test.expected == nil {
+			if err, ok := e.(*jmapError); !ok || err.Type != "invalidProperties" {
+				t.Errorf("patchSet(%v: %v) should have failed, got %v %v", test.key, test.value, got, e)
+			}
+		} else if e != nil || !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("patchSet(%v: %v) = %v %v, expected %v", test.key, test.value, got, e, test.expected)
+		}
+	}
+}
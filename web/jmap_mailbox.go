@@ -0,0 +1,694 @@
+package web
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/emersion/go-imap"
+	"hash/fnv"
+	"henrymail/database"
+	"henrymail/logic"
+	"henrymail/models"
+	"sort"
+	"strings"
+)
+
+/**
+ * Mailboxes, see RFC 8621 section 2. Mailbox names are paths in IMAP,
+ * here each has a name and a parent.
+ */
+
+var mailboxProperties = []string{"id", "name", "parentId", "role", "sortOrder", "totalEmails", "unreadEmails",
+	"totalThreads", "unreadThreads", "myRights", "isSubscribed"}
+
+// Which properties change when messages do
+var mailboxCountProperties = []string{"totalEmails", "unreadEmails", "totalThreads", "unreadThreads"}
+
+const seenPattern = `%"\\Seen"%`
+
+/**
+ * The user's own mailboxes. Those shared with them aren't included, see jmap.go.
+ */
+func (c *jmapCall) mailboxes(db models.XODB) ([]*models.Mailbox, error) {
+	mailboxes, e := models.MailboxesByUserid(db, c.user.ID)
+	if e != nil {
+		return nil, e
+	}
+	sort.Slice(mailboxes, func(i, j int) bool { return mailboxes[i].ID < mailboxes[j].ID })
+	return mailboxes, nil
+}
+
+/**
+ * Finds one of the user's mailboxes by its JMAP id. Mailboxes belonging
+ * to someone else aren't found, even if they've been shared.
+ */
+func (c *jmapCall) mailbox(db models.XODB, id string) (*models.Mailbox, error) {
+	mailboxid, ok := parseJmapId("M", c.resolveId(id))
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	mailbox, e := models.MailboxByID(db, mailboxid)
+	if e == nil && mailbox.Userid != c.user.ID {
+		return nil, sql.ErrNoRows
+	}
+	return mailbox, e
+}
+
+/**
+ * Mailboxes change when their messages do, since they're counted, as
+ * well as when they're renamed and so on
+ */
+func mailboxState(mailboxes []*models.Mailbox) string {
+	h := fnv.New32a()
+	for _, m := range mailboxes {
+		fmt.Fprintf(h, "%d %v %v %v %v\n", m.ID, m.Name, m.Specialuse, m.Subscribed, m.Noselect)
+	}
+	return fmt.Sprintf("%vh%x", newJmapState(mailboxes), h.Sum32())
+}
+
+func (c *jmapCall) mailboxState() (string, error) {
+	mailboxes, e := c.mailboxes(c.wa.db)
+	if e != nil {
+		return "", e
+	}
+	return mailboxState(mailboxes), nil
+}
+
+func mailboxRole(m *models.Mailbox) interface{} {
+	if m.Name == imap.InboxName {
+		return "inbox"
+	}
+	if m.Specialuse != "" {
+		return strings.ToLower(strings.TrimPrefix(m.Specialuse, `\`))
+	}
+	return nil
+}
+
+/**
+ * The last part of the mailbox's path
+ */
+func mailboxName(m *models.Mailbox) string {
+	return m.Name[strings.LastIndex(m.Name, logic.MailboxDelimiter)+1:]
+}
+
+type mailboxCounts struct {
+	total, unread, threads, unreadThreads int
+}
+
+func (c *jmapCall) mailboxCounts(db models.XODB) (map[int]*mailboxCounts, error) {
+	rows, e := db.Query(`SELECT m.mailboxid, count(*), sum(m.flagsjson NOT LIKE ?), count(DISTINCT m.threadid),
+		count(DISTINCT CASE WHEN m.flagsjson NOT LIKE ? THEN m.threadid END)
+		FROM messages m JOIN mailboxes b ON b.id = m.mailboxid WHERE b.userid = ? GROUP BY m.mailboxid`,
+		seenPattern, seenPattern, c.user.ID)
+	if e != nil {
+		return nil, e
+	}
+	defer rows.Close()
+	counts := map[int]*mailboxCounts{}
+	for rows.Next() {
+		var mailboxid int
+		n := &mailboxCounts{}
+		e = rows.Scan(&mailboxid, &n.total, &n.unread, &n.threads, &n.unreadThreads)
+		if e != nil {
+			return nil, e
+		}
+		counts[mailboxid] = n
+	}
+	return counts, rows.Err()
+}
+
+func mailboxObject(m *models.Mailbox, byName map[string]*models.Mailbox, counts *mailboxCounts) map[string]interface{} {
+	if counts == nil {
+		counts = &mailboxCounts{}
+	}
+	var parentId interface{}
+	if parent, ok := byName[logic.ParentName(m.Name)]; ok {
+		parentId = jmapId("M", parent.ID)
+	}
+	selectable := !m.Noselect
+	inbox := m.Name == imap.InboxName
+	return map[string]interface{}{
+		"id":            jmapId("M", m.ID),
+		"name":          mailboxName(m),
+		"parentId":      parentId,
+		"role":          mailboxRole(m),
+		"sortOrder":     0,
+		"totalEmails":   counts.total,
+		"unreadEmails":  counts.unread,
+		"totalThreads":  counts.threads,
+		"unreadThreads": counts.unreadThreads,
+		"myRights": map[string]bool{
+			"mayReadItems":   selectable,
+			"mayAddItems":    selectable,
+			"mayRemoveItems": selectable,
+			"maySetSeen":     selectable,
+			"maySetKeywords": selectable,
+			"mayCreateChild": true,
+			"mayRename":      !inbox,
+			"mayDelete":      !inbox,
+			"maySubmit":      true,
+		},
+		"isSubscribed": m.Subscribed,
+	}
+}
+
+func mailboxesByName(mailboxes []*models.Mailbox) map[string]*models.Mailbox {
+	byName := map[string]*models.Mailbox{}
+	for _, m := range mailboxes {
+		byName[m.Name] = m
+	}
+	return byName
+}
+
+func (c *jmapCall) mailboxGet(raw json.RawMessage) (interface{}, error) {
+	var args jmapGetArgs
+	e := parseArgs(raw, &args)
+	if e != nil {
+		return nil, e
+	}
+	e = c.checkAccount(args.AccountId)
+	if e != nil {
+		return nil, e
+	}
+	properties, e := checkProperties(args.Properties, mailboxProperties)
+	if e != nil {
+		return nil, e
+	}
+	mailboxes, e := c.mailboxes(c.wa.db)
+	if e != nil {
+		return nil, e
+	}
+	counts, e := c.mailboxCounts(c.wa.db)
+	if e != nil {
+		return nil, e
+	}
+	byName := mailboxesByName(mailboxes)
+	response := &jmapGetResponse{
+		AccountId: args.AccountId,
+		State:     mailboxState(mailboxes),
+		List:      []interface{}{},
+		NotFound:  []string{},
+	}
+	if args.Ids == nil {
+		for _, m := range mailboxes {
+			response.List = append(response.List, pickProperties(mailboxObject(m, byName, counts[m.ID]), properties))
+		}
+		return response, nil
+	}
+	if len(*args.Ids) > jmapMaxObjects {
+		return nil, jmapErr("requestTooLarge", "More than maxObjectsInGet ids")
+	}
+	byId := map[string]*models.Mailbox{}
+	for _, m := range mailboxes {
+		byId[jmapId("M", m.ID)] = m
+	}
+	for _, id := range *args.Ids {
+		m, ok := byId[c.resolveId(id)]
+		if !ok {
+			response.NotFound = append(response.NotFound, id)
+			continue
+		}
+		response.List = append(response.List, pickProperties(mailboxObject(m, byName, counts[m.ID]), properties))
+	}
+	return response, nil
+}
+
+type mailboxChangesResponse struct {
+	*jmapChangesResponse
+	UpdatedProperties []string `json:"updatedProperties"`
+}
+
+/**
+ * Mailboxes whose messages changed only have new counts, unless the
+ * hash shows something else about the mailboxes changed too
+ */
+func (c *jmapCall) mailboxChanges(raw json.RawMessage) (interface{}, error) {
+	var args jmapChangesArgs
+	e := parseArgs(raw, &args)
+	if e != nil {
+		return nil, e
+	}
+	e = c.checkAccount(args.AccountId)
+	if e != nil {
+		return nil, e
+	}
+	mailboxes, e := c.mailboxes(c.wa.db)
+	if e != nil {
+		return nil, e
+	}
+	state := mailboxState(mailboxes)
+	response := &mailboxChangesResponse{jmapChangesResponse: newChangesResponse(&args, state)}
+	if args.SinceState == state {
+		return response, nil
+	}
+	ix := strings.LastIndex(args.SinceState, "h")
+	if ix < 0 {
+		return nil, jmapErr("cannotCalculateChanges", "Unknown state")
+	}
+	old, e := parseJmapState(args.SinceState[:ix])
+	if e != nil {
+		return nil, e
+	}
+	current := newJmapState(mailboxes)
+	sameHash := args.SinceState[ix:] == state[strings.LastIndex(state, "h"):]
+	for _, m := range mailboxes {
+		position, ok := old[m.ID]
+		switch {
+		case !ok:
+			response.Created = append(response.Created, jmapId("M", m.ID))
+		case !sameHash || position != current[m.ID]:
+			response.Updated = append(response.Updated, jmapId("M", m.ID))
+		}
+	}
+	for id := range old {
+		if _, ok := current[id]; !ok {
+			response.Destroyed = append(response.Destroyed, jmapId("M", id))
+		}
+	}
+	if sameHash {
+		response.UpdatedProperties = mailboxCountProperties
+	}
+	return response, response.checkMax(&args)
+}
+
+/**
+ * A filter is a condition, or an operator with filters under it
+ */
+type jmapPredicate func(interface{}) bool
+
+func compileFilter(raw json.RawMessage, condition func(json.RawMessage) (jmapPredicate, error)) (jmapPredicate, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return func(interface{}) bool { return true }, nil
+	}
+	var fields map[string]json.RawMessage
+	e := json.Unmarshal(raw, &fields)
+	if e != nil {
+		return nil, jmapErr("invalidArguments", "Filters must be objects")
+	}
+	if _, ok := fields["operator"]; !ok {
+		return condition(raw)
+	}
+	var op struct {
+		Operator   string            `json:"operator"`
+		Conditions []json.RawMessage `json:"conditions"`
+	}
+	e = parseArgs(raw, &op)
+	if e != nil {
+		return nil, e
+	}
+	var predicates []jmapPredicate
+	for _, c := range op.Conditions {
+		p, e := compileFilter(c, condition)
+		if e != nil {
+			return nil, e
+		}
+		predicates = append(predicates, p)
+	}
+	switch op.Operator {
+	case "AND", "OR", "NOT":
+	default:
+		return nil, jmapErr("unsupportedFilter", "Unknown operator "+op.Operator)
+	}
+	return func(v interface{}) bool {
+		for _, p := range predicates {
+			matched := p(v)
+			switch {
+			case op.Operator == "AND" && !matched:
+				return false
+			case op.Operator == "OR" && matched:
+				return true
+			case op.Operator == "NOT" && matched:
+				return false
+			}
+		}
+		return op.Operator != "OR"
+	}, nil
+}
+
+func mailboxCondition(raw json.RawMessage) (jmapPredicate, error) {
+	var condition struct {
+		ParentId     json.RawMessage `json:"parentId"`
+		Name         *string         `json:"name"`
+		Role         json.RawMessage `json:"role"`
+		HasAnyRole   *bool           `json:"hasAnyRole"`
+		IsSubscribed *bool           `json:"isSubscribed"`
+	}
+	e := parseArgs(raw, &condition)
+	if e != nil {
+		return nil, jmapErr("unsupportedFilter", e.Error())
+	}
+	// parentId and role can be null, which is different to leaving them out
+	var parentId, role *string
+	if len(condition.ParentId) > 0 {
+		_ = json.Unmarshal(condition.ParentId, &parentId)
+	}
+	if len(condition.Role) > 0 {
+		_ = json.Unmarshal(condition.Role, &role)
+	}
+	return func(v interface{}) bool {
+		m := v.(map[string]interface{})
+		if len(condition.ParentId) > 0 {
+			if parentId == nil && m["parentId"] != nil || parentId != nil && m["parentId"] != *parentId {
+				return false
+			}
+		}
+		if condition.Name != nil && !strings.Contains(strings.ToLower(m["name"].(string)), strings.ToLower(*condition.Name)) {
+			return false
+		}
+		if len(condition.Role) > 0 {
+			if role == nil && m["role"] != nil || role != nil && m["role"] != *role {
+				return false
+			}
+		}
+		if condition.HasAnyRole != nil && (m["role"] != nil) != *condition.HasAnyRole {
+			return false
+		}
+		if condition.IsSubscribed != nil && m["isSubscribed"] != *condition.IsSubscribed {
+			return false
+		}
+		return true
+	}, nil
+}
+
+func (c *jmapCall) mailboxQuery(raw json.RawMessage) (interface{}, error) {
+	var args struct {
+		jmapQueryArgs
+		SortAsTree   bool `json:"sortAsTree"`
+		FilterAsTree bool `json:"filterAsTree"`
+	}
+	e := parseArgs(raw, &args)
+	if e != nil {
+		return nil, e
+	}
+	e = c.checkAccount(args.AccountId)
+	if e != nil {
+		return nil, e
+	}
+	match, e := compileFilter(args.Filter, mailboxCondition)
+	if e != nil {
+		return nil, e
+	}
+	for _, comparator := range args.Sort {
+		if comparator.Property != "name" && comparator.Property != "sortOrder" {
+			return nil, jmapErr("unsupportedSort", "Can't sort on "+comparator.Property)
+		}
+	}
+	mailboxes, e := c.mailboxes(c.wa.db)
+	if e != nil {
+		return nil, e
+	}
+	byName := mailboxesByName(mailboxes)
+	var matched []*models.Mailbox
+	for _, m := range mailboxes {
+		if match(mailboxObject(m, byName, nil)) {
+			matched = append(matched, m)
+		}
+	}
+	// Every mailbox has the same sort order, so only names matter
+	sort.SliceStable(matched, func(i, j int) bool {
+		a, b := matched[i], matched[j]
+		for _, comparator := range args.Sort {
+			if comparator.Property != "name" || mailboxName(a) == mailboxName(b) {
+				continue
+			}
+			return (strings.ToLower(mailboxName(a)) < strings.ToLower(mailboxName(b))) == comparator.ascending()
+		}
+		return false
+	})
+	if args.SortAsTree {
+		// Sorting on the whole path puts parents before their children
+		sort.SliceStable(matched, func(i, j int) bool {
+			return strings.ToLower(matched[i].Name) < strings.ToLower(matched[j].Name)
+		})
+	}
+	var ids []string
+	for _, m := range matched {
+		ids = append(ids, jmapId("M", m.ID))
+	}
+	return queryPage(&args.jmapQueryArgs, ids, mailboxState(mailboxes))
+}
+
+type mailboxProps struct {
+	Name         *string         `json:"name"`
+	ParentId     json.RawMessage `json:"parentId"`
+	Role         json.RawMessage `json:"role"`
+	SortOrder    *int            `json:"sortOrder"`
+	IsSubscribed *bool           `json:"isSubscribed"`
+}
+
+func parseMailboxProps(raw json.RawMessage) (*mailboxProps, error) {
+	var props mailboxProps
+	e := parseArgs(raw, &props)
+	if e != nil {
+		return nil, invalidProperties(e.(*jmapError).Description)
+	}
+	if props.SortOrder != nil && *props.SortOrder != 0 {
+		return nil, invalidProperties("Mailboxes can't be given a sort order", "sortOrder")
+	}
+	if props.Name != nil && (*props.Name == "" || strings.Contains(*props.Name, logic.MailboxDelimiter)) {
+		return nil, invalidProperties("Names can't be empty or contain "+logic.MailboxDelimiter, "name")
+	}
+	return &props, nil
+}
+
+/**
+ * The full name for a mailbox with this name and parent, where the
+ * parent is null for a mailbox at the top
+ */
+func (c *jmapCall) mailboxPath(tx *sql.Tx, name string, parentId json.RawMessage) (string, error) {
+	var parent *string
+	if len(parentId) > 0 && json.Unmarshal(parentId, &parent) != nil {
+		return "", invalidProperties("parentId must be an id or null", "parentId")
+	}
+	if parent == nil {
+		return name, nil
+	}
+	m, e := c.mailbox(tx, *parent)
+	if e == sql.ErrNoRows {
+		return "", invalidProperties("No such parent mailbox", "parentId")
+	} else if e != nil {
+		return "", e
+	}
+	return m.Name + logic.MailboxDelimiter + name, nil
+}
+
+func (c *jmapCall) setMailboxProps(tx *sql.Tx, m *models.Mailbox, props *mailboxProps) error {
+	if len(props.Role) > 0 {
+		var role *string
+		if json.Unmarshal(props.Role, &role) != nil || (role != nil && *role == "inbox") {
+			return invalidProperties("Unknown role", "role")
+		}
+		use := ""
+		if role != nil {
+			use = `\` + *role
+		}
+		e := logic.SetSpecialUse(tx, m, use)
+		if e == logic.ErrInvalidSpecialUse || e == logic.ErrSpecialUseTaken {
+			return invalidProperties(e.Error(), "role")
+		} else if e != nil {
+			return e
+		}
+	}
+	if props.IsSubscribed != nil {
+		m.Subscribed = *props.IsSubscribed
+		return m.Save(tx)
+	}
+	return nil
+}
+
+func mailboxError(e error) error {
+	switch e {
+	case logic.ErrMailboxExists:
+		return invalidProperties("There's already a mailbox with that name", "name")
+	case logic.ErrInvalidMailboxName:
+		return invalidProperties(e.Error(), "name")
+	case logic.ErrRenameIntoItself:
+		return invalidProperties(e.Error(), "parentId")
+	case logic.ErrNoSuchMailbox, sql.ErrNoRows:
+		return jmapErr("notFound", "")
+	}
+	return e
+}
+
+func (c *jmapCall) mailboxSet(raw json.RawMessage) (interface{}, error) {
+	var args struct {
+		jmapSetArgs
+		OnDestroyRemoveEmails bool `json:"onDestroyRemoveEmails"`
+	}
+	e := parseArgs(raw, &args)
+	if e != nil {
+		return nil, e
+	}
+	e = c.checkAccount(args.AccountId)
+	if e != nil {
+		return nil, e
+	}
+	oldState, e := c.mailboxState()
+	if e != nil {
+		return nil, e
+	}
+	e = args.check(oldState)
+	if e != nil {
+		return nil, e
+	}
+	response := &jmapSetResponse{AccountId: args.AccountId, OldState: oldState}
+
+	// Parents are created before mailboxes that refer to them by creation id
+	pending := map[string]json.RawMessage{}
+	for id, props := range args.Create {
+		pending[id] = props
+	}
+	for len(pending) > 0 {
+		var ready []string
+		for id, props := range pending {
+			var p struct {
+				ParentId string `json:"parentId"`
+			}
+			_ = json.Unmarshal(props, &p)
+			if _, waiting := pending[strings.TrimPrefix(p.ParentId, "#")]; !strings.HasPrefix(p.ParentId, "#") || !waiting {
+				ready = append(ready, id)
+			}
+		}
+		if len(ready) == 0 {
+			for id := range pending {
+				ready = append(ready, id)
+			}
+		}
+		sort.Strings(ready)
+		for _, id := range ready {
+			object, e := c.createMailbox(pending[id])
+			if e == nil {
+				response.created(c, id, object["id"].(string), object)
+			} else if e = response.failed(&response.NotCreated, id, e); e != nil {
+				return nil, e
+			}
+			delete(pending, id)
+		}
+	}
+
+	for id, patch := range args.Update {
+		e := c.updateMailbox(id, patch)
+		if e == nil {
+			response.updated(id)
+		} else if e = response.failed(&response.NotUpdated, id, e); e != nil {
+			return nil, e
+		}
+	}
+
+	for _, id := range args.Destroy {
+		e := c.destroyMailbox(id, args.OnDestroyRemoveEmails)
+		if e == nil {
+			response.Destroyed = append(response.Destroyed, id)
+		} else if e = response.failed(&response.NotDestroyed, id, e); e != nil {
+			return nil, e
+		}
+	}
+	response.NewState, e = c.mailboxState()
+	return response, e
+}
+
+func (c *jmapCall) createMailbox(raw json.RawMessage) (map[string]interface{}, error) {
+	props, e := parseMailboxProps(raw)
+	if e != nil {
+		return nil, e
+	}
+	if props.Name == nil {
+		return nil, invalidProperties("Mailboxes must have a name", "name")
+	}
+	var created *models.Mailbox
+	e = database.Transact(c.wa.db, func(tx *sql.Tx) error {
+		name, e := c.mailboxPath(tx, *props.Name, props.ParentId)
+		if e != nil {
+			return e
+		}
+		created, e = logic.CreateMailbox(tx, c.user.ID, name)
+		if e != nil {
+			return mailboxError(e)
+		}
+		return c.setMailboxProps(tx, created, props)
+	})
+	if e != nil {
+		return nil, e
+	}
+	mailboxes, e := c.mailboxes(c.wa.db)
+	if e != nil {
+		return nil, e
+	}
+	return mailboxObject(created, mailboxesByName(mailboxes), nil), nil
+}
+
+func (c *jmapCall) updateMailbox(id string, raw json.RawMessage) error {
+	props, e := parseMailboxProps(raw)
+	if e != nil {
+		return e
+	}
+	return database.Transact(c.wa.db, func(tx *sql.Tx) error {
+		m, e := c.mailbox(tx, id)
+		if e != nil {
+			return mailboxError(e)
+		}
+		if props.Name != nil || len(props.ParentId) > 0 {
+			name := mailboxName(m)
+			if props.Name != nil {
+				name = *props.Name
+			}
+			parentId := props.ParentId
+			if len(parentId) == 0 {
+				parentId = json.RawMessage("null")
+				if parent := logic.ParentName(m.Name); parent != "" {
+					parentMailbox, e := models.MailboxByUseridName(tx, c.user.ID, parent)
+					if e != nil {
+						return e
+					}
+					parentId, _ = json.Marshal(jmapId("M", parentMailbox.ID))
+				}
+			}
+			path, e := c.mailboxPath(tx, name, parentId)
+			if e != nil {
+				return e
+			}
+			if path != m.Name {
+				if m.Name == imap.InboxName {
+					return jmapErr("forbidden", "The inbox can't be renamed")
+				}
+				e = logic.RenameMailbox(tx, c.user.ID, m.Name, path)
+				if e != nil {
+					return mailboxError(e)
+				}
+				m, e = models.MailboxByID(tx, m.ID)
+				if e != nil {
+					return e
+				}
+			}
+		}
+		return c.setMailboxProps(tx, m, props)
+	})
+}
+
+func (c *jmapCall) destroyMailbox(id string, removeEmails bool) error {
+	return database.Transact(c.wa.db, func(tx *sql.Tx) error {
+		m, e := c.mailbox(tx, id)
+		if e != nil {
+			return mailboxError(e)
+		}
+		if m.Name == imap.InboxName {
+			return jmapErr("forbidden", logic.ErrDeleteInbox.Error())
+		}
+		hasChildren, e := logic.HasChildren(tx, m)
+		if e != nil {
+			return e
+		}
+		if hasChildren {
+			return jmapErr("mailboxHasChild", "")
+		}
+		var count int
+		e = tx.QueryRow("SELECT count(*) FROM messages WHERE mailboxid = ?", m.ID).Scan(&count)
+		if e != nil {
+			return e
+		}
+		if count > 0 && !removeEmails {
+			return jmapErr("mailboxHasEmail", "")
+		}
+		return mailboxError(logic.DeleteMailbox(tx, c.user.ID, m.Name))
+	})
+}
@@ -0,0 +1,401 @@
+package web
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/emersion/go-message"
+	"hash/fnv"
+	"henrymail/config"
+	"henrymail/logic"
+	"henrymail/process"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+/**
+ * Sending, see RFC 8621 sections 6 and 7. Users can send from their own
+ * address and from the aliases that deliver to them. Messages go through
+ * the same chain as those submitted by SMTP, and aren't kept once they
+ * have been handed to it, so there are no submissions to look at later.
+ */
+
+var identityProperties = []string{"id", "name", "email", "replyTo", "bcc", "textSignature", "htmlSignature", "mayDelete"}
+
+// Submissions aren't kept, so their state never changes
+const submissionState = "s0"
+
+func identityObject(id, email string) map[string]interface{} {
+	return map[string]interface{}{
+		"id":            id,
+		"name":          "",
+		"email":         email,
+		"replyTo":       nil,
+		"bcc":           nil,
+		"textSignature": "",
+		"htmlSignature": "",
+		"mayDelete":     false,
+	}
+}
+
+func (c *jmapCall) identities() ([]map[string]interface{}, error) {
+	identities := []map[string]interface{}{identityObject("I0", logic.QualifyUsername(c.user.Username))}
+	aliases, e := logic.AliasesForUser(c.wa.db, c.user)
+	if e != nil {
+		return nil, e
+	}
+	for _, alias := range aliases {
+		identities = append(identities, identityObject(jmapId("I", alias.ID), alias.Address))
+	}
+	return identities, nil
+}
+
+func identityState(identities []map[string]interface{}) string {
+	h := fnv.New32a()
+	for _, identity := range identities {
+		fmt.Fprintf(h, "%v %v\n", identity["id"], identity["email"])
+	}
+	return fmt.Sprintf("%x", h.Sum32())
+}
+
+/**
+ * Whether the user can send from the address
+ */
+func mayUse(identities []map[string]interface{}, address string) bool {
+	for _, identity := range identities {
+		if strings.EqualFold(identity["email"].(string), address) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *jmapCall) identityGet(raw json.RawMessage) (interface{}, error) {
+	var args jmapGetArgs
+	e := parseArgs(raw, &args)
+	if e != nil {
+		return nil, e
+	}
+	e = c.checkAccount(args.AccountId)
+	if e != nil {
+		return nil, e
+	}
+	properties, e := checkProperties(args.Properties, identityProperties)
+	if e != nil {
+		return nil, e
+	}
+	identities, e := c.identities()
+	if e != nil {
+		return nil, e
+	}
+	response := &jmapGetResponse{
+		AccountId: args.AccountId,
+		State:     identityState(identities),
+		List:      []interface{}{},
+		NotFound:  []string{},
+	}
+	for _, identity := range identities {
+		if args.Ids == nil || stringIn(identity["id"].(string), *args.Ids) {
+			response.List = append(response.List, pickProperties(identity, properties))
+		}
+	}
+	if args.Ids != nil {
+		for _, id := range *args.Ids {
+			found := false
+			for _, identity := range identities {
+				found = found || identity["id"] == id
+			}
+			if !found {
+				response.NotFound = append(response.NotFound, id)
+			}
+		}
+	}
+	return response, nil
+}
+
+func (c *jmapCall) emailSubmissionGet(raw json.RawMessage) (interface{}, error) {
+	var args jmapGetArgs
+	e := parseArgs(raw, &args)
+	if e != nil {
+		return nil, e
+	}
+	e = c.checkAccount(args.AccountId)
+	if e != nil {
+		return nil, e
+	}
+	response := &jmapGetResponse{AccountId: args.AccountId, State: submissionState, List: []interface{}{}, NotFound: []string{}}
+	if args.Ids != nil {
+		response.NotFound = append(response.NotFound, *args.Ids...)
+	}
+	return response, nil
+}
+
+func (c *jmapCall) emailSubmissionChanges(raw json.RawMessage) (interface{}, error) {
+	var args jmapChangesArgs
+	e := parseArgs(raw, &args)
+	if e != nil {
+		return nil, e
+	}
+	e = c.checkAccount(args.AccountId)
+	if e != nil {
+		return nil, e
+	}
+	if args.SinceState != submissionState {
+		return nil, jmapErr("cannotCalculateChanges", "Unknown state")
+	}
+	return newChangesResponse(&args, submissionState), nil
+}
+
+type jmapSmtpAddress struct {
+	Email      string             `json:"email"`
+	Parameters map[string]*string `json:"parameters"`
+}
+
+type submissionCreate struct {
+	IdentityId string  `json:"identityId"`
+	EmailId    string  `json:"emailId"`
+	UndoStatus *string `json:"undoStatus"`
+	Envelope   *struct {
+		MailFrom jmapSmtpAddress   `json:"mailFrom"`
+		RcptTo   []jmapSmtpAddress `json:"rcptTo"`
+	} `json:"envelope"`
+}
+
+/**
+ * The message without its Bcc header, which recipients mustn't see
+ */
+func withoutBcc(content []byte) []byte {
+	var b bytes.Buffer
+	skipping := false
+	rest := content
+	for len(rest) > 0 {
+		end := bytes.IndexByte(rest, '\n') + 1
+		if end == 0 {
+			end = len(rest)
+		}
+		line := rest[:end]
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			break
+		}
+		// Folded lines belong to the field before them
+		if line[0] != ' ' && line[0] != '\t' {
+			skipping = len(line) >= 4 && strings.EqualFold(string(line[:4]), "bcc:")
+		}
+		if !skipping {
+			b.Write(line)
+		}
+		rest = rest[end:]
+	}
+	return append(b.Bytes(), rest...)
+}
+
+func (c *jmapCall) submit(raw json.RawMessage, identities []map[string]interface{}) (map[string]interface{}, string, error) {
+	var create submissionCreate
+	e := parseArgs(raw, &create)
+	if e != nil {
+		return nil, "", invalidProperties(e.(*jmapError).Description)
+	}
+	if create.UndoStatus != nil && *create.UndoStatus != "final" {
+		return nil, "", invalidProperties("Sending can't be delayed or undone", "undoStatus")
+	}
+	var identity map[string]interface{}
+	for _, i := range identities {
+		if i["id"] == c.resolveId(create.IdentityId) {
+			identity = i
+		}
+	}
+	if identity == nil {
+		return nil, "", invalidProperties("No such identity", "identityId")
+	}
+	msgs, e := c.emailsById(c.wa.db, true, []string{create.EmailId})
+	if e != nil {
+		return nil, "", e
+	}
+	msg, ok := msgs[c.resolveId(create.EmailId)]
+	if !ok {
+		return nil, "", invalidProperties("No such email", "emailId")
+	}
+	if msg.Size > config.GetInt(config.MaxMessageBytes) {
+		return nil, "", jmapErr("tooLarge", "The email is bigger than the server accepts")
+	}
+	ent, e := message.Read(bytes.NewReader(msg.Content))
+	if e != nil && !message.IsUnknownCharset(e) {
+		return nil, "", jmapErr("invalidEmail", e.Error())
+	}
+	for _, from := range parseAddresses(ent.Header.Get("From")) {
+		if !mayUse(identities, from.Email) {
+			return nil, "", jmapErr("forbiddenFrom", "You can't send from "+from.Email)
+		}
+	}
+
+	from := identity["email"].(string)
+	var to []string
+	if create.Envelope != nil {
+		from = create.Envelope.MailFrom.Email
+		for _, rcpt := range create.Envelope.RcptTo {
+			to = append(to, rcpt.Email)
+		}
+	} else {
+		seen := map[string]bool{}
+		for _, key := range []string{"To", "Cc", "Bcc"} {
+			for _, a := range parseAddresses(ent.Header.Get(key)) {
+				if !seen[strings.ToLower(a.Email)] {
+					seen[strings.ToLower(a.Email)] = true
+					to = append(to, a.Email)
+				}
+			}
+		}
+	}
+	received, e := c.send(msg.Content, from, to, identities)
+	if e != nil {
+		return nil, "", e
+	}
+	return map[string]interface{}{
+		"id":             "S" + received.Id,
+		"threadId":       jmapId("T", msg.Threadid),
+		"sendAt":         utcDate(received.Timestamp),
+		"undoStatus":     "final",
+		"deliveryStatus": nil,
+		"dsnBlobIds":     []string{},
+		"mdnBlobIds":     []string{},
+	}, jmapId("E", msg.ID), nil
+}
+
+/**
+ * Hands a message to the same chain as mail submitted by SMTP, from an
+ * address the user can send from. The message is sent without its Bcc
+ * header, so it can be the copy the user keeps.
+ */
+func (c *jmapCall) send(content []byte, from string, to []string, identities []map[string]interface{}) (*process.ReceivedMsg, error) {
+	if !mayUse(identities, from) {
+		return nil, jmapErr("forbiddenMailFrom", "You can't send from "+from)
+	}
+	if len(to) == 0 {
+		return nil, jmapErr("noRecipients", "There's no one to send it to")
+	}
+	var invalid []string
+	for _, rcpt := range to {
+		if _, domain := logic.SplitAddress(rcpt); domain == "" {
+			invalid = append(invalid, rcpt)
+		}
+	}
+	if invalid != nil {
+		return nil, jmapErr("invalidRecipients", strings.Join(invalid, ", "))
+	}
+	if max := config.GetInt(config.MaxRecipients); max > 0 && len(to) > max {
+		return nil, jmapErr("tooManyRecipients", "It can't be sent to that many people at once")
+	}
+
+	received := &process.ReceivedMsg{
+		Id:            process.NewQueueId(),
+		From:          from,
+		To:            to,
+		Content:       withoutBcc(content),
+		Timestamp:     time.Now(),
+		Protocol:      "HTTP",
+		Tls:           c.r.TLS,
+		Authenticated: true,
+		Userid:        c.user.ID,
+		Notify:        map[string]string{},
+		Orcpt:         map[string]string{},
+	}
+	if c.r.TLS != nil {
+		received.Protocol = "HTTPS"
+	}
+	if host, _, e := net.SplitHostPort(c.r.RemoteAddr); e == nil {
+		received.ClientIp = net.ParseIP(host)
+	}
+	e := c.wa.msa.Process(received)
+	if e != nil {
+		log.Printf("Unable to send %v for %v: %v", received.Id, c.user.Username, e)
+		return nil, jmapErr("forbiddenToSend", e.Error())
+	}
+	return received, nil
+}
+
+/**
+ * Emails can be changed once they're sent, typically to move them from
+ * Drafts to Sent, by an Email/set call made on the client's behalf
+ */
+func (c *jmapCall) emailSubmissionSet(raw json.RawMessage) (interface{}, error) {
+	var args struct {
+		jmapSetArgs
+		OnSuccessUpdateEmail  map[string]json.RawMessage `json:"onSuccessUpdateEmail"`
+		OnSuccessDestroyEmail []string                   `json:"onSuccessDestroyEmail"`
+	}
+	e := parseArgs(raw, &args)
+	if e != nil {
+		return nil, e
+	}
+	e = c.checkAccount(args.AccountId)
+	if e != nil {
+		return nil, e
+	}
+	e = args.check(submissionState)
+	if e != nil {
+		return nil, e
+	}
+	identities, e := c.identities()
+	if e != nil {
+		return nil, e
+	}
+	response := &jmapSetResponse{AccountId: args.AccountId, OldState: submissionState, NewState: submissionState}
+	sent := map[string]string{} // Emails, by submission id and creation id
+	var creationIds []string
+	for id := range args.Create {
+		creationIds = append(creationIds, id)
+	}
+	sort.Strings(creationIds)
+	for _, id := range creationIds {
+		object, emailId, e := c.submit(args.Create[id], identities)
+		if e == nil {
+			response.created(c, id, object["id"].(string), object)
+			sent["#"+id] = emailId
+			sent[object["id"].(string)] = emailId
+		} else if e = response.failed(&response.NotCreated, id, e); e != nil {
+			return nil, e
+		}
+	}
+	for id := range args.Update {
+		_ = response.failed(&response.NotUpdated, id, jmapErr("cannotUnsend", "Messages are sent straight away"))
+	}
+	for _, id := range args.Destroy {
+		_ = response.failed(&response.NotDestroyed, id, jmapErr("notFound", ""))
+	}
+
+	emailArgs := map[string]interface{}{"accountId": args.AccountId}
+	update := map[string]json.RawMessage{}
+	for id, patch := range args.OnSuccessUpdateEmail {
+		if emailId, ok := sent[id]; ok {
+			update[emailId] = patch
+		}
+	}
+	var destroy []string
+	for _, id := range args.OnSuccessDestroyEmail {
+		if emailId, ok := sent[id]; ok {
+			destroy = append(destroy, emailId)
+		}
+	}
+	if len(update) == 0 && len(destroy) == 0 {
+		return response, nil
+	}
+	if len(update) > 0 {
+		emailArgs["update"] = update
+	}
+	if len(destroy) > 0 {
+		emailArgs["destroy"] = destroy
+	}
+	implicit, e := json.Marshal(emailArgs)
+	if e != nil {
+		return nil, e
+	}
+	result, e := c.emailSet(implicit)
+	if e != nil {
+		return nil, e
+	}
+	c.extra = append(c.extra, c.response("Email/set", c.callId, result))
+	return response, nil
+}
@@ -0,0 +1,27 @@
+package web
+
+import (
+	"testing"
+)
+
+func TestWithoutBcc(t *testing.T) {
+	tests := []struct {
+		content, expected string
+	}{
+		{"From: a@example.com\r\nBcc: b@example.com\r\nTo: c@example.com\r\n\r\nBody\r\n",
+			"From: a@example.com\r\nTo: c@example.com\r\n\r\nBody\r\n"},
+		// Folded onto more lines, and in any case
+		{"BCC: b@example.com,\r\n d@example.com\r\n\tmore\r\nSubject: hi\r\n\r\nBody\r\n",
+			"Subject: hi\r\n\r\nBody\r\n"},
+		{"Subject: hi\nbcc:\nTo: c@example.com\n\nBcc: in the body\n",
+			"Subject: hi\nTo: c@example.com\n\nBcc: in the body\n"},
+		{"Bcced: not the same\r\n\r\n", "Bcced: not the same\r\n\r\n"},
+		{"Subject: no body\r\nBcc: b@example.com", "Subject: no body\r\n"},
+		{"", ""},
+	}
+	for _, test := range tests {
+		if got := string(withoutBcc([]byte(test.content))); got != test.expected {
+			t.Errorf("withoutBcc(%q) = %q, expected %q", test.content, got, test.expected)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package web
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestResolveReferences(t *testing.T) {
+	// Like the example in RFC 8620 section 3.7
+	responses := []jmapInvocation{
+		{name: "Email/query", callId: "t0", args: json.RawMessage(`{"ids":["E1","E2"],"total":2}`)},
+		{name: "Email/get", callId: "t1", args: json.RawMessage(`{"list":[
+			{"id":"E1","threadId":"T1","to":[{"email":"a@example.com"}]},
+			{"id":"E2","threadId":"T2","to":[{"email":"b@example.com"},{"email":"c@example.com"}]}]}`)},
+	}
+	tests := []struct {
+		args     string
+		expected string // Empty if it should fail
+		errType  string
+	}{
+		{`{"accountId":"A2"}`, `{"accountId":"A2"}`, ""},
+		{`{"#ids":{"resultOf":"t0","name":"Email/query","path":"/ids"}}`, `{"ids":["E1","E2"]}`, ""},
+		{`{"#ids":{"resultOf":"t1","name":"Email/get","path":"/list/*/threadId"}}`, `{"ids":["T1","T2"]}`, ""},
+		// Lists found through * are joined together
+		{`{"#to":{"resultOf":"t1","name":"Email/get","path":"/list/*/to/*/email"}}`,
+			`{"to":["a@example.com","b@example.com","c@example.com"]}`, ""},
+		{`{"#id":{"resultOf":"t1","name":"Email/get","path":"/list/1/id"}}`, `{"id":"E2"}`, ""},
+		{`{"#ids":{"resultOf":"t0","name":"Email/get","path":"/ids"}}`, "", "invalidResultReference"},
+		{`{"#ids":{"resultOf":"t0","name":"Email/query","path":"/nothing"}}`, "", "invalidResultReference"},
+		{`{"#ids":{"resultOf":"t0","name":"Email/query","path":"/ids/2"}}`, "", "invalidResultReference"},
+		{`{"#ids":{"resultOf":"t0","name":"Email/query","path":"ids"}}`, "", "invalidResultReference"},
+		{`{"ids":[],"#ids":{"resultOf":"t0","name":"Email/query","path":"/ids"}}`, "", "invalidArguments"},
+		{`[]`, "", "invalidArguments"},
+	}
+	for _, test := range tests {
+		resolved, e := resolveReferences(json.RawMessage(test.args), responses)
+		if test.expected == "" {
+			if err, ok := e.(*jmapError); !ok || err.Type != test.errType {
+				t.Errorf("resolveReferences(%s) should have failed with %v, got %s %v", test.args, test.errType, resolved, e)
+			}
+			continue
+		}
+		if e != nil {
+			t.Errorf("resolveReferences(%s) failed: %v", test.args, e)
+			continue
+		}
+		var got, expected interface{}
+		_ = json.Unmarshal(resolved, &got)
+		_ = json.Unmarshal([]byte(test.expected), &expected)
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("resolveReferences(%s) = %s, expected %s", test.args, resolved, test.expected)
+		}
+	}
+}
+
+func TestEvalPointer(t *testing.T) {
+	var doc interface{}
+	_ = json.Unmarshal([]byte(`{"a/b":1,"m~n":2,"list":[{"x":[1,2]},{"x":[3]}],"s":"str"}`), &doc)
+	tests := []struct {
+		tokens   []string
+		expected interface{} // Nil if it should fail
+	}{
+		{[]string{}, doc},
+		{[]string{"a~1b"}, 1.0},
+		{[]string{"m~0n"}, 2.0},
+		{[]string{"list", "0", "x", "1"}, 2.0},
+		{[]string{"list", "*", "x"}, []interface{}{1.0, 2.0, 3.0}},
+		{[]string{"list", "-1"}, nil},
+		{[]string{"list", "first"}, nil},
+		{[]string{"s", "0"}, nil},
+		{[]string{"missing"}, nil},
+	}
+	for _, test := range tests {
+		got, e := evalPointer(doc, test.tokens)
+		if test.expected == nil {
+			if e == nil {
+				t.Errorf("evalPointer(%q) should have failed, got %v", test.tokens, got)
+			}
+		} else if e != nil || !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("evalPointer(%q) = %v %v, expected %v", test.tokens, got, e, test.expected)
+		}
+	}
+}
+
+func TestParseJmapState(t *testing.T) {
+	state := jmapState{3: {modseq: 10, uidnext: 4}, 1: {modseq: 2, uidnext: 7}}
+	str := state.String()
+	if str != "s1-2-7_3-10-4" {
+		t.Errorf("unexpected state string %v", str)
+	}
+	parsed, e := parseJmapState(str)
+	if e != nil || !reflect.DeepEqual(parsed, state) {
+		t.Errorf("parseJmapState(%v) = %v %v, expected %v", str, parsed, e, state)
+	}
+	for _, bad := range []string{"", "1-2-7", "s1-2", "s1-2-7_", "sx-y-z", "s1-2-7__3-10-4"} {
+		_, e := parseJmapState(bad)
+		if err, ok := e.(*jmapError); !ok || err.Type != "cannotCalculateChanges" {
+			t.Errorf("parseJmapState(%q) should have failed with cannotCalculateChanges, got %v", bad, e)
+		}
+	}
+}
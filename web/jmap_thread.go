@@ -0,0 +1,130 @@
+package web
+
+import (
+	"encoding/json"
+	"henrymail/models"
+)
+
+/**
+ * Threads, see RFC 8621 section 3. Messages are put in threads as
+ * they're saved, see logic.assignThread, and a thread is numbered after
+ * the message that started it.
+ */
+
+var threadProperties = []string{"id", "emailIds"}
+
+func (c *jmapCall) threadGet(raw json.RawMessage) (interface{}, error) {
+	var args jmapGetArgs
+	e := parseArgs(raw, &args)
+	if e != nil {
+		return nil, e
+	}
+	e = c.checkAccount(args.AccountId)
+	if e != nil {
+		return nil, e
+	}
+	properties, e := checkProperties(args.Properties, threadProperties)
+	if e != nil {
+		return nil, e
+	}
+	if args.Ids == nil {
+		return nil, jmapErr("requestTooLarge", "Ask for threads by id")
+	}
+	if len(*args.Ids) > jmapMaxObjects {
+		return nil, jmapErr("requestTooLarge", "More than maxObjectsInGet ids")
+	}
+	state, e := c.emailState(c.wa.db)
+	if e != nil {
+		return nil, e
+	}
+	var threadids []interface{}
+	for _, id := range *args.Ids {
+		if threadid, ok := parseJmapId("T", id); ok {
+			threadids = append(threadids, threadid)
+		}
+	}
+	threads := map[string][]string{}
+	if len(threadids) > 0 {
+		var msgs []*models.Message
+		msgs, e = c.loadEmails(c.wa.db, false, "threadid IN ("+placeholders(len(threadids))+") ORDER BY ts, id",
+			threadids...)
+		if e != nil {
+			return nil, e
+		}
+		for _, msg := range msgs {
+			id := jmapId("T", msg.Threadid)
+			threads[id] = append(threads[id], jmapId("E", msg.ID))
+		}
+	}
+	response := &jmapGetResponse{AccountId: args.AccountId, State: state, List: []interface{}{}, NotFound: []string{}}
+	for _, id := range *args.Ids {
+		emailIds, ok := threads[id]
+		if !ok {
+			response.NotFound = append(response.NotFound, id)
+			continue
+		}
+		response.List = append(response.List, pickProperties(map[string]interface{}{
+			"id":       id,
+			"emailIds": emailIds,
+		}, properties))
+	}
+	return response, nil
+}
+
+/**
+ * Threads change when their emails do. Which thread an email that's gone
+ * was in isn't kept, so if any have gone the client has to start again.
+ */
+func (c *jmapCall) threadChanges(raw json.RawMessage) (interface{}, error) {
+	var args jmapChangesArgs
+	e := parseArgs(raw, &args)
+	if e != nil {
+		return nil, e
+	}
+	e = c.checkAccount(args.AccountId)
+	if e != nil {
+		return nil, e
+	}
+	mailboxes, e := c.mailboxes(c.wa.db)
+	if e != nil {
+		return nil, e
+	}
+	response := newChangesResponse(&args, newJmapState(mailboxes).String())
+	if args.SinceState == response.NewState {
+		return response, nil
+	}
+	changes, e := c.emailChangesSince(args.SinceState, mailboxes)
+	if e != nil {
+		return nil, e
+	}
+	if len(changes.destroyed) > 0 {
+		return nil, jmapErr("cannotCalculateChanges", "Emails have been destroyed since")
+	}
+	var ids []interface{}
+	for id := range changes.created {
+		ids = append(ids, id)
+	}
+	for id := range changes.updated {
+		ids = append(ids, id)
+	}
+	created, updated := map[int]bool{}, map[int]bool{}
+	if len(ids) > 0 {
+		msgs, e := c.loadEmails(c.wa.db, false, "id IN ("+placeholders(len(ids))+")", ids...)
+		if e != nil {
+			return nil, e
+		}
+		for _, msg := range msgs {
+			if msg.Threadid == msg.ID && changes.created[msg.ID] {
+				created[msg.Threadid] = true
+			} else {
+				updated[msg.Threadid] = true
+			}
+		}
+	}
+	for id := range created {
+		delete(updated, id)
+	}
+	response.Created = sortedIds("T", created)
+	response.Updated = sortedIds("T", updated)
+	return response, response.checkMax(&args)
+}
@@ -0,0 +1,74 @@
+package web
+
+import (
+	"henrymail/logic"
+	"henrymail/models"
+	"net/http"
+	"strconv"
+)
+
+type queueEntry struct {
+	*models.Delivery
+	Sender string
+}
+
+func (wa *wa) queue(w http.ResponseWriter, r *http.Request, u *models.User) {
+	ld, e := wa.layoutData(u)
+	if e != nil {
+		wa.renderError(w, e)
+		return
+	}
+	deliveries, e := models.GetAllDelivery(wa.db)
+	if e != nil {
+		wa.renderError(w, e)
+		return
+	}
+	var entries []queueEntry
+	for _, delivery := range deliveries {
+		queue, e := delivery.Queue(wa.db)
+		if e != nil {
+			wa.renderError(w, e)
+			return
+		}
+		entries = append(entries, queueEntry{
+			Delivery: delivery,
+			Sender:   queue.Sender,
+		})
+	}
+	data := struct {
+		layoutData
+		Entries []queueEntry
+	}{
+		*ld,
+		entries,
+	}
+	wa.queueView.render(w, data)
+}
+
+func (wa *wa) retryDelivery(w http.ResponseWriter, r *http.Request, u *models.User) {
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		wa.renderError(w, err)
+		return
+	}
+	err = logic.RetryDelivery(wa.db, id)
+	if err != nil {
+		wa.renderError(w, err)
+		return
+	}
+	http.Redirect(w, r, "queue", http.StatusFound)
+}
+
+func (wa *wa) deleteDelivery(w http.ResponseWriter, r *http.Request, u *models.User) {
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		wa.renderError(w, err)
+		return
+	}
+	err = logic.DeleteDelivery(wa.db, id)
+	if err != nil {
+		wa.renderError(w, err)
+		return
+	}
+	http.Redirect(w, r, "queue", http.StatusFound)
+}
@@ -2,9 +2,12 @@ package web
 
 import (
 	"errors"
+	"fmt"
 	"henrymail/logic"
 	"henrymail/models"
 	"net/http"
+	"strconv"
+	"strings"
 )
 
 func (wa *wa) delete(w http.ResponseWriter, r *http.Request, u *models.User) {
@@ -18,6 +21,11 @@ func (wa *wa) delete(w http.ResponseWriter, r *http.Request, u *models.User) {
 		wa.renderError(w, err)
 		return
 	}
+	err = logic.RemoveGrants(wa.db, user.ID)
+	if err != nil {
+		wa.renderError(w, err)
+		return
+	}
 	err = user.Delete(wa.db)
 	if err != nil {
 		wa.renderError(w, err)
@@ -29,6 +37,9 @@ func (wa *wa) delete(w http.ResponseWriter, r *http.Request, u *models.User) {
 
 func (wa *wa) add(w http.ResponseWriter, r *http.Request, u *models.User) {
 	username := r.FormValue("username")
+	if domain := r.FormValue("domain"); domain != "" && !strings.Contains(username, "@") {
+		username += "@" + domain
+	}
 	password := r.FormValue("password")
 	isadmin := r.FormValue("admin") == "admin"
 	_, err := logic.NewUser(wa.db, username, password, isadmin)
@@ -51,12 +62,115 @@ func (wa *wa) users(w http.ResponseWriter, r *http.Request, u *models.User) {
 		wa.renderError(w, e)
 		return
 	}
+	var rows []userRow
+	for _, user := range users {
+		q, e := logic.GetQuota(wa.db, user)
+		if e != nil {
+			wa.renderError(w, e)
+			return
+		}
+		rows = append(rows, userRow{
+			User:          user,
+			Quota:         q,
+			StorageMb:     quotaField(user.Quotabytes, 1024*1024),
+			QuotaMessages: quotaField(user.Quotamessages, 1),
+		})
+	}
+	domains, e := models.GetAllDomain(wa.db)
+	if e != nil {
+		wa.renderError(w, e)
+		return
+	}
 	data := struct {
 		layoutData
-		Users []*models.User
+		Users   []userRow
+		Domains []*models.Domain
 	}{
 		*ld,
-		users,
+		rows,
+		domains,
 	}
 	wa.usersView.render(w, data)
 }
+
+type userRow struct {
+	*models.User
+	Quota *logic.Quota
+	// The user's own quota, as it appears in the form
+	StorageMb     string
+	QuotaMessages string
+}
+
+func (r userRow) UsedMb() string {
+	return fmt.Sprintf("%.1f", float64(r.Quota.UsedBytes)/(1024*1024))
+}
+
+func (r userRow) LimitMb() string {
+	if r.Quota.Bytes == 0 {
+		return "unlimited"
+	}
+	return fmt.Sprintf("%.1f", float64(r.Quota.Bytes)/(1024*1024))
+}
+
+func (r userRow) LimitMessages() string {
+	if r.Quota.Messages == 0 {
+		return "unlimited"
+	}
+	return strconv.Itoa(r.Quota.Messages)
+}
+
+/**
+ * 0 for unlimited. The minified templates can't have empty attributes,
+ * so the default is spelled out.
+ */
+const defaultQuotaField = "default"
+
+func quotaField(limit, unit int) string {
+	switch {
+	case limit == 0:
+		return defaultQuotaField
+	case limit < 0:
+		return "0"
+	}
+	return strconv.Itoa(limit / unit)
+}
+
+func parseQuotaField(value string, unit int) (int, error) {
+	value = strings.TrimSpace(value)
+	if value == "" || strings.EqualFold(value, defaultQuotaField) {
+		return 0, nil
+	}
+	limit, e := strconv.Atoi(value)
+	if e != nil || limit < 0 {
+		return 0, errors.New("Quotas must be a whole number, 0 for unlimited, or default")
+	}
+	if limit == 0 {
+		return logic.QuotaUnlimited, nil
+	}
+	return limit * unit, nil
+}
+
+func (wa *wa) setQuota(w http.ResponseWriter, r *http.Request, u *models.User) {
+	user, err := models.UserByUsername(wa.db, r.FormValue("username"))
+	if err != nil {
+		wa.renderError(w, err)
+		return
+	}
+	bytes, err := parseQuotaField(r.FormValue("storage"), 1024*1024)
+	if err != nil {
+		wa.renderError(w, err)
+		return
+	}
+	messages, err := parseQuotaField(r.FormValue("messages"), 1)
+	if err != nil {
+		wa.renderError(w, err)
+		return
+	}
+	err = logic.SetQuota(wa.db, user, bytes, messages)
+	if err != nil {
+		wa.renderError(w, err)
+		return
+	}
+
+	http.Redirect(w, r, "users", http.StatusFound)
+}
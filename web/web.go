@@ -7,6 +7,7 @@ import (
 	"henrymail/config"
 	"henrymail/embedded"
 	"henrymail/models"
+	"henrymail/process"
 	"html/template"
 	"log"
 	"net"
@@ -26,7 +27,8 @@ type layoutData struct {
 }
 
 type wa struct {
-	db *sql.DB
+	db  *sql.DB
+	msa process.MsgProcessor // For mail sent from the web
 
 	// All views are pre-loaded
 	loginView          *view
@@ -35,6 +37,13 @@ type wa struct {
 	usersView          *view
 	healthChecksView   *view
 	securityView       *view
+	queueView          *view
+	aliasesView        *view
+	myAliasesView      *view
+	domainsView        *view
+	mailboxView        *view
+	messageView        *view
+	composeView        *view
 }
 
 func newView(layout string, files ...string) *view {
@@ -82,22 +91,45 @@ func (wa *wa) layoutData(u *models.User) (*layoutData, error) {
 	}, nil
 }
 
-func StartWebAdmin(db *sql.DB, tlsC *tls.Config) {
+func StartWebAdmin(db *sql.DB, msa process.MsgProcessor, tlsC *tls.Config) {
 	webAdmin := wa{
 		db:                 db,
+		msa:                msa,
 		loginView:          newView("login.html", "/templates/login.html"),
 		changePasswordView: newView("index.html", "/templates/change_password.html"),
 		usersView:          newView("index.html", "/templates/users.html"),
 		healthChecksView:   newView("index.html", "/templates/healthchecks.html"),
 		securityView:       newView("index.html", "/templates/security.html"),
+		queueView:          newView("index.html", "/templates/queue.html"),
+		aliasesView:        newView("index.html", "/templates/aliases.html"),
+		myAliasesView:      newView("index.html", "/templates/my_aliases.html"),
+		domainsView:        newView("index.html", "/templates/domains.html"),
+		mailboxView:        newView("index.html", "/templates/mailbox.html", "/templates/folders.html"),
+		messageView:        newView("index.html", "/templates/message.html", "/templates/folders.html"),
+		composeView:        newView("index.html", "/templates/compose.html", "/templates/folders.html"),
 		errorView:          newView("error.html", "/templates/error.html"),
 	}
 
 	router := mux.NewRouter()
 	router.HandleFunc("/login", webAdmin.login)
 	router.HandleFunc("/logout", webAdmin.logout)
-	router.Handle("/", http.RedirectHandler("/changePassword", http.StatusTemporaryRedirect))
+	router.Handle("/", http.RedirectHandler("/mail", http.StatusTemporaryRedirect))
 	router.Handle("/changePassword", webAdmin.checkLogin(webAdmin.changePassword))
+	router.Handle("/aliases", webAdmin.checkLogin(webAdmin.myAliases))
+
+	router.Handle("/mail", webAdmin.checkLogin(webAdmin.mail))
+	router.Handle("/mail/message", webAdmin.checkLogin(webAdmin.mailMessage))
+	router.Handle("/mail/html", webAdmin.checkLogin(webAdmin.mailHtml))
+	router.Handle("/mail/compose", webAdmin.checkLogin(webAdmin.mailCompose))
+	router.Handle("/mail/send", webAdmin.checkForm(webAdmin.mailSend))
+	router.Handle("/mail/action", webAdmin.checkForm(webAdmin.mailAction))
+
+	router.Handle("/.well-known/jmap", webAdmin.checkApiLogin(webAdmin.jmapSession))
+	router.Handle("/jmap/session", webAdmin.checkApiLogin(webAdmin.jmapSession))
+	router.Handle("/jmap/api", webAdmin.checkApiLogin(webAdmin.jmapApi))
+	router.Handle("/jmap/upload/{accountId}/", webAdmin.checkApiLogin(webAdmin.jmapUpload))
+	router.Handle("/jmap/download/{accountId}/{blobId}/{name}", webAdmin.checkApiLogin(webAdmin.jmapDownload))
+	router.Handle("/jmap/eventsource", webAdmin.checkApiLogin(webAdmin.jmapEventSource))
 
 	router.PathPrefix("/assets/").Handler(embedded.GetEmbeddedContent())
 
@@ -105,9 +137,19 @@ func StartWebAdmin(db *sql.DB, tlsC *tls.Config) {
 	admin.Handle("/users", webAdmin.checkAdmin(webAdmin.users))
 	admin.Handle("/addUser", webAdmin.checkAdmin(webAdmin.add))
 	admin.Handle("/deleteUser", webAdmin.checkAdmin(webAdmin.delete))
+	admin.Handle("/setQuota", webAdmin.checkAdmin(webAdmin.setQuota))
+	admin.Handle("/domains", webAdmin.checkAdmin(webAdmin.domains))
+	admin.Handle("/addDomain", webAdmin.checkAdmin(webAdmin.addDomain))
+	admin.Handle("/deleteDomain", webAdmin.checkAdmin(webAdmin.deleteDomain))
+	admin.Handle("/aliases", webAdmin.checkAdmin(webAdmin.aliases))
+	admin.Handle("/addAlias", webAdmin.checkAdmin(webAdmin.addAlias))
+	admin.Handle("/deleteAlias", webAdmin.checkAdmin(webAdmin.deleteAlias))
 	admin.Handle("/security", webAdmin.checkAdmin(webAdmin.security))
 	admin.Handle("/rotateJwt", webAdmin.checkAdmin(webAdmin.rotateJwt))
 	admin.Handle("/healthChecks", webAdmin.checkAdmin(webAdmin.healthChecks))
+	admin.Handle("/queue", webAdmin.checkAdmin(webAdmin.queue))
+	admin.Handle("/retryDelivery", webAdmin.checkAdmin(webAdmin.retryDelivery))
+	admin.Handle("/deleteDelivery", webAdmin.checkAdmin(webAdmin.deleteDelivery))
 
 	server := &http.Server{Addr: config.GetString(config.WebAdminAddress), Handler: router}
 
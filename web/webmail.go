@@ -0,0 +1,844 @@
+package web
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/mail"
+	"henrymail/config"
+	"henrymail/logic"
+	"henrymail/models"
+	"html"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	netmail "net/mail"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/**
+ * Webmail, for reading and sending mail in the browser. It acts for the
+ * user through the same code as the JMAP API, and messages, mailboxes
+ * and attachments are named by their JMAP ids.
+ */
+
+const webmailPageSize = 50
+
+/**
+ * Messages are shown in a sandbox, where they can't run scripts, submit
+ * forms or load anything from elsewhere unless the user asks them to.
+ * Loading images tells the sender the message has been read, and where.
+ */
+const (
+	webmailSandbox = "sandbox allow-popups allow-popups-to-escape-sandbox"
+	webmailPolicy  = "default-src 'none'; style-src 'unsafe-inline'; img-src data:; font-src data:; " +
+		"form-action 'none'; " + webmailSandbox
+	webmailRemotePolicy = "default-src 'none'; style-src 'unsafe-inline' http: https:; img-src data: http: https:; " +
+		"font-src data: http: https:; form-action 'none'; " + webmailSandbox
+)
+
+var (
+	remoteContent = regexp.MustCompile(`(?i)\b(src|background|poster)\s*=\s*["']?\s*(https?:)?//|url\(\s*["']?\s*(https?:)?//|<link\b`)
+	contentId     = regexp.MustCompile(`(?i)\bcid:[^"'\s)>]+`)
+)
+
+type webFolder struct {
+	ID         string
+	Name       string
+	Depth      int
+	Total      int
+	Unread     int
+	Selectable bool
+}
+
+// Data that every webmail page needs
+type webmailPage struct {
+	layoutData
+	Token   string
+	Account string
+	Folders []webFolder
+	Current string // The mailbox being looked at
+}
+
+type webMessage struct {
+	ID         string
+	Mailbox    string
+	From       string
+	Subject    string
+	Date       time.Time
+	Unread     bool
+	Flagged    bool
+	Answered   bool
+	Attachment bool
+	Size       int
+}
+
+type webAttachment struct {
+	Name string
+	Type string
+	Size int
+	Href string
+}
+
+type webDraft struct {
+	From       string
+	To         string
+	Cc         string
+	Subject    string
+	Body       string
+	InReplyTo  string
+	References string
+	Replying   string // The message being replied to
+	Forwarding string // The message being forwarded, which is attached
+	Forwarded  string // Its subject
+}
+
+func (wa *wa) mailCall(r *http.Request, u *models.User) *jmapCall {
+	return &jmapCall{wa: wa, user: u, r: r}
+}
+
+/**
+ * Errors from the JMAP code say what went wrong in their description
+ */
+func (wa *wa) renderMailError(w http.ResponseWriter, e error) {
+	if je, ok := e.(*jmapError); ok && je.Description != "" {
+		e = errors.New(je.Description)
+	}
+	wa.renderError(w, e)
+}
+
+/**
+ * The user's mailboxes, each after its parent, with the inbox first
+ */
+func webFolders(c *jmapCall) ([]webFolder, error) {
+	mailboxes, e := c.mailboxes(c.wa.db)
+	if e != nil {
+		return nil, e
+	}
+	counts, e := c.mailboxCounts(c.wa.db)
+	if e != nil {
+		return nil, e
+	}
+	key := func(m *models.Mailbox) string {
+		name := strings.Replace(m.Name, logic.MailboxDelimiter, "\x01", -1)
+		if m.Name == imap.InboxName || strings.HasPrefix(m.Name, imap.InboxName+logic.MailboxDelimiter) {
+			name = "\x00" + name
+		}
+		return name
+	}
+	sort.Slice(mailboxes, func(i, j int) bool { return key(mailboxes[i]) < key(mailboxes[j]) })
+	var folders []webFolder
+	for _, m := range mailboxes {
+		f := webFolder{
+			ID:         jmapId("M", m.ID),
+			Name:       mailboxName(m),
+			Depth:      strings.Count(m.Name, logic.MailboxDelimiter),
+			Selectable: !m.Noselect,
+		}
+		if n, ok := counts[m.ID]; ok {
+			f.Total, f.Unread = n.total, n.unread
+		}
+		folders = append(folders, f)
+	}
+	return folders, nil
+}
+
+func (wa *wa) webmailPage(c *jmapCall, current string) (*webmailPage, error) {
+	ld, e := wa.layoutData(c.user)
+	if e != nil {
+		return nil, e
+	}
+	folders, e := webFolders(c)
+	if e != nil {
+		return nil, e
+	}
+	return &webmailPage{
+		layoutData: *ld,
+		Token:      wa.formToken(c.r),
+		Account:    jmapAccountId(c.user),
+		Folders:    folders,
+		Current:    current,
+	}, nil
+}
+
+/**
+ * One of the user's messages, with its content
+ */
+func (wa *wa) webEmail(c *jmapCall, id string) (*models.Message, error) {
+	msgs, e := c.emailsById(wa.db, true, []string{id})
+	if e != nil {
+		return nil, e
+	}
+	msg, ok := msgs[id]
+	if !ok {
+		return nil, errors.New("There's no such message")
+	}
+	return msg, nil
+}
+
+func newWebMessage(msg *models.Message, envelope *imap.Envelope) (*webMessage, error) {
+	structure, e := logic.BodyStructure(msg)
+	if e != nil {
+		return nil, e
+	}
+	flags := messageFlags(msg)
+	m := &webMessage{
+		ID:         jmapId("E", msg.ID),
+		Mailbox:    jmapId("M", msg.Mailboxid),
+		From:       addressNames(envelope.From),
+		Subject:    decodeWords(envelope.Subject),
+		Date:       messageDate(msg, envelope),
+		Unread:     !stringIn(imap.SeenFlag, flags),
+		Flagged:    stringIn(imap.FlaggedFlag, flags),
+		Answered:   stringIn(imap.AnsweredFlag, flags),
+		Attachment: hasAttachment(structure),
+		Size:       msg.Size,
+	}
+	return m, nil
+}
+
+/**
+ * When the message was sent, or when we got it if it doesn't say
+ */
+func messageDate(msg *models.Message, envelope *imap.Envelope) time.Time {
+	if envelope.Date.IsZero() {
+		return msg.Ts.Time.Local()
+	}
+	return envelope.Date.Local()
+}
+
+func addressEmail(a *imap.Address) string {
+	return a.MailboxName + "@" + a.HostName
+}
+
+/**
+ * Names where there are any, for lists of messages
+ */
+func addressNames(list []*imap.Address) string {
+	var names []string
+	for _, a := range list {
+		if a.HostName == "" {
+			continue
+		}
+		if name := decodeWords(a.PersonalName); name != "" {
+			names = append(names, name)
+		} else {
+			names = append(names, addressEmail(a))
+		}
+	}
+	return strings.Join(names, ", ")
+}
+
+/**
+ * Addresses in full, written so they can be parsed again
+ */
+func formatAddresses(list []*imap.Address) string {
+	var addresses []string
+	for _, a := range list {
+		if a.HostName == "" {
+			continue
+		}
+		address := addressEmail(a)
+		if name := decodeWords(a.PersonalName); name != "" {
+			address = `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(name) + `" <` + address + ">"
+		}
+		addresses = append(addresses, address)
+	}
+	return strings.Join(addresses, ", ")
+}
+
+func parseAddressField(field, value string) ([]*mail.Address, error) {
+	if strings.TrimSpace(value) == "" {
+		return nil, nil
+	}
+	parser := netmail.AddressParser{WordDecoder: &mime.WordDecoder{CharsetReader: message.CharsetReader}}
+	list, e := parser.ParseList(value)
+	if e != nil {
+		return nil, fmt.Errorf("The %v addresses aren't right: %v", field, e)
+	}
+	addresses := make([]*mail.Address, len(list))
+	for i, a := range list {
+		addresses[i] = (*mail.Address)(a)
+	}
+	return addresses, nil
+}
+
+/**
+ * The text of the message, with line breaks, made from the HTML if
+ * that's all there is
+ */
+func messageText(bodies *emailBodies) string {
+	var parts []string
+	for _, p := range bodies.text {
+		switch p.typ {
+		case "text/plain":
+			parts = append(parts, p.value(0).Value)
+		case "text/html":
+			parts = append(parts, strings.TrimSpace(htmlText(p.value(0).Value)))
+		}
+	}
+	return strings.Join(parts, "\n\n")
+}
+
+/**
+ * The user's mailbox, or their inbox if there's no id
+ */
+func (wa *wa) webMailbox(c *jmapCall, id string) (*models.Mailbox, error) {
+	if id == "" {
+		return models.MailboxByUseridName(wa.db, c.user.ID, imap.InboxName)
+	}
+	mailbox, e := c.mailbox(wa.db, id)
+	if e == sql.ErrNoRows || (e == nil && mailbox.Noselect) {
+		return nil, errors.New("There's no such mailbox")
+	}
+	return mailbox, e
+}
+
+/**
+ * Lists the messages in a mailbox, newest first
+ */
+func (wa *wa) mail(w http.ResponseWriter, r *http.Request, u *models.User) {
+	c := wa.mailCall(r, u)
+	mailbox, e := wa.webMailbox(c, r.FormValue("mailbox"))
+	if e != nil {
+		wa.renderMailError(w, e)
+		return
+	}
+	page, e := wa.webmailPage(c, jmapId("M", mailbox.ID))
+	if e != nil {
+		wa.renderMailError(w, e)
+		return
+	}
+	var total int
+	for _, f := range page.Folders {
+		if f.ID == page.Current {
+			total = f.Total
+		}
+	}
+	pages := (total + webmailPageSize - 1) / webmailPageSize
+	n, _ := strconv.Atoi(r.FormValue("page"))
+	if n > pages {
+		n = pages
+	}
+	if n < 1 {
+		n = 1
+	}
+	msgs, e := c.loadEmails(wa.db, false, "mailboxid = ? ORDER BY uid DESC LIMIT ? OFFSET ?",
+		mailbox.ID, webmailPageSize, (n-1)*webmailPageSize)
+	if e != nil {
+		wa.renderMailError(w, e)
+		return
+	}
+	var messages []*webMessage
+	for _, msg := range msgs {
+		envelope, e := logic.Envelope(msg)
+		if e != nil {
+			wa.renderMailError(w, e)
+			return
+		}
+		m, e := newWebMessage(msg, envelope)
+		if e != nil {
+			wa.renderMailError(w, e)
+			return
+		}
+		messages = append(messages, m)
+	}
+	data := struct {
+		webmailPage
+		Mailbox  string
+		Messages []*webMessage
+		Page     int
+		Pages    int
+		Newer    int // Pages to link to, or 0
+		Older    int
+	}{
+		webmailPage: *page,
+		Mailbox:     mailboxName(mailbox),
+		Messages:    messages,
+		Page:        n,
+		Pages:       pages,
+	}
+	if n > 1 {
+		data.Newer = n - 1
+	}
+	if n < pages {
+		data.Older = n + 1
+	}
+	wa.mailboxView.render(w, data)
+}
+
+/**
+ * Shows a message. It's marked read by opening it from the mailbox, which
+ * posts the "read" action, so that a link from elsewhere can't do it.
+ */
+func (wa *wa) mailMessage(w http.ResponseWriter, r *http.Request, u *models.User) {
+	c := wa.mailCall(r, u)
+	msg, e := wa.webEmail(c, r.FormValue("id"))
+	if e != nil {
+		wa.renderMailError(w, e)
+		return
+	}
+	envelope, e := logic.Envelope(msg)
+	if e != nil {
+		wa.renderMailError(w, e)
+		return
+	}
+	summary, e := newWebMessage(msg, envelope)
+	if e != nil {
+		wa.renderMailError(w, e)
+		return
+	}
+	page, e := wa.webmailPage(c, summary.Mailbox)
+	if e != nil {
+		wa.renderMailError(w, e)
+		return
+	}
+
+	root, _ := parseBody(msg.ID, msg.Content)
+	bodies := splitBodies(root)
+	hasHtml, remote := false, false
+	shown := map[string]bool{} // Images in the HTML, which needn't be listed as attachments
+	for _, p := range bodies.html {
+		if p.typ == "text/html" {
+			hasHtml = true
+			remote = remote || remoteContent.Match(p.content)
+			for _, ref := range contentId.FindAllString(p.value(0).Value, -1) {
+				shown[strings.ToLower(unescapeCid(ref))] = true
+			}
+		}
+	}
+	showHtml := hasHtml && r.FormValue("text") == ""
+	var attachments []webAttachment
+	for _, p := range bodies.attachments {
+		if showHtml && p.cid != "" && shown[strings.ToLower(p.cid)] {
+			continue
+		}
+		name := p.name
+		if name == "" {
+			name = "attachment"
+		}
+		attachments = append(attachments, webAttachment{
+			Name: name,
+			Type: p.typ,
+			Size: p.size,
+			Href: "/jmap/download/" + page.Account + "/" + p.blobId + "/" + url.PathEscape(name),
+		})
+	}
+	data := struct {
+		webmailPage
+		Message     *webMessage
+		From        string
+		To          string
+		Cc          string
+		ReplyTo     string
+		Text        string
+		Html        bool
+		Remote      bool // Whether the HTML loads anything from elsewhere
+		ShowRemote  bool
+		Attachments []webAttachment
+		Original    string
+	}{
+		webmailPage: *page,
+		Message:     summary,
+		From:        formatAddresses(envelope.From),
+		To:          formatAddresses(envelope.To),
+		Cc:          formatAddresses(envelope.Cc),
+		Html:        showHtml,
+		Remote:      remote,
+		ShowRemote:  r.FormValue("remote") != "",
+		Attachments: attachments,
+		Original:    "/jmap/download/" + page.Account + "/" + jmapId("R", msg.ID) + "/message.eml",
+	}
+	if replyTo := formatAddresses(envelope.ReplyTo); replyTo != formatAddresses(envelope.From) {
+		data.ReplyTo = replyTo
+	}
+	if !data.Html {
+		data.Text = messageText(bodies)
+	}
+	wa.messageView.render(w, data)
+}
+
+/**
+ * The Content-ID a cid: URL refers to, see RFC 2392
+ */
+func unescapeCid(ref string) string {
+	cid := ref[len("cid:"):]
+	if unescaped, e := url.PathUnescape(cid); e == nil {
+		return unescaped
+	}
+	return cid
+}
+
+/**
+ * The HTML of a message, for the frame it's shown in. Images that come
+ * with the message are put in the page.
+ */
+func (wa *wa) mailHtml(w http.ResponseWriter, r *http.Request, u *models.User) {
+	c := wa.mailCall(r, u)
+	msg, e := wa.webEmail(c, r.FormValue("id"))
+	if e != nil {
+		wa.renderMailError(w, e)
+		return
+	}
+	root, _ := parseBody(msg.ID, msg.Content)
+	images := map[string]*emailBodyPart{}
+	for _, p := range root.leaves() {
+		if p.cid != "" && strings.HasPrefix(p.typ, "image/") {
+			images[strings.ToLower(p.cid)] = p
+		}
+	}
+	dataUri := func(p *emailBodyPart) string {
+		return "data:" + p.typ + ";base64," + base64.StdEncoding.EncodeToString(p.content)
+	}
+	var b strings.Builder
+	b.WriteString(`<!doctype html><meta charset="utf-8"><base target="_blank">`)
+	for _, p := range splitBodies(root).html {
+		switch {
+		case p.typ == "text/html":
+			b.WriteString(contentId.ReplaceAllStringFunc(p.value(0).Value, func(ref string) string {
+				if image, ok := images[strings.ToLower(unescapeCid(ref))]; ok {
+					return dataUri(image)
+				}
+				return ref
+			}))
+		case p.typ == "text/plain":
+			b.WriteString(`<pre style="white-space: pre-wrap">` + html.EscapeString(p.value(0).Value) + "</pre>")
+		case strings.HasPrefix(p.typ, "image/"):
+			b.WriteString(`<img src="` + dataUri(p) + `">`)
+		}
+	}
+	policy := webmailPolicy
+	if r.FormValue("remote") != "" {
+		policy = webmailRemotePolicy
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", policy)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	_, _ = io.WriteString(w, b.String())
+}
+
+/**
+ * The address the message was sent to that the user can send from, so
+ * replies come from it, or the user's own
+ */
+func replyIdentity(identities []map[string]interface{}, envelope *imap.Envelope) string {
+	for _, a := range append(append([]*imap.Address{}, envelope.To...), envelope.Cc...) {
+		for _, identity := range identities {
+			if strings.EqualFold(identity["email"].(string), addressEmail(a)) {
+				return identity["email"].(string)
+			}
+		}
+	}
+	return identities[0]["email"].(string)
+}
+
+func withPrefix(prefix, subject string) string {
+	if strings.HasPrefix(strings.ToLower(subject), strings.ToLower(prefix)) {
+		return subject
+	}
+	return prefix + " " + subject
+}
+
+func replyDraft(msg *models.Message, identities []map[string]interface{}, all bool) (*webDraft, error) {
+	envelope, e := logic.Envelope(msg)
+	if e != nil {
+		return nil, e
+	}
+	references, e := logic.References(msg)
+	if e != nil {
+		return nil, e
+	}
+	d := &webDraft{
+		From:     replyIdentity(identities, envelope),
+		Subject:  withPrefix("Re:", decodeWords(envelope.Subject)),
+		Replying: jmapId("E", msg.ID),
+	}
+	to := envelope.ReplyTo
+	if len(to) == 0 {
+		to = envelope.From
+	}
+	d.To = formatAddresses(to)
+	if all {
+		seen := map[string]bool{}
+		for _, a := range to {
+			seen[strings.ToLower(addressEmail(a))] = true
+		}
+		var cc []*imap.Address
+		for _, a := range append(append([]*imap.Address{}, envelope.To...), envelope.Cc...) {
+			email := strings.ToLower(addressEmail(a))
+			if a.HostName == "" || seen[email] || mayUse(identities, email) {
+				continue
+			}
+			seen[email] = true
+			cc = append(cc, a)
+		}
+		d.Cc = formatAddresses(cc)
+	}
+	if msg.Messageidhdr != "" {
+		d.InReplyTo = msg.Messageidhdr
+		d.References = strings.Join(append(references, msg.Messageidhdr), " ")
+	}
+
+	root, _ := parseBody(msg.ID, msg.Content)
+	var quoted strings.Builder
+	fmt.Fprintf(&quoted, "\n\nOn %v, %v wrote:\n", messageDate(msg, envelope).Format("2 Jan 2006 at 15:04"), addressNames(envelope.From))
+	for _, line := range strings.Split(strings.TrimRight(messageText(splitBodies(root)), "\r\n"), "\n") {
+		quoted.WriteString("> " + strings.TrimRight(line, "\r") + "\n")
+	}
+	d.Body = quoted.String()
+	return d, nil
+}
+
+/**
+ * The form for a new message, a reply or a forward
+ */
+func (wa *wa) mailCompose(w http.ResponseWriter, r *http.Request, u *models.User) {
+	c := wa.mailCall(r, u)
+	identities, e := c.identities()
+	if e != nil {
+		wa.renderMailError(w, e)
+		return
+	}
+	draft := &webDraft{From: identities[0]["email"].(string)}
+	if id := r.FormValue("reply"); id != "" {
+		msg, e := wa.webEmail(c, id)
+		if e != nil {
+			wa.renderMailError(w, e)
+			return
+		}
+		draft, e = replyDraft(msg, identities, r.FormValue("all") != "")
+		if e != nil {
+			wa.renderMailError(w, e)
+			return
+		}
+	} else if id := r.FormValue("forward"); id != "" {
+		msg, e := wa.webEmail(c, id)
+		if e != nil {
+			wa.renderMailError(w, e)
+			return
+		}
+		envelope, e := logic.Envelope(msg)
+		if e != nil {
+			wa.renderMailError(w, e)
+			return
+		}
+		subject := decodeWords(envelope.Subject)
+		draft = &webDraft{
+			From:       replyIdentity(identities, envelope),
+			Subject:    withPrefix("Fwd:", subject),
+			Forwarding: id,
+			Forwarded:  subject,
+		}
+	}
+	page, e := wa.webmailPage(c, "")
+	if e != nil {
+		wa.renderMailError(w, e)
+		return
+	}
+	var from []string
+	for _, identity := range identities {
+		from = append(from, identity["email"].(string))
+	}
+	data := struct {
+		webmailPage
+		From  []string
+		Draft *webDraft
+	}{
+		*page,
+		from,
+		draft,
+	}
+	wa.composeView.render(w, data)
+}
+
+func readAttachment(fh *multipart.FileHeader) (composedAttachment, error) {
+	a := composedAttachment{typ: fh.Header.Get("Content-Type"), name: fh.Filename}
+	if a.typ == "" {
+		a.typ = "application/octet-stream"
+	}
+	f, e := fh.Open()
+	if e != nil {
+		return a, e
+	}
+	defer f.Close()
+	a.content, e = ioutil.ReadAll(f)
+	return a, e
+}
+
+/**
+ * Sends a message from the compose form, and keeps a copy in Sent
+ */
+func (wa *wa) mailSend(w http.ResponseWriter, r *http.Request, u *models.User) {
+	c := wa.mailCall(r, u)
+	identities, e := c.identities()
+	if e != nil {
+		wa.renderMailError(w, e)
+		return
+	}
+	from := r.FormValue("from")
+	m := &composedEmail{text: strings.Replace(r.FormValue("body"), "\r\n", "\n", -1)}
+	m.header.SetAddressList("From", []*mail.Address{{Address: from}})
+	var recipients []string
+	seen := map[string]bool{}
+	for _, field := range []string{"To", "Cc", "Bcc"} {
+		addresses, e := parseAddressField(field, r.FormValue(strings.ToLower(field)))
+		if e != nil {
+			wa.renderMailError(w, e)
+			return
+		}
+		if len(addresses) > 0 {
+			m.header.SetAddressList(field, addresses)
+		}
+		for _, a := range addresses {
+			if !seen[strings.ToLower(a.Address)] {
+				seen[strings.ToLower(a.Address)] = true
+				recipients = append(recipients, a.Address)
+			}
+		}
+	}
+	m.header.SetSubject(r.FormValue("subject"))
+	// These come back from the form, so can't be trusted not to break the header
+	for key, field := range map[string]string{"In-Reply-To": "inReplyTo", "References": "references"} {
+		if ids := logic.MessageIds(r.FormValue(field)); len(ids) > 0 {
+			m.header.Set(key, strings.Join(ids, " "))
+		}
+	}
+	if r.MultipartForm != nil {
+		for _, fh := range r.MultipartForm.File["attachments"] {
+			a, e := readAttachment(fh)
+			if e != nil {
+				wa.renderMailError(w, e)
+				return
+			}
+			m.attachments = append(m.attachments, a)
+		}
+	}
+	if id := r.FormValue("forwarding"); id != "" {
+		forwarded, e := wa.webEmail(c, id)
+		if e != nil {
+			wa.renderMailError(w, e)
+			return
+		}
+		envelope, e := logic.Envelope(forwarded)
+		if e != nil {
+			wa.renderMailError(w, e)
+			return
+		}
+		name := strings.TrimSpace(decodeWords(envelope.Subject))
+		if name == "" {
+			name = "message"
+		}
+		m.attachments = append(m.attachments, composedAttachment{
+			typ:     "message/rfc822",
+			name:    name + ".eml",
+			content: forwarded.Content,
+		})
+	}
+	content, e := m.bytes()
+	if e != nil {
+		wa.renderMailError(w, e)
+		return
+	}
+	if len(content) > config.GetInt(config.MaxMessageBytes) {
+		wa.renderMailError(w, errors.New("The message is too big to send"))
+		return
+	}
+	// Better not to send it than to find out afterwards there's no room for the copy
+	e = logic.CheckQuota(wa.db, u.ID, len(content), 1)
+	if e == logic.ErrOverQuota || e == logic.ErrMessageExceedsQuota {
+		wa.renderMailError(w, errors.New("Your mailbox is full, so the message wasn't sent, "+
+			"as there's no room to keep a copy in Sent"))
+		return
+	} else if e != nil {
+		wa.renderMailError(w, e)
+		return
+	}
+	_, e = c.send(content, from, recipients, identities)
+	if e != nil {
+		wa.renderMailError(w, e)
+		return
+	}
+
+	sent, e := logic.FindOrCreateSpecialMailbox(wa.db, logic.QualifyUsername(u.Username), logic.SpecialUseSent)
+	if e == nil {
+		_, e = c.saveEmail(content, map[string]bool{jmapId("M", sent.ID): true}, map[string]bool{"$seen": true}, time.Now())
+	}
+	if e != nil {
+		wa.renderMailError(w, fmt.Errorf("The message was sent, but a copy couldn't be kept in Sent: %v", e))
+		return
+	}
+	for field, keyword := range map[string]string{"replying": "$answered", "forwarding": "$forwarded"} {
+		if id := r.FormValue(field); id != "" {
+			e = c.updateEmail(id, json.RawMessage(`{"keywords/`+keyword+`": true}`))
+			if e != nil {
+				log.Printf("Unable to mark %v %v: %v", id, keyword, e)
+			}
+		}
+	}
+	http.Redirect(w, r, "/mail?mailbox="+jmapId("M", sent.ID), http.StatusFound)
+}
+
+/**
+ * Marks, moves or deletes a message. Deleted messages go to Trash, and
+ * are only expunged from there. Marking it read opens it.
+ */
+func (wa *wa) mailAction(w http.ResponseWriter, r *http.Request, u *models.User) {
+	c := wa.mailCall(r, u)
+	id := r.FormValue("id")
+	msg, e := c.emailById(wa.db, id)
+	if e != nil {
+		wa.renderMailError(w, errors.New("There's no such message"))
+		return
+	}
+	back := "/mail?mailbox=" + jmapId("M", msg.Mailboxid)
+	moveTo := func(mailboxId string) error {
+		patch, e := json.Marshal(map[string]map[string]bool{"mailboxIds": {mailboxId: true}})
+		if e != nil {
+			return e
+		}
+		return c.updateEmail(id, patch)
+	}
+	switch r.FormValue("action") {
+	case "read":
+		e = c.updateEmail(id, json.RawMessage(`{"keywords/$seen": true}`))
+		back = "/mail/message?id=" + url.QueryEscape(id)
+	case "unread":
+		e = c.updateEmail(id, json.RawMessage(`{"keywords/$seen": null}`))
+	case "flag":
+		e = c.updateEmail(id, json.RawMessage(`{"keywords/$flagged": true}`))
+		back = "/mail/message?id=" + url.QueryEscape(id)
+	case "unflag":
+		e = c.updateEmail(id, json.RawMessage(`{"keywords/$flagged": null}`))
+		back = "/mail/message?id=" + url.QueryEscape(id)
+	case "move":
+		e = moveTo(r.FormValue("mailbox"))
+	case "delete":
+		var trash *models.Mailbox
+		trash, e = logic.FindOrCreateSpecialMailbox(wa.db, logic.QualifyUsername(u.Username), logic.SpecialUseTrash)
+		if e == nil && trash.ID == msg.Mailboxid {
+			e = c.destroyEmail(id)
+		} else if e == nil {
+			e = moveTo(jmapId("M", trash.ID))
+		}
+	default:
+		e = errors.New("Unknown action")
+	}
+	if e != nil {
+		wa.renderMailError(w, e)
+		return
+	}
+	http.Redirect(w, r, back, http.StatusFound)
+}